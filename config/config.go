@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -35,6 +36,8 @@ import (
 type AuthCache struct {
 	NextBatch       string `yaml:"next_batch"`
 	FilterID        string `yaml:"filter_id"`
+	FilterPresence  bool   `yaml:"filter_presence"`
+	FilterVersion   int    `yaml:"filter_version"`
 	InitialSyncDone bool   `yaml:"initial_sync_done"`
 }
 
@@ -45,25 +48,44 @@ type UserPreferences struct {
 	DisableImages       bool `yaml:"disable_images"`
 	DisableTypingNotifs bool `yaml:"disable_typing_notifs"`
 	DisableEmojis       bool `yaml:"disable_emojis"`
+	EnablePresence      bool `yaml:"enable_presence"`
 }
 
 // Config contains the main config of gomuks.
 type Config struct {
 	UserID      string `yaml:"mxid"`
 	AccessToken string `yaml:"access_token"`
+	DeviceID    string `yaml:"device_id"`
 	HS          string `yaml:"homeserver"`
 
 	RoomCacheSize int   `yaml:"room_cache_size"`
 	RoomCacheAge  int64 `yaml:"room_cache_age"`
+	// MediaCacheSize is the maximum size of the media cache in megabytes. Zero means unlimited.
+	MediaCacheSize int `yaml:"media_cache_size"`
+
+	// HistoryMaxAge is the number of days that events are kept in the local history. Zero means forever.
+	HistoryMaxAge int `yaml:"history_max_age"`
+	// HistoryMaxEvents is the maximum number of events kept in the local history of each room. Zero means unlimited.
+	HistoryMaxEvents int `yaml:"history_max_events"`
 
 	NotifySound bool `yaml:"notify_sound"`
 
+	// Accounts contains the IDs of additional accounts. The main account is stored in this config directly.
+	Accounts []string `yaml:"accounts,omitempty"`
+
 	Dir          string `yaml:"-"`
 	CacheDir     string `yaml:"cache_dir"`
 	HistoryPath  string `yaml:"history_path"`
+	CryptoPath   string `yaml:"crypto_path"`
 	RoomListPath string `yaml:"room_list_path"`
 	MediaDir     string `yaml:"media_dir"`
 	StateDir     string `yaml:"state_dir"`
+	// DownloadDir is where files are saved when downloading them from messages.
+	DownloadDir string `yaml:"download_dir"`
+	// LogDir is where plaintext logs of rooms are written. Chat logging is disabled if this is empty.
+	LogDir string `yaml:"log_dir"`
+	// LogFormat is the format of lines in the chat logs. See matrix.ChatLogger for the supported placeholders.
+	LogFormat string `yaml:"log_format"`
 
 	Preferences UserPreferences        `yaml:"-"`
 	AuthCache   AuthCache              `yaml:"-"`
@@ -79,27 +101,103 @@ func NewConfig(configDir, cacheDir string) *Config {
 		Dir:          configDir,
 		CacheDir:     cacheDir,
 		HistoryPath:  filepath.Join(cacheDir, "history.db"),
+		CryptoPath:   filepath.Join(cacheDir, "crypto.db"),
 		RoomListPath: filepath.Join(cacheDir, "rooms.gob.gz"),
 		StateDir:     filepath.Join(cacheDir, "state"),
 		MediaDir:     filepath.Join(cacheDir, "media"),
+		DownloadDir:  defaultDownloadDir(cacheDir),
+		LogFormat:    "[{time}] {sender} {message}",
 
-		RoomCacheSize: 32,
-		RoomCacheAge:  1 * 60,
+		RoomCacheSize:  32,
+		RoomCacheAge:   1 * 60,
+		MediaCacheSize: 512,
 
 		NotifySound: true,
 	}
 }
 
+// defaultDownloadDir returns the Downloads directory in the home directory of the user,
+// or a directory in the cache if the home directory is unknown.
+func defaultDownloadDir(cacheDir string) string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, "Downloads")
+	}
+	return filepath.Join(cacheDir, "downloads")
+}
+
+// accountsDir is the name of the subdirectory of the config and cache directories where additional accounts are stored.
+const accountsDir = "accounts"
+
 // Clear clears the session cache and removes all history.
+// The caches of additional accounts are not touched.
 func (config *Config) Clear() {
 	_ = os.Remove(config.HistoryPath)
+	_ = os.Remove(config.CryptoPath)
 	_ = os.Remove(config.RoomListPath)
 	_ = os.RemoveAll(config.StateDir)
 	_ = os.RemoveAll(config.MediaDir)
-	_ = os.RemoveAll(config.CacheDir)
+	if len(config.Accounts) == 0 {
+		_ = os.RemoveAll(config.CacheDir)
+	} else if entries, err := ioutil.ReadDir(config.CacheDir); err == nil {
+		for _, entry := range entries {
+			if entry.Name() != accountsDir {
+				_ = os.RemoveAll(filepath.Join(config.CacheDir, entry.Name()))
+			}
+		}
+	}
 	config.nosave = true
 }
 
+// AccountConfig creates the config of the additional account with the given ID.
+// Each account has its own config and cache directory, and thus its own history, room cache and auth cache.
+func (config *Config) AccountConfig(id string) *Config {
+	accountConfig := NewConfig(filepath.Join(config.Dir, accountsDir, id), filepath.Join(config.CacheDir, accountsDir, id))
+	accountConfig.RoomCacheSize = config.RoomCacheSize
+	accountConfig.RoomCacheAge = config.RoomCacheAge
+	accountConfig.MediaCacheSize = config.MediaCacheSize
+	accountConfig.HistoryMaxAge = config.HistoryMaxAge
+	accountConfig.HistoryMaxEvents = config.HistoryMaxEvents
+	accountConfig.DownloadDir = config.DownloadDir
+	if len(config.LogDir) > 0 {
+		accountConfig.LogDir = filepath.Join(config.LogDir, accountsDir, id)
+	}
+	accountConfig.LogFormat = config.LogFormat
+	return accountConfig
+}
+
+// AddAccount registers a new additional account and returns its ID.
+func (config *Config) AddAccount() string {
+	id := 1
+	for config.hasAccount(strconv.Itoa(id)) {
+		id++
+	}
+	config.Accounts = append(config.Accounts, strconv.Itoa(id))
+	config.Save()
+	return strconv.Itoa(id)
+}
+
+func (config *Config) hasAccount(id string) bool {
+	for _, account := range config.Accounts {
+		if account == id {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveAccount unregisters the additional account with the given ID and deletes all its data.
+func (config *Config) RemoveAccount(id string) {
+	for i, account := range config.Accounts {
+		if account == id {
+			config.Accounts = append(config.Accounts[:i], config.Accounts[i+1:]...)
+			break
+		}
+	}
+	config.Save()
+	_ = os.RemoveAll(filepath.Join(config.Dir, accountsDir, id))
+	_ = os.RemoveAll(filepath.Join(config.CacheDir, accountsDir, id))
+}
+
 func (config *Config) CreateCacheDirs() {
 	_ = os.MkdirAll(config.CacheDir, 0700)
 	_ = os.MkdirAll(config.StateDir, 0700)
@@ -110,6 +208,7 @@ func (config *Config) DeleteSession() {
 	config.AuthCache.NextBatch = ""
 	config.AuthCache.InitialSyncDone = false
 	config.AccessToken = ""
+	config.DeviceID = ""
 	config.Rooms = rooms.NewRoomCache(config.RoomListPath, config.StateDir, config.RoomCacheSize, config.RoomCacheAge, config.GetUserID)
 	config.PushRules = nil
 
@@ -29,7 +29,9 @@ func TestNewConfig_Defaults(t *testing.T) {
 	cfg := config.NewConfig("/tmp/gomuks-test-0", "/tmp/gomuks-test-0")
 	assert.Equal(t, "/tmp/gomuks-test-0", cfg.Dir)
 	assert.Equal(t, "/tmp/gomuks-test-0/history.db", cfg.HistoryPath)
+	assert.Equal(t, "/tmp/gomuks-test-0/crypto.db", cfg.CryptoPath)
 	assert.Equal(t, "/tmp/gomuks-test-0/media", cfg.MediaDir)
+	assert.Equal(t, 512, cfg.MediaCacheSize)
 }
 
 func TestConfig_Load_NonexistentDoesntFail(t *testing.T) {
@@ -147,3 +149,39 @@ func TestConfig_Save(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Contains(t, string(dat), "/tmp/gomuks-test-6")
 }
+
+func TestConfig_Accounts(t *testing.T) {
+	cfg := config.NewConfig("/tmp/gomuks-test-7", "/tmp/gomuks-test-7/cache")
+
+	defer os.RemoveAll("/tmp/gomuks-test-7")
+
+	cfg.Load()
+	id := cfg.AddAccount()
+	assert.Equal(t, "1", id)
+	assert.Equal(t, "2", cfg.AddAccount())
+	assert.Equal(t, []string{"1", "2"}, cfg.Accounts)
+
+	account := cfg.AccountConfig(id)
+	assert.Equal(t, "/tmp/gomuks-test-7/accounts/1", account.Dir)
+	assert.Equal(t, "/tmp/gomuks-test-7/cache/accounts/1/history.db", account.HistoryPath)
+	assert.Equal(t, cfg.DownloadDir, account.DownloadDir)
+	assert.Empty(t, account.LogDir)
+	cfg.LogDir = "/tmp/gomuks-test-7/logs"
+	assert.Equal(t, "/tmp/gomuks-test-7/logs/accounts/1", cfg.AccountConfig(id).LogDir)
+	account.Load()
+
+	// Clearing the main account must not remove the caches of other accounts.
+	cfg.Clear()
+	stat, err := os.Stat(cfg.MediaDir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, stat)
+	stat, err = os.Stat(account.MediaDir)
+	assert.Nil(t, err)
+	assert.True(t, stat.IsDir())
+
+	cfg.RemoveAccount(id)
+	assert.Equal(t, []string{"2"}, cfg.Accounts)
+	_, err = os.Stat(account.CacheDir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "1", cfg.AddAccount())
+}
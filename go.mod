@@ -11,10 +11,12 @@ require (
 	github.com/mattn/go-runewidth v0.0.8
 	github.com/petermattis/goid v0.0.0-20180202154549-b0b1615b78e5 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/russross/blackfriday/v2 v2.0.1
 	github.com/sasha-s/go-deadlock v0.2.0
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	github.com/stretchr/testify v1.5.1
 	go.etcd.io/bbolt v1.3.3
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	golang.org/x/image v0.0.0-20200119044424-58c23975cae1
 	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
 	gopkg.in/toast.v1 v1.0.0-20180812000517-0a84660828b2
@@ -19,6 +19,7 @@ package main
 import (
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -34,6 +35,15 @@ type Gomuks struct {
 	matrix *matrix.Container
 	config *config.Config
 	stop   chan bool
+
+	accounts     []*account
+	accountsLock sync.RWMutex
+}
+
+// account is an additional Matrix account. The main account is stored in Gomuks.matrix directly.
+type account struct {
+	id     string
+	matrix *matrix.Container
 }
 
 // NewGomuks creates a new Gomuks instance with everything initialized,
@@ -48,6 +58,7 @@ func NewGomuks(uiProvider ifc.UIProvider, configDir, cacheDir string) *Gomuks {
 	gmx.matrix = matrix.NewContainer(gmx)
 
 	gmx.config.LoadAll()
+	gmx.loadAccounts()
 	gmx.ui.Init()
 
 	debug.OnRecover = gmx.ui.Finish
@@ -55,9 +66,32 @@ func NewGomuks(uiProvider ifc.UIProvider, configDir, cacheDir string) *Gomuks {
 	return gmx
 }
 
+// loadAccounts creates containers for the additional accounts in the config.
+// Accounts that were logged out are removed.
+func (gmx *Gomuks) loadAccounts() {
+	for _, id := range append([]string{}, gmx.config.Accounts...) {
+		accountConfig := gmx.config.AccountConfig(id)
+		accountConfig.LoadAll()
+		if len(accountConfig.AccessToken) == 0 {
+			debug.Print("Removing logged out account", id)
+			gmx.config.RemoveAccount(id)
+			continue
+		}
+		gmx.accounts = append(gmx.accounts, &account{
+			id:     id,
+			matrix: matrix.NewAccountContainer(gmx, accountConfig),
+		})
+	}
+}
+
 // Save saves the active session and message history.
 func (gmx *Gomuks) Save() {
 	gmx.config.SaveAll()
+	gmx.accountsLock.RLock()
+	for _, acc := range gmx.accounts {
+		acc.matrix.Config().SaveAll()
+	}
+	gmx.accountsLock.RUnlock()
 }
 
 // StartAutosave calls Save() every minute until it receives a stop signal
@@ -84,6 +118,11 @@ func (gmx *Gomuks) StartAutosave() {
 func (gmx *Gomuks) Stop(save bool) {
 	debug.Print("Disconnecting from Matrix...")
 	gmx.matrix.Stop()
+	gmx.accountsLock.RLock()
+	for _, acc := range gmx.accounts {
+		acc.matrix.Stop()
+	}
+	gmx.accountsLock.RUnlock()
 	debug.Print("Cleaning up UI...")
 	gmx.ui.Stop()
 	gmx.stop <- true
@@ -99,6 +138,13 @@ func (gmx *Gomuks) Stop(save bool) {
 // will be recovered as specified in Recover().
 func (gmx *Gomuks) Start() {
 	_ = gmx.matrix.InitClient()
+	gmx.accountsLock.RLock()
+	for _, acc := range gmx.accounts {
+		if err := acc.matrix.InitClient(); err != nil {
+			debug.Print("Failed to initialize account", acc.id, err)
+		}
+	}
+	gmx.accountsLock.RUnlock()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -118,6 +164,49 @@ func (gmx *Gomuks) Matrix() ifc.MatrixContainer {
 	return gmx.matrix
 }
 
+// Accounts returns the MatrixContainer instances of all accounts, starting with the main account.
+func (gmx *Gomuks) Accounts() []ifc.MatrixContainer {
+	gmx.accountsLock.RLock()
+	defer gmx.accountsLock.RUnlock()
+	accounts := make([]ifc.MatrixContainer, 1, len(gmx.accounts)+1)
+	accounts[0] = gmx.matrix
+	for _, acc := range gmx.accounts {
+		accounts = append(accounts, acc.matrix)
+	}
+	return accounts
+}
+
+// AddAccount creates a MatrixContainer for a new account. If the main account isn't logged in,
+// the main container is returned instead.
+func (gmx *Gomuks) AddAccount() ifc.MatrixContainer {
+	if len(gmx.config.AccessToken) == 0 {
+		return gmx.matrix
+	}
+	id := gmx.config.AddAccount()
+	acc := &account{
+		id:     id,
+		matrix: matrix.NewAccountContainer(gmx, gmx.config.AccountConfig(id)),
+	}
+	acc.matrix.Config().LoadAll()
+	gmx.accountsLock.Lock()
+	gmx.accounts = append(gmx.accounts, acc)
+	gmx.accountsLock.Unlock()
+	return acc.matrix
+}
+
+// RemoveAccount removes an additional account that isn't logged in and deletes its data.
+func (gmx *Gomuks) RemoveAccount(container ifc.MatrixContainer) {
+	gmx.accountsLock.Lock()
+	defer gmx.accountsLock.Unlock()
+	for i, acc := range gmx.accounts {
+		if acc.matrix == container {
+			gmx.accounts = append(gmx.accounts[:i], gmx.accounts[i+1:]...)
+			gmx.config.RemoveAccount(acc.id)
+			return
+		}
+	}
+}
+
 // Config returns the Gomuks config instance.
 func (gmx *Gomuks) Config() *config.Config {
 	return gmx.config
@@ -23,6 +23,12 @@ import (
 // Gomuks is the wrapper for everything.
 type Gomuks interface {
 	Matrix() MatrixContainer
+	// Accounts returns the containers of all accounts. The first one is always the main account.
+	Accounts() []MatrixContainer
+	// AddAccount creates a container for a new account. If the main account is logged out, it's returned instead.
+	AddAccount() MatrixContainer
+	// RemoveAccount stops the given account and deletes its data. The main account can't be removed.
+	RemoveAccount(matrix MatrixContainer)
 	UI() GomuksUI
 	Config() *config.Config
 
@@ -17,9 +17,15 @@
 package ifc
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	"maunium.net/go/gomuks/matrix/event"
 	"maunium.net/go/mautrix"
 
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/matrix/crypto"
 	"maunium.net/go/gomuks/matrix/rooms"
 )
 
@@ -28,22 +34,163 @@ type Relation struct {
 	Event *event.Event
 }
 
+// RelThread is the relation type of replies in a thread.
+const RelThread mautrix.RelationType = "m.thread"
+
+// ThreadRootID returns the ID of the event that started the thread the given event is in,
+// or an empty string if the event isn't in a thread.
+func ThreadRootID(evt *event.Event) string {
+	rel := evt.Content.RelatesTo
+	if rel != nil && rel.Type == RelThread {
+		return rel.EventID
+	}
+	return ""
+}
+
+// ConnectionState is the state of the connection to the homeserver.
+type ConnectionState int
+
+const (
+	// ConnectionOffline means that the sync loop isn't running or the homeserver couldn't be reached.
+	ConnectionOffline ConnectionState = iota
+	// ConnectionSyncing means that a sync is in progress, but hasn't succeeded since starting or reconnecting.
+	ConnectionSyncing
+	// ConnectionConnected means that the last sync succeeded.
+	ConnectionConnected
+	// ConnectionRetrying means that the homeserver returned an error and the sync will be retried.
+	ConnectionRetrying
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case ConnectionOffline:
+		return "offline"
+	case ConnectionSyncing:
+		return "syncing"
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionRetrying:
+		return "retrying"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(state))
+	}
+}
+
+// ConnectionStatus describes the current connection state and when the next sync will be attempted after a failure.
+type ConnectionStatus struct {
+	State     ConnectionState
+	NextRetry time.Time
+	Error     error
+}
+
+// Presence states as defined in the spec.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// UserPresence is the last known presence of a user.
+type UserPresence struct {
+	Presence  string
+	StatusMsg string
+	// LastActive is when the user was last active, or zero if the server didn't say.
+	LastActive time.Time
+}
+
+// SpaceChild is a room in a space, as returned by the space hierarchy API.
+type SpaceChild struct {
+	RoomID           string `json:"room_id"`
+	Name             string `json:"name,omitempty"`
+	Topic            string `json:"topic,omitempty"`
+	CanonicalAlias   string `json:"canonical_alias,omitempty"`
+	NumJoinedMembers int    `json:"num_joined_members"`
+	RoomType         string `json:"room_type,omitempty"`
+}
+
+// PublicRoom is a room in the public room directory.
+type PublicRoom struct {
+	RoomID           string `json:"room_id"`
+	Name             string `json:"name,omitempty"`
+	Topic            string `json:"topic,omitempty"`
+	CanonicalAlias   string `json:"canonical_alias,omitempty"`
+	NumJoinedMembers int    `json:"num_joined_members"`
+	WorldReadable    bool   `json:"world_readable"`
+	GuestCanJoin     bool   `json:"guest_can_join"`
+}
+
+// PublicRoomsPage is a page of the public room directory.
+type PublicRoomsPage struct {
+	Rooms []PublicRoom `json:"chunk"`
+	// NextBatch is the token for getting the next page, or empty if this is the last page.
+	NextBatch string `json:"next_batch,omitempty"`
+	// TotalCount is an estimate of the total number of rooms, or zero if the server didn't say.
+	TotalCount int `json:"total_room_count_estimate,omitempty"`
+}
+
+// ServerSearchResult is a message found by the server-side search along with the events around it.
+type ServerSearchResult struct {
+	Event        *event.Event
+	EventsBefore []*event.Event
+	EventsAfter  []*event.Event
+}
+
+// ServerSearchPage is a page of server-side search results.
+type ServerSearchPage struct {
+	Results []ServerSearchResult
+	// Count is an estimate of the total number of results, or zero if the server didn't say.
+	Count int
+	// NextBatch is the token for getting the next page, or empty if this is the last page.
+	NextBatch string
+}
+
+// HistoryCompaction describes the result of pruning and compacting the local history database.
+type HistoryCompaction struct {
+	PrunedEvents int
+	SizeBefore   int64
+	SizeAfter    int64
+}
+
+// MediaCacheStats describes the current size of the media cache.
+type MediaCacheStats struct {
+	Files int
+	Size  int64
+	// Quota is the maximum size of the cache in bytes, or zero if the size is unlimited.
+	Quota int64
+}
+
 type MatrixContainer interface {
 	Client() *mautrix.Client
+	Config() *config.Config
+	Crypto() *crypto.OlmMachine
+	ImportKeys(data []byte, passphrase string) (imported, total int, err error)
 	InitClient() error
 	Initialized() bool
 
 	Start()
 	Stop()
+	ConnectionStatus() ConnectionStatus
 
 	Login(user, password string) error
 	Logout()
 
 	SendPreferencesToMatrix()
 	PrepareMarkdownMessage(roomID string, msgtype mautrix.MessageType, message string, relation *Relation) *event.Event
+	PrepareMediaMessage(roomID, path string) (*event.Event, []byte, error)
+	UploadMedia(evt *event.Event, data []byte, progress func(sent, total int64)) error
 	SendEvent(evt *event.Event) (string, error)
+	QueueEvent(evt *event.Event) error
+	ResendEvent(txnID string) error
+	CancelEvent(txnID string) (*event.Event, error)
+	GetOutgoing(roomID string) []*event.Event
 	Redact(roomID, eventID, reason string) error
 	SendTyping(roomID string, typing bool)
+	SetPresence(presence, statusMsg string) error
+	SetIdle(idle bool)
+	GetPresence(userID string) (UserPresence, bool)
+	GetSpaceChildren(spaceID string) ([]SpaceChild, error)
+	GetPublicRooms(server, search, since string) (*PublicRoomsPage, error)
+	PreviewRoom(roomID string, limit int) ([]*mautrix.Event, error)
 	MarkRead(roomID, eventID string)
 	JoinRoom(roomID, server string) (*rooms.Room, error)
 	LeaveRoom(roomID string) error
@@ -51,11 +198,21 @@ type MatrixContainer interface {
 
 	FetchMembers(room *rooms.Room) error
 	GetHistory(room *rooms.Room, limit int) ([]*event.Event, error)
+	GetHistoryBefore(room *rooms.Room, eventID string, limit int) ([]*event.Event, error)
+	FillGap(room *rooms.Room, gap *event.Event) ([]*event.Event, *event.Event, error)
 	GetEvent(room *rooms.Room, eventID string) (*event.Event, error)
+	GetThreadReplies(room *rooms.Room, rootID string) ([]*event.Event, *event.Event, error)
+	SearchHistory(query string, room *rooms.Room, limit int) ([]*event.Event, error)
+	SearchServer(query string, room *rooms.Room, nextBatch string) (*ServerSearchPage, error)
 	GetRoom(roomID string) *rooms.Room
 	GetOrCreateRoom(roomID string) *rooms.Room
 
 	Download(mxcURL string) ([]byte, string, string, error)
+	DownloadFile(ctx context.Context, mxcURL string, progress func(done, total int64)) (string, error)
+	DownloadThumbnail(mxcURL string, width, height int) ([]byte, error)
 	GetDownloadURL(homeserver, fileID string) string
 	GetCachePath(homeserver, fileID string) string
+	MediaCacheStats() MediaCacheStats
+	ClearMediaCache() error
+	CompactHistory() (*HistoryCompaction, error)
 }
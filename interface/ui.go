@@ -19,6 +19,7 @@ package ifc
 import (
 	"time"
 
+	"maunium.net/go/gomuks/matrix/crypto"
 	"maunium.net/go/gomuks/matrix/event"
 	"maunium.net/go/gomuks/matrix/pushrules"
 	"maunium.net/go/gomuks/matrix/rooms"
@@ -30,8 +31,9 @@ type GomuksUI interface {
 	Render()
 	HandleNewPreferences()
 	OnLogin()
-	OnLogout()
-	MainView() MainView
+	OnLogout(account MatrixContainer)
+	// MainView returns the main view as seen by the given account.
+	MainView(account MatrixContainer) MainView
 
 	Init()
 	Start() error
@@ -47,10 +49,14 @@ type MainView interface {
 	Bump(room *rooms.Room)
 
 	UpdateTags(room *rooms.Room)
+	UpdateSpaces()
+	RoomReplaced(room *rooms.Room)
 
 	SetTyping(roomID string, users []string)
 
 	NotifyMessage(room *rooms.Room, message Message, should pushrules.PushActionArrayShould)
+
+	ShowVerification(v *crypto.Verification)
 }
 
 type RoomView interface {
@@ -64,8 +70,13 @@ type RoomView interface {
 	AddRedaction(evt *event.Event)
 	AddEdit(evt *event.Event)
 	AddReaction(evt *event.Event, key string)
+	AddThreadReply(root *event.Event, reply *event.Event) Message
+	SetOutgoingState(evt *event.Event, eventID string, state event.OutgoingState)
 	GetEvent(eventID string) Message
 	AddServiceMessage(message string)
+	// MessageSizeChanged is called when the height of a message changed in the background,
+	// e.g. when an image finished loading.
+	MessageSizeChanged()
 }
 
 type Message interface {
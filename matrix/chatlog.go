@@ -0,0 +1,217 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+const logDateFormat = "2006-01-02"
+
+// ChatLogger appends IRC-style plaintext logs of messages, edits, redactions and membership changes to a file per
+// room. The files are rotated daily: the log of the current day is in <room ID>.gmxlog, and older logs are renamed
+// to <room ID>.<date>.gmxlog.
+//
+// Each line is formatted with a format string containing the following placeholders:
+//
+//	{date}    - the date when the event was sent (YYYY-MM-DD)
+//	{time}    - the time when the event was sent (HH:MM:SS)
+//	{sender}  - <name> for messages, * for emotes and *** for other events
+//	{name}    - the display name of the sender
+//	{user}    - the user ID of the sender
+//	{event}   - the event ID
+//	{room}    - the room ID
+//	{message} - the text of the message, or a description of the event
+//
+// Multi-line messages are written as multiple lines with the same prefix.
+type ChatLogger struct {
+	dir    string
+	format string
+	lock   sync.Mutex
+}
+
+// NewChatLogger creates a chat logger that writes logs into the given directory using the given line format.
+func NewChatLogger(dir, format string) *ChatLogger {
+	return &ChatLogger{dir: dir, format: format}
+}
+
+func (cl *ChatLogger) logPath(roomID string) string {
+	return filepath.Join(cl.dir, fmt.Sprintf("%s.gmxlog", roomID))
+}
+
+func (cl *ChatLogger) rotatedLogPath(roomID, date string) string {
+	return filepath.Join(cl.dir, fmt.Sprintf("%s.%s.gmxlog", roomID, date))
+}
+
+// LogEvent writes the given event to the log of the room it's in. Event types that aren't logged are ignored.
+func (cl *ChatLogger) LogEvent(room *rooms.Room, evt *event.Event) {
+	sender, message := cl.describe(room, evt)
+	if len(message) == 0 {
+		return
+	}
+	ts := time.Unix(0, evt.Timestamp*int64(time.Millisecond))
+	replacer := strings.NewReplacer(
+		"{date}", ts.Format(logDateFormat),
+		"{time}", ts.Format("15:04:05"),
+		"{sender}", sender,
+		"{name}", cl.displayName(room, evt.Sender),
+		"{user}", evt.Sender,
+		"{event}", evt.ID,
+		"{room}", evt.RoomID)
+	prefix := replacer.Replace(cl.format)
+	var buf strings.Builder
+	for _, line := range strings.Split(message, "\n") {
+		buf.WriteString(strings.Replace(prefix, "{message}", line, -1))
+		buf.WriteByte('\n')
+	}
+	if err := cl.write(evt.RoomID, buf.String()); err != nil {
+		debug.Printf("Failed to write %s to chat log: %v", evt.ID, err)
+	}
+}
+
+func (cl *ChatLogger) write(roomID, lines string) error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if err := os.MkdirAll(cl.dir, 0700); err != nil {
+		return err
+	}
+	path := cl.logPath(roomID)
+	if stat, err := os.Stat(path); err == nil {
+		if date := stat.ModTime().Format(logDateFormat); date != time.Now().Format(logDateFormat) {
+			if err = os.Rename(path, cl.rotatedLogPath(roomID, date)); err != nil {
+				return err
+			}
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(lines)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (cl *ChatLogger) displayName(room *rooms.Room, userID string) string {
+	if member := room.GetMember(userID); member != nil && len(member.Displayname) > 0 {
+		return member.Displayname
+	}
+	return userID
+}
+
+// describe returns the {sender} and {message} values for the given event.
+func (cl *ChatLogger) describe(room *rooms.Room, evt *event.Event) (sender, message string) {
+	name := cl.displayName(room, evt.Sender)
+	switch evt.Type {
+	case mautrix.EventMessage, mautrix.EventSticker:
+		content := &evt.Content
+		edited := false
+		if content.GetRelatesTo().GetReplaceID() != "" && content.NewContent != nil {
+			content = content.NewContent
+			edited = true
+		}
+		body := content.Body
+		if len(content.GetReplyTo()) > 0 {
+			body = mautrix.TrimReplyFallbackText(body)
+		}
+		switch {
+		case len(content.URL) > 0:
+			body = fmt.Sprintf("%s (%s)", body, content.URL)
+		case evt.Type == mautrix.EventSticker:
+			body = fmt.Sprintf("[sticker] %s", body)
+		}
+		if edited {
+			body = "(edited) " + body
+		}
+		if content.MsgType == mautrix.MsgEmote {
+			return "*", fmt.Sprintf("%s %s", name, body)
+		}
+		return fmt.Sprintf("<%s>", name), body
+	case mautrix.EventEncrypted:
+		return fmt.Sprintf("<%s>", name), "[encrypted message]"
+	case mautrix.EventRedaction:
+		message = fmt.Sprintf("%s redacted %s", name, evt.Redacts)
+		if reason, _ := evt.Content.Raw["reason"].(string); len(reason) > 0 {
+			message = fmt.Sprintf("%s: %s", message, reason)
+		}
+		return "***", message
+	case mautrix.StateMember:
+		return "***", cl.describeMembership(evt, name)
+	default:
+		return "", ""
+	}
+}
+
+func (cl *ChatLogger) describeMembership(evt *event.Event, senderName string) string {
+	targetName := evt.GetStateKey()
+	if len(evt.Content.Displayname) > 0 {
+		targetName = evt.Content.Displayname
+	}
+	prevMembership := mautrix.MembershipLeave
+	prevName := evt.GetStateKey()
+	if prev := evt.Unsigned.PrevContent; prev != nil {
+		prevMembership = prev.Membership
+		if len(prev.Displayname) > 0 {
+			prevName = prev.Displayname
+		}
+	}
+	isSelf := evt.Sender == evt.GetStateKey()
+	var message string
+	switch evt.Content.Membership {
+	case mautrix.MembershipJoin:
+		if prevMembership != mautrix.MembershipJoin {
+			message = fmt.Sprintf("%s joined the room", targetName)
+		} else if prevName != targetName {
+			message = fmt.Sprintf("%s changed their display name to %s", prevName, targetName)
+		}
+	case mautrix.MembershipInvite:
+		message = fmt.Sprintf("%s invited %s", senderName, targetName)
+	case mautrix.MembershipLeave:
+		switch {
+		case prevMembership == mautrix.MembershipBan:
+			message = fmt.Sprintf("%s unbanned %s", senderName, prevName)
+		case isSelf && prevMembership == mautrix.MembershipInvite:
+			message = fmt.Sprintf("%s rejected the invite", prevName)
+		case isSelf:
+			message = fmt.Sprintf("%s left the room", prevName)
+		case prevMembership == mautrix.MembershipInvite:
+			message = fmt.Sprintf("%s revoked the invite of %s", senderName, prevName)
+		default:
+			message = fmt.Sprintf("%s kicked %s", senderName, prevName)
+		}
+	case mautrix.MembershipBan:
+		message = fmt.Sprintf("%s banned %s", senderName, prevName)
+	}
+	if len(message) > 0 && len(evt.Content.Reason) > 0 {
+		message = fmt.Sprintf("%s: %s", message, evt.Content.Reason)
+	}
+	return message
+}
@@ -0,0 +1,306 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+var chatLogTestRoom *rooms.Room
+
+func init() {
+	cache := rooms.NewRoomCache("/tmp/gomuks-chatlogtest/rooms.gob.gz", "/tmp/gomuks-chatlogtest/rooms", 32, 0, func() string {
+		return "@tulir:maunium.net"
+	})
+	chatLogTestRoom = rooms.NewRoom("!foo:maunium.net", cache)
+	stateKey := "@tulir:maunium.net"
+	chatLogTestRoom.UpdateState(&mautrix.Event{
+		Type:     mautrix.StateMember,
+		Sender:   "@tulir:maunium.net",
+		StateKey: &stateKey,
+		Content: mautrix.Content{
+			Membership: mautrix.MembershipJoin,
+			Member:     mautrix.Member{Displayname: "Tulir"},
+		},
+	})
+}
+
+func newChatLogTestMember(sender, target string, content, prevContent *mautrix.Content) *event.Event {
+	return event.Wrap(&mautrix.Event{
+		Type:     mautrix.StateMember,
+		Sender:   sender,
+		StateKey: &target,
+		Content:  *content,
+		Unsigned: mautrix.Unsigned{PrevContent: prevContent},
+	})
+}
+
+func TestChatLogger_Describe_Text(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	sender, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:    mautrix.EventMessage,
+		Sender:  "@tulir:maunium.net",
+		Content: mautrix.Content{MsgType: mautrix.MsgText, Body: "hello"},
+	}))
+	assert.Equal(t, "<Tulir>", sender)
+	assert.Equal(t, "hello", message)
+}
+
+func TestChatLogger_Describe_UnknownSender(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	sender, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:    mautrix.EventMessage,
+		Sender:  "@you:maunium.net",
+		Content: mautrix.Content{MsgType: mautrix.MsgText, Body: "hi"},
+	}))
+	assert.Equal(t, "<@you:maunium.net>", sender)
+	assert.Equal(t, "hi", message)
+}
+
+func TestChatLogger_Describe_Emote(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	sender, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:    mautrix.EventMessage,
+		Sender:  "@tulir:maunium.net",
+		Content: mautrix.Content{MsgType: mautrix.MsgEmote, Body: "waves"},
+	}))
+	assert.Equal(t, "*", sender)
+	assert.Equal(t, "Tulir waves", message)
+}
+
+func TestChatLogger_Describe_Reply(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	_, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:   mautrix.EventMessage,
+		Sender: "@tulir:maunium.net",
+		Content: mautrix.Content{
+			MsgType:   mautrix.MsgText,
+			Body:      "> <@you:maunium.net> hi\n\nhello",
+			RelatesTo: &mautrix.RelatesTo{Type: mautrix.RelReference, EventID: "$parent"},
+		},
+	}))
+	assert.Equal(t, "hello", message)
+}
+
+func TestChatLogger_Describe_Edit(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	_, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:   mautrix.EventMessage,
+		Sender: "@tulir:maunium.net",
+		Content: mautrix.Content{
+			MsgType:    mautrix.MsgText,
+			Body:       " * helo",
+			NewContent: &mautrix.Content{MsgType: mautrix.MsgText, Body: "hello"},
+			RelatesTo:  &mautrix.RelatesTo{Type: mautrix.RelReplace, EventID: "$original"},
+		},
+	}))
+	assert.Equal(t, "(edited) hello", message)
+}
+
+func TestChatLogger_Describe_File(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	_, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:    mautrix.EventMessage,
+		Sender:  "@tulir:maunium.net",
+		Content: mautrix.Content{MsgType: mautrix.MsgFile, Body: "file.txt", URL: "mxc://maunium.net/file"},
+	}))
+	assert.Equal(t, "file.txt (mxc://maunium.net/file)", message)
+}
+
+func TestChatLogger_Describe_Sticker(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	_, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:    mautrix.EventSticker,
+		Sender:  "@tulir:maunium.net",
+		Content: mautrix.Content{Body: "cat"},
+	}))
+	assert.Equal(t, "[sticker] cat", message)
+}
+
+func TestChatLogger_Describe_Encrypted(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	sender, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:   mautrix.EventEncrypted,
+		Sender: "@tulir:maunium.net",
+	}))
+	assert.Equal(t, "<Tulir>", sender)
+	assert.Equal(t, "[encrypted message]", message)
+}
+
+func TestChatLogger_Describe_Redaction(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	sender, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:    mautrix.EventRedaction,
+		Sender:  "@tulir:maunium.net",
+		Redacts: "$spam",
+		Content: mautrix.Content{Raw: map[string]interface{}{"reason": "spam"}},
+	}))
+	assert.Equal(t, "***", sender)
+	assert.Equal(t, "Tulir redacted $spam: spam", message)
+}
+
+func TestChatLogger_Describe_NotLogged(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	sender, message := cl.describe(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		Type:   mautrix.EventReaction,
+		Sender: "@tulir:maunium.net",
+	}))
+	assert.Empty(t, sender)
+	assert.Empty(t, message)
+}
+
+func TestChatLogger_DescribeMembership_Join(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@you:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "You"},
+	}, nil)
+	assert.Equal(t, "You joined the room", cl.describeMembership(evt, "You"))
+}
+
+func TestChatLogger_DescribeMembership_NameChange(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@you:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "Someone"},
+	}, &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "You"},
+	})
+	assert.Equal(t, "You changed their display name to Someone", cl.describeMembership(evt, "You"))
+}
+
+func TestChatLogger_DescribeMembership_AvatarChange(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@you:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "You", AvatarURL: "mxc://maunium.net/avatar"},
+	}, &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "You"},
+	})
+	assert.Empty(t, cl.describeMembership(evt, "You"))
+}
+
+func TestChatLogger_DescribeMembership_Leave(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@you:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipLeave,
+	}, &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "You"},
+	})
+	assert.Equal(t, "You left the room", cl.describeMembership(evt, "You"))
+}
+
+func TestChatLogger_DescribeMembership_RejectInvite(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@you:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipLeave,
+	}, &mautrix.Content{
+		Membership: mautrix.MembershipInvite,
+	})
+	assert.Equal(t, "@you:maunium.net rejected the invite", cl.describeMembership(evt, "@you:maunium.net"))
+}
+
+func TestChatLogger_DescribeMembership_Kick(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@tulir:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipLeave,
+		Member:     mautrix.Member{Reason: "rude"},
+	}, &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "You"},
+	})
+	assert.Equal(t, "Tulir kicked You: rude", cl.describeMembership(evt, "Tulir"))
+}
+
+func TestChatLogger_DescribeMembership_Ban(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@tulir:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipBan,
+	}, &mautrix.Content{
+		Membership: mautrix.MembershipJoin,
+		Member:     mautrix.Member{Displayname: "You"},
+	})
+	assert.Equal(t, "Tulir banned You", cl.describeMembership(evt, "Tulir"))
+}
+
+func TestChatLogger_DescribeMembership_Unban(t *testing.T) {
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	evt := newChatLogTestMember("@tulir:maunium.net", "@you:maunium.net", &mautrix.Content{
+		Membership: mautrix.MembershipLeave,
+	}, &mautrix.Content{
+		Membership: mautrix.MembershipBan,
+	})
+	assert.Equal(t, "Tulir unbanned @you:maunium.net", cl.describeMembership(evt, "Tulir"))
+}
+
+func TestChatLogger_LogEvent(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-chatlogtest")
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "[{time}] {sender} {message}")
+	cl.LogEvent(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		ID:        "$msg",
+		Type:      mautrix.EventMessage,
+		RoomID:    "!foo:maunium.net",
+		Sender:    "@tulir:maunium.net",
+		Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local).UnixNano() / int64(time.Millisecond),
+		Content:   mautrix.Content{MsgType: mautrix.MsgText, Body: "first\nsecond"},
+	}))
+	cl.LogEvent(chatLogTestRoom, event.Wrap(&mautrix.Event{
+		ID:     "$reaction",
+		Type:   mautrix.EventReaction,
+		RoomID: "!foo:maunium.net",
+		Sender: "@tulir:maunium.net",
+	}))
+
+	data, err := ioutil.ReadFile(cl.logPath("!foo:maunium.net"))
+	assert.Nil(t, err)
+	assert.Equal(t, "[03:04:05] <Tulir> first\n[03:04:05] <Tulir> second\n", string(data))
+}
+
+func TestChatLogger_Write_Rotation(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-chatlogtest")
+	cl := NewChatLogger("/tmp/gomuks-chatlogtest/logs", "")
+	assert.Nil(t, cl.write("!foo:maunium.net", "first\n"))
+	assert.Nil(t, cl.write("!foo:maunium.net", "second\n"))
+	data, err := ioutil.ReadFile(cl.logPath("!foo:maunium.net"))
+	assert.Nil(t, err)
+	assert.Equal(t, "first\nsecond\n", string(data))
+
+	// Logs written on a previous day are moved aside before writing.
+	yesterday := time.Now().AddDate(0, 0, -1)
+	assert.Nil(t, os.Chtimes(cl.logPath("!foo:maunium.net"), yesterday, yesterday))
+	assert.Nil(t, cl.write("!foo:maunium.net", "third\n"))
+
+	data, err = ioutil.ReadFile(cl.logPath("!foo:maunium.net"))
+	assert.Nil(t, err)
+	assert.Equal(t, "third\n", string(data))
+	data, err = ioutil.ReadFile(cl.rotatedLogPath("!foo:maunium.net", yesterday.Format(logDateFormat)))
+	assert.Nil(t, err)
+	assert.Equal(t, "first\nsecond\n", string(data))
+}
@@ -0,0 +1,217 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"encoding/json"
+	"errors"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/crypto"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// initCrypto opens the crypto store and loads (or creates) the Olm account of the current device.
+func (c *Container) initCrypto() {
+	if len(c.config.DeviceID) == 0 {
+		debug.Print("No device ID stored, end-to-end encryption is disabled. Log in again to enable it.")
+		return
+	}
+	store, err := crypto.NewStore(c.config.CryptoPath)
+	if err != nil {
+		debug.Print("Failed to open crypto store:", err)
+		return
+	}
+	mach := crypto.NewOlmMachine(c.client, c.config.DeviceID, store)
+	mach.VerificationHandler = c.handleVerificationUpdate
+	mach.SendRoomEvent = c.sendVerificationEvent
+	if err = mach.Load(); err != nil {
+		debug.Print("Failed to load crypto account:", err)
+	}
+	c.crypto = mach
+}
+
+// handleEncryptionSync passes the end-to-end encryption related parts of a sync response to the crypto machine.
+func (c *Container) handleEncryptionSync(resp *SyncResponse) {
+	if c.crypto == nil {
+		return
+	}
+	for _, rawEvt := range resp.ToDevice.Events {
+		evt := &mautrix.Event{}
+		if err := json.Unmarshal(rawEvt, evt); err != nil {
+			debug.Printf("Failed to unmarshal to-device event: %v\n%s", err, string(rawEvt))
+			continue
+		}
+		c.crypto.HandleToDeviceEvent(evt)
+	}
+	c.crypto.HandleDeviceLists(resp.DeviceLists.Changed, resp.DeviceLists.Left)
+	c.crypto.HandleOTKCounts(resp.DeviceOneTimeKeysCount)
+}
+
+// decryptEvent wraps the given event and decrypts it if it's encrypted.
+// If decryption fails, the encrypted event is returned with the decryption error set.
+func (c *Container) decryptEvent(mxEvent *mautrix.Event) *event.Event {
+	if mxEvent.Type != mautrix.EventEncrypted {
+		return event.Wrap(mxEvent)
+	} else if c.crypto == nil {
+		evt := event.Wrap(mxEvent)
+		evt.Gomuks.DecryptionError = "end-to-end encryption is not enabled"
+		return evt
+	}
+	decrypted, info, err := c.crypto.DecryptMegolmEvent(mxEvent)
+	if err != nil {
+		debug.Printf("Failed to decrypt %s in %s: %v", mxEvent.ID, mxEvent.RoomID, err)
+		evt := event.Wrap(mxEvent)
+		evt.Gomuks.DecryptionError = err.Error()
+		return evt
+	}
+	evt := event.Wrap(decrypted)
+	evt.Gomuks.Encryption = info
+	return evt
+}
+
+// decryptEvents decrypts the given events with decryptEvent.
+func (c *Container) decryptEvents(events []*mautrix.Event) []*event.Event {
+	decrypted := make([]*event.Event, len(events))
+	for i, evt := range events {
+		decrypted[i] = c.decryptEvent(evt)
+	}
+	return decrypted
+}
+
+// encryptEvent shares the room's group session with all members and encrypts the given event content with it.
+// The relation is copied to the unencrypted part of the event so that the server can aggregate it.
+func (c *Container) encryptEvent(room *rooms.Room, evtType mautrix.EventType, content interface{}, relatesTo *mautrix.RelatesTo) (*crypto.EncryptedContent, error) {
+	if c.crypto == nil {
+		return nil, errors.New("end-to-end encryption is not enabled")
+	}
+	var settings crypto.RoomEncryption
+	if evt := room.GetStateEvent(rooms.StateEncryption, ""); evt == nil {
+		return nil, errors.New("room is not encrypted")
+	} else if err := json.Unmarshal(evt.Content.VeryRaw, &settings); err != nil {
+		return nil, err
+	}
+	if !room.MembersFetched {
+		if err := c.FetchMembers(room); err != nil {
+			return nil, err
+		}
+	}
+	members := room.GetMembers()
+	users := make([]string, 0, len(members))
+	for userID := range members {
+		users = append(users, userID)
+	}
+	if err := c.crypto.ShareGroupSession(room.ID, users, settings); err != nil {
+		return nil, err
+	}
+	encrypted, err := c.crypto.EncryptMegolmEvent(room.ID, evtType, content)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.RelatesTo = relatesTo
+	return encrypted, nil
+}
+
+// handleVerificationUpdate shows the current state of a verification in the UI.
+func (c *Container) handleVerificationUpdate(v *crypto.Verification) {
+	c.ui.MainView(c).ShowVerification(v)
+	c.ui.Render()
+}
+
+// sendVerificationEvent sends an event of an in-room verification, encrypting it if the room is encrypted.
+func (c *Container) sendVerificationEvent(roomID string, evtType mautrix.EventType, content interface{}, relatesTo *mautrix.RelatesTo) (string, error) {
+	if room := c.GetRoom(roomID); room != nil && room.IsEncrypted() {
+		encrypted, err := c.encryptEvent(room, evtType, content, relatesTo)
+		if err != nil {
+			return "", err
+		}
+		evtType, content = mautrix.EventEncrypted, encrypted
+	}
+	resp, err := c.client.SendMessageEvent(roomID, evtType, content)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// ImportKeys imports the Megolm sessions from the given key export file and uses them to decrypt stored events
+// that couldn't be decrypted earlier.
+func (c *Container) ImportKeys(data []byte, passphrase string) (imported, total int, err error) {
+	if c.crypto == nil {
+		return 0, 0, errors.New("end-to-end encryption is not enabled")
+	}
+	sessions, total, err := c.crypto.ImportKeys(data, passphrase)
+	if len(sessions) == 0 {
+		return 0, total, err
+	}
+	sessionsByRoom := make(map[string]map[string]struct{})
+	for _, session := range sessions {
+		if _, ok := sessionsByRoom[session.RoomID]; !ok {
+			sessionsByRoom[session.RoomID] = make(map[string]struct{})
+		}
+		sessionsByRoom[session.RoomID][session.SessionID] = struct{}{}
+	}
+	for roomID, sessionIDs := range sessionsByRoom {
+		room := c.GetRoom(roomID)
+		if room == nil {
+			continue
+		}
+		c.redecryptEvents(room, sessionIDs)
+	}
+	c.ui.Render()
+	return len(sessions), total, err
+}
+
+// redecryptEvents retries decrypting stored events in the given room that were encrypted with one of the given sessions.
+func (c *Container) redecryptEvents(room *rooms.Room, sessionIDs map[string]struct{}) {
+	updated, err := c.history.UpdateAll(room, func(evt *event.Event) *event.Event {
+		if evt.Type != mautrix.EventEncrypted || len(evt.Gomuks.DecryptionError) == 0 {
+			return nil
+		}
+		var content crypto.EncryptedContent
+		if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+			return nil
+		} else if _, ok := sessionIDs[content.SessionID]; !ok {
+			return nil
+		}
+		decrypted := c.decryptEvent(evt.Event)
+		if decrypted.Gomuks.Encryption == nil {
+			return nil
+		}
+		decrypted.Gomuks.Edits = evt.Gomuks.Edits
+		return decrypted
+	})
+	if err != nil {
+		debug.Printf("Failed to update events in %s after importing keys: %v", room.ID, err)
+	}
+	if len(updated) == 0 || !room.Loaded() {
+		return
+	}
+	debug.Printf("Decrypted %d previously undecryptable events in %s", len(updated), room.ID)
+	roomView := c.ui.MainView(c).GetRoom(room.ID)
+	if roomView == nil {
+		return
+	}
+	for _, evt := range updated {
+		if roomView.GetEvent(evt.ID) != nil {
+			roomView.AddEdit(evt)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/matrix/crypto/olm"
+)
+
+func newTestMachine(t *testing.T, dir, userID, deviceID string) *OlmMachine {
+	client, err := mautrix.NewClient("https://example.com", userID, "token")
+	require.NoError(t, err)
+	store, err := NewStore(filepath.Join(dir, deviceID+".db"))
+	require.NoError(t, err)
+	mach := NewOlmMachine(client, deviceID, store)
+	mach.account = olm.NewAccount()
+	mach.shared = true
+	return mach
+}
+
+func toEvent(t *testing.T, sender, roomID, eventID string, content interface{}) *mautrix.Event {
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	evt := &mautrix.Event{
+		ID:     eventID,
+		Sender: sender,
+		RoomID: roomID,
+		Type:   mautrix.EventEncrypted,
+	}
+	require.NoError(t, json.Unmarshal(data, &evt.Content))
+	return evt
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	data, err := CanonicalJSON(json.RawMessage(`{"b": 2, "a": {"d": "<&>", "c": 1}, "signatures": {}, "unsigned": {"x": 1}}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":{"c":1,"d":"<&>"},"b":2}`, string(data))
+}
+
+func TestOlmMachine_SignedDeviceKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomuks-crypto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	mach := newTestMachine(t, dir, "@alice:example.com", "ALICE")
+
+	deviceKeys, err := mach.ownDeviceKeys()
+	require.NoError(t, err)
+	raw, err := json.Marshal(deviceKeys)
+	require.NoError(t, err)
+	device, err := parseDeviceKeys("@alice:example.com", "ALICE", raw)
+	require.NoError(t, err)
+	assert.Equal(t, mach.OwnIdentity(), device)
+
+	_, err = parseDeviceKeys("@alice:example.com", "OTHER", raw)
+	assert.Error(t, err)
+}
+
+func TestOlmMachine_RoomKeyAndMegolm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomuks-crypto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	alice := newTestMachine(t, dir, "@alice:example.com", "ALICE")
+	bob := newTestMachine(t, dir, "@bob:example.com", "BOB")
+	const roomID = "!room:example.com"
+
+	bob.account.GenerateOneTimeKeys(1)
+	var otk string
+	for _, key := range bob.account.UnpublishedOneTimeKeys() {
+		otk = key
+	}
+	bobIdentity := bob.OwnIdentity()
+	session, err := alice.account.NewOutboundSession(bobIdentity.IdentityKey, otk)
+	require.NoError(t, err)
+
+	outbound, err := alice.newOutboundGroupSession(roomID, RoomEncryption{Algorithm: AlgorithmMegolmV1})
+	require.NoError(t, err)
+	roomKey, err := alice.encryptOlmEvent(session, bobIdentity, ToDeviceRoomKey.Type, &roomKeyContent{
+		Algorithm:  AlgorithmMegolmV1,
+		RoomID:     roomID,
+		SessionID:  outbound.Session.ID(),
+		SessionKey: outbound.Session.SessionKey(),
+	})
+	require.NoError(t, err)
+	bob.HandleToDeviceEvent(toEvent(t, "@alice:example.com", "", "", roomKey))
+	assert.Empty(t, bob.account.OneTimeKeys)
+
+	encrypted, err := alice.EncryptMegolmEvent(roomID, mautrix.EventMessage, &mautrix.Content{
+		MsgType: mautrix.MsgText,
+		Body:    "Hello, World!",
+	})
+	require.NoError(t, err)
+	evt := toEvent(t, "@alice:example.com", roomID, "$event1", encrypted)
+	decrypted, info, err := bob.DecryptMegolmEvent(evt)
+	require.NoError(t, err)
+	assert.Equal(t, mautrix.EventMessage, decrypted.Type)
+	assert.Equal(t, "Hello, World!", decrypted.Content.Body)
+	assert.Equal(t, "ALICE", info.SenderDevice)
+	assert.Equal(t, alice.OwnIdentity().IdentityKey, info.SenderKey)
+
+	// Decrypting the same event again is fine, but reusing the index for another event isn't.
+	_, _, err = bob.DecryptMegolmEvent(evt)
+	assert.NoError(t, err)
+	_, _, err = bob.DecryptMegolmEvent(toEvent(t, "@alice:example.com", roomID, "$event2", encrypted))
+	assert.Equal(t, ErrDuplicateMessageIndex, err)
+
+	// Alice can decrypt her own messages too.
+	decrypted, _, err = alice.DecryptMegolmEvent(evt)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, World!", decrypted.Content.Body)
+
+	_, _, err = bob.DecryptMegolmEvent(toEvent(t, "@alice:example.com", "!other:example.com", "$event3", encrypted))
+	assert.Equal(t, ErrSessionNotFound, err)
+}
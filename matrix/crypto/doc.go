@@ -0,0 +1,3 @@
+// Package crypto contains the end-to-end encryption support of gomuks: device key management,
+// Olm sessions for to-device messages and Megolm sessions for room messages.
+package crypto
@@ -0,0 +1,263 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/crypto/olm"
+)
+
+const (
+	keyExportHeader  = "-----BEGIN MEGOLM SESSION DATA-----"
+	keyExportTrailer = "-----END MEGOLM SESSION DATA-----"
+
+	keyExportVersion = 1
+	// keyExportRounds is the number of PBKDF2 rounds used when exporting, which is the same as other clients use.
+	keyExportRounds = 500000
+	// keyExportMaxRounds is the highest number of PBKDF2 rounds accepted when importing. The round count is read
+	// from the file, so without a limit a crafted file could keep the key derivation busy for hours.
+	keyExportMaxRounds = 5000000
+	// keyExportLineLength is the number of bytes encoded on each line of the export file.
+	keyExportLineLength = 96
+
+	keyExportSaltLength = 16
+	keyExportIVLength   = 16
+	keyExportMACLength  = 32
+)
+
+var (
+	ErrInvalidExportFile   = errors.New("invalid key export file")
+	ErrExportBadPassphrase = errors.New("wrong passphrase or corrupted key export file")
+)
+
+// ExportedSession is a Megolm session in the format used by key exports.
+type ExportedSession struct {
+	Algorithm         string            `json:"algorithm"`
+	ForwardingChain   []string          `json:"forwarding_curve25519_key_chain"`
+	RoomID            string            `json:"room_id"`
+	SenderKey         string            `json:"sender_key"`
+	SenderClaimedKeys map[string]string `json:"sender_claimed_keys"`
+	SessionID         string            `json:"session_id"`
+	SessionKey        string            `json:"session_key"`
+}
+
+func deriveExportKeys(passphrase string, salt []byte, rounds uint32) (aesKey, hmacKey []byte) {
+	key := pbkdf2.Key([]byte(passphrase), salt, int(rounds), 64, sha512.New)
+	return key[:32], key[32:]
+}
+
+// EncryptKeyExport encrypts the given sessions with the given passphrase into the armored MEGOLM SESSION DATA format.
+func EncryptKeyExport(sessions []ExportedSession, passphrase string) ([]byte, error) {
+	return encryptKeyExport(sessions, passphrase, keyExportRounds)
+}
+
+func encryptKeyExport(sessions []ExportedSession, passphrase string, rounds uint32) ([]byte, error) {
+	if sessions == nil {
+		sessions = []ExportedSession{}
+	}
+	plaintext, err := json.Marshal(sessions)
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, keyExportSaltLength+keyExportIVLength)
+	if _, err = rand.Read(random); err != nil {
+		return nil, err
+	}
+	salt, iv := random[:keyExportSaltLength], random[keyExportSaltLength:]
+	// Clear bit 63 of the counter so it can't overflow the low 64 bits.
+	iv[8] &= 0x7f
+	aesKey, hmacKey := deriveExportKeys(passphrase, salt, rounds)
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, 1+len(random)+4+len(plaintext)+keyExportMACLength)
+	data = append(data, keyExportVersion)
+	data = append(data, salt...)
+	data = append(data, iv...)
+	var roundsBytes [4]byte
+	binary.BigEndian.PutUint32(roundsBytes[:], rounds)
+	data = append(data, roundsBytes[:]...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+	data = append(data, ciphertext...)
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(data)
+	data = mac.Sum(data)
+
+	var buf bytes.Buffer
+	buf.WriteString(keyExportHeader)
+	buf.WriteByte('\n')
+	for i := 0; i < len(data); i += keyExportLineLength {
+		end := i + keyExportLineLength
+		if end > len(data) {
+			end = len(data)
+		}
+		buf.WriteString(base64.StdEncoding.EncodeToString(data[i:end]))
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(keyExportTrailer)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// DecryptKeyExport decrypts an armored MEGOLM SESSION DATA file with the given passphrase.
+func DecryptKeyExport(file []byte, passphrase string) ([]ExportedSession, error) {
+	var encoded strings.Builder
+	inData := false
+	for _, line := range strings.Split(string(file), "\n") {
+		line = strings.TrimSpace(line)
+		if line == keyExportHeader {
+			inData = true
+		} else if line == keyExportTrailer {
+			inData = false
+			break
+		} else if inData {
+			encoded.WriteString(line)
+		}
+	}
+	if encoded.Len() == 0 || inData {
+		return nil, ErrInvalidExportFile
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, ErrInvalidExportFile
+	}
+	headerLength := 1 + keyExportSaltLength + keyExportIVLength + 4
+	if len(data) < headerLength+keyExportMACLength {
+		return nil, ErrInvalidExportFile
+	} else if data[0] != keyExportVersion {
+		return nil, fmt.Errorf("unsupported key export version %d", data[0])
+	}
+	salt := data[1 : 1+keyExportSaltLength]
+	iv := data[1+keyExportSaltLength : 1+keyExportSaltLength+keyExportIVLength]
+	rounds := binary.BigEndian.Uint32(data[headerLength-4 : headerLength])
+	if rounds == 0 || rounds > keyExportMaxRounds {
+		return nil, fmt.Errorf("unsupported number of key export rounds %d", rounds)
+	}
+	ciphertext := data[headerLength : len(data)-keyExportMACLength]
+	expectedMAC := data[len(data)-keyExportMACLength:]
+
+	aesKey, hmacKey := deriveExportKeys(passphrase, salt, rounds)
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(data[:len(data)-keyExportMACLength])
+	if !hmac.Equal(mac.Sum(nil), expectedMAC) {
+		return nil, ErrExportBadPassphrase
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+	var sessions []ExportedSession
+	if err = json.Unmarshal(plaintext, &sessions); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted key export: %v", err)
+	}
+	return sessions, nil
+}
+
+// ExportKeys exports all the Megolm sessions in the store and encrypts them with the given passphrase.
+func (mach *OlmMachine) ExportKeys(passphrase string) ([]byte, int, error) {
+	mach.lock.Lock()
+	stored, err := mach.store.GetAllInboundGroupSessions()
+	mach.lock.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	sessions := make([]ExportedSession, 0, len(stored))
+	for _, igs := range stored {
+		sessionKey, err := igs.Session.Export(igs.Session.FirstKnownIndex())
+		if err != nil {
+			debug.Printf("Failed to export session %s in %s: %v", igs.Session.ID(), igs.RoomID, err)
+			continue
+		}
+		forwardingChain := igs.ForwardingChain
+		if forwardingChain == nil {
+			forwardingChain = []string{}
+		}
+		sessions = append(sessions, ExportedSession{
+			Algorithm:         AlgorithmMegolmV1,
+			ForwardingChain:   forwardingChain,
+			RoomID:            igs.RoomID,
+			SenderKey:         igs.SenderKey,
+			SenderClaimedKeys: map[string]string{keyAlgorithmEd25519: igs.SigningKey},
+			SessionID:         igs.Session.ID(),
+			SessionKey:        sessionKey,
+		})
+	}
+	data, err := EncryptKeyExport(sessions, passphrase)
+	return data, len(sessions), err
+}
+
+// ImportKeys decrypts the given key export file and stores the sessions in it. Sessions that are already known
+// from an earlier index are skipped. The sessions that were imported are returned.
+func (mach *OlmMachine) ImportKeys(file []byte, passphrase string) (imported []ExportedSession, total int, err error) {
+	sessions, err := DecryptKeyExport(file, passphrase)
+	if err != nil {
+		return nil, 0, err
+	}
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	for _, exported := range sessions {
+		if exported.Algorithm != AlgorithmMegolmV1 {
+			debug.Printf("Skipping imported session %s with unsupported algorithm %s", exported.SessionID, exported.Algorithm)
+			continue
+		}
+		session, err := olm.ImportInboundGroupSession(exported.SessionKey)
+		if err != nil {
+			debug.Printf("Failed to import session %s: %v", exported.SessionID, err)
+			continue
+		} else if session.ID() != exported.SessionID {
+			debug.Printf("Imported session has mismatching session ID (%s != %s)", session.ID(), exported.SessionID)
+			continue
+		}
+		existing, _ := mach.store.GetInboundGroupSession(exported.RoomID, exported.SenderKey, exported.SessionID)
+		if existing != nil && existing.Session.FirstKnownIndex() <= session.FirstKnownIndex() {
+			continue
+		}
+		err = mach.store.PutInboundGroupSession(&InboundGroupSession{
+			Session:         session,
+			RoomID:          exported.RoomID,
+			SenderKey:       exported.SenderKey,
+			SigningKey:      exported.SenderClaimedKeys[keyAlgorithmEd25519],
+			ForwardingChain: exported.ForwardingChain,
+		})
+		if err != nil {
+			return imported, len(sessions), err
+		}
+		imported = append(imported, exported)
+	}
+	return imported, len(sessions), nil
+}
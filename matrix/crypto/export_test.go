@@ -0,0 +1,113 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestKeyExport_RoundTrip(t *testing.T) {
+	sessions := []ExportedSession{{
+		Algorithm:         AlgorithmMegolmV1,
+		ForwardingChain:   []string{},
+		RoomID:            "!room:example.com",
+		SenderKey:         "senderkey",
+		SenderClaimedKeys: map[string]string{"ed25519": "signingkey"},
+		SessionID:         "sessionid",
+		SessionKey:        strings.Repeat("sessionkey", 20),
+	}}
+	data, err := encryptKeyExport(sessions, "hunter2", 1000)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, keyExportHeader, lines[0])
+	assert.Equal(t, keyExportTrailer, lines[len(lines)-1])
+	assert.True(t, len(lines) > 3)
+
+	decrypted, err := DecryptKeyExport(data, "hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, sessions, decrypted)
+
+	_, err = DecryptKeyExport(data, "hunter3")
+	assert.Equal(t, ErrExportBadPassphrase, err)
+	_, err = DecryptKeyExport([]byte("not an export"), "hunter2")
+	assert.Equal(t, ErrInvalidExportFile, err)
+}
+
+func TestKeyExport_TooManyRounds(t *testing.T) {
+	data, err := encryptKeyExport([]ExportedSession{}, "hunter2", 1000)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	require.NoError(t, err)
+	binary.BigEndian.PutUint32(raw[1+keyExportSaltLength+keyExportIVLength:], keyExportMaxRounds+1)
+	crafted := keyExportHeader + "\n" + base64.StdEncoding.EncodeToString(raw) + "\n" + keyExportTrailer + "\n"
+
+	_, err = DecryptKeyExport([]byte(crafted), "hunter2")
+	assert.EqualError(t, err, "unsupported number of key export rounds 5000001")
+}
+
+func TestOlmMachine_ExportImportKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomuks-crypto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	alice := newTestMachine(t, dir, "@alice:example.com", "ALICE")
+	bob := newTestMachine(t, dir, "@alice:example.com", "ALICE2")
+	const roomID = "!room:example.com"
+
+	_, err = alice.newOutboundGroupSession(roomID, RoomEncryption{Algorithm: AlgorithmMegolmV1})
+	require.NoError(t, err)
+	encrypted, err := alice.EncryptMegolmEvent(roomID, mautrix.EventMessage, &mautrix.Content{
+		MsgType: mautrix.MsgText,
+		Body:    "Hello, World!",
+	})
+	require.NoError(t, err)
+	evt := toEvent(t, "@alice:example.com", roomID, "$event1", encrypted)
+	_, _, err = bob.DecryptMegolmEvent(evt)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	data, count, err := alice.ExportKeys("hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, _, err = bob.ImportKeys(data, "wrong")
+	assert.Equal(t, ErrExportBadPassphrase, err)
+	imported, total, err := bob.ImportKeys(data, "hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+	require.Len(t, imported, 1)
+	assert.Equal(t, roomID, imported[0].RoomID)
+
+	decrypted, _, err := bob.DecryptMegolmEvent(evt)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, World!", decrypted.Content.Body)
+
+	// Importing the same keys again doesn't replace anything.
+	imported, total, err = bob.ImportKeys(data, "hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Empty(t, imported)
+}
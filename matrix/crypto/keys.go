@@ -0,0 +1,379 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/crypto/olm"
+)
+
+const (
+	AlgorithmOlmV1    = "m.olm.v1.curve25519-aes-sha2"
+	AlgorithmMegolmV1 = "m.megolm.v1.aes-sha2"
+
+	keyAlgorithmCurve25519       = "curve25519"
+	keyAlgorithmEd25519          = "ed25519"
+	keyAlgorithmSignedCurve25519 = "signed_curve25519"
+)
+
+// TrustState is the local trust level of a device.
+type TrustState int
+
+const (
+	TrustStateUnverified TrustState = iota
+	TrustStateVerified
+)
+
+func (trust TrustState) String() string {
+	switch trust {
+	case TrustStateVerified:
+		return "verified"
+	default:
+		return "unverified"
+	}
+}
+
+// DeviceIdentity contains the identity keys of a device.
+type DeviceIdentity struct {
+	UserID      string     `json:"user_id"`
+	DeviceID    string     `json:"device_id"`
+	IdentityKey string     `json:"identity_key"`
+	SigningKey  string     `json:"signing_key"`
+	Name        string     `json:"name,omitempty"`
+	Trust       TrustState `json:"trust,omitempty"`
+}
+
+// DeviceKeys is the device key object uploaded to and returned by the server.
+type DeviceKeys struct {
+	UserID     string                       `json:"user_id"`
+	DeviceID   string                       `json:"device_id"`
+	Algorithms []string                     `json:"algorithms"`
+	Keys       map[string]string            `json:"keys"`
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+	Unsigned   struct {
+		DeviceDisplayName string `json:"device_display_name,omitempty"`
+	} `json:"unsigned,omitempty"`
+}
+
+// OneTimeKey is a signed Curve25519 one-time key.
+type OneTimeKey struct {
+	Key        string                       `json:"key"`
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+}
+
+// CanonicalJSON returns the canonical JSON form of the given object without the signatures and unsigned fields,
+// which is the form that is signed in the Matrix key APIs.
+func CanonicalJSON(data interface{}) ([]byte, error) {
+	var raw []byte
+	var err error
+	if rawMsg, ok := data.(json.RawMessage); ok {
+		raw = rawMsg
+	} else if raw, err = json.Marshal(data); err != nil {
+		return nil, err
+	}
+	var parsed interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err = dec.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	if obj, ok := parsed.(map[string]interface{}); ok {
+		delete(obj, "signatures")
+		delete(obj, "unsigned")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(parsed); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+// VerifySignedJSON checks that the given JSON object has a valid signature from the given Ed25519 key.
+func VerifySignedJSON(data json.RawMessage, userID, deviceID, signingKey string) error {
+	var obj struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	signature, ok := obj.Signatures[userID][fmt.Sprintf("%s:%s", keyAlgorithmEd25519, deviceID)]
+	if !ok {
+		return fmt.Errorf("no signature from %s/%s", userID, deviceID)
+	}
+	canonical, err := CanonicalJSON(data)
+	if err != nil {
+		return err
+	}
+	if !olm.VerifySignature(signingKey, signature, canonical) {
+		return fmt.Errorf("invalid signature from %s/%s", userID, deviceID)
+	}
+	return nil
+}
+
+func (mach *OlmMachine) signJSON(data interface{}) (string, error) {
+	canonical, err := CanonicalJSON(data)
+	if err != nil {
+		return "", err
+	}
+	return mach.account.Sign(canonical), nil
+}
+
+func (mach *OlmMachine) signatures(signature string) map[string]map[string]string {
+	return map[string]map[string]string{
+		mach.userID: {fmt.Sprintf("%s:%s", keyAlgorithmEd25519, mach.deviceID): signature},
+	}
+}
+
+func (mach *OlmMachine) ownDeviceKeys() (*DeviceKeys, error) {
+	identityKey, signingKey := mach.account.IdentityKeys()
+	deviceKeys := &DeviceKeys{
+		UserID:     mach.userID,
+		DeviceID:   mach.deviceID,
+		Algorithms: []string{AlgorithmOlmV1, AlgorithmMegolmV1},
+		Keys: map[string]string{
+			fmt.Sprintf("%s:%s", keyAlgorithmCurve25519, mach.deviceID): identityKey,
+			fmt.Sprintf("%s:%s", keyAlgorithmEd25519, mach.deviceID):    signingKey,
+		},
+	}
+	signature, err := mach.signJSON(deviceKeys)
+	if err != nil {
+		return nil, err
+	}
+	deviceKeys.Signatures = mach.signatures(signature)
+	return deviceKeys, nil
+}
+
+type reqUploadKeys struct {
+	DeviceKeys  *DeviceKeys           `json:"device_keys,omitempty"`
+	OneTimeKeys map[string]OneTimeKey `json:"one_time_keys,omitempty"`
+}
+
+type respUploadKeys struct {
+	OneTimeKeyCounts map[string]int `json:"one_time_key_counts"`
+}
+
+// shareKeys uploads the device keys (if they haven't been uploaded yet) and enough one-time keys
+// to bring the count on the server up to half of the maximum.
+func (mach *OlmMachine) shareKeys(currentOTKCount int) error {
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	var req reqUploadKeys
+	if !mach.shared {
+		deviceKeys, err := mach.ownDeviceKeys()
+		if err != nil {
+			return err
+		}
+		req.DeviceKeys = deviceKeys
+	}
+	if newCount := olm.MaxOneTimeKeys/2 - currentOTKCount; newCount > 0 {
+		mach.account.GenerateOneTimeKeys(newCount)
+	}
+	req.OneTimeKeys = make(map[string]OneTimeKey)
+	for keyID, key := range mach.account.UnpublishedOneTimeKeys() {
+		otk := OneTimeKey{Key: key}
+		signature, err := mach.signJSON(&otk)
+		if err != nil {
+			return err
+		}
+		otk.Signatures = mach.signatures(signature)
+		req.OneTimeKeys[fmt.Sprintf("%s:%s", keyAlgorithmSignedCurve25519, keyID)] = otk
+	}
+	if req.DeviceKeys == nil && len(req.OneTimeKeys) == 0 {
+		return nil
+	}
+	var resp respUploadKeys
+	_, err := mach.client.MakeRequest("POST", mach.client.BuildURL("keys", "upload"), &req, &resp)
+	if err != nil {
+		return err
+	}
+	mach.account.MarkKeysAsPublished()
+	mach.shared = true
+	mach.otkCount = resp.OneTimeKeyCounts[keyAlgorithmSignedCurve25519]
+	return mach.store.PutAccount(mach.account, true)
+}
+
+type reqQueryKeys struct {
+	DeviceKeys map[string][]string `json:"device_keys"`
+	Timeout    int                 `json:"timeout,omitempty"`
+}
+
+type respQueryKeys struct {
+	DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+}
+
+// queryKeys fetches the device lists of the given users and stores the devices with valid signatures.
+func (mach *OlmMachine) queryKeys(users []string) error {
+	if len(users) == 0 {
+		return nil
+	}
+	req := reqQueryKeys{DeviceKeys: make(map[string][]string, len(users)), Timeout: 10000}
+	for _, userID := range users {
+		req.DeviceKeys[userID] = []string{}
+	}
+	var resp respQueryKeys
+	_, err := mach.client.MakeRequest("POST", mach.client.BuildURL("keys", "query"), &req, &resp)
+	if err != nil {
+		return err
+	}
+	var queried []string
+	for userID, devices := range resp.DeviceKeys {
+		existing, err := mach.store.GetDevices(userID)
+		if err != nil {
+			return err
+		}
+		newDevices := make(map[string]*DeviceIdentity, len(devices))
+		for deviceID, rawKeys := range devices {
+			device, err := parseDeviceKeys(userID, deviceID, rawKeys)
+			if err != nil {
+				debug.Printf("Skipping device %s of %s: %v", deviceID, userID, err)
+				continue
+			}
+			if old, ok := existing[deviceID]; ok && old.SigningKey != device.SigningKey {
+				debug.Printf("Signing key of %s/%s changed from %s to %s, ignoring new key", userID, deviceID, old.SigningKey, device.SigningKey)
+				newDevices[deviceID] = old
+				continue
+			} else if ok {
+				device.Trust = old.Trust
+			}
+			newDevices[deviceID] = device
+		}
+		if err = mach.store.PutDevices(userID, newDevices); err != nil {
+			return err
+		}
+		queried = append(queried, userID)
+	}
+	return mach.store.MarkTracked(queried)
+}
+
+// GetDevice returns the given device of the given user, fetching the user's device list from the server
+// if it isn't known or is outdated.
+func (mach *OlmMachine) GetDevice(userID, deviceID string) (*DeviceIdentity, error) {
+	if untracked := mach.store.FilterUntrackedUsers([]string{userID}); len(untracked) > 0 {
+		if err := mach.queryKeys(untracked); err != nil {
+			return nil, err
+		}
+	}
+	return mach.store.GetDevice(userID, deviceID)
+}
+
+// GetDevices returns all devices of the given user, fetching the device list from the server if necessary.
+func (mach *OlmMachine) GetDevices(userID string) (map[string]*DeviceIdentity, error) {
+	if untracked := mach.store.FilterUntrackedUsers([]string{userID}); len(untracked) > 0 {
+		if err := mach.queryKeys(untracked); err != nil {
+			return nil, err
+		}
+	}
+	return mach.store.GetDevices(userID)
+}
+
+// IsDeviceVerified checks whether the given device has been verified and that its identity key matches
+// the given key. The current device is always considered verified. Only the local store is used,
+// so unknown devices are treated as unverified.
+func (mach *OlmMachine) IsDeviceVerified(userID, deviceID, identityKey string) bool {
+	if userID == mach.userID && deviceID == mach.deviceID {
+		ownKey, _ := mach.account.IdentityKeys()
+		return ownKey == identityKey
+	}
+	device, err := mach.store.GetDevice(userID, deviceID)
+	if err != nil {
+		return false
+	}
+	return device.Trust == TrustStateVerified && device.IdentityKey == identityKey
+}
+
+func parseDeviceKeys(userID, deviceID string, rawKeys json.RawMessage) (*DeviceIdentity, error) {
+	var keys DeviceKeys
+	if err := json.Unmarshal(rawKeys, &keys); err != nil {
+		return nil, err
+	} else if keys.UserID != userID || keys.DeviceID != deviceID {
+		return nil, fmt.Errorf("mismatching user or device ID in keys (%s/%s)", keys.UserID, keys.DeviceID)
+	}
+	device := &DeviceIdentity{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		IdentityKey: keys.Keys[fmt.Sprintf("%s:%s", keyAlgorithmCurve25519, deviceID)],
+		SigningKey:  keys.Keys[fmt.Sprintf("%s:%s", keyAlgorithmEd25519, deviceID)],
+		Name:        keys.Unsigned.DeviceDisplayName,
+	}
+	if len(device.IdentityKey) == 0 || len(device.SigningKey) == 0 {
+		return nil, fmt.Errorf("missing identity keys")
+	} else if err := VerifySignedJSON(rawKeys, userID, deviceID, device.SigningKey); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+type reqClaimKeys struct {
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+	Timeout     int                          `json:"timeout,omitempty"`
+}
+
+type respClaimKeys struct {
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+// createOutboundSessions claims one-time keys for the given devices and creates new Olm sessions with them.
+func (mach *OlmMachine) createOutboundSessions(devices []*DeviceIdentity) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	req := reqClaimKeys{OneTimeKeys: make(map[string]map[string]string), Timeout: 10000}
+	deviceMap := make(map[string]map[string]*DeviceIdentity)
+	for _, device := range devices {
+		if _, ok := req.OneTimeKeys[device.UserID]; !ok {
+			req.OneTimeKeys[device.UserID] = make(map[string]string)
+			deviceMap[device.UserID] = make(map[string]*DeviceIdentity)
+		}
+		req.OneTimeKeys[device.UserID][device.DeviceID] = keyAlgorithmSignedCurve25519
+		deviceMap[device.UserID][device.DeviceID] = device
+	}
+	var resp respClaimKeys
+	_, err := mach.client.MakeRequest("POST", mach.client.BuildURL("keys", "claim"), &req, &resp)
+	if err != nil {
+		return err
+	}
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	for userID, userKeys := range resp.OneTimeKeys {
+		for deviceID, deviceKeys := range userKeys {
+			device, ok := deviceMap[userID][deviceID]
+			if !ok {
+				continue
+			}
+			for _, rawKey := range deviceKeys {
+				var otk OneTimeKey
+				if err = json.Unmarshal(rawKey, &otk); err != nil {
+					debug.Printf("Failed to parse one-time key of %s/%s: %v", userID, deviceID, err)
+				} else if err = VerifySignedJSON(rawKey, userID, deviceID, device.SigningKey); err != nil {
+					debug.Printf("Failed to verify one-time key of %s/%s: %v", userID, deviceID, err)
+				} else if session, err := mach.account.NewOutboundSession(device.IdentityKey, otk.Key); err != nil {
+					debug.Printf("Failed to create Olm session with %s/%s: %v", userID, deviceID, err)
+				} else if err = mach.store.PutOlmSession(device.IdentityKey, session); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
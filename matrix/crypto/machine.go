@@ -0,0 +1,376 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/crypto/olm"
+)
+
+var ToDeviceRoomKey = mautrix.NewEventType("m.room_key")
+
+// OlmMachine is the main end-to-end encryption manager. It owns the Olm account of the device and
+// handles sharing and receiving room keys.
+type OlmMachine struct {
+	client   *mautrix.Client
+	store    *Store
+	userID   string
+	deviceID string
+
+	account  *olm.Account
+	shared   bool
+	otkCount int
+
+	outbound map[string]*OutboundGroupSession
+
+	lock      sync.Mutex
+	shareLock sync.Mutex
+
+	verifications    map[string]*Verification
+	verificationLock sync.Mutex
+
+	// ToDeviceHandler is called with to-device events that the machine doesn't handle itself.
+	// Encrypted events are decrypted before being passed to the handler.
+	ToDeviceHandler func(evt *mautrix.Event)
+	// VerificationHandler is called when a verification is requested or its state changes.
+	VerificationHandler func(v *Verification)
+	// SendRoomEvent is used to send the events of in-room verifications.
+	// It should encrypt the event if the room is encrypted.
+	SendRoomEvent func(roomID string, evtType mautrix.EventType, content interface{}, relatesTo *mautrix.RelatesTo) (string, error)
+}
+
+// NewOlmMachine creates a new crypto machine for the device ID of the given client.
+// Load must be called before the machine is used.
+func NewOlmMachine(client *mautrix.Client, deviceID string, store *Store) *OlmMachine {
+	return &OlmMachine{
+		client:   client,
+		store:    store,
+		userID:   client.UserID,
+		deviceID: deviceID,
+		outbound: make(map[string]*OutboundGroupSession),
+
+		verifications: make(map[string]*Verification),
+	}
+}
+
+// Load loads the Olm account from the store, or creates a new one if there isn't one yet,
+// and uploads the device keys if they haven't been uploaded before.
+func (mach *OlmMachine) Load() (err error) {
+	mach.lock.Lock()
+	mach.account, mach.shared, err = mach.store.GetAccount()
+	if err == nil && mach.account == nil {
+		debug.Print("Creating new Olm account")
+		mach.account = olm.NewAccount()
+		err = mach.store.PutAccount(mach.account, false)
+	}
+	mach.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !mach.shared {
+		err = mach.shareKeys(0)
+	}
+	return
+}
+
+// Close closes the crypto store.
+func (mach *OlmMachine) Close() error {
+	return mach.store.Close()
+}
+
+// OwnIdentity returns the identity of the current device.
+func (mach *OlmMachine) OwnIdentity() *DeviceIdentity {
+	identityKey, signingKey := mach.account.IdentityKeys()
+	return &DeviceIdentity{
+		UserID:      mach.userID,
+		DeviceID:    mach.deviceID,
+		IdentityKey: identityKey,
+		SigningKey:  signingKey,
+	}
+}
+
+// HandleOTKCounts uploads more one-time keys if the server is running low.
+func (mach *OlmMachine) HandleOTKCounts(counts map[string]int) {
+	if counts == nil {
+		return
+	}
+	count := counts[keyAlgorithmSignedCurve25519]
+	mach.otkCount = count
+	if count < olm.MaxOneTimeKeys/2 {
+		debug.Printf("Server has %d one-time keys, uploading more", count)
+		if err := mach.shareKeys(count); err != nil {
+			debug.Print("Failed to upload one-time keys:", err)
+		}
+	}
+}
+
+// HandleDeviceLists marks the device lists of the given users as outdated,
+// so they'll be fetched again the next time a room key is shared with them.
+func (mach *OlmMachine) HandleDeviceLists(changed, left []string) {
+	if err := mach.store.MarkOutdated(append(changed, left...)); err != nil {
+		debug.Print("Failed to mark device lists as outdated:", err)
+	}
+}
+
+// HandleToDeviceEvent processes a to-device event from the sync response.
+func (mach *OlmMachine) HandleToDeviceEvent(evt *mautrix.Event) {
+	if evt.Type != mautrix.EventEncrypted {
+		mach.dispatchToDevice(evt)
+		return
+	}
+	decrypted, err := mach.decryptOlmEvent(evt)
+	if err != nil {
+		debug.Printf("Failed to decrypt to-device event from %s: %v", evt.Sender, err)
+		return
+	}
+	switch decrypted.Type {
+	case ToDeviceRoomKey.Type:
+		mach.handleRoomKey(decrypted)
+	default:
+		decryptedEvt := &mautrix.Event{
+			Sender: decrypted.Sender,
+			Type:   mautrix.NewEventType(decrypted.Type),
+		}
+		if err = json.Unmarshal(decrypted.Content, &decryptedEvt.Content); err != nil {
+			debug.Printf("Failed to parse content of decrypted %s event from %s: %v", decrypted.Type, evt.Sender, err)
+			return
+		}
+		mach.dispatchToDevice(decryptedEvt)
+	}
+}
+
+func (mach *OlmMachine) dispatchToDevice(evt *mautrix.Event) {
+	switch evt.Type {
+	case VerificationRequest, VerificationReady, VerificationStart, VerificationAccept, VerificationKey,
+		VerificationMAC, VerificationDone, VerificationCancel:
+		mach.handleToDeviceVerificationEvent(evt)
+	default:
+		if mach.ToDeviceHandler != nil {
+			mach.ToDeviceHandler(evt)
+		} else {
+			debug.Printf("Unhandled to-device event of type %s from %s", evt.Type.String(), evt.Sender)
+		}
+	}
+}
+
+type roomKeyContent struct {
+	Algorithm  string `json:"algorithm"`
+	RoomID     string `json:"room_id"`
+	SessionID  string `json:"session_id"`
+	SessionKey string `json:"session_key"`
+}
+
+func (mach *OlmMachine) handleRoomKey(evt *DecryptedOlmEvent) {
+	var content roomKeyContent
+	if err := json.Unmarshal(evt.Content, &content); err != nil {
+		debug.Printf("Failed to parse room key from %s: %v", evt.Sender, err)
+		return
+	} else if content.Algorithm != AlgorithmMegolmV1 {
+		debug.Printf("Ignoring room key with unsupported algorithm %s from %s", content.Algorithm, evt.Sender)
+		return
+	}
+	session, err := olm.NewInboundGroupSession(content.SessionKey)
+	if err != nil {
+		debug.Printf("Failed to create inbound group session from %s: %v", evt.Sender, err)
+		return
+	} else if session.ID() != content.SessionID {
+		debug.Printf("Room key from %s has mismatching session ID (%s != %s)", evt.Sender, session.ID(), content.SessionID)
+		return
+	}
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	existing, _ := mach.store.GetInboundGroupSession(content.RoomID, evt.SenderKey, content.SessionID)
+	if existing != nil && existing.Session.FirstKnownIndex() <= session.FirstKnownIndex() {
+		return
+	}
+	err = mach.store.PutInboundGroupSession(&InboundGroupSession{
+		Session:    session,
+		RoomID:     content.RoomID,
+		SenderKey:  evt.SenderKey,
+		SigningKey: evt.Keys.Ed25519,
+	})
+	if err != nil {
+		debug.Print("Failed to store inbound group session:", err)
+		return
+	}
+	debug.Printf("Received room key %s for %s from %s/%s", content.SessionID, content.RoomID, evt.Sender, evt.SenderDevice)
+}
+
+type olmEventKeys struct {
+	Ed25519 string `json:"ed25519"`
+}
+
+// DecryptedOlmEvent is the plaintext payload of an Olm-encrypted to-device event.
+type DecryptedOlmEvent struct {
+	SenderKey string `json:"-"`
+
+	Sender        string          `json:"sender"`
+	SenderDevice  string          `json:"sender_device,omitempty"`
+	Keys          olmEventKeys    `json:"keys"`
+	Recipient     string          `json:"recipient"`
+	RecipientKeys olmEventKeys    `json:"recipient_keys"`
+	Type          string          `json:"type"`
+	Content       json.RawMessage `json:"content"`
+}
+
+type olmCiphertext struct {
+	Type int    `json:"type"`
+	Body string `json:"body"`
+}
+
+// EncryptedContent is the content of a m.room.encrypted event.
+type EncryptedContent struct {
+	Algorithm  string          `json:"algorithm"`
+	SenderKey  string          `json:"sender_key"`
+	DeviceID   string          `json:"device_id,omitempty"`
+	SessionID  string          `json:"session_id,omitempty"`
+	Ciphertext json.RawMessage `json:"ciphertext"`
+
+	RelatesTo *mautrix.RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+func (mach *OlmMachine) decryptOlmEvent(evt *mautrix.Event) (*DecryptedOlmEvent, error) {
+	var content EncryptedContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		return nil, err
+	} else if content.Algorithm != AlgorithmOlmV1 {
+		return nil, fmt.Errorf("unsupported algorithm %s", content.Algorithm)
+	}
+	var ciphertexts map[string]olmCiphertext
+	if err := json.Unmarshal(content.Ciphertext, &ciphertexts); err != nil {
+		return nil, err
+	}
+	ownKey, ownSigningKey := mach.account.IdentityKeys()
+	ciphertext, ok := ciphertexts[ownKey]
+	if !ok {
+		return nil, errors.New("event is not encrypted for this device")
+	}
+	body, err := olm.DecodeBase64(ciphertext.Body)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := mach.decryptOlmCiphertext(content.SenderKey, ciphertext.Type, body)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := &DecryptedOlmEvent{SenderKey: content.SenderKey}
+	if err = json.Unmarshal(plaintext, decrypted); err != nil {
+		return nil, err
+	} else if decrypted.Sender != evt.Sender {
+		return nil, fmt.Errorf("mismatching sender in payload (%s != %s)", decrypted.Sender, evt.Sender)
+	} else if decrypted.Recipient != mach.userID {
+		return nil, fmt.Errorf("mismatching recipient in payload (%s)", decrypted.Recipient)
+	} else if decrypted.RecipientKeys.Ed25519 != ownSigningKey {
+		return nil, errors.New("mismatching recipient key in payload")
+	}
+	return decrypted, nil
+}
+
+func (mach *OlmMachine) decryptOlmCiphertext(senderKey string, msgType int, body []byte) ([]byte, error) {
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	sessions, err := mach.store.GetOlmSessions(senderKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if msgType == olm.MessageTypePreKey && !session.MatchesInboundSession(senderKey, body) {
+			continue
+		}
+		plaintext, err := session.Decrypt(msgType, body)
+		if err != nil {
+			if msgType == olm.MessageTypePreKey {
+				return nil, err
+			}
+			continue
+		}
+		return plaintext, mach.store.PutOlmSession(senderKey, session)
+	}
+	if msgType != olm.MessageTypePreKey {
+		return nil, errors.New("no matching Olm session found")
+	}
+	session, err := mach.account.NewInboundSession(senderKey, body)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := session.Decrypt(msgType, body)
+	if err != nil {
+		return nil, err
+	}
+	mach.account.RemoveOneTimeKeys(session)
+	if err = mach.store.PutAccount(mach.account, mach.shared); err != nil {
+		return nil, err
+	}
+	return plaintext, mach.store.PutOlmSession(senderKey, session)
+}
+
+// encryptOlmEvent encrypts the given to-device event for the given device. The caller must hold the machine lock.
+func (mach *OlmMachine) encryptOlmEvent(session *olm.Session, recipient *DeviceIdentity, evtType string, content interface{}) (*EncryptedContent, error) {
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	ownKey, ownSigningKey := mach.account.IdentityKeys()
+	plaintext, err := json.Marshal(&DecryptedOlmEvent{
+		Sender:        mach.userID,
+		SenderDevice:  mach.deviceID,
+		Keys:          olmEventKeys{Ed25519: ownSigningKey},
+		Recipient:     recipient.UserID,
+		RecipientKeys: olmEventKeys{Ed25519: recipient.SigningKey},
+		Type:          evtType,
+		Content:       rawContent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgType, body, err := session.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	} else if err = mach.store.PutOlmSession(recipient.IdentityKey, session); err != nil {
+		return nil, err
+	}
+	ciphertext, err := json.Marshal(map[string]olmCiphertext{
+		recipient.IdentityKey: {Type: msgType, Body: olm.EncodeBase64(body)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedContent{
+		Algorithm:  AlgorithmOlmV1,
+		SenderKey:  ownKey,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+type reqSendToDevice struct {
+	Messages map[string]map[string]interface{} `json:"messages"`
+}
+
+// SendToDevice sends a to-device event of the given type to the given user ID -> device ID -> content map.
+func (mach *OlmMachine) SendToDevice(evtType mautrix.EventType, messages map[string]map[string]interface{}) error {
+	urlPath := mach.client.BuildURL("sendToDevice", evtType.Type, mach.client.TxnID())
+	_, err := mach.client.MakeRequest("PUT", urlPath, &reqSendToDevice{Messages: messages}, nil)
+	return err
+}
@@ -0,0 +1,325 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/crypto/olm"
+	"maunium.net/go/gomuks/matrix/event"
+)
+
+const (
+	defaultRotationPeriod   = 7 * 24 * time.Hour
+	defaultRotationMessages = 100
+)
+
+var (
+	ErrNoGroupSession        = errors.New("no outbound group session for room")
+	ErrSessionNotFound       = errors.New("the room key for this message has not been received")
+	ErrDuplicateMessageIndex = errors.New("duplicate message index, possible replay attack")
+)
+
+// RoomEncryption is the content of a m.room.encryption state event.
+type RoomEncryption struct {
+	Algorithm              string `json:"algorithm"`
+	RotationPeriodMillis   int64  `json:"rotation_period_ms,omitempty"`
+	RotationPeriodMessages int    `json:"rotation_period_msgs,omitempty"`
+}
+
+type megolmPayload struct {
+	RoomID  string          `json:"room_id"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+func (mach *OlmMachine) getOutboundGroupSession(roomID string) (*OutboundGroupSession, error) {
+	session, ok := mach.outbound[roomID]
+	if !ok {
+		var err error
+		session, err = mach.store.GetOutboundGroupSession(roomID)
+		if err != nil {
+			return nil, err
+		}
+		mach.outbound[roomID] = session
+	}
+	return session, nil
+}
+
+func (mach *OlmMachine) newOutboundGroupSession(roomID string, settings RoomEncryption) (*OutboundGroupSession, error) {
+	session := &OutboundGroupSession{
+		Session:      olm.NewOutboundGroupSession(),
+		RoomID:       roomID,
+		CreationTime: time.Now(),
+		MaxAge:       defaultRotationPeriod,
+		MaxMessages:  defaultRotationMessages,
+		SharedWith:   make(map[string]map[string]string),
+	}
+	if settings.RotationPeriodMillis > 0 {
+		session.MaxAge = time.Duration(settings.RotationPeriodMillis) * time.Millisecond
+	}
+	if settings.RotationPeriodMessages > 0 {
+		session.MaxMessages = settings.RotationPeriodMessages
+	}
+	inbound, err := olm.NewInboundGroupSession(session.Session.SessionKey())
+	if err != nil {
+		return nil, err
+	}
+	ownKey, ownSigningKey := mach.account.IdentityKeys()
+	err = mach.store.PutInboundGroupSession(&InboundGroupSession{
+		Session:    inbound,
+		RoomID:     roomID,
+		SenderKey:  ownKey,
+		SigningKey: ownSigningKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	mach.outbound[roomID] = session
+	debug.Printf("Created new outbound group session %s for %s", session.Session.ID(), roomID)
+	return session, mach.store.PutOutboundGroupSession(session)
+}
+
+// prepareGroupSession returns the outbound group session for the room, creating a new one if the existing
+// one has expired or has been shared with users who are no longer in the room.
+func (mach *OlmMachine) prepareGroupSession(roomID string, users map[string]bool, settings RoomEncryption) (*OutboundGroupSession, error) {
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	session, err := mach.getOutboundGroupSession(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if session != nil && session.Expired() {
+		debug.Printf("Outbound group session %s for %s has expired", session.Session.ID(), roomID)
+		session = nil
+	} else if session != nil {
+		for userID := range session.SharedWith {
+			if !users[userID] {
+				debug.Printf("%s has left %s, rotating outbound group session", userID, roomID)
+				session = nil
+				break
+			}
+		}
+	}
+	if session == nil {
+		return mach.newOutboundGroupSession(roomID, settings)
+	}
+	return session, nil
+}
+
+// ShareGroupSession makes sure the room has a valid outbound group session and that it has been shared
+// with all devices of the given users.
+func (mach *OlmMachine) ShareGroupSession(roomID string, users []string, settings RoomEncryption) error {
+	if settings.Algorithm != AlgorithmMegolmV1 {
+		return fmt.Errorf("unsupported encryption algorithm %s", settings.Algorithm)
+	}
+	mach.shareLock.Lock()
+	defer mach.shareLock.Unlock()
+
+	if err := mach.queryKeys(mach.store.FilterUntrackedUsers(users)); err != nil {
+		return fmt.Errorf("failed to query device keys: %v", err)
+	}
+	userMap := make(map[string]bool, len(users))
+	for _, userID := range users {
+		userMap[userID] = true
+	}
+	session, err := mach.prepareGroupSession(roomID, userMap, settings)
+	if err != nil {
+		return err
+	}
+
+	var toShare, missingSessions []*DeviceIdentity
+	for _, userID := range users {
+		devices, err := mach.store.GetDevices(userID)
+		if err != nil {
+			return err
+		}
+		for deviceID, device := range devices {
+			if userID == mach.userID && deviceID == mach.deviceID {
+				continue
+			} else if session.SharedWith[userID][deviceID] == device.IdentityKey {
+				continue
+			}
+			toShare = append(toShare, device)
+			if sessions, err := mach.store.GetOlmSessions(device.IdentityKey); err != nil {
+				return err
+			} else if len(sessions) == 0 {
+				missingSessions = append(missingSessions, device)
+			}
+		}
+	}
+	if len(toShare) == 0 {
+		return nil
+	}
+	if err = mach.createOutboundSessions(missingSessions); err != nil {
+		return fmt.Errorf("failed to claim one-time keys: %v", err)
+	}
+
+	mach.lock.Lock()
+	content := &roomKeyContent{
+		Algorithm:  AlgorithmMegolmV1,
+		RoomID:     roomID,
+		SessionID:  session.Session.ID(),
+		SessionKey: session.Session.SessionKey(),
+	}
+	messages := make(map[string]map[string]interface{})
+	var shared []*DeviceIdentity
+	for _, device := range toShare {
+		sessions, err := mach.store.GetOlmSessions(device.IdentityKey)
+		if err != nil || len(sessions) == 0 {
+			debug.Printf("No Olm session with %s/%s, not sharing room key", device.UserID, device.DeviceID)
+			continue
+		}
+		encrypted, err := mach.encryptOlmEvent(sessions[0], device, ToDeviceRoomKey.Type, content)
+		if err != nil {
+			debug.Printf("Failed to encrypt room key for %s/%s: %v", device.UserID, device.DeviceID, err)
+			continue
+		}
+		if _, ok := messages[device.UserID]; !ok {
+			messages[device.UserID] = make(map[string]interface{})
+		}
+		messages[device.UserID][device.DeviceID] = encrypted
+		shared = append(shared, device)
+	}
+	mach.lock.Unlock()
+	if len(messages) == 0 {
+		return nil
+	}
+
+	debug.Printf("Sharing group session %s for %s with %d devices", session.Session.ID(), roomID, len(shared))
+	if err = mach.SendToDevice(mautrix.EventEncrypted, messages); err != nil {
+		return fmt.Errorf("failed to send room key: %v", err)
+	}
+
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	for _, device := range shared {
+		if _, ok := session.SharedWith[device.UserID]; !ok {
+			session.SharedWith[device.UserID] = make(map[string]string)
+		}
+		session.SharedWith[device.UserID][device.DeviceID] = device.IdentityKey
+	}
+	return mach.store.PutOutboundGroupSession(session)
+}
+
+// EncryptMegolmEvent encrypts the given event with the outbound group session of the room.
+// ShareGroupSession must be called first to make sure the session exists and has been shared.
+func (mach *OlmMachine) EncryptMegolmEvent(roomID string, evtType mautrix.EventType, content interface{}) (*EncryptedContent, error) {
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(&megolmPayload{
+		RoomID:  roomID,
+		Type:    evtType.Type,
+		Content: rawContent,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mach.lock.Lock()
+	defer mach.lock.Unlock()
+	session, err := mach.getOutboundGroupSession(roomID)
+	if err != nil {
+		return nil, err
+	} else if session == nil {
+		return nil, ErrNoGroupSession
+	}
+	ciphertext, err := json.Marshal(session.Session.Encrypt(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	session.MessageCount++
+	if err = mach.store.PutOutboundGroupSession(session); err != nil {
+		return nil, err
+	}
+	ownKey, _ := mach.account.IdentityKeys()
+	return &EncryptedContent{
+		Algorithm:  AlgorithmMegolmV1,
+		SenderKey:  ownKey,
+		DeviceID:   mach.deviceID,
+		SessionID:  session.Session.ID(),
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// DecryptMegolmEvent decrypts the given m.room.encrypted event and returns the decrypted event
+// along with info about the encryption.
+func (mach *OlmMachine) DecryptMegolmEvent(evt *mautrix.Event) (*mautrix.Event, *event.EncryptionInfo, error) {
+	var content EncryptedContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		return nil, nil, err
+	} else if content.Algorithm != AlgorithmMegolmV1 {
+		return nil, nil, fmt.Errorf("unsupported algorithm %s", content.Algorithm)
+	}
+	var ciphertext string
+	if err := json.Unmarshal(content.Ciphertext, &ciphertext); err != nil {
+		return nil, nil, err
+	}
+
+	mach.lock.Lock()
+	session, err := mach.store.GetInboundGroupSession(evt.RoomID, content.SenderKey, content.SessionID)
+	if err == ErrNotFound {
+		mach.lock.Unlock()
+		return nil, nil, ErrSessionNotFound
+	} else if err != nil {
+		mach.lock.Unlock()
+		return nil, nil, err
+	}
+	plaintext, index, err := session.Session.Decrypt(ciphertext)
+	if err == nil {
+		var ok bool
+		if ok, err = mach.store.ValidateMessageIndex(content.SenderKey, content.SessionID, evt.ID, index); err == nil && !ok {
+			err = ErrDuplicateMessageIndex
+		} else if err == nil {
+			err = mach.store.PutInboundGroupSession(session)
+		}
+	}
+	mach.lock.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var payload megolmPayload
+	if err = json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, nil, err
+	} else if payload.RoomID != evt.RoomID {
+		return nil, nil, fmt.Errorf("mismatching room ID in payload (%s != %s)", payload.RoomID, evt.RoomID)
+	}
+	decrypted := *evt
+	decrypted.Type = mautrix.NewEventType(payload.Type)
+	decrypted.Content = mautrix.Content{}
+	if err = json.Unmarshal(payload.Content, &decrypted.Content); err != nil {
+		return nil, nil, err
+	}
+	if decrypted.Content.RelatesTo == nil && content.RelatesTo != nil {
+		decrypted.Content.RelatesTo = content.RelatesTo
+	}
+	return &decrypted, &event.EncryptionInfo{
+		Algorithm:    content.Algorithm,
+		SenderKey:    content.SenderKey,
+		SenderDevice: content.DeviceID,
+		SessionID:    content.SessionID,
+	}, nil
+}
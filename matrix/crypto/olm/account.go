@@ -0,0 +1,214 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// MaxOneTimeKeys is the maximum number of one-time keys an account keeps.
+const MaxOneTimeKeys = 100
+
+var ErrUnknownOneTimeKey = errors.New("unknown one-time key")
+
+// OneTimeKey is a Curve25519 key that is used once to create an inbound Olm session.
+type OneTimeKey struct {
+	ID        uint32            `json:"id"`
+	Key       Curve25519KeyPair `json:"key"`
+	Published bool              `json:"published"`
+}
+
+// KeyID returns the base64-encoded ID of the key, as used in the key upload API.
+func (otk OneTimeKey) KeyID() string {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], otk.ID)
+	return EncodeBase64(id[:])
+}
+
+// Account contains the long-term identity keys and one-time keys of a device.
+type Account struct {
+	IdentityKey Curve25519KeyPair `json:"identity_key"`
+	SigningKey  Ed25519KeyPair    `json:"signing_key"`
+
+	OneTimeKeys      []OneTimeKey `json:"one_time_keys"`
+	NextOneTimeKeyID uint32       `json:"next_one_time_key_id"`
+}
+
+// NewAccount creates a new account with random identity keys.
+func NewAccount() *Account {
+	return &Account{
+		IdentityKey: NewCurve25519KeyPair(),
+		SigningKey:  NewEd25519KeyPair(),
+	}
+}
+
+// IdentityKeys returns the base64-encoded Curve25519 and Ed25519 public keys of the account.
+func (account *Account) IdentityKeys() (curve25519, ed25519 string) {
+	return EncodeBase64(account.IdentityKey.Public), EncodeBase64(account.SigningKey.Public)
+}
+
+// Sign signs the given message with the Ed25519 key of the account and returns the base64-encoded signature.
+func (account *Account) Sign(message []byte) string {
+	return EncodeBase64(account.SigningKey.Sign(message))
+}
+
+// GenerateOneTimeKeys generates the given number of new one-time keys.
+// The oldest keys are discarded if the account has more than MaxOneTimeKeys keys.
+func (account *Account) GenerateOneTimeKeys(count int) {
+	for i := 0; i < count; i++ {
+		account.NextOneTimeKeyID++
+		account.OneTimeKeys = append(account.OneTimeKeys, OneTimeKey{
+			ID:  account.NextOneTimeKeyID,
+			Key: NewCurve25519KeyPair(),
+		})
+	}
+	if len(account.OneTimeKeys) > MaxOneTimeKeys {
+		account.OneTimeKeys = account.OneTimeKeys[len(account.OneTimeKeys)-MaxOneTimeKeys:]
+	}
+}
+
+// UnpublishedOneTimeKeys returns the one-time keys that haven't been marked as published.
+// The map keys are the key IDs and the values are the base64-encoded public keys.
+func (account *Account) UnpublishedOneTimeKeys() map[string]string {
+	keys := make(map[string]string)
+	for _, otk := range account.OneTimeKeys {
+		if !otk.Published {
+			keys[otk.KeyID()] = EncodeBase64(otk.Key.Public)
+		}
+	}
+	return keys
+}
+
+// MarkKeysAsPublished marks all current one-time keys as published.
+func (account *Account) MarkKeysAsPublished() {
+	for i := range account.OneTimeKeys {
+		account.OneTimeKeys[i].Published = true
+	}
+}
+
+func (account *Account) findOneTimeKey(public []byte) *OneTimeKey {
+	for i, otk := range account.OneTimeKeys {
+		if bytes.Equal(otk.Key.Public, public) {
+			return &account.OneTimeKeys[i]
+		}
+	}
+	return nil
+}
+
+// RemoveOneTimeKeys removes the one-time key that was used to create the given inbound session.
+func (account *Account) RemoveOneTimeKeys(session *Session) {
+	for i, otk := range account.OneTimeKeys {
+		if bytes.Equal(otk.Key.Public, session.BobOneTimeKey) {
+			account.OneTimeKeys = append(account.OneTimeKeys[:i], account.OneTimeKeys[i+1:]...)
+			return
+		}
+	}
+}
+
+// NewOutboundSession creates a new Olm session to send messages to the device with the given
+// identity key, using one of the device's one-time keys.
+func (account *Account) NewOutboundSession(theirIdentityKey, theirOneTimeKey string) (*Session, error) {
+	identityKey, err := DecodeBase64(theirIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	oneTimeKey, err := DecodeBase64(theirOneTimeKey)
+	if err != nil {
+		return nil, err
+	}
+	baseKey := NewCurve25519KeyPair()
+	secret, err := tripleDH(
+		func() ([]byte, error) { return account.IdentityKey.SharedSecret(oneTimeKey) },
+		func() ([]byte, error) { return baseKey.SharedSecret(identityKey) },
+		func() ([]byte, error) { return baseKey.SharedSecret(oneTimeKey) },
+	)
+	if err != nil {
+		return nil, err
+	}
+	derived := deriveKeys(secret, nil, kdfInfoRoot, 64)
+	return &Session{
+		RootKey: derived[:32],
+		SenderChain: &SenderChain{
+			RatchetKey: NewCurve25519KeyPair(),
+			ChainKey:   derived[32:],
+		},
+		AliceIdentityKey: account.IdentityKey.Public,
+		AliceBaseKey:     baseKey.Public,
+		BobOneTimeKey:    oneTimeKey,
+	}, nil
+}
+
+// NewInboundSession creates a new Olm session from a pre-key message that was sent to this account.
+// If theirIdentityKey is not empty, it is checked against the identity key in the message.
+//
+// The session doesn't decrypt the message: Decrypt must be called separately. After the message has been
+// decrypted successfully, the one-time key should be removed with RemoveOneTimeKeys.
+func (account *Account) NewInboundSession(theirIdentityKey string, preKeyMessageBody []byte) (*Session, error) {
+	msg, err := decodePreKeyMessage(preKeyMessageBody)
+	if err != nil {
+		return nil, err
+	}
+	if len(theirIdentityKey) > 0 {
+		identityKey, err := DecodeBase64(theirIdentityKey)
+		if err != nil {
+			return nil, err
+		} else if !bytes.Equal(identityKey, msg.IdentityKey) {
+			return nil, ErrInvalidKey
+		}
+	}
+	otk := account.findOneTimeKey(msg.OneTimeKey)
+	if otk == nil {
+		return nil, ErrUnknownOneTimeKey
+	}
+	inner, _, err := decodeMessage(msg.Message)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := tripleDH(
+		func() ([]byte, error) { return otk.Key.SharedSecret(msg.IdentityKey) },
+		func() ([]byte, error) { return account.IdentityKey.SharedSecret(msg.BaseKey) },
+		func() ([]byte, error) { return otk.Key.SharedSecret(msg.BaseKey) },
+	)
+	if err != nil {
+		return nil, err
+	}
+	derived := deriveKeys(secret, nil, kdfInfoRoot, 64)
+	return &Session{
+		RootKey: derived[:32],
+		ReceiverChains: []ReceiverChain{{
+			RatchetKey: inner.RatchetKey,
+			ChainKey:   derived[32:],
+		}},
+		AliceIdentityKey: msg.IdentityKey,
+		AliceBaseKey:     msg.BaseKey,
+		BobOneTimeKey:    msg.OneTimeKey,
+	}, nil
+}
+
+func tripleDH(parts ...func() ([]byte, error)) ([]byte, error) {
+	var secret []byte
+	for _, part := range parts {
+		data, err := part()
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, data...)
+	}
+	return secret, nil
+}
@@ -0,0 +1,111 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	kdfInfoRoot       = "OLM_ROOT"
+	kdfInfoRatchet    = "OLM_RATCHET"
+	kdfInfoOlmKeys    = "OLM_KEYS"
+	kdfInfoMegolmKeys = "MEGOLM_KEYS"
+
+	macLength = 8
+)
+
+var (
+	ErrBadMAC     = errors.New("bad message MAC")
+	ErrBadPadding = errors.New("bad message padding")
+)
+
+func deriveKeys(secret, salt []byte, info string, length int) []byte {
+	derived := make([]byte, length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), derived)
+	if err != nil {
+		panic(err)
+	}
+	return derived
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// cipherKeys contains the AES-256-CBC and HMAC-SHA-256 keys derived from a message key.
+type cipherKeys struct {
+	aesKey []byte
+	macKey []byte
+	iv     []byte
+}
+
+func deriveCipherKeys(info string, key []byte) cipherKeys {
+	derived := deriveKeys(key, nil, info, 80)
+	return cipherKeys{
+		aesKey: derived[:32],
+		macKey: derived[32:64],
+		iv:     derived[64:],
+	}
+}
+
+func (keys cipherKeys) encrypt(plaintext []byte) []byte {
+	block, err := aes.NewCipher(keys.aesKey)
+	if err != nil {
+		panic(err)
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, keys.iv).CryptBlocks(ciphertext, padded)
+	return ciphertext
+}
+
+func (keys cipherKeys) decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrBadPadding
+	}
+	block, err := aes.NewCipher(keys.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, keys.iv).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) {
+		return nil, ErrBadPadding
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+func (keys cipherKeys) mac(data []byte) []byte {
+	return hmacSHA256(keys.macKey, data)[:macLength]
+}
+
+func (keys cipherKeys) verifyMAC(data, mac []byte) bool {
+	return hmac.Equal(keys.mac(data), mac)
+}
@@ -0,0 +1,3 @@
+// Package olm contains a pure Go implementation of the Olm and Megolm cryptographic ratchets
+// that is wire-compatible with libolm.
+package olm
@@ -0,0 +1,107 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Encoding is the unpadded base64 encoding used for all keys and messages in Olm.
+var Encoding = base64.RawStdEncoding
+
+// EncodeBase64 encodes the given data with unpadded base64.
+func EncodeBase64(data []byte) string {
+	return Encoding.EncodeToString(data)
+}
+
+// DecodeBase64 decodes unpadded (or padded) base64.
+func DecodeBase64(data string) ([]byte, error) {
+	return Encoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+var ErrInvalidKey = errors.New("invalid key")
+
+// Curve25519KeyPair is a Curve25519 key pair used for Diffie-Hellman key exchange.
+type Curve25519KeyPair struct {
+	Private []byte `json:"private,omitempty"`
+	Public  []byte `json:"public"`
+}
+
+// NewCurve25519KeyPair generates a new random Curve25519 key pair.
+func NewCurve25519KeyPair() Curve25519KeyPair {
+	private := randomBytes(curve25519.ScalarSize)
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	return Curve25519KeyPair{Private: private, Public: public}
+}
+
+// SharedSecret computes the Diffie-Hellman shared secret between this key pair and the given public key.
+func (kp Curve25519KeyPair) SharedSecret(theirPublic []byte) ([]byte, error) {
+	if len(kp.Private) != curve25519.ScalarSize || len(theirPublic) != curve25519.PointSize {
+		return nil, ErrInvalidKey
+	}
+	return curve25519.X25519(kp.Private, theirPublic)
+}
+
+// Ed25519KeyPair is an Ed25519 key pair used for signing.
+type Ed25519KeyPair struct {
+	Private ed25519.PrivateKey `json:"private,omitempty"`
+	Public  ed25519.PublicKey  `json:"public"`
+}
+
+// NewEd25519KeyPair generates a new random Ed25519 key pair.
+func NewEd25519KeyPair() Ed25519KeyPair {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return Ed25519KeyPair{Private: private, Public: public}
+}
+
+// Sign signs the given message with the private key.
+func (kp Ed25519KeyPair) Sign(message []byte) []byte {
+	return ed25519.Sign(kp.Private, message)
+}
+
+// VerifySignature checks the base64-encoded signature of the given message against the base64-encoded Ed25519 key.
+func VerifySignature(key, signature string, message []byte) bool {
+	keyBytes, err := DecodeBase64(key)
+	if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+		return false
+	}
+	sigBytes, err := DecodeBase64(signature)
+	if err != nil || len(sigBytes) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(keyBytes, message, sigBytes)
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return data
+}
@@ -0,0 +1,271 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	megolmRatchetParts      = 4
+	megolmRatchetPartLength = 32
+	megolmRatchetLength     = megolmRatchetParts * megolmRatchetPartLength
+
+	sessionKeyVersion      = 2
+	sessionExportVersion   = 1
+	sessionKeyLength       = 1 + 4 + megolmRatchetLength + ed25519.PublicKeySize + ed25519.SignatureSize
+	sessionExportKeyLength = 1 + 4 + megolmRatchetLength + ed25519.PublicKeySize
+)
+
+var (
+	ErrBadSignature        = errors.New("bad signature")
+	ErrBadSessionKey       = errors.New("malformed session key")
+	ErrUnknownMessageIndex = errors.New("message index is earlier than the first known index")
+)
+
+// MegolmRatchet is the hash ratchet used in Megolm sessions.
+type MegolmRatchet struct {
+	Data    []byte `json:"data"`
+	Counter uint32 `json:"counter"`
+}
+
+func (ratchet *MegolmRatchet) copy() MegolmRatchet {
+	return MegolmRatchet{
+		Data:    append([]byte{}, ratchet.Data...),
+		Counter: ratchet.Counter,
+	}
+}
+
+func (ratchet *MegolmRatchet) part(i int) []byte {
+	return ratchet.Data[i*megolmRatchetPartLength : (i+1)*megolmRatchetPartLength]
+}
+
+func (ratchet *MegolmRatchet) rehashPart(from, to int) {
+	copy(ratchet.part(to), hmacSHA256(ratchet.part(from), []byte{byte(to)}))
+}
+
+func (ratchet *MegolmRatchet) advance() {
+	mask := uint32(0x00FFFFFF)
+	h := 0
+	ratchet.Counter++
+	// Figure out how much of the ratchet needs to be rehashed.
+	for h < megolmRatchetParts {
+		if ratchet.Counter&mask == 0 {
+			break
+		}
+		h++
+		mask >>= 8
+	}
+	// Update R(h)...R(3) based on R(h). R(h) itself must be updated last.
+	for i := megolmRatchetParts - 1; i >= h; i-- {
+		ratchet.rehashPart(h, i)
+	}
+}
+
+func (ratchet *MegolmRatchet) advanceTo(index uint32) {
+	for j := 0; j < megolmRatchetParts; j++ {
+		shift := uint((megolmRatchetParts - j - 1) * 8)
+		mask := ^uint32(0) << shift
+		// How many times this part needs to be rehashed. '& 0xff' handles integer wraparound.
+		steps := ((index >> shift) - (ratchet.Counter >> shift)) & 0xff
+		if steps == 0 {
+			continue
+		}
+		// For all but the last step, only R(j) needs to be bumped.
+		for ; steps > 1; steps-- {
+			ratchet.rehashPart(j, j)
+		}
+		// On the last step, R(j+1)...R(3) need to be bumped too.
+		for k := megolmRatchetParts - 1; k >= j; k-- {
+			ratchet.rehashPart(j, k)
+		}
+		ratchet.Counter = index & mask
+	}
+}
+
+// OutboundGroupSession is a Megolm session used to encrypt messages to a room.
+type OutboundGroupSession struct {
+	Ratchet    MegolmRatchet  `json:"ratchet"`
+	SigningKey Ed25519KeyPair `json:"signing_key"`
+}
+
+// NewOutboundGroupSession creates a new Megolm session with a random ratchet and signing key.
+func NewOutboundGroupSession() *OutboundGroupSession {
+	return &OutboundGroupSession{
+		Ratchet:    MegolmRatchet{Data: randomBytes(megolmRatchetLength)},
+		SigningKey: NewEd25519KeyPair(),
+	}
+}
+
+// ID returns the ID of the session, which is the base64-encoded public signing key.
+func (session *OutboundGroupSession) ID() string {
+	return EncodeBase64(session.SigningKey.Public)
+}
+
+// MessageIndex returns the index that will be used for the next message.
+func (session *OutboundGroupSession) MessageIndex() uint32 {
+	return session.Ratchet.Counter
+}
+
+// SessionKey returns the base64-encoded key that can be shared with other devices to let them decrypt messages
+// starting from the current message index.
+func (session *OutboundGroupSession) SessionKey() string {
+	data := make([]byte, 0, sessionKeyLength)
+	data = append(data, sessionKeyVersion)
+	data = appendUint32(data, session.Ratchet.Counter)
+	data = append(data, session.Ratchet.Data...)
+	data = append(data, session.SigningKey.Public...)
+	data = append(data, session.SigningKey.Sign(data)...)
+	return EncodeBase64(data)
+}
+
+// Encrypt encrypts the given plaintext and returns the base64-encoded message.
+func (session *OutboundGroupSession) Encrypt(plaintext []byte) string {
+	keys := deriveCipherKeys(kdfInfoMegolmKeys, session.Ratchet.Data)
+	msg := &groupMessage{
+		Index:      session.Ratchet.Counter,
+		Ciphertext: keys.encrypt(plaintext),
+	}
+	data := msg.encode()
+	data = append(data, keys.mac(data)...)
+	data = append(data, session.SigningKey.Sign(data)...)
+	session.Ratchet.advance()
+	return EncodeBase64(data)
+}
+
+// InboundGroupSession is a Megolm session used to decrypt messages from another device.
+type InboundGroupSession struct {
+	InitialRatchet     MegolmRatchet     `json:"initial_ratchet"`
+	LatestRatchet      MegolmRatchet     `json:"latest_ratchet"`
+	SigningKey         ed25519.PublicKey `json:"signing_key"`
+	SigningKeyVerified bool              `json:"signing_key_verified"`
+}
+
+// NewInboundGroupSession creates an inbound session from a session key received in a m.room_key event.
+func NewInboundGroupSession(sessionKey string) (*InboundGroupSession, error) {
+	data, err := DecodeBase64(sessionKey)
+	if err != nil {
+		return nil, err
+	} else if len(data) != sessionKeyLength || data[0] != sessionKeyVersion {
+		return nil, ErrBadSessionKey
+	}
+	signedData := data[:len(data)-ed25519.SignatureSize]
+	signingKey := ed25519.PublicKey(data[1+4+megolmRatchetLength : len(signedData)])
+	if !ed25519.Verify(signingKey, signedData, data[len(signedData):]) {
+		return nil, ErrBadSignature
+	}
+	return newInboundGroupSession(data, true), nil
+}
+
+// ImportInboundGroupSession creates an inbound session from a session key that was exported with Export.
+func ImportInboundGroupSession(exportedKey string) (*InboundGroupSession, error) {
+	data, err := DecodeBase64(exportedKey)
+	if err != nil {
+		return nil, err
+	} else if len(data) != sessionExportKeyLength || data[0] != sessionExportVersion {
+		return nil, ErrBadSessionKey
+	}
+	return newInboundGroupSession(data, false), nil
+}
+
+func newInboundGroupSession(data []byte, verified bool) *InboundGroupSession {
+	ratchet := MegolmRatchet{
+		Counter: binary.BigEndian.Uint32(data[1:5]),
+		Data:    append([]byte{}, data[5:5+megolmRatchetLength]...),
+	}
+	return &InboundGroupSession{
+		InitialRatchet:     ratchet,
+		LatestRatchet:      ratchet.copy(),
+		SigningKey:         append(ed25519.PublicKey{}, data[5+megolmRatchetLength:5+megolmRatchetLength+ed25519.PublicKeySize]...),
+		SigningKeyVerified: verified,
+	}
+}
+
+// ID returns the ID of the session, which is the base64-encoded public signing key.
+func (session *InboundGroupSession) ID() string {
+	return EncodeBase64(session.SigningKey)
+}
+
+// FirstKnownIndex returns the first message index this session can decrypt.
+func (session *InboundGroupSession) FirstKnownIndex() uint32 {
+	return session.InitialRatchet.Counter
+}
+
+// Export exports the session starting at the given message index.
+func (session *InboundGroupSession) Export(index uint32) (string, error) {
+	if index < session.InitialRatchet.Counter {
+		return "", ErrUnknownMessageIndex
+	}
+	ratchet := session.InitialRatchet.copy()
+	ratchet.advanceTo(index)
+	data := make([]byte, 0, sessionExportKeyLength)
+	data = append(data, sessionExportVersion)
+	data = appendUint32(data, ratchet.Counter)
+	data = append(data, ratchet.Data...)
+	data = append(data, session.SigningKey...)
+	return EncodeBase64(data), nil
+}
+
+// Decrypt decrypts the given base64-encoded Megolm message and returns the plaintext and the message index.
+func (session *InboundGroupSession) Decrypt(body string) ([]byte, uint32, error) {
+	data, err := DecodeBase64(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	msg, mac, signature, err := decodeGroupMessage(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	signedData := data[:len(data)-ed25519.SignatureSize]
+	if !ed25519.Verify(session.SigningKey, signedData, signature) {
+		return nil, 0, ErrBadSignature
+	}
+
+	var ratchet MegolmRatchet
+	advanceLatest := false
+	if session.LatestRatchet.Counter <= msg.Index {
+		ratchet = session.LatestRatchet.copy()
+		advanceLatest = true
+	} else if session.InitialRatchet.Counter > msg.Index {
+		return nil, 0, ErrUnknownMessageIndex
+	} else {
+		ratchet = session.InitialRatchet.copy()
+	}
+	ratchet.advanceTo(msg.Index)
+
+	keys := deriveCipherKeys(kdfInfoMegolmKeys, ratchet.Data)
+	if !keys.verifyMAC(signedData[:len(signedData)-macLength], mac) {
+		return nil, 0, ErrBadMAC
+	}
+	plaintext, err := keys.decrypt(msg.Ciphertext)
+	if err != nil {
+		return nil, 0, err
+	}
+	if advanceLatest {
+		session.LatestRatchet = ratchet
+	}
+	session.SigningKeyVerified = true
+	return plaintext, msg.Index, nil
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	return append(data, buf[:]...)
+}
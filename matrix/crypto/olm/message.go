@@ -0,0 +1,202 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+const protocolVersion = 3
+
+var (
+	ErrBadVersion = errors.New("unsupported message version")
+	ErrBadMessage = errors.New("malformed message")
+)
+
+// message is a normal Olm message.
+type message struct {
+	RatchetKey []byte
+	Counter    uint32
+	Ciphertext []byte
+}
+
+// preKeyMessage is an Olm message that also contains the information needed to create the session on the recipient's side.
+type preKeyMessage struct {
+	OneTimeKey  []byte
+	BaseKey     []byte
+	IdentityKey []byte
+	Message     []byte
+}
+
+// groupMessage is a Megolm message.
+type groupMessage struct {
+	Index      uint32
+	Ciphertext []byte
+}
+
+func appendVarint(data []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	return append(data, buf[:n]...)
+}
+
+func appendBytesField(data []byte, tag byte, value []byte) []byte {
+	data = append(data, tag)
+	data = appendVarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func appendIntField(data []byte, tag byte, value uint32) []byte {
+	data = append(data, tag)
+	return appendVarint(data, uint64(value))
+}
+
+// decodeFields parses the protobuf-like field list used in Olm messages.
+// The callbacks receive the field tag and either the integer or byte value.
+func decodeFields(data []byte, onInt func(tag byte, value uint32), onBytes func(tag byte, value []byte)) error {
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrBadMessage
+		}
+		data = data[n:]
+		switch tag & 0x7 {
+		case 0:
+			onInt(tag, uint32(value))
+		case 2:
+			if uint64(len(data)) < value {
+				return ErrBadMessage
+			}
+			onBytes(tag, data[:value])
+			data = data[value:]
+		default:
+			return ErrBadMessage
+		}
+	}
+	return nil
+}
+
+func (msg *message) encode() []byte {
+	data := []byte{protocolVersion}
+	data = appendBytesField(data, 0x0A, msg.RatchetKey)
+	data = appendIntField(data, 0x10, msg.Counter)
+	data = appendBytesField(data, 0x22, msg.Ciphertext)
+	return data
+}
+
+// decodeMessage decodes a normal Olm message and returns it along with its MAC.
+func decodeMessage(data []byte) (*message, []byte, error) {
+	if len(data) < 1+macLength {
+		return nil, nil, ErrBadMessage
+	} else if data[0] != protocolVersion {
+		return nil, nil, ErrBadVersion
+	}
+	msg := &message{}
+	err := decodeFields(data[1:len(data)-macLength], func(tag byte, value uint32) {
+		if tag == 0x10 {
+			msg.Counter = value
+		}
+	}, func(tag byte, value []byte) {
+		switch tag {
+		case 0x0A:
+			msg.RatchetKey = value
+		case 0x22:
+			msg.Ciphertext = value
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	} else if len(msg.RatchetKey) != 32 || len(msg.Ciphertext) == 0 {
+		return nil, nil, ErrBadMessage
+	}
+	return msg, data[len(data)-macLength:], nil
+}
+
+func (msg *preKeyMessage) encode() []byte {
+	data := []byte{protocolVersion}
+	data = appendBytesField(data, 0x0A, msg.OneTimeKey)
+	data = appendBytesField(data, 0x12, msg.BaseKey)
+	data = appendBytesField(data, 0x1A, msg.IdentityKey)
+	data = appendBytesField(data, 0x22, msg.Message)
+	return data
+}
+
+func decodePreKeyMessage(data []byte) (*preKeyMessage, error) {
+	if len(data) < 1 {
+		return nil, ErrBadMessage
+	} else if data[0] != protocolVersion {
+		return nil, ErrBadVersion
+	}
+	msg := &preKeyMessage{}
+	err := decodeFields(data[1:], func(tag byte, value uint32) {}, func(tag byte, value []byte) {
+		switch tag {
+		case 0x0A:
+			msg.OneTimeKey = value
+		case 0x12:
+			msg.BaseKey = value
+		case 0x1A:
+			msg.IdentityKey = value
+		case 0x22:
+			msg.Message = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	} else if len(msg.OneTimeKey) != 32 || len(msg.BaseKey) != 32 || len(msg.IdentityKey) != 32 || len(msg.Message) == 0 {
+		return nil, ErrBadMessage
+	}
+	return msg, nil
+}
+
+func (msg *groupMessage) encode() []byte {
+	data := []byte{protocolVersion}
+	data = appendIntField(data, 0x08, msg.Index)
+	data = appendBytesField(data, 0x12, msg.Ciphertext)
+	return data
+}
+
+// decodeGroupMessage decodes a Megolm message and returns it along with its MAC and signature.
+func decodeGroupMessage(data []byte) (*groupMessage, []byte, []byte, error) {
+	if len(data) < 1+macLength+ed25519.SignatureSize {
+		return nil, nil, nil, ErrBadMessage
+	} else if data[0] != protocolVersion {
+		return nil, nil, nil, ErrBadVersion
+	}
+	macStart := len(data) - ed25519.SignatureSize - macLength
+	msg := &groupMessage{}
+	hasIndex := false
+	err := decodeFields(data[1:macStart], func(tag byte, value uint32) {
+		if tag == 0x08 {
+			msg.Index = value
+			hasIndex = true
+		}
+	}, func(tag byte, value []byte) {
+		if tag == 0x12 {
+			msg.Ciphertext = value
+		}
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	} else if !hasIndex || len(msg.Ciphertext) == 0 {
+		return nil, nil, nil, ErrBadMessage
+	}
+	return msg, data[macStart : macStart+macLength], data[macStart+macLength:], nil
+}
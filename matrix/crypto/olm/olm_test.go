@@ -0,0 +1,211 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSessionPair(t *testing.T) (alice *Session, bob *Session, bobAccount *Account) {
+	aliceAccount := NewAccount()
+	bobAccount = NewAccount()
+	bobAccount.GenerateOneTimeKeys(1)
+	var otk string
+	for _, key := range bobAccount.UnpublishedOneTimeKeys() {
+		otk = key
+	}
+	bobIdentity, _ := bobAccount.IdentityKeys()
+	aliceIdentity, _ := aliceAccount.IdentityKeys()
+
+	alice, err := aliceAccount.NewOutboundSession(bobIdentity, otk)
+	require.NoError(t, err)
+	msgType, body, err := alice.Encrypt([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, MessageTypePreKey, msgType)
+
+	bob, err = bobAccount.NewInboundSession(aliceIdentity, body)
+	require.NoError(t, err)
+	assert.True(t, bob.MatchesInboundSession(aliceIdentity, body))
+	plaintext, err := bob.Decrypt(msgType, body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+	assert.Equal(t, alice.ID(), bob.ID())
+	bobAccount.RemoveOneTimeKeys(bob)
+	return
+}
+
+func TestSession_RoundTrip(t *testing.T) {
+	alice, bob, bobAccount := newSessionPair(t)
+	assert.Empty(t, bobAccount.OneTimeKeys)
+
+	msgType, body, err := bob.Encrypt([]byte("hi alice"))
+	require.NoError(t, err)
+	assert.Equal(t, MessageTypeMessage, msgType)
+	plaintext, err := alice.Decrypt(msgType, body)
+	require.NoError(t, err)
+	assert.Equal(t, "hi alice", string(plaintext))
+
+	msgType, body, err = alice.Encrypt([]byte("how are you?"))
+	require.NoError(t, err)
+	assert.Equal(t, MessageTypeMessage, msgType)
+	plaintext, err = bob.Decrypt(msgType, body)
+	require.NoError(t, err)
+	assert.Equal(t, "how are you?", string(plaintext))
+}
+
+func TestSession_OutOfOrder(t *testing.T) {
+	alice, bob, _ := newSessionPair(t)
+
+	_, first, err := alice.Encrypt([]byte("first"))
+	require.NoError(t, err)
+	msgType, second, err := alice.Encrypt([]byte("second"))
+	require.NoError(t, err)
+
+	plaintext, err := bob.Decrypt(msgType, second)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(plaintext))
+	plaintext, err = bob.Decrypt(msgType, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(plaintext))
+
+	_, err = bob.Decrypt(msgType, first)
+	assert.Equal(t, ErrUnknownMessageKey, err)
+}
+
+func TestSession_TamperedMessage(t *testing.T) {
+	alice, bob, _ := newSessionPair(t)
+	msgType, body, err := alice.Encrypt([]byte("secret"))
+	require.NoError(t, err)
+	body[len(body)-1] ^= 0xFF
+	_, err = bob.Decrypt(msgType, body)
+	assert.Equal(t, ErrBadMAC, err)
+}
+
+func TestAccount_UnknownOneTimeKey(t *testing.T) {
+	_, _, bobAccount := newSessionPair(t)
+	aliceAccount := NewAccount()
+	bobAccount.GenerateOneTimeKeys(1)
+	otk := bobAccount.OneTimeKeys[0]
+	bobIdentity, _ := bobAccount.IdentityKeys()
+	session, err := aliceAccount.NewOutboundSession(bobIdentity, EncodeBase64(otk.Key.Public))
+	require.NoError(t, err)
+	msgType, body, _ := session.Encrypt([]byte("test"))
+	require.Equal(t, MessageTypePreKey, msgType)
+	bobAccount.OneTimeKeys = nil
+	_, err = bobAccount.NewInboundSession("", body)
+	assert.Equal(t, ErrUnknownOneTimeKey, err)
+}
+
+func TestMegolmRatchet_AdvanceTo(t *testing.T) {
+	for _, target := range []uint32{1, 255, 256, 257, 65535, 65536, 70000} {
+		stepwise := MegolmRatchet{Data: make([]byte, megolmRatchetLength)}
+		for i := range stepwise.Data {
+			stepwise.Data[i] = byte(i)
+		}
+		jumped := stepwise.copy()
+		for stepwise.Counter < target {
+			stepwise.advance()
+		}
+		jumped.advanceTo(target)
+		assert.Equal(t, stepwise, jumped, "advancing to %d", target)
+	}
+}
+
+func TestGroupSession_RoundTrip(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	first := outbound.Encrypt([]byte("first"))
+	inbound, err := NewInboundGroupSession(outbound.SessionKey())
+	require.NoError(t, err)
+	assert.Equal(t, outbound.ID(), inbound.ID())
+	assert.Equal(t, uint32(1), inbound.FirstKnownIndex())
+
+	_, _, err = inbound.Decrypt(first)
+	assert.Equal(t, ErrUnknownMessageIndex, err)
+
+	var messages []string
+	for i := 0; i < 300; i++ {
+		messages = append(messages, outbound.Encrypt([]byte{byte(i)}))
+	}
+	plaintext, index, err := inbound.Decrypt(messages[299])
+	require.NoError(t, err)
+	assert.Equal(t, uint32(300), index)
+	assert.Equal(t, []byte{byte(299 % 256)}, plaintext)
+	plaintext, index, err = inbound.Decrypt(messages[0])
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), index)
+	assert.Equal(t, []byte{0}, plaintext)
+}
+
+func TestGroupSession_ExportImport(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	inbound, err := NewInboundGroupSession(outbound.SessionKey())
+	require.NoError(t, err)
+	outbound.Encrypt([]byte("skipped"))
+	msg := outbound.Encrypt([]byte("exported"))
+
+	exported, err := inbound.Export(1)
+	require.NoError(t, err)
+	imported, err := ImportInboundGroupSession(exported)
+	require.NoError(t, err)
+	assert.False(t, imported.SigningKeyVerified)
+	assert.Equal(t, uint32(1), imported.FirstKnownIndex())
+	plaintext, _, err := imported.Decrypt(msg)
+	require.NoError(t, err)
+	assert.Equal(t, "exported", string(plaintext))
+	assert.True(t, imported.SigningKeyVerified)
+}
+
+func TestGroupSession_BadSignature(t *testing.T) {
+	outbound := NewOutboundGroupSession()
+	inbound, err := NewInboundGroupSession(outbound.SessionKey())
+	require.NoError(t, err)
+	other := NewOutboundGroupSession()
+	other.Ratchet = outbound.Ratchet.copy()
+	_, _, err = inbound.Decrypt(other.Encrypt([]byte("forged")))
+	assert.Equal(t, ErrBadSignature, err)
+}
+
+func TestSAS(t *testing.T) {
+	alice, bob := NewSAS(), NewSAS()
+	_, err := alice.GenerateBytes("info", 6)
+	assert.Equal(t, ErrNoTheirKey, err)
+	require.NoError(t, alice.SetTheirKey(bob.PublicKey()))
+	require.NoError(t, bob.SetTheirKey(alice.PublicKey()))
+
+	aliceBytes, err := alice.GenerateBytes("info", 6)
+	require.NoError(t, err)
+	bobBytes, err := bob.GenerateBytes("info", 6)
+	require.NoError(t, err)
+	assert.Len(t, aliceBytes, 6)
+	assert.Equal(t, aliceBytes, bobBytes)
+
+	aliceMAC, err := alice.CalculateMAC("input", "info")
+	require.NoError(t, err)
+	bobMAC, err := bob.CalculateMAC("input", "info")
+	require.NoError(t, err)
+	assert.Equal(t, aliceMAC, bobMAC)
+
+	legacyMAC, err := alice.CalculateMACLegacy("input", "info")
+	require.NoError(t, err)
+	assert.Len(t, legacyMAC, len(aliceMAC))
+	// The first group is encoded before anything is overwritten, the rest is mangled.
+	assert.Equal(t, aliceMAC[:4], legacyMAC[:4])
+	assert.NotEqual(t, aliceMAC, legacyMAC)
+}
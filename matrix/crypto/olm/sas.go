@@ -0,0 +1,120 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"errors"
+)
+
+var ErrNoTheirKey = errors.New("the other party's public key has not been set")
+
+// SAS is an ephemeral Curve25519 key pair used for short authentication string verification.
+// It implements the same operations as the olm_sas object in libolm.
+type SAS struct {
+	keyPair Curve25519KeyPair
+	secret  []byte
+}
+
+// NewSAS creates a new SAS object with a random key pair.
+func NewSAS() *SAS {
+	return &SAS{keyPair: NewCurve25519KeyPair()}
+}
+
+// PublicKey returns the base64-encoded public key of the SAS object.
+func (sas *SAS) PublicKey() string {
+	return EncodeBase64(sas.keyPair.Public)
+}
+
+// SetTheirKey computes the shared secret with the given base64-encoded public key of the other party.
+func (sas *SAS) SetTheirKey(theirKey string) error {
+	keyBytes, err := DecodeBase64(theirKey)
+	if err != nil {
+		return ErrInvalidKey
+	}
+	sas.secret, err = sas.keyPair.SharedSecret(keyBytes)
+	return err
+}
+
+// GenerateBytes derives the given number of bytes from the shared secret for displaying as the short authentication string.
+func (sas *SAS) GenerateBytes(info string, length int) ([]byte, error) {
+	if sas.secret == nil {
+		return nil, ErrNoTheirKey
+	}
+	return deriveKeys(sas.secret, nil, info, length), nil
+}
+
+func (sas *SAS) calculateMAC(input, info string) ([]byte, error) {
+	if sas.secret == nil {
+		return nil, ErrNoTheirKey
+	}
+	key := deriveKeys(sas.secret, nil, info, 32)
+	return hmacSHA256(key, []byte(input)), nil
+}
+
+// CalculateMAC calculates a base64-encoded MAC of the given input using a key derived from the shared secret.
+// This is the hkdf-hmac-sha256.v2 method.
+func (sas *SAS) CalculateMAC(input, info string) (string, error) {
+	mac, err := sas.calculateMAC(input, info)
+	if err != nil {
+		return "", err
+	}
+	return EncodeBase64(mac), nil
+}
+
+// CalculateMACLegacy is the same as CalculateMAC, except it reproduces the broken base64 encoding
+// of olm_sas_calculate_mac, which is used by the hkdf-hmac-sha256 method.
+func (sas *SAS) CalculateMACLegacy(input, info string) (string, error) {
+	mac, err := sas.calculateMAC(input, info)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, Encoding.EncodedLen(len(mac)))
+	copy(buf, mac)
+	return string(encodeBase64InPlace(buf, len(mac))), nil
+}
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// encodeBase64InPlace encodes the first inputLength bytes of buf into buf itself the same way libolm does,
+// which means input bytes are overwritten by output before they're read.
+func encodeBase64InPlace(buf []byte, inputLength int) []byte {
+	pos, out := 0, 0
+	end := inputLength / 3 * 3
+	for pos != end {
+		value := uint(buf[pos])<<16 | uint(buf[pos+1])<<8 | uint(buf[pos+2])
+		pos += 3
+		buf[out+3] = base64Alphabet[value&0x3F]
+		buf[out+2] = base64Alphabet[(value>>6)&0x3F]
+		buf[out+1] = base64Alphabet[(value>>12)&0x3F]
+		buf[out] = base64Alphabet[value>>18]
+		out += 4
+	}
+	switch inputLength - pos {
+	case 2:
+		value := (uint(buf[pos])<<8 | uint(buf[pos+1])) << 2
+		buf[out+2] = base64Alphabet[value&0x3F]
+		buf[out+1] = base64Alphabet[(value>>6)&0x3F]
+		buf[out] = base64Alphabet[value>>12]
+		out += 3
+	case 1:
+		value := uint(buf[pos]) << 4
+		buf[out+1] = base64Alphabet[value&0x3F]
+		buf[out] = base64Alphabet[value>>6]
+		out += 2
+	}
+	return buf[:out]
+}
@@ -0,0 +1,269 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package olm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+const (
+	// MessageTypePreKey is the type of messages that can be used to create a new inbound session.
+	MessageTypePreKey = 0
+	// MessageTypeMessage is the type of normal messages.
+	MessageTypeMessage = 1
+
+	maxReceiverChains = 5
+	maxSkippedKeys    = 40
+	maxMessageGap     = 2000
+)
+
+var (
+	ErrUnknownMessageType = errors.New("unknown message type")
+	ErrMessageGapTooLarge = errors.New("message gap too large")
+	ErrUnknownMessageKey  = errors.New("message key not found")
+)
+
+var (
+	messageKeySeed = []byte{0x01}
+	chainKeySeed   = []byte{0x02}
+)
+
+// SenderChain is the sending half of the Olm double ratchet.
+type SenderChain struct {
+	RatchetKey Curve25519KeyPair `json:"ratchet_key"`
+	ChainKey   []byte            `json:"chain_key"`
+	Index      uint32            `json:"index"`
+}
+
+// ReceiverChain is a receiving chain of the Olm double ratchet.
+type ReceiverChain struct {
+	RatchetKey []byte `json:"ratchet_key"`
+	ChainKey   []byte `json:"chain_key"`
+	Index      uint32 `json:"index"`
+}
+
+// SkippedMessageKey is a message key that was skipped over when receiving out-of-order messages.
+type SkippedMessageKey struct {
+	RatchetKey []byte `json:"ratchet_key"`
+	Index      uint32 `json:"index"`
+	MessageKey []byte `json:"message_key"`
+}
+
+// Session is an Olm double ratchet session between two devices.
+type Session struct {
+	RootKey        []byte              `json:"root_key"`
+	SenderChain    *SenderChain        `json:"sender_chain,omitempty"`
+	ReceiverChains []ReceiverChain     `json:"receiver_chains,omitempty"`
+	SkippedKeys    []SkippedMessageKey `json:"skipped_keys,omitempty"`
+
+	ReceivedMessage bool `json:"received_message"`
+
+	AliceIdentityKey []byte `json:"alice_identity_key"`
+	AliceBaseKey     []byte `json:"alice_base_key"`
+	BobOneTimeKey    []byte `json:"bob_one_time_key"`
+}
+
+// ID returns the session ID, which is derived from the keys that were used to create the session.
+func (session *Session) ID() string {
+	hash := sha256.New()
+	hash.Write(session.AliceIdentityKey)
+	hash.Write(session.AliceBaseKey)
+	hash.Write(session.BobOneTimeKey)
+	return EncodeBase64(hash.Sum(nil))
+}
+
+// HasReceivedMessage returns whether the session has successfully decrypted a message from the other device.
+func (session *Session) HasReceivedMessage() bool {
+	return session.ReceivedMessage
+}
+
+// MatchesInboundSession checks if the given pre-key message was sent using this session.
+func (session *Session) MatchesInboundSession(theirIdentityKey string, preKeyMessageBody []byte) bool {
+	msg, err := decodePreKeyMessage(preKeyMessageBody)
+	if err != nil {
+		return false
+	}
+	if len(theirIdentityKey) > 0 {
+		identityKey, err := DecodeBase64(theirIdentityKey)
+		if err != nil || !bytes.Equal(identityKey, msg.IdentityKey) {
+			return false
+		}
+	}
+	return bytes.Equal(msg.IdentityKey, session.AliceIdentityKey) &&
+		bytes.Equal(msg.BaseKey, session.AliceBaseKey) &&
+		bytes.Equal(msg.OneTimeKey, session.BobOneTimeKey)
+}
+
+func advanceRootKey(rootKey []byte, ourKey Curve25519KeyPair, theirKey []byte) (newRootKey, chainKey []byte, err error) {
+	secret, err := ourKey.SharedSecret(theirKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	derived := deriveKeys(secret, rootKey, kdfInfoRatchet, 64)
+	return derived[:32], derived[32:], nil
+}
+
+// Encrypt encrypts the given plaintext and returns the message type and the encrypted message body.
+func (session *Session) Encrypt(plaintext []byte) (int, []byte, error) {
+	if session.SenderChain == nil {
+		if len(session.ReceiverChains) == 0 {
+			return 0, nil, errors.New("session has no chains")
+		}
+		ratchetKey := NewCurve25519KeyPair()
+		rootKey, chainKey, err := advanceRootKey(session.RootKey, ratchetKey, session.ReceiverChains[0].RatchetKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		session.RootKey = rootKey
+		session.SenderChain = &SenderChain{
+			RatchetKey: ratchetKey,
+			ChainKey:   chainKey,
+		}
+	}
+	chain := session.SenderChain
+	messageKey := hmacSHA256(chain.ChainKey, messageKeySeed)
+	msg := &message{
+		RatchetKey: chain.RatchetKey.Public,
+		Counter:    chain.Index,
+	}
+	chain.ChainKey = hmacSHA256(chain.ChainKey, chainKeySeed)
+	chain.Index++
+
+	keys := deriveCipherKeys(kdfInfoOlmKeys, messageKey)
+	msg.Ciphertext = keys.encrypt(plaintext)
+	data := msg.encode()
+	data = append(data, keys.mac(data)...)
+
+	if session.ReceivedMessage {
+		return MessageTypeMessage, data, nil
+	}
+	preKeyMsg := &preKeyMessage{
+		OneTimeKey:  session.BobOneTimeKey,
+		BaseKey:     session.AliceBaseKey,
+		IdentityKey: session.AliceIdentityKey,
+		Message:     data,
+	}
+	return MessageTypePreKey, preKeyMsg.encode(), nil
+}
+
+// Decrypt decrypts the given message. The session state is only updated if decryption succeeds.
+func (session *Session) Decrypt(msgType int, body []byte) ([]byte, error) {
+	switch msgType {
+	case MessageTypePreKey:
+		preKeyMsg, err := decodePreKeyMessage(body)
+		if err != nil {
+			return nil, err
+		}
+		body = preKeyMsg.Message
+	case MessageTypeMessage:
+	default:
+		return nil, ErrUnknownMessageType
+	}
+	msg, mac, err := decodeMessage(body)
+	if err != nil {
+		return nil, err
+	}
+	macData := body[:len(body)-macLength]
+
+	var chain *ReceiverChain
+	for i := range session.ReceiverChains {
+		if bytes.Equal(session.ReceiverChains[i].RatchetKey, msg.RatchetKey) {
+			chain = &session.ReceiverChains[i]
+			break
+		}
+	}
+
+	if chain != nil && msg.Counter < chain.Index {
+		return session.decryptSkipped(msg, macData, mac)
+	}
+
+	var newRootKey []byte
+	newChain := ReceiverChain{RatchetKey: msg.RatchetKey}
+	if chain != nil {
+		newChain = *chain
+	} else if session.SenderChain == nil {
+		return nil, errors.New("no chain to ratchet from")
+	} else {
+		newRootKey, newChain.ChainKey, err = advanceRootKey(session.RootKey, session.SenderChain.RatchetKey, msg.RatchetKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if msg.Counter-newChain.Index > maxMessageGap {
+		return nil, ErrMessageGapTooLarge
+	}
+	var skipped []SkippedMessageKey
+	for newChain.Index < msg.Counter {
+		skipped = append(skipped, SkippedMessageKey{
+			RatchetKey: msg.RatchetKey,
+			Index:      newChain.Index,
+			MessageKey: hmacSHA256(newChain.ChainKey, messageKeySeed),
+		})
+		newChain.ChainKey = hmacSHA256(newChain.ChainKey, chainKeySeed)
+		newChain.Index++
+	}
+	keys := deriveCipherKeys(kdfInfoOlmKeys, hmacSHA256(newChain.ChainKey, messageKeySeed))
+	if !keys.verifyMAC(macData, mac) {
+		return nil, ErrBadMAC
+	}
+	plaintext, err := keys.decrypt(msg.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	newChain.ChainKey = hmacSHA256(newChain.ChainKey, chainKeySeed)
+	newChain.Index++
+
+	if chain != nil {
+		*chain = newChain
+	} else {
+		session.RootKey = newRootKey
+		session.ReceiverChains = append([]ReceiverChain{newChain}, session.ReceiverChains...)
+		if len(session.ReceiverChains) > maxReceiverChains {
+			session.ReceiverChains = session.ReceiverChains[:maxReceiverChains]
+		}
+		session.SenderChain = nil
+	}
+	session.SkippedKeys = append(session.SkippedKeys, skipped...)
+	if len(session.SkippedKeys) > maxSkippedKeys {
+		session.SkippedKeys = session.SkippedKeys[len(session.SkippedKeys)-maxSkippedKeys:]
+	}
+	session.ReceivedMessage = true
+	return plaintext, nil
+}
+
+func (session *Session) decryptSkipped(msg *message, macData, mac []byte) ([]byte, error) {
+	for i, skipped := range session.SkippedKeys {
+		if skipped.Index != msg.Counter || !bytes.Equal(skipped.RatchetKey, msg.RatchetKey) {
+			continue
+		}
+		keys := deriveCipherKeys(kdfInfoOlmKeys, skipped.MessageKey)
+		if !keys.verifyMAC(macData, mac) {
+			return nil, ErrBadMAC
+		}
+		plaintext, err := keys.decrypt(msg.Ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		session.SkippedKeys = append(session.SkippedKeys[:i], session.SkippedKeys[i+1:]...)
+		session.ReceivedMessage = true
+		return plaintext, nil
+	}
+	return nil, ErrUnknownMessageKey
+}
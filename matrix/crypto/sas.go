@@ -0,0 +1,67 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+// SASEmoji is an emoji used in short authentication string verification.
+type SASEmoji struct {
+	Emoji string
+	Name  string
+}
+
+// sasEmojis is the table of emojis from the Matrix spec. The index of each emoji is the 6-bit number it represents.
+var sasEmojis = [64]SASEmoji{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
+
+// sasBytesLength is the number of bytes generated from the shared secret. The emoji method needs 42 bits
+// and the decimal method needs 39 bits.
+const sasBytesLength = 6
+
+// sasDecimal converts the generated SAS bytes into three four-digit numbers.
+func sasDecimal(data []byte) [3]int {
+	return [3]int{
+		(int(data[0])<<5 | int(data[1])>>3) + 1000,
+		(int(data[1]&0x7)<<10 | int(data[2])<<2 | int(data[3])>>6) + 1000,
+		(int(data[3]&0x3F)<<7 | int(data[4])>>1) + 1000,
+	}
+}
+
+// sasEmoji converts the generated SAS bytes into seven emojis.
+func sasEmoji(data []byte) [7]SASEmoji {
+	bits := uint64(data[0])<<40 | uint64(data[1])<<32 | uint64(data[2])<<24 |
+		uint64(data[3])<<16 | uint64(data[4])<<8 | uint64(data[5])
+	var emojis [7]SASEmoji
+	for i := range emojis {
+		emojis[i] = sasEmojis[(bits>>uint(42-i*6))&0x3F]
+	}
+	return emojis
+}
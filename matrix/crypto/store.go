@@ -0,0 +1,373 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/gomuks/matrix/crypto/olm"
+)
+
+var (
+	bucketAccount               = []byte("account")
+	bucketOlmSessions           = []byte("olm_sessions")
+	bucketInboundGroupSessions  = []byte("inbound_group_sessions")
+	bucketOutboundGroupSessions = []byte("outbound_group_sessions")
+	bucketMessageIndices        = []byte("megolm_message_indices")
+	bucketDevices               = []byte("devices")
+	bucketTrackedUsers          = []byte("tracked_users")
+
+	keyAccount = []byte("account")
+	keyShared  = []byte("shared")
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+)
+
+// InboundGroupSession is a Megolm session received from another device, along with the
+// info needed to check who it belongs to.
+type InboundGroupSession struct {
+	Session *olm.InboundGroupSession `json:"session"`
+
+	RoomID     string `json:"room_id"`
+	SenderKey  string `json:"sender_key"`
+	SigningKey string `json:"signing_key"`
+
+	ForwardingChain []string `json:"forwarding_chain,omitempty"`
+}
+
+// OutboundGroupSession is a Megolm session that is used to send messages to a room.
+type OutboundGroupSession struct {
+	Session *olm.OutboundGroupSession `json:"session"`
+
+	RoomID       string    `json:"room_id"`
+	CreationTime time.Time `json:"creation_time"`
+	MessageCount int       `json:"message_count"`
+
+	MaxAge      time.Duration `json:"max_age"`
+	MaxMessages int           `json:"max_messages"`
+
+	// SharedWith contains the user ID -> device ID -> identity key mappings of the devices
+	// the session has been shared with.
+	SharedWith map[string]map[string]string `json:"shared_with"`
+}
+
+// Expired returns whether the session has been used for too long and should be rotated.
+func (ogs *OutboundGroupSession) Expired() bool {
+	return ogs.MessageCount >= ogs.MaxMessages || time.Now().Sub(ogs.CreationTime) > ogs.MaxAge
+}
+
+// Store is a bbolt-backed storage for everything the crypto machine needs to persist.
+//
+// The keys are stored unencrypted, which means the store file must be protected the same
+// way as the rest of the gomuks cache directory.
+type Store struct {
+	db *bolt.DB
+}
+
+// NewStore opens the crypto store at the given path, creating it if it doesn't exist.
+func NewStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:      1,
+		FreelistType: bolt.FreelistArrayType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketAccount, bucketOlmSessions, bucketInboundGroupSessions,
+			bucketOutboundGroupSessions, bucketMessageIndices, bucketDevices, bucketTrackedUsers} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (store *Store) Close() error {
+	return store.db.Close()
+}
+
+func getJSON(bucket *bolt.Bucket, key []byte, target interface{}) error {
+	data := bucket.Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, target)
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, source interface{}) error {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+func joinKey(parts ...string) []byte {
+	var key []byte
+	for i, part := range parts {
+		if i > 0 {
+			key = append(key, 0)
+		}
+		key = append(key, part...)
+	}
+	return key
+}
+
+// GetAccount returns the stored Olm account and whether its keys have been uploaded to the server.
+func (store *Store) GetAccount() (account *olm.Account, shared bool, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAccount)
+		shared = bucket.Get(keyShared) != nil
+		account = &olm.Account{}
+		return getJSON(bucket, keyAccount, account)
+	})
+	if err == ErrNotFound {
+		account = nil
+		err = nil
+	}
+	return
+}
+
+// PutAccount stores the Olm account.
+func (store *Store) PutAccount(account *olm.Account, shared bool) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAccount)
+		if shared {
+			if err := bucket.Put(keyShared, []byte{1}); err != nil {
+				return err
+			}
+		}
+		return putJSON(bucket, keyAccount, account)
+	})
+}
+
+// GetOlmSessions returns all the Olm sessions with the device that has the given identity key,
+// sorted by session ID.
+func (store *Store) GetOlmSessions(senderKey string) (sessions []*olm.Session, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketOlmSessions).Bucket([]byte(senderKey))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			session := &olm.Session{}
+			if err := json.Unmarshal(data, session); err != nil {
+				return err
+			}
+			sessions = append(sessions, session)
+			return nil
+		})
+	})
+	return
+}
+
+// PutOlmSession stores an Olm session with the device that has the given identity key.
+func (store *Store) PutOlmSession(senderKey string, session *olm.Session) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketOlmSessions).CreateBucketIfNotExists([]byte(senderKey))
+		if err != nil {
+			return err
+		}
+		return putJSON(bucket, []byte(session.ID()), session)
+	})
+}
+
+// GetInboundGroupSession returns the Megolm session with the given room ID, sender key and session ID.
+func (store *Store) GetInboundGroupSession(roomID, senderKey, sessionID string) (igs *InboundGroupSession, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		igs = &InboundGroupSession{}
+		return getJSON(tx.Bucket(bucketInboundGroupSessions), joinKey(roomID, senderKey, sessionID), igs)
+	})
+	if err != nil {
+		igs = nil
+	}
+	return
+}
+
+// PutInboundGroupSession stores a Megolm session received from another device.
+func (store *Store) PutInboundGroupSession(igs *InboundGroupSession) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		key := joinKey(igs.RoomID, igs.SenderKey, igs.Session.ID())
+		return putJSON(tx.Bucket(bucketInboundGroupSessions), key, igs)
+	})
+}
+
+// GetAllInboundGroupSessions returns all stored Megolm sessions.
+func (store *Store) GetAllInboundGroupSessions() (sessions []*InboundGroupSession, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInboundGroupSessions).ForEach(func(_, data []byte) error {
+			igs := &InboundGroupSession{}
+			if err := json.Unmarshal(data, igs); err != nil {
+				return err
+			}
+			sessions = append(sessions, igs)
+			return nil
+		})
+	})
+	return
+}
+
+// ValidateMessageIndex checks that the given Megolm message index hasn't been used for another event.
+// The first event ID to use an index is remembered, so decrypting the same event again is allowed.
+func (store *Store) ValidateMessageIndex(senderKey, sessionID, eventID string, index uint32) (ok bool, err error) {
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketMessageIndices)
+		key := append(joinKey(senderKey, sessionID), itob(index)...)
+		existing := bucket.Get(key)
+		if existing == nil {
+			ok = true
+			return bucket.Put(key, []byte(eventID))
+		}
+		ok = string(existing) == eventID
+		return nil
+	})
+	return
+}
+
+// GetOutboundGroupSession returns the Megolm session used for sending messages to the given room.
+func (store *Store) GetOutboundGroupSession(roomID string) (ogs *OutboundGroupSession, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		ogs = &OutboundGroupSession{}
+		return getJSON(tx.Bucket(bucketOutboundGroupSessions), []byte(roomID), ogs)
+	})
+	if err != nil {
+		ogs = nil
+	}
+	if err == ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// PutOutboundGroupSession stores the Megolm session used for sending messages to a room.
+func (store *Store) PutOutboundGroupSession(ogs *OutboundGroupSession) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketOutboundGroupSessions), []byte(ogs.RoomID), ogs)
+	})
+}
+
+// RemoveOutboundGroupSession removes the outbound Megolm session of the given room,
+// which causes a new one to be created for the next message.
+func (store *Store) RemoveOutboundGroupSession(roomID string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOutboundGroupSessions).Delete([]byte(roomID))
+	})
+}
+
+// GetDevices returns the known devices of the given user.
+func (store *Store) GetDevices(userID string) (devices map[string]*DeviceIdentity, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(bucketDevices), []byte(userID), &devices)
+	})
+	if err == ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// PutDevices replaces the known devices of the given user.
+func (store *Store) PutDevices(userID string, devices map[string]*DeviceIdentity) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketDevices), []byte(userID), devices)
+	})
+}
+
+// GetDevice returns a single known device of the given user.
+func (store *Store) GetDevice(userID, deviceID string) (*DeviceIdentity, error) {
+	devices, err := store.GetDevices(userID)
+	if err != nil {
+		return nil, err
+	} else if device, ok := devices[deviceID]; ok {
+		return device, nil
+	}
+	return nil, ErrNotFound
+}
+
+// PutDevice updates a single device of the user in the known device list.
+func (store *Store) PutDevice(device *DeviceIdentity) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketDevices)
+		var devices map[string]*DeviceIdentity
+		if err := getJSON(bucket, []byte(device.UserID), &devices); err == ErrNotFound {
+			devices = make(map[string]*DeviceIdentity)
+		} else if err != nil {
+			return err
+		}
+		devices[device.DeviceID] = device
+		return putJSON(bucket, []byte(device.UserID), devices)
+	})
+}
+
+// FilterUntrackedUsers returns the users in the given list whose device lists are not known or are outdated.
+func (store *Store) FilterUntrackedUsers(users []string) (untracked []string) {
+	_ = store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTrackedUsers)
+		for _, userID := range users {
+			if val := bucket.Get([]byte(userID)); val == nil || val[0] != 0 {
+				untracked = append(untracked, userID)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// MarkTracked marks the device lists of the given users as up to date.
+func (store *Store) MarkTracked(users []string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTrackedUsers)
+		for _, userID := range users {
+			if err := bucket.Put([]byte(userID), []byte{0}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MarkOutdated marks the device lists of the given users as outdated if they're being tracked.
+func (store *Store) MarkOutdated(users []string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTrackedUsers)
+		for _, userID := range users {
+			if bucket.Get([]byte(userID)) != nil {
+				if err := bucket.Put([]byte(userID), []byte{1}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func itob(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
@@ -0,0 +1,858 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/crypto/olm"
+)
+
+var (
+	VerificationRequest = mautrix.NewEventType("m.key.verification.request")
+	VerificationReady   = mautrix.NewEventType("m.key.verification.ready")
+	VerificationStart   = mautrix.NewEventType("m.key.verification.start")
+	VerificationAccept  = mautrix.NewEventType("m.key.verification.accept")
+	VerificationKey     = mautrix.NewEventType("m.key.verification.key")
+	VerificationMAC     = mautrix.NewEventType("m.key.verification.mac")
+	VerificationDone    = mautrix.NewEventType("m.key.verification.done")
+	VerificationCancel  = mautrix.NewEventType("m.key.verification.cancel")
+)
+
+// MsgVerificationRequest is the msgtype of m.room.message events that request an in-room verification.
+const MsgVerificationRequest mautrix.MessageType = "m.key.verification.request"
+
+const (
+	VerificationMethodSAS = "m.sas.v1"
+
+	SASMethodDecimal = "decimal"
+	SASMethodEmoji   = "emoji"
+
+	sasKeyAgreementProtocol = "curve25519-hkdf-sha256"
+	sasHash                 = "sha256"
+	sasMACMethod            = "hkdf-hmac-sha256.v2"
+	sasMACMethodLegacy      = "hkdf-hmac-sha256"
+
+	// Requests that are older or further in the future than these are ignored.
+	verificationRequestMaxAge    = 10 * time.Minute
+	verificationRequestMaxFuture = 5 * time.Minute
+)
+
+// VerificationCancelCode is the reason code of a m.key.verification.cancel event.
+type VerificationCancelCode string
+
+const (
+	VerificationCancelByUser               VerificationCancelCode = "m.user"
+	VerificationCancelTimeout              VerificationCancelCode = "m.timeout"
+	VerificationCancelUnknownTransaction   VerificationCancelCode = "m.unknown_transaction"
+	VerificationCancelUnknownMethod        VerificationCancelCode = "m.unknown_method"
+	VerificationCancelUnexpectedMessage    VerificationCancelCode = "m.unexpected_message"
+	VerificationCancelKeyMismatch          VerificationCancelCode = "m.key_mismatch"
+	VerificationCancelUserMismatch         VerificationCancelCode = "m.user_mismatch"
+	VerificationCancelInvalidMessage       VerificationCancelCode = "m.invalid_message"
+	VerificationCancelAccepted             VerificationCancelCode = "m.accepted"
+	VerificationCancelMismatchedCommitment VerificationCancelCode = "m.mismatched_commitment"
+	VerificationCancelMismatchedSAS        VerificationCancelCode = "m.mismatched_sas"
+)
+
+var ErrVerificationNotActive = errors.New("the verification is not in a state where that can be done")
+
+// VerificationState is the current step of a verification.
+type VerificationState int
+
+const (
+	// VerificationStateRequested means the request has been sent or received, but not accepted yet.
+	VerificationStateRequested VerificationState = iota
+	// VerificationStateReady means the request has been accepted, but the SAS flow hasn't been started yet.
+	VerificationStateReady
+	// VerificationStateStarted means the SAS flow has been started, but the other side hasn't accepted it yet.
+	VerificationStateStarted
+	// VerificationStateAccepted means the SAS flow has been accepted and the ephemeral keys are being exchanged.
+	VerificationStateAccepted
+	// VerificationStateKeysExchanged means the short authentication string is ready to be compared by the user.
+	VerificationStateKeysExchanged
+	// VerificationStateConfirmed means the user has confirmed that the strings match and we're waiting for the other side.
+	VerificationStateConfirmed
+	// VerificationStateDone means the other device has been verified successfully.
+	VerificationStateDone
+	// VerificationStateCancelled means the verification was cancelled by either side.
+	VerificationStateCancelled
+)
+
+func (state VerificationState) String() string {
+	switch state {
+	case VerificationStateRequested:
+		return "requested"
+	case VerificationStateReady:
+		return "ready"
+	case VerificationStateStarted:
+		return "started"
+	case VerificationStateAccepted:
+		return "accepted"
+	case VerificationStateKeysExchanged:
+		return "keys exchanged"
+	case VerificationStateConfirmed:
+		return "confirmed"
+	case VerificationStateDone:
+		return "done"
+	case VerificationStateCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// verificationRelation is the m.relates_to field of in-room verification events. mautrix.RelatesTo isn't used,
+// because it adds a reply fallback to references.
+type verificationRelation struct {
+	Type    mautrix.RelationType `json:"rel_type"`
+	EventID string               `json:"event_id"`
+}
+
+// verificationContent contains the fields of all the m.key.verification.* events.
+type verificationContent struct {
+	TransactionID string                `json:"transaction_id,omitempty"`
+	RelatesTo     *verificationRelation `json:"m.relates_to,omitempty"`
+
+	// Fields of in-room requests
+	MsgType mautrix.MessageType `json:"msgtype,omitempty"`
+	Body    string              `json:"body,omitempty"`
+	To      string              `json:"to,omitempty"`
+
+	// Fields of requests and ready events
+	FromDevice string   `json:"from_device,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	Timestamp  int64    `json:"timestamp,omitempty"`
+
+	// Fields of start events
+	Method                     string   `json:"method,omitempty"`
+	KeyAgreementProtocols      []string `json:"key_agreement_protocols,omitempty"`
+	Hashes                     []string `json:"hashes,omitempty"`
+	MessageAuthenticationCodes []string `json:"message_authentication_codes,omitempty"`
+	ShortAuthenticationString  []string `json:"short_authentication_string,omitempty"`
+
+	// Fields of accept events
+	KeyAgreementProtocol      string `json:"key_agreement_protocol,omitempty"`
+	Hash                      string `json:"hash,omitempty"`
+	MessageAuthenticationCode string `json:"message_authentication_code,omitempty"`
+	Commitment                string `json:"commitment,omitempty"`
+
+	// Fields of key events
+	Key string `json:"key,omitempty"`
+
+	// Fields of MAC events
+	MAC  map[string]string `json:"mac,omitempty"`
+	Keys string            `json:"keys,omitempty"`
+
+	// Fields of cancel events
+	Code   VerificationCancelCode `json:"code,omitempty"`
+	Reason string                 `json:"reason,omitempty"`
+}
+
+type verificationMessage struct {
+	Type    mautrix.EventType
+	Content *verificationContent
+	// Devices overrides the devices that a to-device message is sent to.
+	Devices []string
+}
+
+// Verification is an interactive SAS verification with a device of another user (or another device of our own user).
+type Verification struct {
+	// TransactionID identifies the verification. For in-room verifications, it's the event ID of the request.
+	TransactionID string
+	// RoomID is the room where an in-room verification is happening. It's empty for to-device verifications.
+	RoomID      string
+	OtherUserID string
+	// Incoming is true if the verification was requested by the other user.
+	Incoming bool
+
+	lock sync.Mutex
+
+	otherDeviceID    string
+	requestedDevices []string
+	state            VerificationState
+	cancelCode       VerificationCancelCode
+	cancelReason     string
+
+	sas          *olm.SAS
+	weStarted    bool
+	startContent json.RawMessage
+	commitment   string
+	macMethod    string
+	sasMethods   []string
+	sasBytes     []byte
+	theirMAC     *verificationContent
+}
+
+// State returns the current step of the verification.
+func (v *Verification) State() VerificationState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.state
+}
+
+// OtherDeviceID returns the ID of the device being verified. It's empty if a request was sent
+// to all devices of a user and none of them have accepted it yet.
+func (v *Verification) OtherDeviceID() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.otherDeviceID
+}
+
+// CancelReason returns the reason why the verification was cancelled.
+func (v *Verification) CancelReason() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.cancelReason) > 0 {
+		return v.cancelReason
+	}
+	return string(v.cancelCode)
+}
+
+// Decimal returns the decimal representation of the short authentication string,
+// or false if the keys haven't been exchanged yet.
+func (v *Verification) Decimal() ([3]int, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.sasBytes == nil {
+		return [3]int{}, false
+	}
+	return sasDecimal(v.sasBytes), true
+}
+
+// Emoji returns the emoji representation of the short authentication string, or false if the keys
+// haven't been exchanged yet or the other device doesn't support emojis.
+func (v *Verification) Emoji() ([7]SASEmoji, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.sasBytes == nil || !containsString(v.sasMethods, SASMethodEmoji) {
+		return [7]SASEmoji{}, false
+	}
+	return sasEmoji(v.sasBytes), true
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Verification) cancel(code VerificationCancelCode, reason string) []verificationMessage {
+	debug.Printf("Cancelling verification %s with %s: %s (%s)", v.TransactionID, v.OtherUserID, reason, code)
+	v.state = VerificationStateCancelled
+	v.cancelCode = code
+	v.cancelReason = reason
+	return []verificationMessage{{
+		Type:    VerificationCancel,
+		Content: &verificationContent{Code: code, Reason: reason},
+	}}
+}
+
+func (v *Verification) finished() bool {
+	return v.state == VerificationStateDone || v.state == VerificationStateCancelled
+}
+
+// IsVerificationEvent checks whether the given room event is a part of an in-room verification.
+func IsVerificationEvent(evt *mautrix.Event) bool {
+	switch evt.Type {
+	case VerificationReady, VerificationStart, VerificationAccept, VerificationKey,
+		VerificationMAC, VerificationDone, VerificationCancel:
+		return true
+	case mautrix.EventMessage:
+		return evt.Content.MsgType == MsgVerificationRequest
+	default:
+		return false
+	}
+}
+
+// HandleRoomVerificationEvent processes an in-room m.key.verification.* event or a verification
+// request message. The event must already be decrypted.
+func (mach *OlmMachine) HandleRoomVerificationEvent(evt *mautrix.Event) {
+	var content verificationContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		debug.Printf("Failed to parse verification event %s from %s: %v", evt.ID, evt.Sender, err)
+		return
+	}
+	if evt.Type == mautrix.EventMessage {
+		if content.MsgType != MsgVerificationRequest || content.To != mach.userID || evt.Sender == mach.userID {
+			return
+		}
+		content.Timestamp = evt.Timestamp
+		mach.handleVerificationRequest(evt.Sender, evt.ID, evt.RoomID, &content)
+		return
+	}
+	relatesTo := evt.Content.GetRelatesTo()
+	if relatesTo.Type != mautrix.RelReference || len(relatesTo.EventID) == 0 {
+		return
+	}
+	v := mach.getVerification(relatesTo.EventID)
+	if v == nil || v.RoomID != evt.RoomID {
+		return
+	} else if evt.Sender == mach.userID {
+		// Our own events are echoed back, but if another one of our devices responded to a request,
+		// this device should stop showing it.
+		if (content.FromDevice != mach.deviceID && (evt.Type == VerificationReady || evt.Type == VerificationStart)) ||
+			evt.Type == VerificationCancel {
+			v.lock.Lock()
+			if !v.finished() && v.state == VerificationStateRequested {
+				v.state = VerificationStateCancelled
+				v.cancelReason = "The request was handled on another device"
+			}
+			v.lock.Unlock()
+			mach.notifyVerification(v)
+		}
+		return
+	} else if v.OtherUserID != evt.Sender {
+		return
+	}
+	mach.handleVerificationEvent(v, evt.Type, &content, evt.Content.VeryRaw)
+}
+
+func (mach *OlmMachine) handleToDeviceVerificationEvent(evt *mautrix.Event) {
+	var content verificationContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		debug.Printf("Failed to parse %s from %s: %v", evt.Type.String(), evt.Sender, err)
+		return
+	} else if len(content.TransactionID) == 0 {
+		debug.Printf("Ignoring %s from %s without transaction ID", evt.Type.String(), evt.Sender)
+		return
+	}
+	switch evt.Type {
+	case VerificationRequest:
+		mach.handleVerificationRequest(evt.Sender, content.TransactionID, "", &content)
+		return
+	case VerificationStart:
+		// Starting without a request is allowed for to-device verifications.
+		if mach.getVerification(content.TransactionID) == nil {
+			content.Timestamp = time.Now().Unix() * 1000
+			mach.handleVerificationRequest(evt.Sender, content.TransactionID, "", &content)
+		}
+	}
+	v := mach.getVerification(content.TransactionID)
+	if v == nil {
+		debug.Printf("Ignoring %s from %s for unknown transaction %s", evt.Type.String(), evt.Sender, content.TransactionID)
+		return
+	} else if v.OtherUserID != evt.Sender {
+		debug.Printf("Ignoring %s from %s for transaction %s with %s", evt.Type.String(), evt.Sender, content.TransactionID, v.OtherUserID)
+		return
+	}
+	mach.handleVerificationEvent(v, evt.Type, &content, evt.Content.VeryRaw)
+}
+
+func (mach *OlmMachine) getVerification(transactionID string) *Verification {
+	mach.verificationLock.Lock()
+	defer mach.verificationLock.Unlock()
+	return mach.verifications[transactionID]
+}
+
+func (mach *OlmMachine) addVerification(v *Verification) bool {
+	mach.verificationLock.Lock()
+	defer mach.verificationLock.Unlock()
+	if _, exists := mach.verifications[v.TransactionID]; exists {
+		return false
+	}
+	mach.verifications[v.TransactionID] = v
+	return true
+}
+
+func (mach *OlmMachine) notifyVerification(v *Verification) {
+	if mach.VerificationHandler != nil {
+		mach.VerificationHandler(v)
+	}
+}
+
+func (mach *OlmMachine) handleVerificationRequest(sender, transactionID, roomID string, content *verificationContent) {
+	ts := time.Unix(content.Timestamp/1000, content.Timestamp%1000*int64(time.Millisecond))
+	if time.Since(ts) > verificationRequestMaxAge || time.Until(ts) > verificationRequestMaxFuture {
+		debug.Printf("Ignoring verification request %s from %s with timestamp %s", transactionID, sender, ts)
+		return
+	} else if len(content.FromDevice) == 0 {
+		debug.Printf("Ignoring verification request %s from %s without device ID", transactionID, sender)
+		return
+	}
+	v := &Verification{
+		TransactionID: transactionID,
+		RoomID:        roomID,
+		OtherUserID:   sender,
+		Incoming:      true,
+		otherDeviceID: content.FromDevice,
+		state:         VerificationStateRequested,
+	}
+	if !mach.addVerification(v) {
+		return
+	}
+	if _, err := mach.GetDevice(sender, content.FromDevice); err != nil {
+		debug.Printf("Failed to get device %s of %s for verification: %v", content.FromDevice, sender, err)
+	}
+	debug.Printf("Received verification request %s from %s/%s", transactionID, sender, content.FromDevice)
+	mach.notifyVerification(v)
+}
+
+func (mach *OlmMachine) handleVerificationEvent(v *Verification, evtType mautrix.EventType, content *verificationContent, raw json.RawMessage) {
+	v.lock.Lock()
+	var messages []verificationMessage
+	if evtType == VerificationCancel {
+		if !v.finished() {
+			v.state = VerificationStateCancelled
+			v.cancelCode = content.Code
+			v.cancelReason = content.Reason
+		}
+	} else if !v.finished() {
+		switch evtType {
+		case VerificationReady:
+			messages = mach.handleVerificationReady(v, content)
+		case VerificationStart:
+			messages = mach.handleVerificationStart(v, content, raw)
+		case VerificationAccept:
+			messages = mach.handleVerificationAccept(v, content)
+		case VerificationKey:
+			messages = mach.handleVerificationKey(v, content)
+		case VerificationMAC:
+			messages = mach.handleVerificationMAC(v, content)
+		case VerificationDone:
+			// The verification is marked as done when the MAC is verified, so the done event doesn't need handling.
+		default:
+			messages = v.cancel(VerificationCancelUnexpectedMessage, fmt.Sprintf("Unexpected %s event", evtType.String()))
+		}
+	}
+	v.lock.Unlock()
+	mach.sendVerificationMessages(v, messages)
+	mach.notifyVerification(v)
+}
+
+func (mach *OlmMachine) handleVerificationReady(v *Verification, content *verificationContent) []verificationMessage {
+	if v.Incoming || v.state != VerificationStateRequested {
+		return v.cancel(VerificationCancelUnexpectedMessage, "Unexpected ready event")
+	} else if !containsString(content.Methods, VerificationMethodSAS) {
+		return v.cancel(VerificationCancelUnknownMethod, "The other device doesn't support SAS verification")
+	}
+	var messages []verificationMessage
+	if len(v.requestedDevices) > 0 {
+		if !containsString(v.requestedDevices, content.FromDevice) {
+			return nil
+		}
+		var others []string
+		for _, deviceID := range v.requestedDevices {
+			if deviceID != content.FromDevice {
+				others = append(others, deviceID)
+			}
+		}
+		if len(others) > 0 {
+			messages = append(messages, verificationMessage{
+				Type:    VerificationCancel,
+				Content: &verificationContent{Code: VerificationCancelAccepted, Reason: "The request was accepted by another device"},
+				Devices: others,
+			})
+		}
+		v.requestedDevices = nil
+	}
+	v.otherDeviceID = content.FromDevice
+	v.state = VerificationStateReady
+	return append(messages, mach.startSAS(v))
+}
+
+func (mach *OlmMachine) startSAS(v *Verification) verificationMessage {
+	content := &verificationContent{
+		FromDevice:                 mach.deviceID,
+		Method:                     VerificationMethodSAS,
+		KeyAgreementProtocols:      []string{sasKeyAgreementProtocol},
+		Hashes:                     []string{sasHash},
+		MessageAuthenticationCodes: []string{sasMACMethod, sasMACMethodLegacy},
+		ShortAuthenticationString:  []string{SASMethodDecimal, SASMethodEmoji},
+	}
+	v.fillRelation(content)
+	// The commitment is calculated from the content as it's sent, so store it exactly.
+	v.startContent, _ = json.Marshal(content)
+	v.weStarted = true
+	v.state = VerificationStateStarted
+	return verificationMessage{Type: VerificationStart, Content: content}
+}
+
+// shouldWinStartConflict returns whether our start event should be used when both sides send one.
+func (mach *OlmMachine) shouldWinStartConflict(v *Verification) bool {
+	if mach.userID != v.OtherUserID {
+		return mach.userID < v.OtherUserID
+	}
+	return mach.deviceID < v.otherDeviceID
+}
+
+func (mach *OlmMachine) handleVerificationStart(v *Verification, content *verificationContent, raw json.RawMessage) []verificationMessage {
+	if content.Method != VerificationMethodSAS {
+		return v.cancel(VerificationCancelUnknownMethod, fmt.Sprintf("Unsupported verification method %s", content.Method))
+	} else if len(v.otherDeviceID) > 0 && content.FromDevice != v.otherDeviceID {
+		return v.cancel(VerificationCancelUnexpectedMessage, "The start event came from an unexpected device")
+	}
+	switch {
+	case v.state == VerificationStateStarted && v.weStarted:
+		if mach.shouldWinStartConflict(v) {
+			return nil
+		}
+		v.weStarted = false
+	case v.state == VerificationStateRequested && v.Incoming:
+		// The start event will be handled when the user accepts the request.
+		v.startContent = raw
+		return nil
+	case v.state != VerificationStateReady:
+		return v.cancel(VerificationCancelUnexpectedMessage, "Unexpected start event")
+	}
+	v.startContent = raw
+	return mach.acceptSAS(v, content)
+}
+
+func (mach *OlmMachine) acceptSAS(v *Verification, start *verificationContent) []verificationMessage {
+	if !containsString(start.KeyAgreementProtocols, sasKeyAgreementProtocol) || !containsString(start.Hashes, sasHash) {
+		return v.cancel(VerificationCancelUnknownMethod, "No supported key agreement protocol or hash")
+	} else if !containsString(start.ShortAuthenticationString, SASMethodDecimal) {
+		return v.cancel(VerificationCancelUnknownMethod, "The other device doesn't support decimal SAS")
+	}
+	if containsString(start.MessageAuthenticationCodes, sasMACMethod) {
+		v.macMethod = sasMACMethod
+	} else if containsString(start.MessageAuthenticationCodes, sasMACMethodLegacy) {
+		v.macMethod = sasMACMethodLegacy
+	} else {
+		return v.cancel(VerificationCancelUnknownMethod, "No supported message authentication code method")
+	}
+	v.sasMethods = []string{SASMethodDecimal}
+	if containsString(start.ShortAuthenticationString, SASMethodEmoji) {
+		v.sasMethods = append(v.sasMethods, SASMethodEmoji)
+	}
+	canonical, err := CanonicalJSON(v.startContent)
+	if err != nil {
+		return v.cancel(VerificationCancelInvalidMessage, "Failed to canonicalize start event")
+	}
+	v.sas = olm.NewSAS()
+	v.state = VerificationStateAccepted
+	content := &verificationContent{
+		Method:                    VerificationMethodSAS,
+		KeyAgreementProtocol:      sasKeyAgreementProtocol,
+		Hash:                      sasHash,
+		MessageAuthenticationCode: v.macMethod,
+		ShortAuthenticationString: v.sasMethods,
+		Commitment:                sasCommitment(v.sas.PublicKey(), canonical),
+	}
+	return []verificationMessage{{Type: VerificationAccept, Content: content}}
+}
+
+func sasCommitment(publicKey string, canonicalStart []byte) string {
+	hash := sha256.Sum256(append([]byte(publicKey), canonicalStart...))
+	return olm.EncodeBase64(hash[:])
+}
+
+func (mach *OlmMachine) handleVerificationAccept(v *Verification, content *verificationContent) []verificationMessage {
+	if !v.weStarted || v.state != VerificationStateStarted {
+		return v.cancel(VerificationCancelUnexpectedMessage, "Unexpected accept event")
+	} else if content.KeyAgreementProtocol != sasKeyAgreementProtocol || content.Hash != sasHash ||
+		(content.MessageAuthenticationCode != sasMACMethod && content.MessageAuthenticationCode != sasMACMethodLegacy) ||
+		!containsString(content.ShortAuthenticationString, SASMethodDecimal) && !containsString(content.ShortAuthenticationString, SASMethodEmoji) {
+		return v.cancel(VerificationCancelUnknownMethod, "The other device accepted with unsupported methods")
+	} else if len(content.Commitment) == 0 {
+		return v.cancel(VerificationCancelInvalidMessage, "Missing commitment")
+	}
+	v.commitment = content.Commitment
+	v.macMethod = content.MessageAuthenticationCode
+	v.sasMethods = content.ShortAuthenticationString
+	v.sas = olm.NewSAS()
+	v.state = VerificationStateAccepted
+	return []verificationMessage{{Type: VerificationKey, Content: &verificationContent{Key: v.sas.PublicKey()}}}
+}
+
+func (mach *OlmMachine) handleVerificationKey(v *Verification, content *verificationContent) []verificationMessage {
+	if v.state != VerificationStateAccepted || v.sas == nil {
+		return v.cancel(VerificationCancelUnexpectedMessage, "Unexpected key event")
+	}
+	var messages []verificationMessage
+	if v.weStarted {
+		canonical, err := CanonicalJSON(v.startContent)
+		if err != nil {
+			return v.cancel(VerificationCancelInvalidMessage, "Failed to canonicalize start event")
+		} else if sasCommitment(content.Key, canonical) != v.commitment {
+			return v.cancel(VerificationCancelMismatchedCommitment, "The key doesn't match the commitment")
+		}
+	} else {
+		messages = append(messages, verificationMessage{Type: VerificationKey, Content: &verificationContent{Key: v.sas.PublicKey()}})
+	}
+	if err := v.sas.SetTheirKey(content.Key); err != nil {
+		return v.cancel(VerificationCancelInvalidMessage, "Invalid key")
+	}
+	var err error
+	v.sasBytes, err = v.sas.GenerateBytes(mach.sasInfo(v, content.Key), sasBytesLength)
+	if err != nil {
+		return v.cancel(VerificationCancelInvalidMessage, err.Error())
+	}
+	v.state = VerificationStateKeysExchanged
+	return messages
+}
+
+func (mach *OlmMachine) sasInfo(v *Verification, theirKey string) string {
+	ourInfo := fmt.Sprintf("%s|%s|%s", mach.userID, mach.deviceID, v.sas.PublicKey())
+	theirInfo := fmt.Sprintf("%s|%s|%s", v.OtherUserID, v.otherDeviceID, theirKey)
+	if v.weStarted {
+		return fmt.Sprintf("MATRIX_KEY_VERIFICATION_SAS|%s|%s|%s", ourInfo, theirInfo, v.TransactionID)
+	}
+	return fmt.Sprintf("MATRIX_KEY_VERIFICATION_SAS|%s|%s|%s", theirInfo, ourInfo, v.TransactionID)
+}
+
+func (v *Verification) calculateMAC(input, info string) (string, error) {
+	if v.macMethod == sasMACMethodLegacy {
+		return v.sas.CalculateMACLegacy(input, info)
+	}
+	return v.sas.CalculateMAC(input, info)
+}
+
+func (mach *OlmMachine) handleVerificationMAC(v *Verification, content *verificationContent) []verificationMessage {
+	if v.state != VerificationStateKeysExchanged && v.state != VerificationStateConfirmed {
+		return v.cancel(VerificationCancelUnexpectedMessage, "Unexpected MAC event")
+	}
+	v.theirMAC = content
+	if v.state == VerificationStateConfirmed {
+		return mach.verifyTheirMAC(v)
+	}
+	return nil
+}
+
+func (mach *OlmMachine) verifyTheirMAC(v *Verification) []verificationMessage {
+	info := fmt.Sprintf("MATRIX_KEY_VERIFICATION_MAC%s%s%s%s%s", v.OtherUserID, v.otherDeviceID, mach.userID, mach.deviceID, v.TransactionID)
+	keyIDs := make([]string, 0, len(v.theirMAC.MAC))
+	for keyID := range v.theirMAC.MAC {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	if expected, err := v.calculateMAC(strings.Join(keyIDs, ","), info+"KEY_IDS"); err != nil || expected != v.theirMAC.Keys {
+		return v.cancel(VerificationCancelKeyMismatch, "The MAC of the key list doesn't match")
+	}
+	device, err := mach.store.GetDevice(v.OtherUserID, v.otherDeviceID)
+	if err != nil {
+		return v.cancel(VerificationCancelKeyMismatch, fmt.Sprintf("Failed to get device keys: %v", err))
+	}
+	deviceKeyID := fmt.Sprintf("%s:%s", keyAlgorithmEd25519, v.otherDeviceID)
+	verifiedDevice := false
+	for _, keyID := range keyIDs {
+		if keyID != deviceKeyID {
+			// Cross-signing keys aren't supported, so they can't be verified.
+			debug.Printf("Ignoring unknown key %s in verification %s", keyID, v.TransactionID)
+			continue
+		}
+		expected, err := v.calculateMAC(device.SigningKey, info+keyID)
+		if err != nil || expected != v.theirMAC.MAC[keyID] {
+			return v.cancel(VerificationCancelKeyMismatch, fmt.Sprintf("The MAC of %s doesn't match", keyID))
+		}
+		verifiedDevice = true
+	}
+	if !verifiedDevice {
+		return v.cancel(VerificationCancelKeyMismatch, "The device key was not included in the MAC")
+	}
+	device.Trust = TrustStateVerified
+	if err = mach.store.PutDevice(device); err != nil {
+		debug.Printf("Failed to store trust of %s/%s: %v", device.UserID, device.DeviceID, err)
+	}
+	debug.Printf("Verified device %s of %s", device.DeviceID, device.UserID)
+	v.state = VerificationStateDone
+	return []verificationMessage{{Type: VerificationDone, Content: &verificationContent{}}}
+}
+
+func (mach *OlmMachine) ourMAC(v *Verification) (*verificationContent, error) {
+	info := fmt.Sprintf("MATRIX_KEY_VERIFICATION_MAC%s%s%s%s%s", mach.userID, mach.deviceID, v.OtherUserID, v.otherDeviceID, v.TransactionID)
+	_, signingKey := mach.account.IdentityKeys()
+	keyID := fmt.Sprintf("%s:%s", keyAlgorithmEd25519, mach.deviceID)
+	keyMAC, err := v.calculateMAC(signingKey, info+keyID)
+	if err != nil {
+		return nil, err
+	}
+	keysMAC, err := v.calculateMAC(keyID, info+"KEY_IDS")
+	if err != nil {
+		return nil, err
+	}
+	return &verificationContent{MAC: map[string]string{keyID: keyMAC}, Keys: keysMAC}, nil
+}
+
+func (v *Verification) fillRelation(content *verificationContent) {
+	if len(v.RoomID) > 0 {
+		content.RelatesTo = &verificationRelation{Type: mautrix.RelReference, EventID: v.TransactionID}
+	} else {
+		content.TransactionID = v.TransactionID
+	}
+}
+
+func (mach *OlmMachine) sendVerificationMessages(v *Verification, messages []verificationMessage) {
+	for _, msg := range messages {
+		if err := mach.sendVerificationMessage(v, msg); err != nil {
+			debug.Printf("Failed to send %s for verification %s: %v", msg.Type.String(), v.TransactionID, err)
+		}
+	}
+}
+
+func (mach *OlmMachine) sendVerificationMessage(v *Verification, msg verificationMessage) error {
+	v.fillRelation(msg.Content)
+	if len(v.RoomID) > 0 {
+		if mach.SendRoomEvent == nil {
+			return errors.New("sending room events is not supported")
+		}
+		relatesTo := &mautrix.RelatesTo{Type: mautrix.RelReference, EventID: v.TransactionID}
+		_, err := mach.SendRoomEvent(v.RoomID, msg.Type, msg.Content, relatesTo)
+		return err
+	}
+	devices := msg.Devices
+	if len(devices) == 0 {
+		v.lock.Lock()
+		if len(v.otherDeviceID) > 0 {
+			devices = []string{v.otherDeviceID}
+		} else {
+			devices = v.requestedDevices
+		}
+		v.lock.Unlock()
+	}
+	deviceMessages := make(map[string]interface{}, len(devices))
+	for _, deviceID := range devices {
+		deviceMessages[deviceID] = msg.Content
+	}
+	return mach.SendToDevice(msg.Type, map[string]map[string]interface{}{v.OtherUserID: deviceMessages})
+}
+
+// RequestVerification sends a to-device verification request to the given device of the given user.
+// If the device ID is empty, the request is sent to all known devices of the user.
+func (mach *OlmMachine) RequestVerification(userID, deviceID string) (*Verification, error) {
+	devices, err := mach.GetDevices(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %v", err)
+	}
+	v := &Verification{
+		TransactionID: mach.client.TxnID(),
+		OtherUserID:   userID,
+		state:         VerificationStateRequested,
+	}
+	if userID == mach.userID && deviceID == mach.deviceID {
+		return nil, errors.New("can't verify the current device")
+	} else if len(deviceID) > 0 {
+		if _, ok := devices[deviceID]; !ok {
+			return nil, fmt.Errorf("device %s of %s not found", deviceID, userID)
+		}
+		v.otherDeviceID = deviceID
+	} else {
+		for otherDeviceID := range devices {
+			if userID != mach.userID || otherDeviceID != mach.deviceID {
+				v.requestedDevices = append(v.requestedDevices, otherDeviceID)
+			}
+		}
+		if len(v.requestedDevices) == 0 {
+			return nil, fmt.Errorf("%s has no devices to verify", userID)
+		}
+		sort.Strings(v.requestedDevices)
+	}
+	mach.addVerification(v)
+	err = mach.sendVerificationMessage(v, verificationMessage{
+		Type: VerificationRequest,
+		Content: &verificationContent{
+			FromDevice: mach.deviceID,
+			Methods:    []string{VerificationMethodSAS},
+			Timestamp:  time.Now().Unix() * 1000,
+		},
+	})
+	if err != nil {
+		mach.verificationLock.Lock()
+		delete(mach.verifications, v.TransactionID)
+		mach.verificationLock.Unlock()
+		return nil, err
+	}
+	mach.notifyVerification(v)
+	return v, nil
+}
+
+// AcceptVerification accepts an incoming verification request.
+func (mach *OlmMachine) AcceptVerification(v *Verification) error {
+	v.lock.Lock()
+	if !v.Incoming || v.state != VerificationStateRequested {
+		v.lock.Unlock()
+		return ErrVerificationNotActive
+	}
+	var messages []verificationMessage
+	if v.startContent != nil {
+		// The other device started without a request (or before we accepted), so accept the start directly.
+		var start verificationContent
+		if err := json.Unmarshal(v.startContent, &start); err != nil {
+			messages = v.cancel(VerificationCancelInvalidMessage, "Failed to parse start event")
+		} else {
+			messages = mach.acceptSAS(v, &start)
+		}
+	} else {
+		v.state = VerificationStateReady
+		messages = []verificationMessage{{
+			Type: VerificationReady,
+			Content: &verificationContent{
+				FromDevice: mach.deviceID,
+				Methods:    []string{VerificationMethodSAS},
+			},
+		}}
+	}
+	v.lock.Unlock()
+	mach.sendVerificationMessages(v, messages)
+	mach.notifyVerification(v)
+	return nil
+}
+
+// ConfirmVerification tells the machine whether the short authentication strings matched.
+// If they did, the MAC of our device key is sent to the other device, otherwise the verification is cancelled.
+func (mach *OlmMachine) ConfirmVerification(v *Verification, match bool) error {
+	v.lock.Lock()
+	if v.state != VerificationStateKeysExchanged {
+		v.lock.Unlock()
+		return ErrVerificationNotActive
+	}
+	var messages []verificationMessage
+	if !match {
+		messages = v.cancel(VerificationCancelMismatchedSAS, "The short authentication strings didn't match")
+	} else if content, err := mach.ourMAC(v); err != nil {
+		messages = v.cancel(VerificationCancelInvalidMessage, fmt.Sprintf("Failed to calculate MAC: %v", err))
+	} else {
+		messages = []verificationMessage{{Type: VerificationMAC, Content: content}}
+		v.state = VerificationStateConfirmed
+		if v.theirMAC != nil {
+			messages = append(messages, mach.verifyTheirMAC(v)...)
+		}
+	}
+	v.lock.Unlock()
+	mach.sendVerificationMessages(v, messages)
+	mach.notifyVerification(v)
+	return nil
+}
+
+// CancelVerification cancels the given verification. Cancelling a finished verification does nothing.
+func (mach *OlmMachine) CancelVerification(v *Verification) error {
+	v.lock.Lock()
+	if v.finished() {
+		v.lock.Unlock()
+		return nil
+	}
+	messages := v.cancel(VerificationCancelByUser, "The user cancelled the verification")
+	v.lock.Unlock()
+	mach.sendVerificationMessages(v, messages)
+	mach.notifyVerification(v)
+	return nil
+}
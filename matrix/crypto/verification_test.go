@@ -0,0 +1,184 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestSASDecimalAndEmoji(t *testing.T) {
+	data := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	assert.Equal(t, [3]int{9191, 9191, 9191}, sasDecimal(data))
+	emojis := sasEmoji(data)
+	for _, emoji := range emojis {
+		assert.Equal(t, "Pin", emoji.Name)
+	}
+
+	data = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	assert.Equal(t, [3]int{1000, 1000, 1000}, sasDecimal(data))
+	assert.Equal(t, "Dog", sasEmoji(data)[6].Name)
+
+	// 000001 000010 000011 ...
+	data = []byte{0x04, 0x20, 0xc4, 0x14, 0x61, 0xc0}
+	emojis = sasEmoji(data)
+	for i, emoji := range emojis {
+		assert.Equal(t, sasEmojis[i+1], emoji)
+	}
+}
+
+type roomEventQueue struct {
+	t      *testing.T
+	roomID string
+	events []*mautrix.Event
+}
+
+func (queue *roomEventQueue) sender(userID string) func(string, mautrix.EventType, interface{}, *mautrix.RelatesTo) (string, error) {
+	return func(roomID string, evtType mautrix.EventType, content interface{}, _ *mautrix.RelatesTo) (string, error) {
+		assert.Equal(queue.t, queue.roomID, roomID)
+		data, err := json.Marshal(content)
+		require.NoError(queue.t, err)
+		evt := &mautrix.Event{
+			Sender:    userID,
+			Type:      evtType,
+			RoomID:    roomID,
+			Timestamp: time.Now().Unix() * 1000,
+		}
+		require.NoError(queue.t, json.Unmarshal(data, &evt.Content))
+		queue.events = append(queue.events, evt)
+		return "$event", nil
+	}
+}
+
+func (queue *roomEventQueue) deliver(machines map[string]*OlmMachine) {
+	for len(queue.events) > 0 {
+		evt := queue.events[0]
+		queue.events = queue.events[1:]
+		for userID, mach := range machines {
+			if userID != evt.Sender {
+				mach.HandleRoomVerificationEvent(evt)
+			}
+		}
+	}
+}
+
+func setupVerification(t *testing.T, dir string) (alice, bob *OlmMachine, aliceV, bobV *Verification, queue *roomEventQueue) {
+	const roomID = "!room:example.com"
+	alice = newTestMachine(t, dir, "@alice:example.com", "ALICE")
+	bob = newTestMachine(t, dir, "@bob:example.com", "BOB")
+	require.NoError(t, alice.store.PutDevice(bob.OwnIdentity()))
+	require.NoError(t, alice.store.MarkTracked([]string{"@bob:example.com"}))
+	require.NoError(t, bob.store.PutDevice(alice.OwnIdentity()))
+	require.NoError(t, bob.store.MarkTracked([]string{"@alice:example.com"}))
+
+	queue = &roomEventQueue{t: t, roomID: roomID}
+	alice.SendRoomEvent = queue.sender("@alice:example.com")
+	bob.SendRoomEvent = queue.sender("@bob:example.com")
+
+	aliceV = &Verification{
+		TransactionID: "$request",
+		RoomID:        roomID,
+		OtherUserID:   "@bob:example.com",
+		state:         VerificationStateRequested,
+	}
+	alice.addVerification(aliceV)
+	bob.VerificationHandler = func(v *Verification) {
+		bobV = v
+	}
+	request := toEvent(t, "@alice:example.com", roomID, "$request", &verificationContent{
+		MsgType:    MsgVerificationRequest,
+		Body:       "Alice is requesting to verify your key",
+		To:         "@bob:example.com",
+		FromDevice: "ALICE",
+		Methods:    []string{VerificationMethodSAS},
+	})
+	request.Type = mautrix.EventMessage
+	request.Timestamp = time.Now().Unix() * 1000
+	bob.HandleRoomVerificationEvent(request)
+	require.NotNil(t, bobV)
+	assert.Equal(t, VerificationStateRequested, bobV.State())
+	assert.True(t, bobV.Incoming)
+
+	machines := map[string]*OlmMachine{"@alice:example.com": alice, "@bob:example.com": bob}
+	require.NoError(t, bob.AcceptVerification(bobV))
+	queue.deliver(machines)
+	require.Equal(t, VerificationStateKeysExchanged, aliceV.State())
+	require.Equal(t, VerificationStateKeysExchanged, bobV.State())
+	return
+}
+
+func TestVerification_InRoomSAS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomuks-crypto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	alice, bob, aliceV, bobV, queue := setupVerification(t, dir)
+	machines := map[string]*OlmMachine{"@alice:example.com": alice, "@bob:example.com": bob}
+
+	aliceDecimal, ok := aliceV.Decimal()
+	require.True(t, ok)
+	bobDecimal, ok := bobV.Decimal()
+	require.True(t, ok)
+	assert.Equal(t, aliceDecimal, bobDecimal)
+	aliceEmoji, ok := aliceV.Emoji()
+	require.True(t, ok)
+	bobEmoji, ok := bobV.Emoji()
+	require.True(t, ok)
+	assert.Equal(t, aliceEmoji, bobEmoji)
+
+	aliceIdentity, bobIdentity := alice.OwnIdentity(), bob.OwnIdentity()
+	assert.False(t, alice.IsDeviceVerified(bobIdentity.UserID, bobIdentity.DeviceID, bobIdentity.IdentityKey))
+
+	require.NoError(t, alice.ConfirmVerification(aliceV, true))
+	queue.deliver(machines)
+	assert.Equal(t, VerificationStateConfirmed, aliceV.State())
+	assert.Equal(t, VerificationStateKeysExchanged, bobV.State())
+
+	require.NoError(t, bob.ConfirmVerification(bobV, true))
+	queue.deliver(machines)
+	assert.Equal(t, VerificationStateDone, aliceV.State())
+	assert.Equal(t, VerificationStateDone, bobV.State())
+	assert.True(t, alice.IsDeviceVerified(bobIdentity.UserID, bobIdentity.DeviceID, bobIdentity.IdentityKey))
+	assert.True(t, bob.IsDeviceVerified(aliceIdentity.UserID, aliceIdentity.DeviceID, aliceIdentity.IdentityKey))
+	assert.False(t, bob.IsDeviceVerified(aliceIdentity.UserID, aliceIdentity.DeviceID, bobIdentity.IdentityKey))
+}
+
+func TestVerification_MismatchedSAS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomuks-crypto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	alice, bob, aliceV, bobV, queue := setupVerification(t, dir)
+	machines := map[string]*OlmMachine{"@alice:example.com": alice, "@bob:example.com": bob}
+
+	require.NoError(t, alice.ConfirmVerification(aliceV, true))
+	require.NoError(t, bob.ConfirmVerification(bobV, false))
+	queue.deliver(machines)
+	assert.Equal(t, VerificationStateCancelled, aliceV.State())
+	assert.Equal(t, VerificationStateCancelled, bobV.State())
+	assert.Equal(t, ErrVerificationNotActive, alice.ConfirmVerification(aliceV, true))
+
+	aliceIdentity, bobIdentity := alice.OwnIdentity(), bob.OwnIdentity()
+	assert.False(t, alice.IsDeviceVerified(bobIdentity.UserID, bobIdentity.DeviceID, bobIdentity.IdentityKey))
+	assert.False(t, bob.IsDeviceVerified(aliceIdentity.UserID, aliceIdentity.DeviceID, aliceIdentity.IdentityKey))
+}
@@ -0,0 +1,73 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"net/url"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/interface"
+)
+
+// publicRoomsPageSize is the number of rooms fetched per page of the public room directory.
+const publicRoomsPageSize = 30
+
+type reqPublicRooms struct {
+	Limit  int                `json:"limit,omitempty"`
+	Since  string             `json:"since,omitempty"`
+	Filter *publicRoomsFilter `json:"filter,omitempty"`
+}
+
+type publicRoomsFilter struct {
+	GenericSearchTerm string `json:"generic_search_term,omitempty"`
+}
+
+// GetPublicRooms fetches a page of the public room directory of the given server.
+// If the server is empty, the directory of our own homeserver is used.
+// The since token is the NextBatch of the previous page, or empty to get the first page.
+func (c *Container) GetPublicRooms(server, search, since string) (*ifc.PublicRoomsPage, error) {
+	u, _ := url.Parse(c.client.BuildURL("publicRooms"))
+	if len(server) > 0 {
+		query := u.Query()
+		query.Set("server", server)
+		u.RawQuery = query.Encode()
+	}
+	req := &reqPublicRooms{
+		Limit: publicRoomsPageSize,
+		Since: since,
+	}
+	if len(search) > 0 {
+		req.Filter = &publicRoomsFilter{GenericSearchTerm: search}
+	}
+	var resp ifc.PublicRoomsPage
+	_, err := c.client.MakeRequest("POST", u.String(), req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// PreviewRoom fetches the latest events in a room that hasn't been joined.
+// This only works for rooms whose history is world-readable.
+func (c *Container) PreviewRoom(roomID string, limit int) ([]*mautrix.Event, error) {
+	resp, err := c.client.Messages(roomID, "", "", 'b', limit)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Chunk, nil
+}
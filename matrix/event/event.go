@@ -37,6 +37,15 @@ func Wrap(event *mautrix.Event) *Event {
 	return &Event{Event: event}
 }
 
+// TypeGap is the type of the markers stored in the history where events are missing because a sync was limited.
+// Gap markers are never sent to the server.
+var TypeGap = mautrix.EventType{Type: "net.maunium.gomuks.gap", Class: mautrix.MessageEventType}
+
+// IsGap returns whether the event is a gap marker rather than a real event.
+func (evt *Event) IsGap() bool {
+	return evt.Type == TypeGap
+}
+
 type OutgoingState int
 
 const (
@@ -45,7 +54,43 @@ const (
 	StateSendFail
 )
 
+// EncryptionInfo contains info about the encryption of an event that was decrypted locally.
+type EncryptionInfo struct {
+	Algorithm    string
+	SenderKey    string
+	SenderDevice string
+	SessionID    string
+}
+
+// ThreadInfo contains the replies to an event that started a thread.
+type ThreadInfo struct {
+	Replies      []string
+	LatestSender string
+}
+
+// AddReply adds the given event to the thread if it isn't there already.
+func (thread *ThreadInfo) AddReply(evt *Event) bool {
+	for _, eventID := range thread.Replies {
+		if eventID == evt.ID {
+			return false
+		}
+	}
+	thread.Replies = append(thread.Replies, evt.ID)
+	thread.LatestSender = evt.Sender
+	return true
+}
+
 type GomuksContent struct {
 	OutgoingState OutgoingState
 	Edits         []*Event
+	// Thread is set for events that have replies in a thread.
+	Thread *ThreadInfo
+
+	// Encryption is set for events that were successfully decrypted.
+	Encryption *EncryptionInfo
+	// DecryptionError is set for encrypted events that couldn't be decrypted.
+	DecryptionError string
+
+	// Gap is the pagination token for fetching the missing events of a gap marker.
+	Gap string
 }
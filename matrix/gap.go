@@ -0,0 +1,180 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// When a sync is limited, a gap marker is appended to the room stream before the new events. The marker is placed
+// gapReserve keys after the previous event, which leaves space for inserting the missing events below the marker
+// when they're backfilled.
+const gapReserve = 1 << 32
+
+// gapFillLimit is the number of events requested per page when filling a gap.
+const gapFillLimit = 50
+
+// AddGap appends a gap marker with the given pagination token to the history of the room. Nothing is added if the
+// room has no stored history, as there is nothing to have a gap with. The timestamp should be the timestamp of the
+// first event after the gap.
+func (hm *HistoryManager) AddGap(room *rooms.Room, prevBatch string, timestamp int64) (gap *event.Event, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.update(func(tx *bolt.Tx) error {
+		rid := []byte(room.ID)
+		stream := tx.Bucket(bucketRoomStreams).Bucket(rid)
+		eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket(rid)
+		if stream == nil || eventIDs == nil {
+			return nil
+		} else if k, _ := stream.Cursor().Last(); k == nil {
+			return nil
+		}
+		key := stream.Sequence() + gapReserve
+		gap = &event.Event{
+			Event: &mautrix.Event{
+				ID:        fmt.Sprintf("%s.%d", event.TypeGap.Type, key),
+				Type:      event.TypeGap,
+				RoomID:    room.ID,
+				Timestamp: timestamp,
+			},
+			Gomuks: event.GomuksContent{Gap: prevBatch},
+		}
+		if err := put(stream, eventIDs, gap, key); err != nil {
+			return err
+		}
+		return stream.SetSequence(key)
+	})
+	return
+}
+
+// FillGap stores events that were fetched for the gap marker with the given ID. The events must be in reverse
+// chronological order, starting right before the marker. They're inserted before the marker, which is then moved
+// before them with the given pagination token to continue filling the gap from.
+//
+// The gap is closed and the marker removed when the events reach already stored history, or when there are no
+// more events. The stored events are returned along with the moved gap marker, or nil if the gap was closed.
+func (hm *HistoryManager) FillGap(room *rooms.Room, gapID string, events []*event.Event, nextBatch string) (stored []*event.Event, gap *event.Event, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.update(func(tx *bolt.Tx) error {
+		stream, gapKey, err := hm.getStreamIndex(tx, []byte(room.ID), []byte(gapID))
+		if err != nil {
+			return err
+		}
+		// Copy the key, as it's only valid until the bucket is modified.
+		gapKey = append([]byte(nil), gapKey...)
+		eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket([]byte(room.ID))
+		searchIndex := tx.Bucket(bucketSearchIndex)
+		gap, err = hm.getEvent(tx, stream, gapKey)
+		if err != nil {
+			return err
+		}
+
+		c := stream.Cursor()
+		c.Seek(gapKey)
+		var lowerKey uint64
+		if k, _ := c.Prev(); k != nil {
+			lowerKey = btoi(k)
+		}
+		key := btoi(gapKey) - 1
+		closed := len(events) == 0 || len(nextBatch) == 0
+		for _, evt := range events {
+			if eventIDs.Get([]byte(evt.ID)) != nil {
+				// The rest of the events are already in the history.
+				closed = true
+				break
+			} else if key <= lowerKey {
+				debug.Printf("Ran out of space for filling gap %s in %s", gapID, room.ID)
+				closed = true
+				break
+			}
+			if err = put(stream, eventIDs, evt, key); err != nil {
+				return err
+			} else if err = indexEvent(searchIndex, evt); err != nil {
+				return err
+			}
+			stored = append(stored, evt)
+			key--
+		}
+		if key <= lowerKey {
+			closed = true
+		}
+
+		if err = stream.Delete(gapKey); err != nil {
+			return err
+		} else if closed {
+			gap = nil
+			return eventIDs.Delete([]byte(gapID))
+		}
+		gap.Gomuks.Gap = nextBatch
+		if len(stored) > 0 {
+			gap.Timestamp = stored[len(stored)-1].Timestamp
+		}
+		return put(stream, eventIDs, gap, key)
+	})
+	return
+}
+
+// HandleTimelineGap is called by the syncer when the timeline of a room in a sync response is limited, before the
+// events of the timeline are handled. It records a gap marker in the history of the room and shows it in the UI.
+func (c *Container) HandleTimelineGap(room *rooms.Room, prevBatch string, timestamp int64) {
+	if !c.config.AuthCache.InitialSyncDone || len(prevBatch) == 0 {
+		return
+	}
+	gap, err := c.history.AddGap(room, prevBatch, timestamp)
+	if err != nil {
+		debug.Printf("Failed to add gap marker to %s: %v", room.ID, err)
+		return
+	} else if gap == nil || !room.Loaded() {
+		return
+	}
+	debug.Printf("Added gap marker %s to %s", gap.ID, room.ID)
+	if roomView := c.ui.MainView(c).GetRoom(room.ID); roomView != nil {
+		roomView.AddEvent(gap)
+	}
+}
+
+// FillGap fetches the newest events that are missing at the given gap marker and stores them in the history.
+// The fetched events are returned in reverse chronological order, along with the updated gap marker, which is nil
+// if the gap was closed.
+func (c *Container) FillGap(room *rooms.Room, gap *event.Event) ([]*event.Event, *event.Event, error) {
+	resp, err := c.client.Messages(room.ID, gap.Gomuks.Gap, "", 'b', gapFillLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	debug.Printf("Loaded %d events for gap %s in %s from %s to %s", len(resp.Chunk), gap.ID, room.ID, resp.Start, resp.End)
+	for _, evt := range resp.State {
+		room.UpdateState(evt)
+	}
+	events := make([]*event.Event, len(resp.Chunk))
+	for i, evt := range resp.Chunk {
+		events[i] = c.decryptEvent(evt)
+	}
+	nextBatch := resp.End
+	if nextBatch == resp.Start {
+		nextBatch = ""
+	}
+	return c.history.FillGap(room, gap.ID, events, nextBatch)
+}
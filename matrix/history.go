@@ -28,38 +28,61 @@ import (
 
 	"maunium.net/go/gomuks/matrix/event"
 	"maunium.net/go/gomuks/matrix/rooms"
-	"maunium.net/go/mautrix"
 )
 
 type HistoryManager struct {
 	sync.Mutex
 
 	db *bolt.DB
+	// dbLock is held for writing while the database file is replaced by CompactDB, and for reading otherwise.
+	dbLock sync.RWMutex
 
 	historyEndPtr  map[*rooms.Room]uint64
 	historyLoadPtr map[*rooms.Room]uint64
+
+	// cleared is set if the stored history was removed when opening the database, because it was in an old format.
+	cleared bool
 }
 
 var bucketRoomStreams = []byte("room_streams")
 var bucketRoomEventIDs = []byte("room_event_ids")
 var bucketStreamPointers = []byte("room_stream_pointers")
+var bucketOutbox = []byte("outbox")
+var bucketOutboxTxnIDs = []byte("outbox_txn_ids")
+var bucketMeta = []byte("meta")
+
+var keyVersion = []byte("version")
 
 const halfUint64 = ^uint64(0) >> 1
 
+// historyVersion is the version of the layout of the room streams. Version 1 changed the keys of prepended events
+// to count down from halfUint64 - 1. Older streams can't be converted, as the old keys of prepended events wrapped
+// around and collided with each other, so they're cleared instead.
+const historyVersion = 1
+
 func NewHistoryManager(dbPath string) (*HistoryManager, error) {
 	hm := &HistoryManager{
 		historyEndPtr:  make(map[*rooms.Room]uint64),
 		historyLoadPtr: make(map[*rooms.Room]uint64),
 	}
-	db, err := bolt.Open(dbPath, 0600, &bolt.Options{
-		Timeout:      1,
-		NoGrowSync:   false,
-		FreelistType: bolt.FreelistArrayType,
-	})
+	db, err := openHistoryDB(dbPath)
 	if err != nil {
 		return nil, err
 	}
+	var buildSearchIndex bool
 	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		if version := meta.Get(keyVersion); version == nil || btoi(version) < historyVersion {
+			hm.cleared, err = clearRoomStreams(tx)
+			if err != nil {
+				return err
+			} else if err = meta.Put(keyVersion, itob(historyVersion)); err != nil {
+				return err
+			}
+		}
 		_, err = tx.CreateBucketIfNotExists(bucketRoomStreams)
 		if err != nil {
 			return err
@@ -72,19 +95,78 @@ func NewHistoryManager(dbPath string) (*HistoryManager, error) {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(bucketOutbox)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucketOutboxTxnIDs)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(bucketSearchIndex) == nil {
+			buildSearchIndex = true
+			_, err = tx.CreateBucket(bucketSearchIndex)
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 	hm.db = db
+	if buildSearchIndex {
+		go hm.indexExisting()
+	}
 	return hm, nil
 }
 
+// clearRoomStreams removes the stored history of all rooms along with the search index. The outbox is kept, so that
+// unsent messages aren't lost. It returns whether there was any history to remove.
+func clearRoomStreams(tx *bolt.Tx) (bool, error) {
+	streams := tx.Bucket(bucketRoomStreams)
+	if streams == nil {
+		return false, nil
+	} else if k, _ := streams.Cursor().First(); k == nil {
+		return false, nil
+	}
+	for _, name := range [][]byte{bucketRoomStreams, bucketRoomEventIDs, bucketStreamPointers, bucketSearchIndex} {
+		if tx.Bucket(name) == nil {
+			continue
+		} else if err := tx.DeleteBucket(name); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func openHistoryDB(dbPath string) (*bolt.DB, error) {
+	return bolt.Open(dbPath, 0600, &bolt.Options{
+		Timeout:      1,
+		NoGrowSync:   false,
+		FreelistType: bolt.FreelistArrayType,
+	})
+}
+
 func (hm *HistoryManager) Close() error {
+	hm.dbLock.Lock()
+	defer hm.dbLock.Unlock()
 	return hm.db.Close()
 }
 
+func (hm *HistoryManager) view(fn func(tx *bolt.Tx) error) error {
+	hm.dbLock.RLock()
+	defer hm.dbLock.RUnlock()
+	return hm.db.View(fn)
+}
+
+func (hm *HistoryManager) update(fn func(tx *bolt.Tx) error) error {
+	hm.dbLock.RLock()
+	defer hm.dbLock.RUnlock()
+	return hm.db.Update(fn)
+}
+
 var (
 	EventNotFoundError = errors.New("event not found")
 	RoomNotFoundError = errors.New("room not found")
@@ -112,7 +194,7 @@ func (hm *HistoryManager) getEvent(tx *bolt.Tx, stream *bolt.Bucket, index []byt
 }
 
 func (hm *HistoryManager) Get(room *rooms.Room, eventID string) (evt *event.Event, err error) {
-	err = hm.db.View(func(tx *bolt.Tx) error {
+	err = hm.view(func(tx *bolt.Tx) error {
 		if stream, index, err := hm.getStreamIndex(tx, []byte(room.ID), []byte(eventID)); err != nil {
 			return err
 		} else if evt, err = hm.getEvent(tx, stream, index); err != nil {
@@ -123,37 +205,90 @@ func (hm *HistoryManager) Get(room *rooms.Room, eventID string) (evt *event.Even
 	return
 }
 
+// Update calls the given function for the stored event with the given ID and stores the modified event. The event is
+// also reindexed for search, as updating may change the searchable text, e.g. when an event is decrypted.
 func (hm *HistoryManager) Update(room *rooms.Room, eventID string, update func(evt *event.Event) error) error {
-	return hm.db.Update(func(tx *bolt.Tx) error {
+	return hm.update(func(tx *bolt.Tx) error {
+		searchIndex := tx.Bucket(bucketSearchIndex)
 		if stream, index, err := hm.getStreamIndex(tx, []byte(room.ID), []byte(eventID)); err != nil {
 			return err
 		} else if evt, err := hm.getEvent(tx, stream, index); err != nil {
 			return err
+		} else if err = unindexEvent(searchIndex, evt); err != nil {
+			return err
 		} else if err = update(evt); err != nil {
 			return err
 		} else if eventData, err := marshalEvent(evt); err != nil {
 			return err
 		} else if err := stream.Put(index, eventData); err != nil {
 			return err
+		} else if err = indexEvent(searchIndex, evt); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// UpdateAll calls the given function for every stored event in the room. If the function returns a non-nil event,
+// it replaces the stored event and is reindexed for search. The replaced events are returned.
+func (hm *HistoryManager) UpdateAll(room *rooms.Room, update func(evt *event.Event) *event.Event) (updated []*event.Event, err error) {
+	err = hm.update(func(tx *bolt.Tx) error {
+		stream := tx.Bucket(bucketRoomStreams).Bucket([]byte(room.ID))
+		if stream == nil {
+			return nil
+		}
+		var keys [][]byte
+		err := stream.ForEach(func(k, v []byte) error {
+			if len(v) == 0 {
+				return nil
+			}
+			evt, err := unmarshalEvent(v)
+			if err != nil {
+				return err
+			}
+			if newEvt := update(evt); newEvt != nil {
+				keys = append(keys, append([]byte(nil), k...))
+				updated = append(updated, newEvt)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// The bucket can't be modified while iterating it, so the replaced events are stored afterwards.
+		searchIndex := tx.Bucket(bucketSearchIndex)
+		for i, evt := range updated {
+			if oldEvt, err := unmarshalEvent(stream.Get(keys[i])); err != nil {
+				return err
+			} else if err = unindexEvent(searchIndex, oldEvt); err != nil {
+				return err
+			} else if eventData, err := marshalEvent(evt); err != nil {
+				return err
+			} else if err = stream.Put(keys[i], eventData); err != nil {
+				return err
+			} else if err = indexEvent(searchIndex, evt); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
+	return
 }
 
-func (hm *HistoryManager) Append(room *rooms.Room, events []*mautrix.Event) ([]*event.Event, error) {
+func (hm *HistoryManager) Append(room *rooms.Room, events []*event.Event) ([]*event.Event, error) {
 	return hm.store(room, events, true)
 }
 
-func (hm *HistoryManager) Prepend(room *rooms.Room, events []*mautrix.Event) ([]*event.Event, error) {
+func (hm *HistoryManager) Prepend(room *rooms.Room, events []*event.Event) ([]*event.Event, error) {
 	return hm.store(room, events, false)
 }
 
-func (hm *HistoryManager) store(room *rooms.Room, events []*mautrix.Event, append bool) ([]*event.Event, error) {
+func (hm *HistoryManager) store(room *rooms.Room, events []*event.Event, append bool) ([]*event.Event, error) {
 	hm.Lock()
 	defer hm.Unlock()
-	newEvents := make([]*event.Event, len(events))
-	err := hm.db.Update(func(tx *bolt.Tx) error {
+	err := hm.update(func(tx *bolt.Tx) error {
 		streamPointers := tx.Bucket(bucketStreamPointers)
+		searchIndex := tx.Bucket(bucketSearchIndex)
 		rid := []byte(room.ID)
 		stream, err := tx.Bucket(bucketRoomStreams).CreateBucketIfNotExists(rid)
 		if err != nil {
@@ -177,8 +312,9 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*mautrix.Event, appen
 				return err
 			}
 			for i, evt := range events {
-				newEvents[i] = event.Wrap(evt)
-				if err := put(stream, eventIDs, newEvents[i], ptrStart+uint64(i)); err != nil {
+				if err := put(stream, eventIDs, evt, ptrStart+uint64(i)); err != nil {
+					return err
+				} else if err = indexEvent(searchIndex, evt); err != nil {
 					return err
 				}
 			}
@@ -197,9 +333,12 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*mautrix.Event, appen
 				}
 			}
 			eventCount := uint64(len(events))
+			// The pointer counts up from halfUint64 - 1 as events are prepended, while the keys count down from it.
+			keyStart := 2*(halfUint64-1) - ptrStart
 			for i, evt := range events {
-				newEvents[i] = event.Wrap(evt)
-				if err := put(stream, eventIDs, newEvents[i], -ptrStart-uint64(i)); err != nil {
+				if err := put(stream, eventIDs, evt, keyStart-uint64(i)); err != nil {
+					return err
+				} else if err = indexEvent(searchIndex, evt); err != nil {
 					return err
 				}
 			}
@@ -212,30 +351,71 @@ func (hm *HistoryManager) store(room *rooms.Room, events []*mautrix.Event, appen
 
 		return nil
 	})
-	return newEvents, err
+	return events, err
 }
 
 func (hm *HistoryManager) Load(room *rooms.Room, num int) (events []*event.Event, err error) {
 	hm.Lock()
 	defer hm.Unlock()
-	err = hm.db.View(func(tx *bolt.Tx) error {
+	err = hm.view(func(tx *bolt.Tx) error {
 		rid := []byte(room.ID)
 		stream := tx.Bucket(bucketRoomStreams).Bucket(rid)
 		if stream == nil {
 			return nil
 		}
-		ptrStart, ok := hm.historyLoadPtr[room]
-		if !ok {
-			ptrStart = stream.Sequence() + 1
-		}
+		// The load pointer is the key of the oldest loaded event. The keys aren't necessarily contiguous, as space is
+		// reserved for the missing events before gap markers, so the stream is walked backwards with a cursor.
 		c := stream.Cursor()
-		k, v := c.Seek(itob(ptrStart - uint64(num)))
-		ptrStartFound := btoi(k)
-		if k == nil || ptrStartFound >= ptrStart {
+		var k, v []byte
+		if ptrStart, ok := hm.historyLoadPtr[room]; !ok {
+			k, v = c.Last()
+		} else if k, _ = c.Seek(itob(ptrStart)); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && len(events) < num; k, v = c.Prev() {
+			hm.historyLoadPtr[room] = btoi(k)
+			if len(v) == 0 {
+				continue
+			}
+			evt, parseError := unmarshalEvent(v)
+			if parseError != nil {
+				return parseError
+			}
+			events = append(events, evt)
+		}
+		return nil
+	})
+	return
+}
+
+// LoadBefore returns up to num events that are older than the event with the given ID, newest first. If the ID is
+// empty, the newest events of the room are returned. Unlike Load, this doesn't move the load pointer of the room, so
+// it can be used to walk the history independently of the message view.
+func (hm *HistoryManager) LoadBefore(room *rooms.Room, eventID string, num int) (events []*event.Event, err error) {
+	err = hm.view(func(tx *bolt.Tx) error {
+		rid := []byte(room.ID)
+		stream := tx.Bucket(bucketRoomStreams).Bucket(rid)
+		if stream == nil {
 			return nil
 		}
-		hm.historyLoadPtr[room] = ptrStartFound - 1
-		for ; k != nil && btoi(k) < ptrStart; k, v = c.Next() {
+		c := stream.Cursor()
+		var k, v []byte
+		if len(eventID) == 0 {
+			k, v = c.Last()
+		} else {
+			_, index, err := hm.getStreamIndex(tx, rid, []byte(eventID))
+			if err != nil {
+				return err
+			}
+			c.Seek(index)
+			k, v = c.Prev()
+		}
+		for ; k != nil && len(events) < num; k, v = c.Prev() {
+			if len(v) == 0 {
+				continue
+			}
 			evt, parseError := unmarshalEvent(v)
 			if parseError != nil {
 				return parseError
@@ -244,14 +424,81 @@ func (hm *HistoryManager) Load(room *rooms.Room, num int) (events []*event.Event
 		}
 		return nil
 	})
-	// Reverse array because we read/append the history in reverse order.
-	i := 0
-	j := len(events) - 1
-	for i < j {
-		events[i], events[j] = events[j], events[i]
-		i++
-		j--
-	}
+	return
+}
+
+// AddOutgoing adds an event to the end of the outbox. The event is identified by its transaction ID.
+func (hm *HistoryManager) AddOutgoing(evt *event.Event) error {
+	return hm.update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(bucketOutbox)
+		key, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+		eventData, err := marshalEvent(evt)
+		if err != nil {
+			return err
+		} else if err = outbox.Put(itob(key), eventData); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketOutboxTxnIDs).Put([]byte(evt.Unsigned.TransactionID), itob(key))
+	})
+}
+
+// UpdateOutgoing replaces an event in the outbox without changing its position.
+func (hm *HistoryManager) UpdateOutgoing(evt *event.Event) error {
+	return hm.update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketOutboxTxnIDs).Get([]byte(evt.Unsigned.TransactionID))
+		if key == nil {
+			return EventNotFoundError
+		}
+		eventData, err := marshalEvent(evt)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketOutbox).Put(key, eventData)
+	})
+}
+
+// GetOutgoingByTxnID gets the event with the given transaction ID from the outbox.
+func (hm *HistoryManager) GetOutgoingByTxnID(txnID string) (evt *event.Event, err error) {
+	err = hm.view(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketOutboxTxnIDs).Get([]byte(txnID))
+		if key == nil {
+			return EventNotFoundError
+		}
+		evt, err = hm.getEvent(tx, tx.Bucket(bucketOutbox), key)
+		return err
+	})
+	return
+}
+
+// RemoveOutgoing removes the event with the given transaction ID from the outbox.
+func (hm *HistoryManager) RemoveOutgoing(txnID string) error {
+	return hm.update(func(tx *bolt.Tx) error {
+		txnIDs := tx.Bucket(bucketOutboxTxnIDs)
+		key := txnIDs.Get([]byte(txnID))
+		if key == nil {
+			return EventNotFoundError
+		} else if err := tx.Bucket(bucketOutbox).Delete(key); err != nil {
+			return err
+		}
+		return txnIDs.Delete([]byte(txnID))
+	})
+}
+
+// GetOutgoing returns all the events in the outbox in the order they were added.
+func (hm *HistoryManager) GetOutgoing() (events []*event.Event, err error) {
+	err = hm.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOutbox).ForEach(func(k, v []byte) error {
+			evt, err := unmarshalEvent(v)
+			if err != nil {
+				return err
+			}
+			events = append(events, evt)
+			return nil
+		})
+	})
 	return
 }
 
@@ -0,0 +1,372 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+func newHistoryTestEvent(id string, timestamp int64) *event.Event {
+	return event.Wrap(&mautrix.Event{
+		ID:        id,
+		Type:      mautrix.EventMessage,
+		RoomID:    "!foo:maunium.net",
+		Sender:    "@tulir:maunium.net",
+		Timestamp: timestamp,
+		Content: mautrix.Content{
+			MsgType: mautrix.MsgText,
+			Body:    "message " + id,
+		},
+	})
+}
+
+func eventIDs(events []*event.Event) []string {
+	ids := make([]string, len(events))
+	for i, evt := range events {
+		ids[i] = evt.ID
+	}
+	return ids
+}
+
+func TestHistoryManager_Append(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-1")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-1", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-1/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$a", 1000), newHistoryTestEvent("$b", 1000)})
+	assert.Nil(t, err)
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$c", 1000)})
+	assert.Nil(t, err)
+
+	events, err := hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$c", "$b", "$a"}, eventIDs(events))
+	evt, err := hm.Get(room, "$b")
+	assert.Nil(t, err)
+	assert.Equal(t, "message $b", evt.Content.Body)
+	_, err = hm.Get(room, "$d")
+	assert.Equal(t, EventNotFoundError, err)
+}
+
+func TestHistoryManager_Prepend(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-2")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-2", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-2/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$c", 1000), newHistoryTestEvent("$d", 1000)})
+	assert.Nil(t, err)
+	// Prepended events are in reverse chronological order, like back-paginated events from the server.
+	_, err = hm.Prepend(room, []*event.Event{newHistoryTestEvent("$b", 1000), newHistoryTestEvent("$a", 1000)})
+	assert.Nil(t, err)
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$e", 1000)})
+	assert.Nil(t, err)
+	_, err = hm.Prepend(room, []*event.Event{newHistoryTestEvent("$0", 1000)})
+	assert.Nil(t, err)
+
+	events, err := hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$e", "$d", "$c", "$b", "$a", "$0"}, eventIDs(events))
+}
+
+func TestHistoryManager_Load_Paging(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-3")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-3", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-3/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+
+	_, err = hm.Append(room, []*event.Event{
+		newHistoryTestEvent("$a", 1000), newHistoryTestEvent("$b", 1000), newHistoryTestEvent("$c", 1000),
+	})
+	assert.Nil(t, err)
+	gap, err := hm.AddGap(room, "prev_batch", 2000)
+	assert.Nil(t, err)
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$x", 2000), newHistoryTestEvent("$y", 2000)})
+	assert.Nil(t, err)
+
+	// The keys below the gap marker are reserved for the missing events, which mustn't affect paging.
+	events, err := hm.Load(room, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$y", "$x"}, eventIDs(events))
+	events, err = hm.Load(room, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{gap.ID, "$c"}, eventIDs(events))
+	events, err = hm.Load(room, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$b", "$a"}, eventIDs(events))
+	events, err = hm.Load(room, 2)
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+}
+
+func TestHistoryManager_LoadBefore(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-12")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-12", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-12/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	_, err = hm.Append(room, []*event.Event{
+		newHistoryTestEvent("$a", 1000), newHistoryTestEvent("$b", 1000), newHistoryTestEvent("$c", 1000),
+	})
+	assert.Nil(t, err)
+
+	events, err := hm.LoadBefore(room, "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$c", "$b"}, eventIDs(events))
+	events, err = hm.LoadBefore(room, "$b", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$a"}, eventIDs(events))
+	_, err = hm.LoadBefore(room, "$d", 2)
+	assert.Equal(t, EventNotFoundError, err)
+
+	// LoadBefore doesn't move the pointer used by Load.
+	events, err = hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$c", "$b", "$a"}, eventIDs(events))
+}
+
+func TestHistoryManager_AddGap_EmptyRoom(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-4")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-4", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-4/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+
+	gap, err := hm.AddGap(&rooms.Room{ID: "!foo:maunium.net"}, "prev_batch", 1000)
+	assert.Nil(t, err)
+	assert.Nil(t, gap)
+}
+
+func TestHistoryManager_FillGap(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-5")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-5", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-5/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$a", 1000), newHistoryTestEvent("$b", 1000)})
+	assert.Nil(t, err)
+	gap, err := hm.AddGap(room, "batch1", 3000)
+	assert.Nil(t, err)
+	assert.True(t, gap.IsGap())
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$y", 3000), newHistoryTestEvent("$z", 3000)})
+	assert.Nil(t, err)
+
+	// The first page doesn't reach the stored history, so the marker is moved below the new events.
+	stored, newGap, err := hm.FillGap(room, gap.ID,
+		[]*event.Event{newHistoryTestEvent("$e", 2000), newHistoryTestEvent("$d", 2000)}, "batch2")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$e", "$d"}, eventIDs(stored))
+	assert.Equal(t, gap.ID, newGap.ID)
+	assert.Equal(t, "batch2", newGap.Gomuks.Gap)
+	events, err := hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$z", "$y", "$e", "$d", gap.ID, "$b", "$a"}, eventIDs(events))
+
+	// The second page overlaps with the stored history, which closes the gap.
+	stored, newGap, err = hm.FillGap(room, gap.ID, []*event.Event{
+		newHistoryTestEvent("$c", 2000), newHistoryTestEvent("$b", 1000), newHistoryTestEvent("$a", 1000),
+	}, "batch3")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$c"}, eventIDs(stored))
+	assert.Nil(t, newGap)
+	events, err = hm.LoadBefore(room, "", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$z", "$y", "$e", "$d", "$c", "$b", "$a"}, eventIDs(events))
+	_, err = hm.Get(room, gap.ID)
+	assert.Equal(t, EventNotFoundError, err)
+}
+
+func TestHistoryManager_FillGap_NoMoreEvents(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-6")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-6", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-6/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$a", 1000)})
+	assert.Nil(t, err)
+	gap, err := hm.AddGap(room, "batch1", 3000)
+	assert.Nil(t, err)
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$z", 3000)})
+	assert.Nil(t, err)
+
+	stored, newGap, err := hm.FillGap(room, gap.ID, []*event.Event{newHistoryTestEvent("$b", 2000)}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$b"}, eventIDs(stored))
+	assert.Nil(t, newGap)
+	events, err := hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$z", "$b", "$a"}, eventIDs(events))
+}
+
+func TestHistoryManager_Prune_MaxEvents(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-7")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-7", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-7/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	_, err = hm.Append(room, []*event.Event{
+		newHistoryTestEvent("$a", now), newHistoryTestEvent("$b", now), newHistoryTestEvent("$c", now),
+	})
+	assert.Nil(t, err)
+
+	pruned, newestPruned, err := hm.Prune(room, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	assert.Equal(t, "$b", newestPruned)
+	events, err := hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$c"}, eventIDs(events))
+	_, err = hm.Get(room, "$a")
+	assert.Equal(t, EventNotFoundError, err)
+}
+
+func TestHistoryManager_Prune_MaxAge(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-8")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-8", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-8/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	old := now - int64(48*time.Hour/time.Millisecond)
+	_, err = hm.Append(room, []*event.Event{
+		newHistoryTestEvent("$a", old), newHistoryTestEvent("$b", old), newHistoryTestEvent("$c", now),
+	})
+	assert.Nil(t, err)
+
+	pruned, newestPruned, err := hm.Prune(room, 24*time.Hour, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	assert.Equal(t, "$b", newestPruned)
+	events, err := hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$c"}, eventIDs(events))
+}
+
+func TestHistoryManager_Prune_NoLimits(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-9")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-9", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-9/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$a", 1000), newHistoryTestEvent("$b", 1000)})
+	assert.Nil(t, err)
+
+	pruned, newestPruned, err := hm.Prune(room, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+	assert.Empty(t, newestPruned)
+	events, err := hm.Load(room, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$b", "$a"}, eventIDs(events))
+}
+
+func TestHistoryManager_Prune_Gap(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-10")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-10", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-10/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$a", now)})
+	assert.Nil(t, err)
+	gap, err := hm.AddGap(room, "batch1", now)
+	assert.Nil(t, err)
+	_, err = hm.Append(room, []*event.Event{newHistoryTestEvent("$b", now)})
+	assert.Nil(t, err)
+
+	pruned, newestPruned, err := hm.Prune(room, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+	// The gap marker was pruned after $a, but it's not a real event that could be paginated from.
+	assert.Equal(t, "$a", newestPruned)
+	_, err = hm.Get(room, gap.ID)
+	assert.Equal(t, EventNotFoundError, err)
+}
+
+func TestNewHistoryManager_ClearsOldLayout(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-historytest-11")
+	_ = os.MkdirAll("/tmp/gomuks-historytest-11", 0700)
+	db, err := openHistoryDB("/tmp/gomuks-historytest-11/history.db")
+	assert.Nil(t, err)
+	// A database from before the layout version was stored.
+	err = db.Update(func(tx *bolt.Tx) error {
+		streams, err := tx.CreateBucket(bucketRoomStreams)
+		if err != nil {
+			return err
+		}
+		stream, err := streams.CreateBucket([]byte("!foo:maunium.net"))
+		if err != nil {
+			return err
+		}
+		if err = stream.Put(itob(halfUint64), []byte(`{}`)); err != nil {
+			return err
+		}
+		outbox, err := tx.CreateBucket(bucketOutbox)
+		if err != nil {
+			return err
+		}
+		return outbox.Put(itob(1), []byte(`{}`))
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	hm, err := NewHistoryManager("/tmp/gomuks-historytest-11/history.db")
+	assert.Nil(t, err)
+	assert.True(t, hm.cleared)
+	events, err := hm.Load(&rooms.Room{ID: "!foo:maunium.net"}, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+	err = hm.view(func(tx *bolt.Tx) error {
+		assert.NotNil(t, tx.Bucket(bucketOutbox).Get(itob(1)))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, hm.Close())
+
+	// The version is stored, so the history isn't cleared again.
+	hm, err = NewHistoryManager("/tmp/gomuks-historytest-11/history.db")
+	assert.Nil(t, err)
+	assert.False(t, hm.cleared)
+	assert.Nil(t, hm.Close())
+}
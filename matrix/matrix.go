@@ -17,7 +17,6 @@
 package matrix
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -31,7 +30,9 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	dbg "runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -44,6 +45,7 @@ import (
 	"maunium.net/go/gomuks/config"
 	"maunium.net/go/gomuks/debug"
 	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/crypto"
 	"maunium.net/go/gomuks/matrix/pushrules"
 	"maunium.net/go/gomuks/matrix/rooms"
 )
@@ -58,21 +60,60 @@ type Container struct {
 	ui      ifc.GomuksUI
 	config  *config.Config
 	history *HistoryManager
+	media   *MediaCache
+	chatLog *ChatLogger
+	crypto  *crypto.OlmMachine
+	outbox  *outbox
 	running bool
 	stop    chan bool
 
+	// retentionStop is closed to stop the background history retention pass.
+	retentionStop chan struct{}
+
+	connStatus     ifc.ConnectionStatus
+	connStatusLock sync.RWMutex
+
 	typing int64
+
+	presence     map[string]ifc.UserPresence
+	ownPresence  string
+	statusMsg    string
+	idle         bool
+	presenceLock sync.RWMutex
+
+	// downloadSlots limits the number of concurrent media downloads.
+	downloadSlots chan struct{}
+	// historyLock is held while loading history, so that the message view and history exports don't paginate from
+	// the server concurrently.
+	historyLock sync.Mutex
 }
 
 // NewContainer creates a new Container for the given Gomuks instance.
 func NewContainer(gmx ifc.Gomuks) *Container {
-	c := &Container{
-		config: gmx.Config(),
+	return NewAccountContainer(gmx, gmx.Config())
+}
+
+// NewAccountContainer creates a new Container for an additional account that uses the given config.
+func NewAccountContainer(gmx ifc.Gomuks, cfg *config.Config) *Container {
+	return &Container{
+		config: cfg,
 		ui:     gmx.UI(),
 		gmx:    gmx,
+
+		presence:      make(map[string]ifc.UserPresence),
+		ownPresence:   ifc.PresenceOnline,
+		downloadSlots: make(chan struct{}, maxConcurrentDownloads),
 	}
+}
 
-	return c
+// isMainAccount returns whether this container uses the main config of gomuks.
+func (c *Container) isMainAccount() bool {
+	return c.config == c.gmx.Config()
+}
+
+// Config returns the config of the account of this container.
+func (c *Container) Config() *config.Config {
+	return c.config
 }
 
 // Client returns the underlying mautrix Client.
@@ -80,6 +121,11 @@ func (c *Container) Client() *mautrix.Client {
 	return c.client
 }
 
+// Crypto returns the end-to-end encryption machine, or nil if encryption is not enabled.
+func (c *Container) Crypto() *crypto.OlmMachine {
+	return c.crypto
+}
+
 type mxLogger struct{}
 
 func (log mxLogger) Debugfln(message string, args ...interface{}) {
@@ -114,9 +160,21 @@ func (c *Container) InitClient() error {
 		c.history, err = NewHistoryManager(c.config.HistoryPath)
 		if err != nil {
 			return errors.Wrap(err, "failed to initialize history")
+		} else if c.history.cleared {
+			debug.Print("History database was in an old format and has been cleared")
+			c.resetPagination()
 		}
 	}
 
+	if len(c.config.LogDir) > 0 {
+		c.chatLog = NewChatLogger(c.config.LogDir, c.config.LogFormat)
+	}
+
+	if c.media == nil {
+		c.media = NewMediaCache(c.config.MediaDir, int64(c.config.MediaCacheSize)*1024*1024)
+		c.media.Load()
+	}
+
 	allowInsecure := len(os.Getenv("GOMUKS_ALLOW_INSECURE_CONNECTIONS")) > 0
 	if allowInsecure {
 		c.client.Client = &http.Client{
@@ -132,6 +190,18 @@ func (c *Container) InitClient() error {
 	return nil
 }
 
+// resetPagination makes the next sync start from scratch after the local history has been cleared. The
+// back-pagination tokens of the rooms would otherwise point past the removed events, which would never be loaded again.
+func (c *Container) resetPagination() {
+	c.config.Rooms.Lock()
+	for _, room := range c.config.Rooms.Map {
+		room.PrevBatch = ""
+	}
+	c.config.Rooms.Unlock()
+	c.config.AuthCache.InitialSyncDone = false
+	c.config.SaveNextBatch(c.config.UserID, "")
+}
+
 // Initialized returns whether or not the mautrix client is initialized (see InitClient())
 func (c *Container) Initialized() bool {
 	return c.client != nil
@@ -158,6 +228,7 @@ func (c *Container) finishLogin(resp *mautrix.RespLogin) {
 	c.client.SetCredentials(resp.UserID, resp.AccessToken)
 	c.config.UserID = resp.UserID
 	c.config.AccessToken = resp.AccessToken
+	c.config.DeviceID = resp.DeviceID
 	c.config.Save()
 
 	go c.Start()
@@ -242,12 +313,33 @@ func (c *Container) Login(user, password string) error {
 }
 
 // Logout revokes the access token, stops the syncer and calls the OnLogout() method of the UI.
+// Additional accounts are removed completely after logging out.
 func (c *Container) Logout() {
 	c.client.Logout()
 	c.config.DeleteSession()
 	c.Stop()
 	c.client = nil
-	c.ui.OnLogout()
+	c.ui.OnLogout(c)
+	if !c.isMainAccount() {
+		c.gmx.RemoveAccount(c)
+	}
+}
+
+// ConnectionStatus returns the current state of the connection to the homeserver.
+func (c *Container) ConnectionStatus() ifc.ConnectionStatus {
+	c.connStatusLock.RLock()
+	defer c.connStatusLock.RUnlock()
+	return c.connStatus
+}
+
+func (c *Container) setConnectionStatus(status ifc.ConnectionStatus) {
+	c.connStatusLock.Lock()
+	changed := c.connStatus.State != status.State || !c.connStatus.NextRetry.Equal(status.NextRetry)
+	c.connStatus = status
+	c.connStatusLock.Unlock()
+	if changed {
+		c.ui.Render()
+	}
 }
 
 // Stop stops the Matrix syncer.
@@ -256,12 +348,28 @@ func (c *Container) Stop() {
 		debug.Print("Stopping Matrix container...")
 		c.stop <- true
 		c.client.StopSync()
+		if c.outbox != nil {
+			close(c.outbox.stop)
+			c.outbox = nil
+		}
+		if c.retentionStop != nil {
+			close(c.retentionStop)
+			c.retentionStop = nil
+		}
 		debug.Print("Closing history manager...")
 		err := c.history.Close()
 		if err != nil {
 			debug.Print("Error closing history manager:", err)
 		}
 		c.history = nil
+		if c.crypto != nil {
+			debug.Print("Closing crypto store...")
+			err = c.crypto.Close()
+			if err != nil {
+				debug.Print("Error closing crypto store:", err)
+			}
+			c.crypto = nil
+		}
 	}
 }
 
@@ -300,18 +408,28 @@ func (c *Container) OnLogin() {
 	c.syncer.OnEventType(mautrix.EventEncrypted, c.HandleMessage)
 	c.syncer.OnEventType(mautrix.EventSticker, c.HandleMessage)
 	c.syncer.OnEventType(mautrix.EventReaction, c.HandleMessage)
+	for _, evtType := range []mautrix.EventType{crypto.VerificationReady, crypto.VerificationStart, crypto.VerificationAccept,
+		crypto.VerificationKey, crypto.VerificationMAC, crypto.VerificationDone, crypto.VerificationCancel} {
+		c.syncer.OnEventType(evtType, c.HandleMessage)
+	}
 	c.syncer.OnEventType(mautrix.EventRedaction, c.HandleRedaction)
 	c.syncer.OnEventType(mautrix.StateAliases, c.HandleMessage)
 	c.syncer.OnEventType(mautrix.StateCanonicalAlias, c.HandleMessage)
 	c.syncer.OnEventType(mautrix.StateTopic, c.HandleMessage)
 	c.syncer.OnEventType(mautrix.StateRoomName, c.HandleMessage)
 	c.syncer.OnEventType(mautrix.StateMember, c.HandleMembership)
+	c.syncer.OnEventType(mautrix.StateTombstone, c.HandleTombstone)
+	c.syncer.OnEventType(mautrix.StateCreate, c.HandleSpace)
+	c.syncer.OnEventType(rooms.StateSpaceChild, c.HandleSpace)
+	c.syncer.OnEventType(rooms.StateSpaceParent, c.HandleSpace)
 	c.syncer.OnEventType(mautrix.EphemeralEventReceipt, c.HandleReadReceipt)
 	c.syncer.OnEventType(mautrix.EphemeralEventTyping, c.HandleTyping)
 	c.syncer.OnEventType(mautrix.AccountDataDirectChats, c.HandleDirectChatInfo)
 	c.syncer.OnEventType(mautrix.AccountDataPushRules, c.HandlePushRules)
 	c.syncer.OnEventType(mautrix.AccountDataRoomTags, c.HandleTag)
 	c.syncer.OnEventType(AccountDataGomuksPreferences, c.HandlePreferences)
+	c.syncer.OnEventType(mautrix.EphemeralEventPresence, c.HandlePresence)
+	c.syncer.OnTimelineGap = c.HandleTimelineGap
 	c.syncer.InitDoneCallback = func() {
 		debug.Print("Initial sync done")
 		c.config.AuthCache.InitialSyncDone = true
@@ -324,7 +442,7 @@ func (c *Container) OnLogin() {
 		debug.Print("Saving all data")
 		c.config.SaveAll()
 		debug.Print("Adding rooms to UI")
-		c.ui.MainView().SetRooms(c.config.Rooms)
+		c.ui.MainView(c).SetRooms(c.config.Rooms)
 		c.ui.Render()
 		// The initial sync can be a bit heavy, so we force run the GC here
 		// after cleaning up rooms from memory above.
@@ -335,7 +453,7 @@ func (c *Container) OnLogin() {
 	c.client.Syncer = c.syncer
 
 	debug.Print("Setting existing rooms")
-	c.ui.MainView().SetRooms(c.config.Rooms)
+	c.ui.MainView(c).SetRooms(c.config.Rooms)
 
 	debug.Print("OnLogin() done.")
 }
@@ -350,27 +468,157 @@ func (c *Container) Start() {
 		return
 	}
 
+	if c.crypto == nil {
+		c.initCrypto()
+	}
+
+	c.outbox = newOutbox()
+	go c.runOutbox(c.outbox)
+	// Send events that were left in the outbox when gomuks was last closed.
+	c.outbox.Wake()
+
+	c.retentionStop = make(chan struct{})
+	go c.runRetention(c.history, c.retentionStop)
+
 	debug.Print("Starting sync...")
 	c.running = true
+	c.setConnectionStatus(ifc.ConnectionStatus{State: ifc.ConnectionSyncing})
 	for {
 		select {
 		case <-c.stop:
 			debug.Print("Stopping sync...")
 			c.running = false
+			c.setConnectionStatus(ifc.ConnectionStatus{State: ifc.ConnectionOffline})
 			return
 		default:
-			if err := c.client.Sync(); err != nil {
+			if err := c.sync(); err != nil {
 				if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.Code == http.StatusUnauthorized {
 					debug.Print("Sync() errored with ", err, " -> logging out")
 					c.Logout()
 				} else {
 					debug.Print("Sync() errored", err)
 				}
+			}
+		}
+	}
+}
+
+// sync sends a single /sync request and processes the response.
+func (c *Container) sync() error {
+	presenceEnabled := c.presenceEnabled()
+	filterID := c.config.LoadFilterID(c.config.UserID)
+	// The filter has to be recreated when presence is toggled or the filter changes.
+	if len(filterID) == 0 || c.config.AuthCache.FilterPresence != presenceEnabled ||
+		c.config.AuthCache.FilterVersion != FilterVersion {
+		c.syncer.IncludePresence = presenceEnabled
+		resp, err := c.client.CreateFilter(c.syncer.GetFilterJSON(c.config.UserID))
+		if err != nil {
+			return err
+		}
+		filterID = resp.FilterID
+		c.config.AuthCache.FilterPresence = presenceEnabled
+		c.config.AuthCache.FilterVersion = FilterVersion
+		c.config.SaveFilterID(c.config.UserID, filterID)
+	}
+	since := c.config.LoadNextBatch(c.config.UserID)
+	query := map[string]string{
+		"timeout": "30000",
+		"filter":  filterID,
+	}
+	if presenceEnabled {
+		query["set_presence"] = c.currentPresence()
+	}
+	if len(since) > 0 {
+		query["since"] = since
+	}
+	var resp SyncResponse
+	err := c.makeSyncRequest(c.client.BuildURLWithQuery([]string{"sync"}, query), &resp)
+	if err != nil {
+		duration, fatalErr := c.syncer.OnFailedSync(nil, err)
+		if fatalErr != nil {
+			return fatalErr
+		}
+		state := ifc.ConnectionRetrying
+		if _, isHTTPErr := err.(mautrix.HTTPError); !isHTTPErr {
+			// The request didn't get a response at all
+			state = ifc.ConnectionOffline
+		}
+		c.setConnectionStatus(ifc.ConnectionStatus{State: state, NextRetry: time.Now().Add(duration), Error: err})
+		c.waitForRetry(duration)
+		if len(c.stop) == 0 {
+			c.setConnectionStatus(ifc.ConnectionStatus{State: ifc.ConnectionSyncing})
+		}
+		return nil
+	} else if len(c.stop) > 0 {
+		// The container was stopped while the request was in progress, discard the response.
+		return nil
+	}
+
+	// Save the token before processing the response, so a malformed event can't get us stuck in a loop.
+	c.config.SaveNextBatch(c.config.UserID, resp.NextBatch)
+	c.setConnectionStatus(ifc.ConnectionStatus{State: ifc.ConnectionConnected})
+	c.handleEncryptionSync(&resp)
+	if c.outbox != nil {
+		c.outbox.SyncSucceeded()
+	}
+	return c.syncer.ProcessResponse(&resp.RespSync, since)
+}
+
+// waitForRetry sleeps until the next sync should be attempted and redraws the UI every second so
+// that the retry countdown in the status bar stays up to date. It returns early if the container is stopped.
+func (c *Container) waitForRetry(duration time.Duration) {
+	deadline := time.After(duration)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline:
+			return
+		case <-ticker.C:
+			if len(c.stop) > 0 {
+				return
+			}
+			c.ui.Render()
+		}
+	}
+}
+
+// makeSyncRequest sends a /sync request. Unlike mautrix's MakeRequest, it keeps the retry_after_ms
+// field of rate limit errors, which is returned as a *RespLimitExceeded in the HTTPError's WrappedError.
+func (c *Container) makeSyncRequest(urlPath string, resp *SyncResponse) error {
+	req, err := http.NewRequest("GET", urlPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.client.AccessToken)
+	res, err := c.client.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		httpErr := mautrix.HTTPError{
+			Code:    res.StatusCode,
+			Message: "Failed to GET JSON to " + req.URL.Path,
+		}
+		var respErr RespLimitExceeded
+		if json.Unmarshal(body, &respErr) == nil && len(respErr.ErrCode) > 0 {
+			httpErr.RespError = &respErr.RespError
+			if respErr.ErrCode == "M_LIMIT_EXCEEDED" {
+				httpErr.WrappedError = &respErr
 			} else {
-				debug.Print("Sync() returned without error")
+				httpErr.WrappedError = httpErr.RespError
 			}
+		} else {
+			httpErr.Message += ": " + string(body)
 		}
+		return httpErr
 	}
+	return json.NewDecoder(res.Body).Decode(resp)
 }
 
 func (c *Container) HandlePreferences(source EventSource, evt *mautrix.Event) {
@@ -384,7 +632,8 @@ func (c *Container) HandlePreferences(source EventSource, evt *mautrix.Event) {
 		return
 	}
 	debug.Print("Updated preferences:", orig, "->", c.config.Preferences)
-	if c.config.AuthCache.InitialSyncDone {
+	// The UI only uses the preferences of the main account.
+	if c.config.AuthCache.InitialSyncDone && c.isMainAccount() {
 		c.ui.HandleNewPreferences()
 	}
 }
@@ -401,6 +650,9 @@ func (c *Container) SendPreferencesToMatrix() {
 
 func (c *Container) HandleRedaction(source EventSource, evt *mautrix.Event) {
 	room := c.GetOrCreateRoom(evt.RoomID)
+	if c.chatLog != nil && c.config.AuthCache.InitialSyncDone && source&EventSourceLeave == 0 {
+		c.chatLog.LogEvent(room, &event.Event{Event: evt})
+	}
 	var redactedEvt *event.Event
 	err := c.history.Update(room, evt.Redacts, func(redacted *event.Event) error {
 		redacted.Unsigned.RedactedBy = evt.ID
@@ -415,7 +667,7 @@ func (c *Container) HandleRedaction(source EventSource, evt *mautrix.Event) {
 		return
 	}
 
-	roomView := c.ui.MainView().GetRoom(evt.RoomID)
+	roomView := c.ui.MainView(c).GetRoom(evt.RoomID)
 	if roomView == nil {
 		debug.Printf("Failed to handle event %v: No room view found.", evt)
 		return
@@ -441,7 +693,7 @@ func (c *Container) HandleEdit(room *rooms.Room, editsID string, editEvent *even
 		return
 	}
 
-	roomView := c.ui.MainView().GetRoom(editEvent.RoomID)
+	roomView := c.ui.MainView(c).GetRoom(editEvent.RoomID)
 	if roomView == nil {
 		debug.Printf("Failed to handle edit event %v: No room view found.", editEvent)
 		return
@@ -453,6 +705,24 @@ func (c *Container) HandleEdit(room *rooms.Room, editsID string, editEvent *even
 	}
 }
 
+// addThreadReply adds the given event to the thread summary of the thread root. The updated root event is returned,
+// or nil if the root isn't in the local history.
+func (c *Container) addThreadReply(room *rooms.Room, rootID string, reply *event.Event) (rootEvt *event.Event) {
+	err := c.history.Update(room, rootID, func(evt *event.Event) error {
+		if evt.Gomuks.Thread == nil {
+			evt.Gomuks.Thread = &event.ThreadInfo{}
+		}
+		evt.Gomuks.Thread.AddReply(reply)
+		rootEvt = evt
+		return nil
+	})
+	if err != nil {
+		debug.Printf("Failed to add %s to thread %s in history db: %v", reply.ID, rootID, err)
+		return nil
+	}
+	return rootEvt
+}
+
 func (c *Container) HandleReaction(room *rooms.Room, reactsTo string, reactEvent *event.Event) {
 	rel := reactEvent.Content.GetRelatesTo()
 	var origEvt *event.Event
@@ -472,7 +742,7 @@ func (c *Container) HandleReaction(room *rooms.Room, reactsTo string, reactEvent
 		return
 	}
 
-	roomView := c.ui.MainView().GetRoom(reactEvent.RoomID)
+	roomView := c.ui.MainView(c).GetRoom(reactEvent.RoomID)
 	if roomView == nil {
 		debug.Printf("Failed to handle edit event %v: No room view found.", reactEvent)
 		return
@@ -494,26 +764,40 @@ func (c *Container) HandleMessage(source EventSource, mxEvent *mautrix.Event) {
 		return
 	}
 
-	if editID := mxEvent.Content.GetRelatesTo().GetReplaceID(); len(editID) > 0 {
-		c.HandleEdit(room, editID, event.Wrap(mxEvent))
+	evt := c.decryptEvent(mxEvent)
+	if c.crypto != nil && crypto.IsVerificationEvent(evt.Event) {
+		c.crypto.HandleRoomVerificationEvent(evt.Event)
+		if evt.Type != mautrix.EventMessage {
+			return
+		}
+	}
+	if c.chatLog != nil && c.config.AuthCache.InitialSyncDone {
+		c.chatLog.LogEvent(room, evt)
+	}
+	if editID := evt.Content.GetRelatesTo().GetReplaceID(); len(editID) > 0 {
+		c.HandleEdit(room, editID, evt)
 		return
-	} else if reactionID := mxEvent.Content.GetRelatesTo().GetAnnotationID(); mxEvent.Type == mautrix.EventReaction && len(reactionID) > 0 {
-		c.HandleReaction(room, reactionID, event.Wrap(mxEvent))
+	} else if reactionID := evt.Content.GetRelatesTo().GetAnnotationID(); evt.Type == mautrix.EventReaction && len(reactionID) > 0 {
+		c.HandleReaction(room, reactionID, evt)
 		return
 	}
 
-	events, err := c.history.Append(room, []*mautrix.Event{mxEvent})
+	_, err := c.history.Append(room, []*event.Event{evt})
 	if err != nil {
-		debug.Printf("Failed to add event %s to history: %v", mxEvent.ID, err)
+		debug.Printf("Failed to add event %s to history: %v", evt.ID, err)
+	}
+
+	var threadRoot *event.Event
+	if rootID := ifc.ThreadRootID(evt); len(rootID) > 0 {
+		threadRoot = c.addThreadReply(room, rootID, evt)
 	}
-	evt := events[0]
 
 	if !c.config.AuthCache.InitialSyncDone {
 		room.LastReceivedMessage = time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*1000)
 		return
 	}
 
-	mainView := c.ui.MainView()
+	mainView := c.ui.MainView(c)
 
 	roomView := mainView.GetRoom(evt.RoomID)
 	if roomView == nil {
@@ -532,7 +816,12 @@ func (c *Container) HandleMessage(source EventSource, mxEvent *mautrix.Event) {
 		}
 	}
 
-	message := roomView.AddEvent(evt)
+	var message ifc.Message
+	if threadRoot != nil {
+		message = roomView.AddThreadReply(threadRoot, evt)
+	} else {
+		message = roomView.AddEvent(evt)
+	}
 	if message != nil {
 		roomView.MxRoom().LastReceivedMessage = message.Time()
 		if c.syncer.FirstSyncDone {
@@ -565,6 +854,14 @@ func (c *Container) HandleMembership(source EventSource, evt *mautrix.Event) {
 	c.HandleMessage(source, evt)
 }
 
+// HandleTombstone is the event handler for the m.room.tombstone state event.
+func (c *Container) HandleTombstone(source EventSource, evt *mautrix.Event) {
+	if c.config.AuthCache.InitialSyncDone && source&EventSourceLeave == 0 {
+		c.ui.MainView(c).RoomReplaced(c.GetOrCreateRoom(evt.RoomID))
+	}
+	c.HandleMessage(source, evt)
+}
+
 func (c *Container) processOwnMembershipChange(evt *mautrix.Event) {
 	membership := evt.Content.Membership
 	prevMembership := mautrix.MembershipLeave
@@ -582,11 +879,11 @@ func (c *Container) processOwnMembershipChange(evt *mautrix.Event) {
 		fallthrough
 	case "invite":
 		if c.config.AuthCache.InitialSyncDone {
-			c.ui.MainView().AddRoom(room)
+			c.ui.MainView(c).AddRoom(room)
 		}
 	case "leave":
 		if c.config.AuthCache.InitialSyncDone {
-			c.ui.MainView().RemoveRoom(room)
+			c.ui.MainView(c).RemoveRoom(room)
 		}
 		room.HasLeft = true
 		room.Unload()
@@ -596,8 +893,10 @@ func (c *Container) processOwnMembershipChange(evt *mautrix.Event) {
 	c.ui.Render()
 }
 
-func (c *Container) parseReadReceipt(evt *mautrix.Event) (largestTimestampEvent string) {
+// parseReadReceipt returns the latest event read by our own user and the latest read receipts of other users.
+func (c *Container) parseReadReceipt(evt *mautrix.Event) (largestTimestampEvent string, others map[string]rooms.ReadReceipt) {
 	var largestTimestamp int64
+	others = make(map[string]rooms.ReadReceipt)
 	for eventID, rawContent := range evt.Content.Raw {
 		content, ok := rawContent.(map[string]interface{})
 		if !ok {
@@ -609,15 +908,20 @@ func (c *Container) parseReadReceipt(evt *mautrix.Event) (largestTimestampEvent
 			continue
 		}
 
-		myInfo, ok := mRead[c.config.UserID].(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		ts, ok := myInfo["ts"].(float64)
-		if int64(ts) > largestTimestamp {
-			largestTimestamp = int64(ts)
-			largestTimestampEvent = eventID
+		for userID, rawInfo := range mRead {
+			info, ok := rawInfo.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ts, _ := info["ts"].(float64)
+			if userID == c.config.UserID {
+				if int64(ts) > largestTimestamp {
+					largestTimestamp = int64(ts)
+					largestTimestampEvent = eventID
+				}
+			} else if prev, ok := others[userID]; !ok || int64(ts) > prev.Timestamp {
+				others[userID] = rooms.ReadReceipt{EventID: eventID, Timestamp: int64(ts)}
+			}
 		}
 	}
 	return
@@ -628,18 +932,21 @@ func (c *Container) HandleReadReceipt(source EventSource, evt *mautrix.Event) {
 		return
 	}
 
-	lastReadEvent := c.parseReadReceipt(evt)
-	if len(lastReadEvent) == 0 {
+	room := c.GetRoom(evt.RoomID)
+	if room == nil {
 		return
 	}
 
-	room := c.GetRoom(evt.RoomID)
-	if room != nil {
-		room.MarkRead(lastReadEvent)
-		if c.config.AuthCache.InitialSyncDone {
-			c.ui.Render()
+	lastReadEvent, others := c.parseReadReceipt(evt)
+	changed := len(lastReadEvent) > 0 && room.MarkRead(lastReadEvent)
+	for userID, receipt := range others {
+		if room.SetReadReceipt(userID, receipt.EventID, receipt.Timestamp) {
+			changed = true
 		}
 	}
+	if changed && c.config.AuthCache.InitialSyncDone {
+		c.ui.Render()
+	}
 }
 
 func (c *Container) parseDirectChatInfo(evt *mautrix.Event) map[*rooms.Room]bool {
@@ -672,7 +979,7 @@ func (c *Container) HandleDirectChatInfo(_ EventSource, evt *mautrix.Event) {
 		if shouldBeDirect != room.IsDirect {
 			room.IsDirect = shouldBeDirect
 			if c.config.AuthCache.InitialSyncDone {
-				c.ui.MainView().UpdateTags(room)
+				c.ui.MainView(c).UpdateTags(room)
 			}
 		}
 	}
@@ -711,7 +1018,7 @@ func (c *Container) HandleTag(_ EventSource, evt *mautrix.Event) {
 	room.RawTags = newTags
 
 	if c.config.AuthCache.InitialSyncDone {
-		mainView := c.ui.MainView()
+		mainView := c.ui.MainView(c)
 		mainView.UpdateTags(room)
 	}
 }
@@ -721,7 +1028,7 @@ func (c *Container) HandleTyping(_ EventSource, evt *mautrix.Event) {
 	if !c.config.AuthCache.InitialSyncDone {
 		return
 	}
-	c.ui.MainView().SetTyping(evt.RoomID, evt.Content.TypingUserIDs)
+	c.ui.MainView(c).SetTyping(evt.RoomID, evt.Content.TypingUserIDs)
 }
 
 func (c *Container) MarkRead(roomID, eventID string) {
@@ -746,8 +1053,23 @@ func (c *Container) PrepareMarkdownMessage(roomID string, msgtype mautrix.Messag
 		}
 	} else if rel != nil && rel.Type == mautrix.RelReference {
 		content.SetReply(rel.Event.Event)
+	} else if rel != nil && rel.Type == ifc.RelThread {
+		content.RelatesTo = &mautrix.RelatesTo{
+			Type:    ifc.RelThread,
+			EventID: rel.Event.ID,
+		}
 	}
 
+	localEcho := c.newLocalEcho(roomID, content)
+	if rel != nil && rel.Type == mautrix.RelReplace {
+		localEcho.ID = rel.Event.ID
+		localEcho.Gomuks.Edits = []*event.Event{localEcho}
+	}
+	return localEcho
+}
+
+// newLocalEcho creates a local echo of a message with the given content and a new transaction ID.
+func (c *Container) newLocalEcho(roomID string, content mautrix.Content) *event.Event {
 	txnID := c.client.TxnID()
 	localEcho := event.Wrap(&mautrix.Event{
 		ID:        txnID,
@@ -761,10 +1083,6 @@ func (c *Container) PrepareMarkdownMessage(roomID string, msgtype mautrix.Messag
 		},
 	})
 	localEcho.Gomuks.OutgoingState = event.StateLocalEcho
-	if rel != nil && rel.Type == mautrix.RelReplace {
-		localEcho.ID = rel.Event.ID
-		localEcho.Gomuks.Edits = []*event.Event{localEcho}
-	}
 	return localEcho
 }
 
@@ -774,13 +1092,29 @@ func (c *Container) Redact(roomID, eventID, reason string) error {
 	return err
 }
 
-// SendMessage sends the given event.
+// SendMessage sends the given event. Events sent to encrypted rooms are encrypted first.
 func (c *Container) SendEvent(event *event.Event) (string, error) {
 	defer debug.Recover()
 
 	c.client.UserTyping(event.RoomID, false, 0)
 	c.typing = 0
-	resp, err := c.client.SendMessageEvent(event.RoomID, event.Type, event.Content, mautrix.ReqSendEvent{TransactionID: event.Unsigned.TransactionID})
+	evtType, content := event.Type, interface{}(&event.Content)
+	room := c.GetRoom(event.RoomID)
+	if len(ifc.ThreadRootID(event)) > 0 && room != nil {
+		threadContent, err := c.threadReplyContent(room, &event.Content)
+		if err != nil {
+			return "", err
+		}
+		content = threadContent
+	}
+	if room != nil && room.IsEncrypted() {
+		encrypted, err := c.encryptEvent(room, event.Type, content, event.Content.RelatesTo)
+		if err != nil {
+			return "", err
+		}
+		evtType, content = mautrix.EventEncrypted, encrypted
+	}
+	resp, err := c.client.SendMessageEvent(event.RoomID, evtType, content, mautrix.ReqSendEvent{TransactionID: event.Unsigned.TransactionID})
 	if err != nil {
 		return "", err
 	}
@@ -857,6 +1191,8 @@ func (c *Container) FetchMembers(room *rooms.Room) error {
 
 // GetHistory fetches room history.
 func (c *Container) GetHistory(room *rooms.Room, limit int) ([]*event.Event, error) {
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
 	events, err := c.history.Load(room, limit)
 	if err != nil {
 		return nil, err
@@ -865,6 +1201,27 @@ func (c *Container) GetHistory(room *rooms.Room, limit int) ([]*event.Event, err
 		debug.Printf("Loaded %d events for %s from local cache", len(events), room.ID)
 		return events, nil
 	}
+	return c.fetchHistory(room, limit)
+}
+
+// GetHistoryBefore fetches room history that is older than the event with the given ID, or the newest history if
+// the ID is empty. It doesn't affect where GetHistory continues from.
+func (c *Container) GetHistoryBefore(room *rooms.Room, eventID string, limit int) ([]*event.Event, error) {
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
+	events, err := c.history.LoadBefore(room, eventID, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > 0 {
+		return events, nil
+	}
+	return c.fetchHistory(room, limit)
+}
+
+// fetchHistory fetches the history before the back-pagination token of the room from the server and prepends it to
+// the local history. The caller must hold historyLock, so that the same page isn't fetched and stored twice.
+func (c *Container) fetchHistory(room *rooms.Room, limit int) ([]*event.Event, error) {
 	resp, err := c.client.Messages(room.ID, room.PrevBatch, "", 'b', limit)
 	if err != nil {
 		return nil, err
@@ -878,7 +1235,11 @@ func (c *Container) GetHistory(room *rooms.Room, limit int) ([]*event.Event, err
 	if len(resp.Chunk) == 0 {
 		return []*event.Event{}, nil
 	}
-	events, err = c.history.Prepend(room, resp.Chunk)
+	events := make([]*event.Event, len(resp.Chunk))
+	for i, evt := range resp.Chunk {
+		events[i] = c.decryptEvent(evt)
+	}
+	events, err = c.history.Prepend(room, events)
 	if err != nil {
 		return nil, err
 	}
@@ -897,7 +1258,7 @@ func (c *Container) GetEvent(room *rooms.Room, eventID string) (*event.Event, er
 	if err != nil {
 		return nil, err
 	}
-	evt = event.Wrap(mxEvent)
+	evt = c.decryptEvent(mxEvent)
 	debug.Printf("Loaded event %s from server", eventID)
 	return evt, nil
 }
@@ -914,9 +1275,13 @@ func (c *Container) GetRoom(roomID string) *rooms.Room {
 
 var mxcRegex = regexp.MustCompile("mxc://(.+)/(.+)")
 
+// maxConcurrentDownloads is the maximum number of media files that are downloaded at the same time.
+const maxConcurrentDownloads = 4
+
 // Download fetches the given Matrix content (mxc) URL and returns the data, homeserver, file ID and potential errors.
 //
 // The file will be either read from the media cache (if found) or downloaded from the server.
+// Large files should be downloaded with DownloadFile instead to avoid reading them into memory.
 func (c *Container) Download(mxcURL string) (data []byte, hs, id string, err error) {
 	parts := mxcRegex.FindStringSubmatch(mxcURL)
 	if parts == nil || len(parts) != 3 {
@@ -927,17 +1292,62 @@ func (c *Container) Download(mxcURL string) (data []byte, hs, id string, err err
 	hs = parts[1]
 	id = parts[2]
 
-	cacheFile := c.GetCachePath(hs, id)
-	var info os.FileInfo
-	if info, err = os.Stat(cacheFile); err == nil && !info.IsDir() {
+	var cacheFile string
+	if cacheFile, err = c.DownloadFile(context.Background(), mxcURL, nil); err == nil {
 		data, err = ioutil.ReadFile(cacheFile)
-		if err == nil {
-			return
+	}
+	return
+}
+
+// DownloadFile makes sure the given Matrix content (mxc) URL is in the media cache and returns the path to the cached file.
+//
+// The download can be cancelled with the context. If a progress function is given, it's called with the number of
+// bytes downloaded so far and the total size of the file, which is -1 if the server didn't tell the size.
+func (c *Container) DownloadFile(ctx context.Context, mxcURL string, progress func(done, total int64)) (string, error) {
+	parts := mxcRegex.FindStringSubmatch(mxcURL)
+	if parts == nil || len(parts) != 3 {
+		return "", fmt.Errorf("invalid matrix content URL")
+	}
+
+	cacheFile := c.GetCachePath(parts[1], parts[2])
+	if c.isCached(cacheFile) {
+		return cacheFile, nil
+	}
+	return cacheFile, c.download(ctx, c.GetDownloadURL(parts[1], parts[2]), cacheFile, progress)
+}
+
+// DownloadThumbnail fetches a thumbnail of the given Matrix content (mxc) URL from the media thumbnail API.
+// The server may return a thumbnail that is larger than the requested size.
+//
+// Thumbnails are cached separately from the original files. If the server can't make a thumbnail, the original
+// file is downloaded instead.
+func (c *Container) DownloadThumbnail(mxcURL string, width, height int) ([]byte, error) {
+	parts := mxcRegex.FindStringSubmatch(mxcURL)
+	if parts == nil || len(parts) != 3 {
+		return nil, fmt.Errorf("invalid matrix content URL")
+	}
+
+	cacheFile := c.GetThumbnailCachePath(parts[1], parts[2], width, height)
+	if !c.isCached(cacheFile) {
+		err := c.download(context.Background(), c.GetThumbnailURL(parts[1], parts[2], width, height), cacheFile, nil)
+		if err != nil {
+			debug.Printf("Failed to download thumbnail of %s, falling back to the original file: %v", mxcURL, err)
+			cacheFile, err = c.DownloadFile(context.Background(), mxcURL, nil)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
+	return ioutil.ReadFile(cacheFile)
+}
 
-	data, err = c.download(hs, id, cacheFile)
-	return
+// isCached checks if the given file exists in the media cache and marks it as accessed if it does.
+func (c *Container) isCached(cacheFile string) bool {
+	if info, err := os.Stat(cacheFile); err != nil || info.IsDir() {
+		return false
+	}
+	c.media.Touch(cacheFile)
+	return true
 }
 
 func (c *Container) GetDownloadURL(hs, id string) string {
@@ -949,24 +1359,101 @@ func (c *Container) GetDownloadURL(hs, id string) string {
 	return dlURL.String()
 }
 
-func (c *Container) download(hs, id, cacheFile string) (data []byte, err error) {
-	var resp *http.Response
-	resp, err = c.client.Client.Get(c.GetDownloadURL(hs, id))
+// GetThumbnailURL gets the media thumbnail API URL for a thumbnail of the given file that is scaled to fit in the given size.
+func (c *Container) GetThumbnailURL(hs, id string, width, height int) string {
+	thumbURL, _ := url.Parse(c.client.HomeserverURL.String())
+	if thumbURL.Scheme == "" {
+		thumbURL.Scheme = "https"
+	}
+	thumbURL.Path = path.Join(thumbURL.Path, "/_matrix/media/r0/thumbnail", hs, id)
+	thumbURL.RawQuery = url.Values{
+		"width":  {strconv.Itoa(width)},
+		"height": {strconv.Itoa(height)},
+		"method": {"scale"},
+	}.Encode()
+	return thumbURL.String()
+}
+
+// download streams the file at the given URL into the media cache.
+//
+// The file is written to a temporary file next to the cache file first, and renamed once the download is complete.
+// That way a failed or cancelled download never leaves a truncated file in the cache.
+func (c *Container) download(ctx context.Context, dlURL, cacheFile string, progress func(done, total int64)) error {
+	select {
+	case c.downloadSlots <- struct{}{}:
+		defer func() {
+			<-c.downloadSlots
+		}()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dlURL, nil)
 	if err != nil {
-		return
+		return err
+	}
+	resp, err := c.client.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned HTTP %d", resp.StatusCode)
+	}
 
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, resp.Body)
+	file, err := ioutil.TempFile(filepath.Dir(cacheFile), filepath.Base(cacheFile)+"-*"+partialSuffix)
 	if err != nil {
-		return
+		return err
 	}
+	size, err := io.Copy(file, &progressReader{
+		Reader:   resp.Body,
+		total:    resp.ContentLength,
+		callback: progress,
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), cacheFile)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		if ctx.Err() != nil {
+			// Return the plain cancellation error instead of whatever the HTTP client wrapped it in.
+			return ctx.Err()
+		}
+		return err
+	}
+	c.media.Add(cacheFile, size)
+	return nil
+}
+
+// writeCacheFile writes the given data to the media cache. The data is written to a temporary file first,
+// so that the cache never contains partially written files.
+func (c *Container) writeCacheFile(cacheFile string, data []byte) error {
+	err := ioutil.WriteFile(cacheFile+partialSuffix, data, 0600)
+	if err == nil {
+		err = os.Rename(cacheFile+partialSuffix, cacheFile)
+	}
+	if err != nil {
+		_ = os.Remove(cacheFile + partialSuffix)
+		return err
+	}
+	c.media.Add(cacheFile, int64(len(data)))
+	return nil
+}
 
-	data = buf.Bytes()
+// MediaCacheStats returns the number of files and total size of the media cache.
+func (c *Container) MediaCacheStats() ifc.MediaCacheStats {
+	return c.media.Stats()
+}
 
-	err = ioutil.WriteFile(cacheFile, data, 0600)
-	return
+// ClearMediaCache removes all downloaded files from the media cache.
+func (c *Container) ClearMediaCache() error {
+	return c.media.Clear()
 }
 
 // GetCachePath gets the path to the cached version of the given homeserver:fileID combination.
@@ -981,3 +1468,16 @@ func (c *Container) GetCachePath(homeserver, fileID string) string {
 
 	return filepath.Join(dir, fileID)
 }
+
+// GetThumbnailCachePath gets the path to the cached thumbnail of the given size of the given homeserver:fileID combination.
+// Thumbnails are stored in their own directory, so they're never mixed up with the original files.
+func (c *Container) GetThumbnailCachePath(homeserver, fileID string, width, height int) string {
+	dir := filepath.Join(c.config.MediaDir, thumbnailDir, homeserver)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%dx%d", fileID, width, height))
+}
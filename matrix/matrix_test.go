@@ -24,6 +24,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -67,6 +68,10 @@ func TestContainer_SendMarkdownMessage_NoMarkdown(t *testing.T) {
 }*/
 
 func TestContainer_SendMarkdownMessage_WithMarkdown(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-mxtest-4")
+	cfg := config.NewConfig("/tmp/gomuks-mxtest-4", "/tmp/gomuks-mxtest-4")
+	cfg.LoadAll()
+	cfg.UserID = "@user:example.com"
 	c := Container{client: mockClient(func(req *http.Request) (*http.Response, error) {
 		if req.Method != http.MethodPut || !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!foo:example.com/send/m.room.message/") {
 			return nil, fmt.Errorf("unexpected query: %s %s", req.Method, req.URL.Path)
@@ -75,18 +80,18 @@ func TestContainer_SendMarkdownMessage_WithMarkdown(t *testing.T) {
 		body := parseBody(req)
 		assert.Equal(t, "m.text", body["msgtype"])
 		assert.Equal(t, "**formatted** test _message_", body["body"])
-		assert.Equal(t, "<p><strong>formatted</strong> <u>test</u> <em>message</em></p>\n", body["formatted_body"])
+		assert.Equal(t, "<strong>formatted</strong> <u>test</u> <em>message</em>", body["formatted_body"])
 		return mockResponse(http.StatusOK, `{"event_id": "!foobar2:example.com"}`), nil
-	}), config: &config.Config{UserID: "@user:example.com"}}
+	}), config: cfg}
 
-	event := c.PrepareMarkdownMessage("!foo:example.com", "m.text", "**formatted** <u>test</u> _message_")
+	event := c.PrepareMarkdownMessage("!foo:example.com", mautrix.MsgText, "**formatted** <u>test</u> _message_", nil)
 	evtID, err := c.SendEvent(event)
 	assert.Nil(t, err)
 	assert.Equal(t, "!foobar2:example.com", evtID)
 }
 
 func TestContainer_SendTyping(t *testing.T) {
-	var calls []mautrix.ReqTyping
+	calls := make(chan mautrix.ReqTyping, 10)
 	c := Container{client: mockClient(func(req *http.Request) (*http.Response, error) {
 		if req.Method != http.MethodPut || req.URL.Path != "/_matrix/client/r0/rooms/!foo:example.com/typing/@user:example.com" {
 			return nil, fmt.Errorf("unexpected query: %s %s", req.Method, req.URL.Path)
@@ -102,7 +107,7 @@ func TestContainer_SendTyping(t *testing.T) {
 		if err != nil {
 			return nil, err
 		}
-		calls = append(calls, call)
+		calls <- call
 
 		return mockResponse(http.StatusOK, `{}`), nil
 	})}
@@ -113,16 +118,33 @@ func TestContainer_SendTyping(t *testing.T) {
 	c.SendTyping("!foo:example.com", false)
 	c.SendTyping("!foo:example.com", true)
 	c.SendTyping("!foo:example.com", false)
-	assert.Len(t, calls, 4)
-	assert.True(t, calls[0].Typing)
-	assert.False(t, calls[1].Typing)
-	assert.True(t, calls[2].Typing)
-	assert.False(t, calls[3].Typing)
+	// The requests are sent in the background, so they may arrive in any order.
+	var typing, notTyping int
+	for i := 0; i < 4; i++ {
+		select {
+		case call := <-calls:
+			if call.Typing {
+				typing++
+			} else {
+				notTyping++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for typing requests")
+		}
+	}
+	assert.Equal(t, 2, typing)
+	assert.Equal(t, 2, notTyping)
+	select {
+	case call := <-calls:
+		t.Errorf("Unexpected typing request %+v", call)
+	case <-time.After(100 * time.Millisecond):
+	}
 }
 
 func TestContainer_JoinRoom(t *testing.T) {
 	defer os.RemoveAll("/tmp/gomuks-mxtest-2")
 	cfg := config.NewConfig("/tmp/gomuks-mxtest-2", "/tmp/gomuks-mxtest-2")
+	cfg.LoadAll()
 	c := Container{client: mockClient(func(req *http.Request) (*http.Response, error) {
 		if req.Method == http.MethodPost && req.URL.Path == "/_matrix/client/r0/join/!foo:example.com" {
 			return mockResponse(http.StatusOK, `{"room_id": "!foo:example.com"}`), nil
@@ -153,7 +175,9 @@ func TestContainer_Download(t *testing.T) {
 		}
 		callCounter++
 		return mockResponse(http.StatusOK, `example file`), nil
-	}), config: cfg}
+	}), config: cfg,
+		downloadSlots: make(chan struct{}, maxConcurrentDownloads),
+		media:         NewMediaCache(cfg.MediaDir, 0)}
 
 	// Check that download works
 	data, hs, id, err := c.Download("mxc://example.com/foobar")
@@ -0,0 +1,208 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"  // initialize decoder
+	_ "image/jpeg" // initialize decoder
+	_ "image/png"  // initialize decoder
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // initialize decoder
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/event"
+)
+
+// ErrEncryptedUpload is returned by PrepareMediaMessage for encrypted rooms, as encrypted attachments aren't supported.
+var ErrEncryptedUpload = errors.New("uploading files to encrypted rooms is not supported")
+
+// ErrEmptyUpload is returned by PrepareMediaMessage for empty files.
+var ErrEmptyUpload = errors.New("the file is empty")
+
+const (
+	thumbnailMaxWidth  = 800
+	thumbnailMaxHeight = 600
+)
+
+// progressReader calls the callback with the total number of bytes read after every read. The callback is not called
+// if the total size is zero. Note that the reader may be read from a goroutine other than the one uploading.
+type progressReader struct {
+	io.Reader
+	sent     int64
+	total    int64
+	callback func(sent, total int64)
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.Reader.Read(p)
+	pr.sent += int64(n)
+	if pr.callback != nil && pr.total > 0 {
+		pr.callback(pr.sent, pr.total)
+	}
+	return
+}
+
+// detectMimeType guesses the MIME type of a file first from the extension and then from the content.
+func detectMimeType(path string, data []byte) string {
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if len(mimeType) == 0 {
+		mimeType = http.DetectContentType(data)
+	}
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mediaType
+	}
+	return mimeType
+}
+
+// PrepareMediaMessage reads the file at the given path and creates a local echo of a media message for it.
+//
+// The msgtype and the info (MIME type, size and image dimensions) are detected from the file.
+// The returned event doesn't have a content URL yet: the returned file data must be passed to UploadMedia
+// before the event is queued for sending.
+func (c *Container) PrepareMediaMessage(roomID, path string) (*event.Event, []byte, error) {
+	if room := c.GetRoom(roomID); room != nil && room.IsEncrypted() {
+		return nil, nil, ErrEncryptedUpload
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	} else if len(data) == 0 {
+		return nil, nil, ErrEmptyUpload
+	}
+
+	info := &mautrix.FileInfo{
+		MimeType: detectMimeType(path, data),
+		Size:     len(data),
+	}
+	content := mautrix.Content{
+		MsgType: mautrix.MsgFile,
+		Body:    filepath.Base(path),
+		Info:    info,
+	}
+	switch {
+	case strings.HasPrefix(info.MimeType, "image/"):
+		// Images that can't be decoded (e.g. SVGs) are sent as files, as they'd have no dimensions.
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			content.MsgType = mautrix.MsgImage
+			info.Width = cfg.Width
+			info.Height = cfg.Height
+		}
+	case strings.HasPrefix(info.MimeType, "video/"):
+		content.MsgType = mautrix.MsgVideo
+	case strings.HasPrefix(info.MimeType, "audio/"):
+		content.MsgType = mautrix.MsgAudio
+	}
+	return c.newLocalEcho(roomID, content), data, nil
+}
+
+// makeThumbnail scales down the given image to fit in the thumbnail size.
+// If the image is already small enough, nil is returned and the image itself should be used as the thumbnail.
+func makeThumbnail(data []byte, info *mautrix.FileInfo) ([]byte, *mautrix.FileInfo, error) {
+	if info.Width <= thumbnailMaxWidth && info.Height <= thumbnailMaxHeight {
+		return nil, nil, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	img = imaging.Fit(img, thumbnailMaxWidth, thumbnailMaxHeight, imaging.Lanczos)
+
+	var buf bytes.Buffer
+	thumbInfo := &mautrix.FileInfo{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}
+	if info.MimeType == "image/png" || info.MimeType == "image/gif" {
+		// Keep transparency
+		thumbInfo.MimeType = "image/png"
+		err = imaging.Encode(&buf, img, imaging.PNG)
+	} else {
+		thumbInfo.MimeType = "image/jpeg"
+		err = imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(85))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	thumbInfo.Size = buf.Len()
+	return buf.Bytes(), thumbInfo, nil
+}
+
+// UploadMedia uploads the file of a media message created with PrepareMediaMessage to the content repository
+// and fills the content URL of the event. Images also get a thumbnail.
+//
+// The progress callback is called with the number of bytes sent so far and the total number of bytes to send.
+func (c *Container) UploadMedia(evt *event.Event, data []byte, progress func(sent, total int64)) error {
+	info := evt.Content.Info
+	var thumbData []byte
+	var thumbInfo *mautrix.FileInfo
+	if evt.Content.MsgType == mautrix.MsgImage {
+		var err error
+		thumbData, thumbInfo, err = makeThumbnail(data, info)
+		if err != nil {
+			// The thumbnail is optional, so don't fail the whole upload.
+			debug.Printf("Failed to generate thumbnail for %s: %v", evt.Content.Body, err)
+		}
+	}
+
+	reader := &progressReader{
+		Reader:   bytes.NewReader(data),
+		total:    int64(len(data) + len(thumbData)),
+		callback: progress,
+	}
+	resp, err := c.client.Upload(reader, info.MimeType, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	evt.Content.URL = resp.ContentURI
+	// Store the file in the media cache so that rendering the message doesn't download it again.
+	if parts := mxcRegex.FindStringSubmatch(resp.ContentURI); len(parts) == 3 {
+		if err = c.writeCacheFile(c.GetCachePath(parts[1], parts[2]), data); err != nil {
+			debug.Printf("Failed to cache uploaded file %s: %v", resp.ContentURI, err)
+		}
+	}
+
+	if thumbData != nil {
+		reader.Reader = bytes.NewReader(thumbData)
+		resp, err = c.client.Upload(reader, thumbInfo.MimeType, int64(len(thumbData)))
+		if err != nil {
+			return err
+		}
+		info.ThumbnailURL = resp.ContentURI
+		info.ThumbnailInfo = thumbInfo
+	} else if evt.Content.MsgType == mautrix.MsgImage {
+		info.ThumbnailURL = evt.Content.URL
+		info.ThumbnailInfo = &mautrix.FileInfo{
+			MimeType: info.MimeType,
+			Width:    info.Width,
+			Height:   info.Height,
+			Size:     info.Size,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+)
+
+// partialSuffix is appended to the names of cache files that are still being written.
+const partialSuffix = ".part"
+
+// thumbnailDir is the subdirectory of the media directory where thumbnails are stored. Original files are stored in
+// directories named after their homeserver, so the name must not be a valid server name. Server names can't contain
+// underscores.
+const thumbnailDir = "_thumbnails"
+
+type mediaCacheEntry struct {
+	size     int64
+	accessed time.Time
+}
+
+// MediaCache keeps track of the files in the media directory and evicts the least recently used files
+// when the total size of the cache exceeds the quota.
+//
+// The last access time of a file is stored as its modification time, so it persists across restarts.
+type MediaCache struct {
+	sync.Mutex
+
+	dir     string
+	quota   int64
+	size    int64
+	entries map[string]*mediaCacheEntry
+}
+
+// NewMediaCache creates a media cache manager for the given directory.
+// The quota is in bytes, zero or less means the cache size is unlimited.
+func NewMediaCache(dir string, quota int64) *MediaCache {
+	return &MediaCache{
+		dir:     dir,
+		quota:   quota,
+		entries: make(map[string]*mediaCacheEntry),
+	}
+}
+
+// Load scans the media directory and removes files that can't belong to the cache, i.e. partially written files
+// and files that aren't in a homeserver directory. The cache is evicted afterwards if it's over the quota.
+func (cache *MediaCache) Load() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.size = 0
+	cache.entries = make(map[string]*mediaCacheEntry)
+	var dirs []string
+	err := filepath.Walk(cache.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			debug.Printf("Failed to read %s in media cache: %v", path, err)
+			return nil
+		} else if info.IsDir() {
+			if path != cache.dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		} else if filepath.Dir(path) == cache.dir || strings.HasSuffix(path, partialSuffix) {
+			debug.Print("Removing orphaned or partial file", path, "from media cache")
+			_ = os.Remove(path)
+			return nil
+		}
+		cache.entries[path] = &mediaCacheEntry{size: info.Size(), accessed: info.ModTime()}
+		cache.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		debug.Print("Failed to scan media cache:", err)
+	}
+	// Remove directories deepest first, so that directories only containing empty directories are removed too.
+	// Directories that still contain files won't be removed.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+	cache.evict("")
+}
+
+// Touch marks the given cache file as accessed now.
+func (cache *MediaCache) Touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	cache.Lock()
+	if entry, ok := cache.entries[path]; ok {
+		entry.accessed = now
+	}
+	cache.Unlock()
+}
+
+// Add adds a newly written file to the cache and evicts other files if the cache is over the quota.
+func (cache *MediaCache) Add(path string, size int64) {
+	cache.Lock()
+	defer cache.Unlock()
+	if entry, ok := cache.entries[path]; ok {
+		cache.size -= entry.size
+	}
+	cache.entries[path] = &mediaCacheEntry{size: size, accessed: time.Now()}
+	cache.size += size
+	cache.evict(path)
+}
+
+// evict removes the least recently accessed files until the cache fits in the quota.
+// The file at the keep path is never removed, as it's about to be used.
+func (cache *MediaCache) evict(keep string) {
+	if cache.quota <= 0 || cache.size <= cache.quota {
+		return
+	}
+	paths := make([]string, 0, len(cache.entries))
+	for path := range cache.entries {
+		if path != keep {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return cache.entries[paths[i]].accessed.Before(cache.entries[paths[j]].accessed)
+	})
+	for _, path := range paths {
+		if cache.size <= cache.quota {
+			break
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			debug.Printf("Failed to evict %s from media cache: %v", path, err)
+			continue
+		}
+		cache.size -= cache.entries[path].size
+		delete(cache.entries, path)
+	}
+}
+
+// Stats returns the number of files and the total size of the cache.
+func (cache *MediaCache) Stats() ifc.MediaCacheStats {
+	cache.Lock()
+	defer cache.Unlock()
+	return ifc.MediaCacheStats{
+		Files: len(cache.entries),
+		Size:  cache.size,
+		Quota: cache.quota,
+	}
+}
+
+// Clear removes all files from the cache.
+func (cache *MediaCache) Clear() error {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.size = 0
+	cache.entries = make(map[string]*mediaCacheEntry)
+	if err := os.RemoveAll(cache.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(cache.dir, 0700)
+}
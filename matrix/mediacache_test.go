@@ -0,0 +1,126 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeMediaCacheTestFile(path string, size int, age time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path, []byte(strings.Repeat("x", size)), 0600); err != nil {
+		return err
+	}
+	accessed := time.Now().Add(-age)
+	return os.Chtimes(path, accessed, accessed)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestMediaCache_Load(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-mediatest-1")
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-1/maunium.net/foo", 10, 0))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-1/maunium.net/bar", 20, 0))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-1/_thumbnails/maunium.net/foo-64x64", 3, 0))
+
+	cache := NewMediaCache("/tmp/gomuks-mediatest-1", 0)
+	cache.Load()
+	assert.Equal(t, 3, cache.Stats().Files)
+	assert.Equal(t, int64(33), cache.Stats().Size)
+	assert.True(t, fileExists("/tmp/gomuks-mediatest-1/_thumbnails/maunium.net/foo-64x64"))
+}
+
+func TestMediaCache_Load_RemovesOrphans(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-mediatest-2")
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-2/maunium.net/foo", 10, 0))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-2/maunium.net/bar.part", 5, 0))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-2/orphan", 5, 0))
+	assert.Nil(t, os.MkdirAll("/tmp/gomuks-mediatest-2/empty/nested", 0700))
+
+	cache := NewMediaCache("/tmp/gomuks-mediatest-2", 0)
+	cache.Load()
+	assert.Equal(t, 1, cache.Stats().Files)
+	assert.Equal(t, int64(10), cache.Stats().Size)
+	assert.True(t, fileExists("/tmp/gomuks-mediatest-2/maunium.net/foo"))
+	assert.False(t, fileExists("/tmp/gomuks-mediatest-2/maunium.net/bar.part"))
+	assert.False(t, fileExists("/tmp/gomuks-mediatest-2/orphan"))
+	assert.False(t, fileExists("/tmp/gomuks-mediatest-2/empty"))
+}
+
+func TestMediaCache_Load_OverQuota(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-mediatest-3")
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-3/maunium.net/old", 10, 3*time.Hour))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-3/maunium.net/mid", 10, 2*time.Hour))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-3/maunium.net/new", 10, time.Hour))
+
+	cache := NewMediaCache("/tmp/gomuks-mediatest-3", 25)
+	cache.Load()
+	assert.Equal(t, int64(20), cache.Stats().Size)
+	assert.False(t, fileExists("/tmp/gomuks-mediatest-3/maunium.net/old"))
+	assert.True(t, fileExists("/tmp/gomuks-mediatest-3/maunium.net/mid"))
+	assert.True(t, fileExists("/tmp/gomuks-mediatest-3/maunium.net/new"))
+}
+
+func TestMediaCache_Evict_Keep(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-mediatest-4")
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-4/maunium.net/a", 10, 4*time.Hour))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-4/maunium.net/b", 10, 3*time.Hour))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-4/maunium.net/c", 10, 2*time.Hour))
+	cache := NewMediaCache("/tmp/gomuks-mediatest-4", 0)
+	cache.Load()
+
+	cache.Lock()
+	cache.quota = 20
+	cache.evict("/tmp/gomuks-mediatest-4/maunium.net/a")
+	cache.Unlock()
+	assert.Equal(t, 2, cache.Stats().Files)
+	assert.True(t, fileExists("/tmp/gomuks-mediatest-4/maunium.net/a"))
+	assert.False(t, fileExists("/tmp/gomuks-mediatest-4/maunium.net/b"))
+	assert.True(t, fileExists("/tmp/gomuks-mediatest-4/maunium.net/c"))
+}
+
+func TestMediaCache_AddTouch(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-mediatest-5")
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-5/maunium.net/a", 10, 3*time.Hour))
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-5/maunium.net/b", 10, 2*time.Hour))
+	cache := NewMediaCache("/tmp/gomuks-mediatest-5", 25)
+	cache.Load()
+
+	// Touching a makes b the least recently used file.
+	cache.Touch("/tmp/gomuks-mediatest-5/maunium.net/a")
+	assert.Nil(t, writeMediaCacheTestFile("/tmp/gomuks-mediatest-5/maunium.net/c", 10, 0))
+	cache.Add("/tmp/gomuks-mediatest-5/maunium.net/c", 10)
+	assert.Equal(t, int64(20), cache.Stats().Size)
+	assert.True(t, fileExists("/tmp/gomuks-mediatest-5/maunium.net/a"))
+	assert.False(t, fileExists("/tmp/gomuks-mediatest-5/maunium.net/b"))
+
+	// Adding the same file again replaces its size instead of counting it twice.
+	cache.Add("/tmp/gomuks-mediatest-5/maunium.net/c", 12)
+	assert.Equal(t, int64(22), cache.Stats().Size)
+	assert.Equal(t, 2, cache.Stats().Files)
+}
@@ -0,0 +1,319 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/event"
+)
+
+const (
+	outboxMinBackoff = 2 * time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+var (
+	ErrNotInOutbox    = errors.New("message is not in the outbox")
+	ErrAlreadySending = errors.New("message is already being sent")
+)
+
+// outbox sends the events stored in the outbox bucket of the history database in order.
+//
+// Events in the StateLocalEcho state are retried automatically with exponential backoff until they're sent.
+// If the server rejects an event permanently, it's moved to the StateSendFail state and must be resent manually.
+type outbox struct {
+	wake chan struct{}
+	stop chan struct{}
+
+	// failures is the number of consecutive failed sends and is used to calculate the backoff.
+	failures int32
+	// reported contains the transaction IDs of events whose failure has already been shown to the user.
+	reported map[string]bool
+
+	// sendLock protects sending. It's held while checking that an event is still queued before sending it, so that
+	// an event can't be cancelled and sent at the same time.
+	sendLock sync.Mutex
+	// sending is the transaction ID of the event that is currently being sent.
+	sending string
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		reported: make(map[string]bool),
+	}
+}
+
+// Wake makes the outbox try sending pending events immediately.
+func (ob *outbox) Wake() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SyncSucceeded resets the backoff and retries pending events if sending has been failing.
+func (ob *outbox) SyncSucceeded() {
+	if atomic.SwapInt32(&ob.failures, 0) > 0 {
+		ob.Wake()
+	}
+}
+
+// startSending marks the event with the given transaction ID as being sent, if it's still queued in the outbox.
+func (ob *outbox) startSending(history *HistoryManager, txnID string) bool {
+	ob.sendLock.Lock()
+	defer ob.sendLock.Unlock()
+	evt, err := history.GetOutgoingByTxnID(txnID)
+	if err != nil || evt.Gomuks.OutgoingState != event.StateLocalEcho {
+		return false
+	}
+	ob.sending = txnID
+	return true
+}
+
+func (ob *outbox) finishSending() {
+	ob.sendLock.Lock()
+	ob.sending = ""
+	ob.sendLock.Unlock()
+}
+
+func (ob *outbox) backoff() time.Duration {
+	failures := atomic.LoadInt32(&ob.failures)
+	if failures > 10 {
+		return outboxMaxBackoff
+	} else if failures < 1 {
+		// Another room may have sent successfully after a failure, which resets the counter.
+		return outboxMinBackoff
+	}
+	delay := outboxMinBackoff << uint(failures-1)
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+	return delay
+}
+
+// isPermanentSendError checks if the error means that retrying the same request won't help. Only network errors and
+// server errors other than 4xx are retried. Anything else, such as a failure to encrypt the event, is a local error.
+func isPermanentSendError(err error) bool {
+	switch typedErr := err.(type) {
+	case mautrix.HTTPError:
+		return typedErr.Code >= 400 && typedErr.Code < 500 && typedErr.Code != http.StatusTooManyRequests
+	case net.Error:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Container) runOutbox(ob *outbox) {
+	defer debug.Recover()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ob.stop:
+			return
+		case <-ob.wake:
+		case <-retry:
+		}
+		retry = nil
+		if !c.processOutbox(ob) {
+			delay := ob.backoff()
+			debug.Printf("Failed to send outgoing events, retrying in %v", delay)
+			retry = time.After(delay)
+		}
+	}
+}
+
+// processOutbox tries to send all pending events in the outbox. Events are sent in order within each room, so if
+// sending an event fails, later events in the same room are skipped until the next try.
+// It returns false if sending should be retried later.
+func (c *Container) processOutbox(ob *outbox) bool {
+	history := c.history
+	if history == nil {
+		return true
+	}
+	events, err := history.GetOutgoing()
+	if err != nil {
+		debug.Print("Failed to read outbox:", err)
+		return true
+	}
+	blockedRooms := make(map[string]bool)
+	for _, evt := range events {
+		if evt.Gomuks.OutgoingState != event.StateLocalEcho || blockedRooms[evt.RoomID] {
+			continue
+		}
+		select {
+		case <-ob.stop:
+			return true
+		default:
+		}
+		if !ob.startSending(history, evt.Unsigned.TransactionID) {
+			// The event was cancelled or failed after the outbox was read.
+			continue
+		}
+		if !c.sendOutgoing(ob, history, evt) {
+			// Don't send later events in the room before this one to keep the order.
+			blockedRooms[evt.RoomID] = true
+		}
+	}
+	return len(blockedRooms) == 0
+}
+
+// sendOutgoing sends an event from the outbox and updates its state. It returns false if sending failed and should
+// be retried later.
+func (c *Container) sendOutgoing(ob *outbox, history *HistoryManager, evt *event.Event) bool {
+	defer ob.finishSending()
+	txnID := evt.Unsigned.TransactionID
+	eventID, err := c.SendEvent(evt)
+	if err == nil {
+		debug.Print("Event ID received:", eventID)
+		delete(ob.reported, txnID)
+		atomic.StoreInt32(&ob.failures, 0)
+		if err = history.RemoveOutgoing(txnID); err != nil && err != EventNotFoundError {
+			debug.Printf("Failed to remove %s from outbox: %v", txnID, err)
+		}
+		c.updateOutgoing(evt, eventID, event.StateDefault, nil)
+		return true
+	} else if isPermanentSendError(err) {
+		delete(ob.reported, txnID)
+		evt.Gomuks.OutgoingState = event.StateSendFail
+		if updateErr := history.UpdateOutgoing(evt); updateErr != nil {
+			debug.Printf("Failed to update %s in outbox: %v", txnID, updateErr)
+		}
+		c.updateOutgoing(evt, "", event.StateSendFail, err)
+		return true
+	}
+	atomic.AddInt32(&ob.failures, 1)
+	if !ob.reported[txnID] {
+		ob.reported[txnID] = true
+		c.updateOutgoing(evt, "", event.StateSendFail, err)
+	}
+	return false
+}
+
+// updateOutgoing updates the state of a local echo in the UI.
+func (c *Container) updateOutgoing(evt *event.Event, eventID string, state event.OutgoingState, err error) {
+	roomView := c.ui.MainView(c).GetRoom(evt.RoomID)
+	if roomView == nil {
+		return
+	}
+	roomView.SetOutgoingState(evt, eventID, state)
+	if err != nil {
+		permanent := isPermanentSendError(err)
+		// Show shorter version if available
+		if httpErr, ok := err.(mautrix.HTTPError); ok {
+			err = httpErr
+			if respErr := httpErr.RespError; respErr != nil {
+				err = respErr
+			}
+		}
+		if permanent {
+			roomView.AddServiceMessage(fmt.Sprintf("Failed to send message: %v. Use /resend to try again or /cancel to discard it.", err))
+		} else {
+			roomView.AddServiceMessage(fmt.Sprintf("Failed to send message: %v. Retrying automatically.", err))
+		}
+	}
+	c.ui.Render()
+}
+
+// QueueEvent stores the given local echo in the outbox and sends it in the background.
+func (c *Container) QueueEvent(evt *event.Event) error {
+	evt.Gomuks.OutgoingState = event.StateLocalEcho
+	stored := evt.SomewhatDangerousCopy()
+	// Local echoes of edits contain themselves in the edit list, which can't be encoded.
+	stored.Gomuks.Edits = nil
+	if err := c.history.AddOutgoing(stored); err != nil {
+		return err
+	}
+	if c.outbox != nil {
+		c.outbox.Wake()
+	}
+	return nil
+}
+
+// ResendEvent moves a failed event in the outbox back to the queue and retries sending immediately.
+func (c *Container) ResendEvent(txnID string) error {
+	evt, err := c.history.GetOutgoingByTxnID(txnID)
+	if err == EventNotFoundError {
+		return ErrNotInOutbox
+	} else if err != nil {
+		return err
+	}
+	evt.Gomuks.OutgoingState = event.StateLocalEcho
+	if err = c.history.UpdateOutgoing(evt); err != nil {
+		return err
+	}
+	if c.outbox != nil {
+		atomic.StoreInt32(&c.outbox.failures, 0)
+		c.outbox.Wake()
+	}
+	return nil
+}
+
+// CancelEvent removes an unsent event from the outbox and returns it. Events that are currently being sent can't be
+// cancelled.
+func (c *Container) CancelEvent(txnID string) (*event.Event, error) {
+	if ob := c.outbox; ob != nil {
+		ob.sendLock.Lock()
+		defer ob.sendLock.Unlock()
+		if ob.sending == txnID {
+			return nil, ErrAlreadySending
+		}
+	}
+	evt, err := c.history.GetOutgoingByTxnID(txnID)
+	if err == EventNotFoundError {
+		return nil, ErrNotInOutbox
+	} else if err != nil {
+		return nil, err
+	}
+	err = c.history.RemoveOutgoing(txnID)
+	if err == EventNotFoundError {
+		return nil, ErrNotInOutbox
+	}
+	return evt, err
+}
+
+// GetOutgoing returns the unsent events in the given room.
+func (c *Container) GetOutgoing(roomID string) []*event.Event {
+	events, err := c.history.GetOutgoing()
+	if err != nil {
+		debug.Print("Failed to read outbox:", err)
+		return nil
+	}
+	roomEvents := events[:0]
+	for _, evt := range events {
+		if evt.RoomID == roomID {
+			if evt.ID != evt.Unsigned.TransactionID {
+				evt.Gomuks.Edits = []*event.Event{evt}
+			}
+			roomEvents = append(roomEvents, evt)
+		}
+	}
+	return roomEvents
+}
@@ -0,0 +1,118 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"encoding/json"
+	"time"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+)
+
+type presenceContent struct {
+	Presence        string `json:"presence"`
+	StatusMsg       string `json:"status_msg"`
+	LastActiveAgo   int64  `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool   `json:"currently_active,omitempty"`
+}
+
+// presenceEnabled returns whether the user has enabled presence. The preference is shared by all accounts.
+func (c *Container) presenceEnabled() bool {
+	return c.gmx.Config().Preferences.EnablePresence
+}
+
+// currentPresence returns the presence that should be sent to the server,
+// i.e. the presence set by the user, or unavailable if the user is online but idle.
+func (c *Container) currentPresence() string {
+	c.presenceLock.RLock()
+	defer c.presenceLock.RUnlock()
+	if c.idle && c.ownPresence == ifc.PresenceOnline {
+		return ifc.PresenceUnavailable
+	}
+	return c.ownPresence
+}
+
+// HandlePresence stores the presence of other users.
+func (c *Container) HandlePresence(source EventSource, evt *mautrix.Event) {
+	var content presenceContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &content)
+	if err != nil {
+		debug.Print("Failed to parse presence of", evt.Sender, err)
+		return
+	}
+	presence := ifc.UserPresence{
+		Presence:  content.Presence,
+		StatusMsg: content.StatusMsg,
+	}
+	if content.CurrentlyActive {
+		presence.LastActive = time.Now()
+	} else if content.LastActiveAgo > 0 {
+		presence.LastActive = time.Now().Add(-time.Duration(content.LastActiveAgo) * time.Millisecond)
+	}
+	c.presenceLock.Lock()
+	c.presence[evt.Sender] = presence
+	c.presenceLock.Unlock()
+	if c.config.AuthCache.InitialSyncDone {
+		c.ui.Render()
+	}
+}
+
+// GetPresence returns the last known presence of the given user.
+func (c *Container) GetPresence(userID string) (presence ifc.UserPresence, ok bool) {
+	c.presenceLock.RLock()
+	presence, ok = c.presence[userID]
+	c.presenceLock.RUnlock()
+	return
+}
+
+// SetPresence sets the presence and status message of the user and sends them to the server.
+func (c *Container) SetPresence(presence, statusMsg string) error {
+	c.presenceLock.Lock()
+	c.ownPresence = presence
+	c.statusMsg = statusMsg
+	c.presenceLock.Unlock()
+	return c.sendPresence()
+}
+
+// SetIdle marks the user as idle or active. Idle users who are online are shown as unavailable.
+func (c *Container) SetIdle(idle bool) {
+	c.presenceLock.Lock()
+	changed := c.idle != idle && c.ownPresence == ifc.PresenceOnline
+	c.idle = idle
+	c.presenceLock.Unlock()
+	if changed && c.presenceEnabled() && c.client != nil && len(c.config.AccessToken) > 0 {
+		go func() {
+			defer debug.Recover()
+			if err := c.sendPresence(); err != nil {
+				debug.Print("Failed to update presence:", err)
+			}
+		}()
+	}
+}
+
+func (c *Container) sendPresence() error {
+	content := presenceContent{Presence: c.currentPresence()}
+	c.presenceLock.RLock()
+	content.StatusMsg = c.statusMsg
+	c.presenceLock.RUnlock()
+	u := c.client.BuildURL("presence", c.config.UserID, "status")
+	_, err := c.client.MakeRequest("PUT", u, &content, nil)
+	return err
+}
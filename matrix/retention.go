@@ -0,0 +1,294 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+const (
+	// retentionDelay is how long after starting the first background retention pass is run.
+	retentionDelay = 5 * time.Minute
+	// retentionInterval is how often old events are pruned from the history database in the background.
+	retentionInterval = 6 * time.Hour
+)
+
+var ErrHistoryClosed = errors.New("the history database is not open")
+
+// Prune removes the oldest events of the room from the history until the room has at most maxEvents events and none
+// of them are older than maxAge. Zero values mean no limit. The number of removed events and the ID of the newest
+// removed event are returned.
+func (hm *HistoryManager) Prune(room *rooms.Room, maxAge time.Duration, maxEvents int) (pruned int, newestPruned string, err error) {
+	if maxAge <= 0 && maxEvents <= 0 {
+		return
+	}
+	var cutoff int64
+	if maxAge > 0 {
+		cutoff = time.Now().Add(-maxAge).UnixNano() / int64(time.Millisecond)
+	}
+	hm.Lock()
+	defer hm.Unlock()
+	err = hm.update(func(tx *bolt.Tx) error {
+		rid := []byte(room.ID)
+		stream := tx.Bucket(bucketRoomStreams).Bucket(rid)
+		if stream == nil {
+			return nil
+		}
+		eventIDs := tx.Bucket(bucketRoomEventIDs).Bucket(rid)
+		searchIndex := tx.Bucket(bucketSearchIndex)
+		total := stream.Stats().KeyN
+		var keys [][]byte
+		c := stream.Cursor()
+		// The stream is ordered from oldest to newest, so stop at the first event that is kept.
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) == 0 {
+				keys = append(keys, append([]byte(nil), k...))
+				continue
+			}
+			evt, err := unmarshalEvent(v)
+			if err != nil {
+				return err
+			}
+			if (maxEvents <= 0 || total-len(keys) <= maxEvents) && (cutoff == 0 || evt.Timestamp >= cutoff) {
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			if !evt.IsGap() {
+				newestPruned = evt.ID
+			}
+			if eventIDs != nil {
+				if err = eventIDs.Delete([]byte(evt.ID)); err != nil {
+					return err
+				}
+			}
+			if err = unindexEvent(searchIndex, evt); err != nil {
+				return err
+			}
+		}
+		for _, key := range keys {
+			if err := stream.Delete(key); err != nil {
+				return err
+			}
+		}
+		pruned = len(keys)
+		return nil
+	})
+	return
+}
+
+// CompactDB rewrites the history database into a new file to return the space freed by pruning to the filesystem.
+// The sizes of the database file before and after compacting are returned.
+func (hm *HistoryManager) CompactDB() (sizeBefore, sizeAfter int64, err error) {
+	hm.dbLock.Lock()
+	defer hm.dbLock.Unlock()
+	path := hm.db.Path()
+	tmpPath := path + ".compact"
+	if stat, statErr := os.Stat(path); statErr == nil {
+		sizeBefore = stat.Size()
+	}
+
+	_ = os.Remove(tmpPath)
+	dst, err := openHistoryDB(tmpPath)
+	if err != nil {
+		return
+	}
+	err = copyDB(hm.db, dst)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return
+	}
+
+	if err = hm.db.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	// Reopen the database even if replacing it failed, in which case the old file is still in place.
+	db, openErr := openHistoryDB(path)
+	if openErr != nil {
+		return sizeBefore, 0, openErr
+	}
+	hm.db = db
+	if stat, statErr := os.Stat(path); statErr == nil {
+		sizeAfter = stat.Size()
+	}
+	return
+}
+
+// copyDB copies all buckets from src to dst. Each nested bucket of a top-level bucket (i.e. each room in the room
+// buckets) is copied in its own transaction to keep the transactions small.
+func copyDB(src, dst *bolt.DB) error {
+	return src.View(func(srcTx *bolt.Tx) error {
+		return srcTx.ForEach(func(name []byte, srcBucket *bolt.Bucket) error {
+			err := dst.Update(func(dstTx *bolt.Tx) error {
+				dstBucket, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				} else if err = dstBucket.SetSequence(srcBucket.Sequence()); err != nil {
+					return err
+				}
+				return srcBucket.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return nil
+					}
+					return dstBucket.Put(k, v)
+				})
+			})
+			if err != nil {
+				return err
+			}
+			return srcBucket.ForEach(func(k, v []byte) error {
+				if v != nil {
+					return nil
+				}
+				return dst.Update(func(dstTx *bolt.Tx) error {
+					dstBucket, err := dstTx.Bucket(name).CreateBucket(k)
+					if err != nil {
+						return err
+					}
+					return copyBucket(srcBucket.Bucket(k), dstBucket)
+				})
+			})
+		})
+	})
+}
+
+func copyBucket(src, dst *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(src.Bucket(k), child)
+	})
+}
+
+// retentionPolicy returns the maximum age and number of events that are kept in the local history of the room.
+// The maximum age is the shorter one of the configured age and the max_lifetime in the m.room.retention state.
+func (c *Container) retentionPolicy(room *rooms.Room) (maxAge time.Duration, maxEvents int) {
+	maxAge = time.Duration(c.config.HistoryMaxAge) * 24 * time.Hour
+	if lifetime := room.MaxLifetime(); lifetime > 0 && (maxAge == 0 || lifetime < maxAge) {
+		maxAge = lifetime
+	}
+	return maxAge, c.config.HistoryMaxEvents
+}
+
+// pruneHistory applies the retention policies of all rooms to the local history and returns the number of removed
+// events.
+func (c *Container) pruneHistory(history *HistoryManager) (int, error) {
+	c.config.Rooms.Lock()
+	roomList := make([]*rooms.Room, 0, len(c.config.Rooms.Map))
+	for _, room := range c.config.Rooms.Map {
+		roomList = append(roomList, room)
+	}
+	c.config.Rooms.Unlock()
+
+	var total int
+	for _, room := range roomList {
+		maxAge, maxEvents := c.retentionPolicy(room)
+		pruned, newestPruned, err := history.Prune(room, maxAge, maxEvents)
+		if err != nil {
+			return total, err
+		} else if pruned > 0 {
+			debug.Printf("Pruned %d events from the history of %s", pruned, room.ID)
+			total += pruned
+			if len(newestPruned) > 0 {
+				c.resetPrevBatch(room, newestPruned)
+			}
+		}
+	}
+	return total, nil
+}
+
+// resetPrevBatch points the back-pagination token of the room right after the given pruned event, so that loading
+// more history continues with the pruned events instead of skipping over them.
+func (c *Container) resetPrevBatch(room *rooms.Room, eventID string) {
+	var resp struct {
+		End string `json:"end"`
+	}
+	u := c.client.BuildURLWithQuery([]string{"rooms", room.ID, "context", eventID}, map[string]string{"limit": "0"})
+	_, err := c.client.MakeRequest("GET", u, nil, &resp)
+	if err != nil || len(resp.End) == 0 {
+		debug.Printf("Failed to get pagination token after pruned event %s in %s: %v", eventID, room.ID, err)
+		return
+	}
+	room.PrevBatch = resp.End
+	c.config.Rooms.Put(room)
+}
+
+// CompactHistory prunes the local history according to the retention policies and compacts the history database.
+func (c *Container) CompactHistory() (*ifc.HistoryCompaction, error) {
+	history := c.history
+	if history == nil {
+		return nil, ErrHistoryClosed
+	}
+	pruned, err := c.pruneHistory(history)
+	if err != nil {
+		return nil, err
+	}
+	sizeBefore, sizeAfter, err := history.CompactDB()
+	if err != nil {
+		return nil, err
+	}
+	return &ifc.HistoryCompaction{PrunedEvents: pruned, SizeBefore: sizeBefore, SizeAfter: sizeAfter}, nil
+}
+
+// runRetention prunes the history in the background every retentionInterval until the stop channel is closed.
+// The database is only compacted if something was pruned.
+func (c *Container) runRetention(history *HistoryManager, stop chan struct{}) {
+	defer debug.Recover()
+	timer := time.NewTimer(retentionDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		pruned, err := c.pruneHistory(history)
+		if err != nil {
+			debug.Print("Failed to prune history:", err)
+		} else if pruned > 0 {
+			sizeBefore, sizeAfter, err := history.CompactDB()
+			if err != nil {
+				debug.Print("Failed to compact history database:", err)
+			} else {
+				debug.Printf("Pruned %d events and compacted history database from %d to %d bytes", pruned, sizeBefore, sizeAfter)
+			}
+		}
+		timer.Reset(retentionInterval)
+	}
+}
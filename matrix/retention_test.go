@@ -0,0 +1,74 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+func newRetentionTestRoom(maxLifetime int) *rooms.Room {
+	cache := rooms.NewRoomCache("/tmp/gomuks-retentiontest/rooms.gob.gz", "/tmp/gomuks-retentiontest/rooms", 32, 0, func() string {
+		return "@tulir:maunium.net"
+	})
+	room := rooms.NewRoom("!foo:maunium.net", cache)
+	stateKey := ""
+	room.UpdateState(&mautrix.Event{
+		Type:     rooms.StateRetention,
+		StateKey: &stateKey,
+		Content: mautrix.Content{
+			Raw: map[string]interface{}{"max_lifetime": float64(maxLifetime)},
+		},
+	})
+	return room
+}
+
+func TestContainer_RetentionPolicy_RoomShorter(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-retentiontest")
+	c := &Container{config: &config.Config{HistoryMaxAge: 7, HistoryMaxEvents: 1000}}
+	room := newRetentionTestRoom(int(24 * time.Hour / time.Millisecond))
+
+	maxAge, maxEvents := c.retentionPolicy(room)
+	assert.Equal(t, 24*time.Hour, maxAge)
+	assert.Equal(t, 1000, maxEvents)
+}
+
+func TestContainer_RetentionPolicy_ConfigShorter(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-retentiontest")
+	c := &Container{config: &config.Config{HistoryMaxAge: 7}}
+	room := newRetentionTestRoom(int(30 * 24 * time.Hour / time.Millisecond))
+
+	maxAge, _ := c.retentionPolicy(room)
+	assert.Equal(t, 7*24*time.Hour, maxAge)
+}
+
+func TestContainer_RetentionPolicy_NoConfiguredAge(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-retentiontest")
+	c := &Container{config: &config.Config{}}
+	room := newRetentionTestRoom(int(24 * time.Hour / time.Millisecond))
+
+	maxAge, _ := c.retentionPolicy(room)
+	assert.Equal(t, 24*time.Hour, maxAge)
+}
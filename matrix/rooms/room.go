@@ -36,6 +36,14 @@ func init() {
 	gob.Register([]interface{}{})
 }
 
+var (
+	StateSpaceChild  = mautrix.EventType{Type: "m.space.child", Class: mautrix.StateEventType}
+	StateSpaceParent = mautrix.EventType{Type: "m.space.parent", Class: mautrix.StateEventType}
+)
+
+// RoomTypeSpace is the room type in the m.room.create event of spaces.
+const RoomTypeSpace = "m.space"
+
 type RoomNameSource int
 
 const (
@@ -59,6 +67,12 @@ type UnreadMessage struct {
 	Highlight bool
 }
 
+// ReadReceipt is the position up to which a user has read a room.
+type ReadReceipt struct {
+	EventID   string
+	Timestamp int64
+}
+
 type Member struct {
 	mautrix.Member
 
@@ -88,11 +102,20 @@ type Room struct {
 	unreadCountCache *int
 	highlightCache   *bool
 	lastMarkedRead   string
+	// The latest read receipts of other users in this room, keyed by user ID.
+	ReadReceipts map[string]ReadReceipt
 	// Whether or not this room is marked as a direct chat.
 	IsDirect bool
 
 	// List of tags given to this room.
 	RawTags []RoomTag
+	// Whether or not this room is a space. Calculated from the m.room.create state event.
+	IsSpace bool
+	// The IDs of the rooms in this space. Calculated from m.space.child state events.
+	SpaceChildren map[string]bool
+	// The IDs of the spaces this room claims to be in, mapped to the senders of the claims. Calculated from
+	// m.space.parent state events.
+	SpaceParents map[string]string
 	// Timestamp of previously received actual message.
 	LastReceivedMessage time.Time
 
@@ -195,6 +218,19 @@ func (room *Room) load() {
 	if err = dec.Decode(&room.state); err != nil {
 		debug.Print("Failed to decode room state:", err)
 	}
+	// Older versions stored state events of types that mautrix doesn't know about without the state class.
+	for evtType, events := range room.state {
+		if evtType.Class == mautrix.UnknownEventType {
+			delete(room.state, evtType)
+			evtType.Class = mautrix.StateEventType
+			for _, evt := range events {
+				evt.Type.Class = mautrix.StateEventType
+			}
+			if room.state[evtType] == nil {
+				room.state[evtType] = events
+			}
+		}
+	}
 	room.changed = false
 }
 
@@ -286,6 +322,32 @@ func (room *Room) MarkRead(eventID string) bool {
 	return true
 }
 
+// SetReadReceipt updates the read receipt of the given user unless the stored receipt is newer.
+// It returns whether the receipt changed.
+func (room *Room) SetReadReceipt(userID, eventID string, timestamp int64) bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	prev, ok := room.ReadReceipts[userID]
+	if ok && (prev.EventID == eventID || prev.Timestamp > timestamp) {
+		return false
+	} else if room.ReadReceipts == nil {
+		room.ReadReceipts = make(map[string]ReadReceipt)
+	}
+	room.ReadReceipts[userID] = ReadReceipt{EventID: eventID, Timestamp: timestamp}
+	return true
+}
+
+// GetReadReceipts returns a copy of the read receipts of other users in this room.
+func (room *Room) GetReadReceipts() map[string]ReadReceipt {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	receipts := make(map[string]ReadReceipt, len(room.ReadReceipts))
+	for userID, receipt := range room.ReadReceipts {
+		receipts[userID] = receipt
+	}
+	return receipts
+}
+
 func (room *Room) UnreadCount() int {
 	room.lock.Lock()
 	defer room.lock.Unlock()
@@ -378,6 +440,11 @@ func (room *Room) UpdateState(event *mautrix.Event) {
 	if event.StateKey == nil {
 		panic("Tried to UpdateState() event with no state key.")
 	}
+	if event.Type.Class == mautrix.UnknownEventType {
+		// mautrix only knows the classes of the event types it has constants for, but anything with a state key
+		// is a state event. The class is fixed here so that the event matches the types defined in this package.
+		event.Type.Class = mautrix.StateEventType
+	}
 	room.Load()
 	room.lock.Lock()
 	defer room.lock.Unlock()
@@ -403,6 +470,15 @@ func (room *Room) UpdateState(event *mautrix.Event) {
 		room.updateMemberState(event)
 	case mautrix.StateTopic:
 		room.topicCache = event.Content.Topic
+	case mautrix.StateCreate:
+		roomType, _ := event.Content.Raw["type"].(string)
+		room.IsSpace = roomType == RoomTypeSpace
+	case mautrix.StateTombstone:
+		room.replacedByCache = nil
+	case StateSpaceChild:
+		room.SpaceChildren = updateSpaceLink(room.SpaceChildren, event)
+	case StateSpaceParent:
+		room.SpaceParents = updateSpaceParent(room.SpaceParents, event)
 	}
 
 	if event.Type != mautrix.StateMember {
@@ -412,6 +488,63 @@ func (room *Room) UpdateState(event *mautrix.Event) {
 	room.state[event.Type][*event.StateKey] = event
 }
 
+// updateSpaceLink adds or removes the room in the state key of a m.space.child or m.space.parent event.
+// Links without any servers to join through are considered removed.
+func updateSpaceLink(links map[string]bool, event *mautrix.Event) map[string]bool {
+	if !hasSpaceVia(event) {
+		delete(links, *event.StateKey)
+		return links
+	}
+	if links == nil {
+		links = make(map[string]bool)
+	}
+	links[*event.StateKey] = true
+	return links
+}
+
+// updateSpaceParent adds or removes the space in the state key of a m.space.parent event. The sender is stored, as
+// the claim is only valid if the sender could also add the room to the space.
+func updateSpaceParent(parents map[string]string, event *mautrix.Event) map[string]string {
+	if !hasSpaceVia(event) {
+		delete(parents, *event.StateKey)
+		return parents
+	}
+	if parents == nil {
+		parents = make(map[string]string)
+	}
+	parents[*event.StateKey] = event.Sender
+	return parents
+}
+
+// hasSpaceVia returns whether the m.space.child or m.space.parent event has servers to join through, which is what
+// makes the link valid. Links are removed by sending the event without them.
+func hasSpaceVia(event *mautrix.Event) bool {
+	via, _ := event.Content.Raw["via"].([]interface{})
+	return len(via) > 0
+}
+
+// GetSpaceChildren returns the IDs of the rooms in this space.
+func (room *Room) GetSpaceChildren() []string {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	children := make([]string, 0, len(room.SpaceChildren))
+	for roomID := range room.SpaceChildren {
+		children = append(children, roomID)
+	}
+	return children
+}
+
+// GetSpaceParents returns the IDs of the spaces this room claims to be in, mapped to the users who made the claims.
+func (room *Room) GetSpaceParents() map[string]string {
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	parents := make(map[string]string, len(room.SpaceParents))
+	for roomID, sender := range room.SpaceParents {
+		parents[roomID] = sender
+	}
+	return parents
+}
+
 func (room *Room) updateMemberState(event *mautrix.Event) {
 	userID := event.GetStateKey()
 	if userID == room.SessionUserID {
@@ -546,6 +679,30 @@ func (room *Room) GetTitle() string {
 	return room.NameCache
 }
 
+// StateEncryption is the type of the m.room.encryption state event, which mautrix doesn't know about.
+var StateEncryption = mautrix.EventType{Type: "m.room.encryption", Class: mautrix.StateEventType}
+
+// The types of room setting state events that mautrix doesn't know about.
+var (
+	StateHistoryVisibility = mautrix.EventType{Type: "m.room.history_visibility", Class: mautrix.StateEventType}
+	StateGuestAccess       = mautrix.EventType{Type: "m.room.guest_access", Class: mautrix.StateEventType}
+	StateRetention         = mautrix.EventType{Type: "m.room.retention", Class: mautrix.StateEventType}
+)
+
+// IsEncrypted returns whether or not end-to-end encryption has been enabled in the room.
+func (room *Room) IsEncrypted() bool {
+	return room.GetStateEvent(StateEncryption, "") != nil
+}
+
+// GetPowerLevels returns the content of the m.room.power_levels event, or the default power levels if the room
+// doesn't have one.
+func (room *Room) GetPowerLevels() *mautrix.PowerLevels {
+	if evt := room.GetStateEvent(mautrix.StatePowerLevels, ""); evt != nil {
+		return evt.Content.GetPowerLevels()
+	}
+	return &mautrix.PowerLevels{}
+}
+
 func (room *Room) IsReplaced() bool {
 	if room.replacedByCache == nil {
 		evt := room.GetStateEvent(mautrix.StateTombstone, "")
@@ -566,6 +723,28 @@ func (room *Room) ReplacedBy() string {
 	return *room.replacedByCache
 }
 
+// MaxLifetime returns how long events in the room should be kept according to the m.room.retention state event,
+// or zero if the room doesn't limit it.
+func (room *Room) MaxLifetime() time.Duration {
+	evt := room.GetStateEvent(StateRetention, "")
+	if evt == nil {
+		return 0
+	}
+	maxLifetime, _ := evt.Content.Raw["max_lifetime"].(float64)
+	return time.Duration(maxLifetime) * time.Millisecond
+}
+
+// Predecessor returns the ID of the room that this room replaced, as specified in the m.room.create event.
+func (room *Room) Predecessor() string {
+	evt := room.GetStateEvent(mautrix.StateCreate, "")
+	if evt == nil {
+		return ""
+	}
+	predecessor, _ := evt.Content.Raw["predecessor"].(map[string]interface{})
+	roomID, _ := predecessor["room_id"].(string)
+	return roomID
+}
+
 func (room *Room) eventToMember(userID string, sender string, content *mautrix.Content) *Member {
 	member := content.Member
 	member.Membership = content.Membership
@@ -0,0 +1,289 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// The search index maps words in message bodies to the events containing them. Each entry has the key
+// word\x00roomID\x00eventID and the timestamp of the event as the value, which means that all events containing a
+// word (optionally in a single room) can be found with a prefix scan.
+var bucketSearchIndex = []byte("search_index")
+
+const (
+	// minSearchWordLength is the length in runes of the shortest words that are indexed.
+	minSearchWordLength = 2
+	// maxSearchWordLength is the length in bytes of the longest words that are indexed.
+	maxSearchWordLength = 64
+)
+
+// searchWords splits text into the lowercase words used in the search index. Each word is only returned once.
+func searchWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	seen := make(map[string]struct{}, len(fields))
+	words := fields[:0]
+	for _, word := range fields {
+		if len(word) > maxSearchWordLength || len([]rune(word)) < minSearchWordLength {
+			continue
+		} else if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		words = append(words, word)
+	}
+	return words
+}
+
+func searchKey(word, roomID, eventID string) []byte {
+	return []byte(word + "\x00" + roomID + "\x00" + eventID)
+}
+
+// eventSearchWords returns the words of a message event that are added to the search index.
+func eventSearchWords(evt *event.Event) []string {
+	if evt.Type != mautrix.EventMessage || len(evt.ID) == 0 {
+		return nil
+	}
+	body := evt.Content.Body
+	if len(evt.Content.GetReplyTo()) > 0 {
+		body = mautrix.TrimReplyFallbackText(body)
+	}
+	return searchWords(body)
+}
+
+// indexEvent adds the body of a message event to the search index.
+func indexEvent(index *bolt.Bucket, evt *event.Event) error {
+	if evt.Unsigned.RedactedBecause != nil {
+		return nil
+	}
+	timestamp := itob(uint64(evt.Timestamp))
+	for _, word := range eventSearchWords(evt) {
+		if err := index.Put(searchKey(word, evt.RoomID, evt.ID), timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexEvent removes a message event from the search index.
+func unindexEvent(index *bolt.Bucket, evt *event.Event) error {
+	for _, word := range eventSearchWords(evt) {
+		if err := index.Delete(searchKey(word, evt.RoomID, evt.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexExisting adds all events that were stored before the search index existed to the index.
+func (hm *HistoryManager) indexExisting() {
+	defer debug.Recover()
+	debug.Print("Building search index from existing history")
+	var count int
+	err := hm.update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bucketSearchIndex)
+		return tx.Bucket(bucketRoomStreams).ForEach(func(roomID, _ []byte) error {
+			return tx.Bucket(bucketRoomStreams).Bucket(roomID).ForEach(func(_, eventData []byte) error {
+				if len(eventData) == 0 {
+					return nil
+				}
+				evt, err := unmarshalEvent(eventData)
+				if err != nil {
+					return err
+				}
+				count++
+				return indexEvent(index, evt)
+			})
+		})
+	})
+	if err != nil {
+		debug.Print("Failed to build search index:", err)
+	} else {
+		debug.Printf("Added %d existing events to the search index", count)
+	}
+}
+
+type searchHit struct {
+	roomID    []byte
+	eventID   []byte
+	timestamp uint64
+}
+
+// Search finds the newest stored message events that contain all the words in the query. If roomID is set, only
+// events in that room are searched.
+func (hm *HistoryManager) Search(query, roomID string, limit int) (events []*event.Event, err error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	err = hm.view(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bucketSearchIndex)
+		prefix := []byte(words[0] + "\x00")
+		if len(roomID) > 0 {
+			prefix = append(prefix, roomID+"\x00"...)
+		}
+		var hits []searchHit
+		c := index.Cursor()
+	Hits:
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			parts := bytes.SplitN(k, []byte{0}, 3)
+			if len(parts) != 3 {
+				continue
+			}
+			for _, word := range words[1:] {
+				if index.Get(searchKey(word, string(parts[1]), string(parts[2]))) == nil {
+					continue Hits
+				}
+			}
+			hits = append(hits, searchHit{parts[1], parts[2], btoi(v)})
+		}
+		sort.Slice(hits, func(i, j int) bool {
+			return hits[i].timestamp > hits[j].timestamp
+		})
+		for _, hit := range hits {
+			if len(events) >= limit {
+				break
+			}
+			stream, streamIndex, err := hm.getStreamIndex(tx, hit.roomID, hit.eventID)
+			if err != nil {
+				continue
+			}
+			evt, err := hm.getEvent(tx, stream, streamIndex)
+			if err != nil {
+				continue
+			} else if evt.Unsigned.RedactedBecause != nil {
+				// The index isn't cleaned up when events are redacted.
+				continue
+			}
+			events = append(events, evt)
+		}
+		return nil
+	})
+	return
+}
+
+// SearchHistory searches the locally stored history of all rooms, or only the given room, for messages that contain
+// all the words in the query. The newest matches are returned first.
+func (c *Container) SearchHistory(query string, room *rooms.Room, limit int) ([]*event.Event, error) {
+	var roomID string
+	if room != nil {
+		roomID = room.ID
+	}
+	return c.history.Search(query, roomID, limit)
+}
+
+// serverSearchContext is the number of events before and after each result that are requested from the server.
+const serverSearchContext = 1
+
+type reqSearch struct {
+	SearchCategories searchCategories `json:"search_categories"`
+}
+
+type searchCategories struct {
+	RoomEvents reqSearchRoomEvents `json:"room_events"`
+}
+
+type reqSearchRoomEvents struct {
+	SearchTerm   string             `json:"search_term"`
+	OrderBy      string             `json:"order_by,omitempty"`
+	Filter       *searchFilter      `json:"filter,omitempty"`
+	EventContext searchEventContext `json:"event_context"`
+}
+
+type searchFilter struct {
+	Rooms []string `json:"rooms,omitempty"`
+}
+
+type searchEventContext struct {
+	BeforeLimit int `json:"before_limit"`
+	AfterLimit  int `json:"after_limit"`
+}
+
+type respSearch struct {
+	SearchCategories struct {
+		RoomEvents struct {
+			Count   int `json:"count"`
+			Results []struct {
+				Result  *mautrix.Event `json:"result"`
+				Context struct {
+					EventsBefore []*mautrix.Event `json:"events_before"`
+					EventsAfter  []*mautrix.Event `json:"events_after"`
+				} `json:"context"`
+			} `json:"results"`
+			NextBatch string `json:"next_batch"`
+		} `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+// SearchServer searches messages using the search API of the homeserver. If room is set, only that room is searched.
+// The next batch token is the NextBatch of the previous page, or empty to get the first page.
+func (c *Container) SearchServer(query string, room *rooms.Room, nextBatch string) (*ifc.ServerSearchPage, error) {
+	u, _ := url.Parse(c.client.BuildURL("search"))
+	if len(nextBatch) > 0 {
+		urlQuery := u.Query()
+		urlQuery.Set("next_batch", nextBatch)
+		u.RawQuery = urlQuery.Encode()
+	}
+	req := &reqSearch{SearchCategories: searchCategories{RoomEvents: reqSearchRoomEvents{
+		SearchTerm: query,
+		OrderBy:    "recent",
+		EventContext: searchEventContext{
+			BeforeLimit: serverSearchContext,
+			AfterLimit:  serverSearchContext,
+		},
+	}}}
+	if room != nil {
+		req.SearchCategories.RoomEvents.Filter = &searchFilter{Rooms: []string{room.ID}}
+	}
+	var resp respSearch
+	_, err := c.client.MakeRequest("POST", u.String(), req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	roomEvents := resp.SearchCategories.RoomEvents
+	page := &ifc.ServerSearchPage{
+		Results:   make([]ifc.ServerSearchResult, 0, len(roomEvents.Results)),
+		Count:     roomEvents.Count,
+		NextBatch: roomEvents.NextBatch,
+	}
+	for _, result := range roomEvents.Results {
+		if result.Result == nil {
+			continue
+		}
+		page.Results = append(page.Results, ifc.ServerSearchResult{
+			Event:        c.decryptEvent(result.Result),
+			EventsBefore: c.decryptEvents(result.Context.EventsBefore),
+			EventsAfter:  c.decryptEvents(result.Context.EventsAfter),
+		})
+	}
+	return page, nil
+}
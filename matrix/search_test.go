@@ -0,0 +1,225 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+func newSearchTestEvent(roomID, id, body string, timestamp int64) *event.Event {
+	return event.Wrap(&mautrix.Event{
+		ID:        id,
+		Type:      mautrix.EventMessage,
+		RoomID:    roomID,
+		Sender:    "@tulir:maunium.net",
+		Timestamp: timestamp,
+		Content:   mautrix.Content{MsgType: mautrix.MsgText, Body: body},
+	})
+}
+
+func TestSearchWords(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world"}, searchWords("Hello WORLD"))
+	assert.Equal(t, []string{"hello", "world", "test"}, searchWords("hello, world! (test)"))
+	assert.Equal(t, []string{"gomuks", "2019"}, searchWords("gomuks 2019"))
+	assert.Equal(t, []string{}, searchWords(""))
+}
+
+func TestSearchWords_Duplicates(t *testing.T) {
+	assert.Equal(t, []string{"foo", "bar"}, searchWords("foo bar foo Foo"))
+}
+
+func TestSearchWords_Length(t *testing.T) {
+	assert.Equal(t, []string{"bb", "dd"}, searchWords("a bb c dd"))
+	assert.Equal(t, []string{"öö"}, searchWords("ä öö"))
+	assert.Equal(t, []string{"ok"}, searchWords("ok "+strings.Repeat("x", maxSearchWordLength+1)))
+	maxLength := strings.Repeat("x", maxSearchWordLength)
+	assert.Equal(t, []string{maxLength}, searchWords(maxLength))
+}
+
+func TestHistoryManager_Search(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-searchtest-1")
+	_ = os.MkdirAll("/tmp/gomuks-searchtest-1", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-searchtest-1/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	foo := &rooms.Room{ID: "!foo:maunium.net"}
+	bar := &rooms.Room{ID: "!bar:maunium.net"}
+	_, err = hm.Append(foo, []*event.Event{
+		newSearchTestEvent(foo.ID, "$foo1", "I like cats", 1000),
+		newSearchTestEvent(foo.ID, "$foo2", "Cats and dogs", 3000),
+	})
+	assert.Nil(t, err)
+	_, err = hm.Append(bar, []*event.Event{
+		newSearchTestEvent(bar.ID, "$bar1", "dogs are great", 2000),
+		newSearchTestEvent(bar.ID, "$bar2", "cats, cats everywhere", 5000),
+	})
+	assert.Nil(t, err)
+
+	// Results are sorted from newest to oldest.
+	events, err := hm.Search("CATS", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, "$bar2", events[0].ID)
+	assert.Equal(t, "$foo2", events[1].ID)
+	assert.Equal(t, "$foo1", events[2].ID)
+
+	events, err = hm.Search("dogs cats", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "$foo2", events[0].ID)
+
+	events, err = hm.Search("birds", "", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+	events, err = hm.Search("a !", "", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+}
+
+func TestHistoryManager_Search_RoomAndLimit(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-searchtest-2")
+	_ = os.MkdirAll("/tmp/gomuks-searchtest-2", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-searchtest-2/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	foo := &rooms.Room{ID: "!foo:maunium.net"}
+	bar := &rooms.Room{ID: "!bar:maunium.net"}
+	_, err = hm.Append(foo, []*event.Event{
+		newSearchTestEvent(foo.ID, "$foo1", "I like cats", 1000),
+		newSearchTestEvent(foo.ID, "$foo2", "Cats and dogs", 3000),
+	})
+	assert.Nil(t, err)
+	_, err = hm.Append(bar, []*event.Event{newSearchTestEvent(bar.ID, "$bar1", "cats everywhere", 2000)})
+	assert.Nil(t, err)
+
+	events, err := hm.Search("cats", bar.ID, 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "$bar1", events[0].ID)
+
+	events, err = hm.Search("cats", "", 2)
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "$foo2", events[0].ID)
+	assert.Equal(t, "$bar1", events[1].ID)
+}
+
+func TestHistoryManager_Search_Reply(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-searchtest-3")
+	_ = os.MkdirAll("/tmp/gomuks-searchtest-3", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-searchtest-3/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	reply := newSearchTestEvent(room.ID, "$reply", "> <@you:maunium.net> quoted text\n\nreply body", 1000)
+	reply.Content.RelatesTo = &mautrix.RelatesTo{Type: mautrix.RelReference, EventID: "$parent"}
+	_, err = hm.Append(room, []*event.Event{reply})
+	assert.Nil(t, err)
+
+	events, err := hm.Search("reply", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	// The reply fallback isn't indexed.
+	events, err = hm.Search("quoted", "", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+}
+
+func TestHistoryManager_Search_Redacted(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-searchtest-4")
+	_ = os.MkdirAll("/tmp/gomuks-searchtest-4", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-searchtest-4/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	redacted := newSearchTestEvent(room.ID, "$redacted", "secret cats", 1000)
+	redacted.Unsigned.RedactedBecause = &mautrix.Event{ID: "$redaction"}
+	_, err = hm.Append(room, []*event.Event{redacted})
+	assert.Nil(t, err)
+
+	events, err := hm.Search("secret", "", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+}
+
+func TestHistoryManager_Search_Update(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-searchtest-5")
+	_ = os.MkdirAll("/tmp/gomuks-searchtest-5", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-searchtest-5/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	_, err = hm.Append(room, []*event.Event{
+		newSearchTestEvent(room.ID, "$a", "original text", 1000),
+		newSearchTestEvent(room.ID, "$b", "another original", 2000),
+	})
+	assert.Nil(t, err)
+
+	err = hm.Update(room, "$a", func(evt *event.Event) error {
+		evt.Content.Body = "changed text"
+		return nil
+	})
+	assert.Nil(t, err)
+	events, err := hm.Search("original", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "$b", events[0].ID)
+	events, err = hm.Search("changed", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "$a", events[0].ID)
+}
+
+func TestHistoryManager_Search_UpdateAll(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-searchtest-6")
+	_ = os.MkdirAll("/tmp/gomuks-searchtest-6", 0700)
+	hm, err := NewHistoryManager("/tmp/gomuks-searchtest-6/history.db")
+	assert.Nil(t, err)
+	defer hm.Close()
+	room := &rooms.Room{ID: "!foo:maunium.net"}
+	_, err = hm.Append(room, []*event.Event{
+		newSearchTestEvent(room.ID, "$a", "original text", 1000),
+		newSearchTestEvent(room.ID, "$b", "another original", 2000),
+	})
+	assert.Nil(t, err)
+
+	_, err = hm.UpdateAll(room, func(evt *event.Event) *event.Event {
+		if evt.ID != "$b" {
+			return nil
+		}
+		evt.Content.Body = "replaced"
+		return evt
+	})
+	assert.Nil(t, err)
+	events, err := hm.Search("original", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "$a", events[0].ID)
+	events, err = hm.Search("replaced", "", 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "$b", events[0].ID)
+}
@@ -0,0 +1,73 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"net/url"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/interface"
+)
+
+// HandleSpace is the event handler for the state events that define the space hierarchy.
+// The state itself has already been stored by the syncer, so only the UI needs to be updated.
+func (c *Container) HandleSpace(_ EventSource, _ *mautrix.Event) {
+	if c.config.AuthCache.InitialSyncDone {
+		c.ui.MainView(c).UpdateSpaces()
+	}
+}
+
+type respSpaceHierarchy struct {
+	Rooms     []ifc.SpaceChild `json:"rooms"`
+	NextBatch string           `json:"next_batch,omitempty"`
+}
+
+// maxHierarchyPages limits how many pages of the space hierarchy are fetched for a single space.
+const maxHierarchyPages = 10
+
+// GetSpaceChildren fetches the rooms directly in the given space from the server, including ones that haven't
+// been joined.
+func (c *Container) GetSpaceChildren(spaceID string) ([]ifc.SpaceChild, error) {
+	var children []ifc.SpaceChild
+	from := ""
+	for page := 0; page < maxHierarchyPages; page++ {
+		u, _ := url.Parse(c.client.BuildBaseURL("_matrix", "client", "v1", "rooms", spaceID, "hierarchy"))
+		query := u.Query()
+		query.Set("max_depth", "1")
+		if len(from) > 0 {
+			query.Set("from", from)
+		}
+		u.RawQuery = query.Encode()
+
+		var resp respSpaceHierarchy
+		if _, err := c.client.MakeRequest("GET", u.String(), nil, &resp); err != nil {
+			return children, err
+		}
+		for _, child := range resp.Rooms {
+			// The space itself is included in the response.
+			if child.RoomID != spaceID {
+				children = append(children, child)
+			}
+		}
+		if len(resp.NextBatch) == 0 {
+			break
+		}
+		from = resp.NextBatch
+	}
+	return children, nil
+}
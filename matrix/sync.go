@@ -21,6 +21,7 @@ package matrix
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -83,6 +84,20 @@ func (es EventSource) String() string {
 	return fmt.Sprintf("unknown (%d)", es)
 }
 
+// SyncResponse is a /sync response that also contains the end-to-end encryption fields,
+// which aren't included in mautrix.RespSync.
+type SyncResponse struct {
+	mautrix.RespSync
+	ToDevice struct {
+		Events []json.RawMessage `json:"events"`
+	} `json:"to_device"`
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
+}
+
 type EventHandler func(source EventSource, event *mautrix.Event)
 
 // GomuksSyncer is the default syncing implementation. You can either write your own syncer, or selectively
@@ -93,6 +108,14 @@ type GomuksSyncer struct {
 	listeners        map[mautrix.EventType][]EventHandler // event type to listeners array
 	FirstSyncDone    bool
 	InitDoneCallback func()
+	// OnTimelineGap is called before handling the timeline of a room if it was limited, i.e. if there are events
+	// missing between the previous sync and this one.
+	OnTimelineGap func(room *rooms.Room, prevBatch string, timestamp int64)
+	// IncludePresence is whether the filter returned by GetFilterJSON includes presence events.
+	IncludePresence bool
+
+	// failures is the number of consecutive failed syncs. It's used to calculate the backoff.
+	failures int
 }
 
 // NewGomuksSyncer returns an instantiated GomuksSyncer
@@ -107,6 +130,7 @@ func NewGomuksSyncer(session SyncerSession) *GomuksSyncer {
 // ProcessResponse processes a Matrix sync response.
 func (s *GomuksSyncer) ProcessResponse(res *mautrix.RespSync, since string) (err error) {
 	debug.Print("Received sync response")
+	s.failures = 0
 	s.processSyncEvents(nil, res.Presence.Events, EventSourcePresence)
 	s.processSyncEvents(nil, res.AccountData.Events, EventSourceAccountData)
 
@@ -114,6 +138,9 @@ func (s *GomuksSyncer) ProcessResponse(res *mautrix.RespSync, since string) (err
 		room := s.Session.GetRoom(roomID)
 		room.UpdateSummary(roomData.Summary)
 		s.processSyncEvents(room, roomData.State.Events, EventSourceJoin|EventSourceState)
+		if roomData.Timeline.Limited && s.OnTimelineGap != nil {
+			s.OnTimelineGap(room, roomData.Timeline.PrevBatch, firstTimestamp(roomData.Timeline.Events))
+		}
 		s.processSyncEvents(room, roomData.Timeline.Events, EventSourceJoin|EventSourceTimeline)
 		s.processSyncEvents(room, roomData.Ephemeral.Events, EventSourceJoin|EventSourceEphemeral)
 		s.processSyncEvents(room, roomData.AccountData.Events, EventSourceJoin|EventSourceAccountData)
@@ -151,6 +178,18 @@ func (s *GomuksSyncer) ProcessResponse(res *mautrix.RespSync, since string) (err
 	return
 }
 
+// firstTimestamp returns the timestamp of the first event in the list, or zero if there are no events.
+func firstTimestamp(events []json.RawMessage) int64 {
+	if len(events) == 0 {
+		return 0
+	}
+	var evt struct {
+		Timestamp int64 `json:"origin_server_ts"`
+	}
+	_ = json.Unmarshal(events[0], &evt)
+	return evt.Timestamp
+}
+
 func (s *GomuksSyncer) processSyncEvents(room *rooms.Room, events []json.RawMessage, source EventSource) {
 	for _, event := range events {
 		s.processSyncEvent(room, event, source)
@@ -161,12 +200,12 @@ func (s *GomuksSyncer) processSyncEvent(room *rooms.Room, eventJSON json.RawMess
 	event := &mautrix.Event{}
 	err := json.Unmarshal(eventJSON, event)
 	if err != nil {
-		debug.Print("Failed to unmarshal event: %v\n%s", err, string(eventJSON))
+		debug.Printf("Failed to unmarshal event: %v\n%s", err, string(eventJSON))
 		return
 	}
 	if room != nil {
 		event.RoomID = room.ID
-		if source&EventSourceState != 0 || (source&EventSourceTimeline != 0 && event.Type.IsState() && event.StateKey != nil) {
+		if source&EventSourceState != 0 || (source&EventSourceTimeline != 0 && event.StateKey != nil) {
 			room.UpdateState(event)
 		}
 	}
@@ -201,14 +240,58 @@ func (s *GomuksSyncer) notifyListeners(source EventSource, event *mautrix.Event)
 	}
 }
 
-// OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
+const (
+	syncMinBackoff = 2 * time.Second
+	syncMaxBackoff = 5 * time.Minute
+)
+
+// syncJitter is only used from the sync goroutine, so it doesn't need locking.
+var syncJitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// RespLimitExceeded is the error body of a M_LIMIT_EXCEEDED response.
+type RespLimitExceeded struct {
+	mautrix.RespError
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+// OnFailedSync returns an exponentially increasing wait period with jitter between failed /syncs,
+// or the wait period requested by the server if it rate limited us. It never returns a fatal error.
 func (s *GomuksSyncer) OnFailedSync(res *mautrix.RespSync, err error) (time.Duration, error) {
-	debug.Printf("Sync failed: %v", err)
-	return 10 * time.Second, nil
+	s.failures++
+	if httpErr, ok := err.(mautrix.HTTPError); ok {
+		if limitErr, ok := httpErr.WrappedError.(*RespLimitExceeded); ok && limitErr.RetryAfterMs > 0 {
+			delay := time.Duration(limitErr.RetryAfterMs) * time.Millisecond
+			debug.Printf("Sync rate limited, retrying in %v", delay)
+			return delay, nil
+		}
+	}
+	delay := syncMaxBackoff
+	if s.failures <= 10 {
+		delay = syncMinBackoff << uint(s.failures-1)
+		if delay > syncMaxBackoff {
+			delay = syncMaxBackoff
+		}
+	}
+	// Wait somewhere between half and all of the backoff so that clients don't retry in sync.
+	delay = delay/2 + time.Duration(syncJitter.Int63n(int64(delay/2)))
+	debug.Printf("Sync failed (%d in a row): %v, retrying in %v", s.failures, err, delay)
+	return delay, nil
 }
 
+// FilterVersion is increased whenever the filter returned by GetFilterJSON changes, so that existing filters
+// are recreated.
+const FilterVersion = 2
+
 // GetFilterJSON returns a filter with a timeline limit of 50.
 func (s *GomuksSyncer) GetFilterJSON(userID string) json.RawMessage {
+	presence := mautrix.FilterPart{
+		NotTypes: []string{"*"},
+	}
+	if s.IncludePresence {
+		presence = mautrix.FilterPart{
+			Types: []string{"m.presence"},
+		}
+	}
 	filter := &mautrix.Filter{
 		Room: mautrix.RoomFilter{
 			IncludeLeave: false,
@@ -222,6 +305,11 @@ func (s *GomuksSyncer) GetFilterJSON(userID string) json.RawMessage {
 					"m.room.aliases",
 					"m.room.power_levels",
 					"m.room.tombstone",
+					"m.room.encryption",
+					"m.room.create",
+					"m.space.child",
+					"m.space.parent",
+					"m.room.retention",
 				},
 			},
 			Timeline: mautrix.FilterPart{
@@ -232,6 +320,7 @@ func (s *GomuksSyncer) GetFilterJSON(userID string) json.RawMessage {
 					"m.room.encrypted",
 					"m.sticker",
 					"m.reaction",
+					"m.key.verification.*",
 
 					"m.room.member",
 					"m.room.name",
@@ -240,6 +329,11 @@ func (s *GomuksSyncer) GetFilterJSON(userID string) json.RawMessage {
 					"m.room.aliases",
 					"m.room.power_levels",
 					"m.room.tombstone",
+					"m.room.encryption",
+					"m.room.create",
+					"m.space.child",
+					"m.space.parent",
+					"m.room.retention",
 				},
 				Limit: 50,
 			},
@@ -253,9 +347,7 @@ func (s *GomuksSyncer) GetFilterJSON(userID string) json.RawMessage {
 		AccountData: mautrix.FilterPart{
 			Types: []string{"m.push_rules", "m.direct", "net.maunium.gomuks.preferences"},
 		},
-		Presence: mautrix.FilterPart{
-			NotTypes: []string{"*"},
-		},
+		Presence: presence,
 	}
 	rawFilter, _ := json.Marshal(&filter)
 	return rawFilter
@@ -17,6 +17,8 @@
 package matrix_test
 
 import (
+	"encoding/json"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -32,24 +34,22 @@ func TestGomuksSyncer_ProcessResponse_Initial(t *testing.T) {
 		initDoneCalled = true
 	}
 
-	syncer.ProcessResponse(newRespSync(), "")
+	syncer.ProcessResponse(newRespSync(t, nil), "")
 	assert.True(t, syncer.FirstSyncDone)
 	assert.True(t, initDoneCalled)
 }
 
 func TestGomuksSyncer_ProcessResponse(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-synctest")
+	cache := rooms.NewRoomCache("/tmp/gomuks-synctest/rooms.gob.gz", "/tmp/gomuks-synctest/rooms", 32, 0, func() string {
+		return "@tulir:maunium.net"
+	})
 	mss := &mockSyncerSession{
 		userID: "@tulir:maunium.net",
 		rooms: map[string]*rooms.Room{
-			"!foo:maunium.net": {
-				Room: mautrix.NewRoom("!foo:maunium.net"),
-			},
-			"!bar:maunium.net": {
-				Room: mautrix.NewRoom("!bar:maunium.net"),
-			},
-			"!test:maunium.net": {
-				Room: mautrix.NewRoom("!test:maunium.net"),
-			},
+			"!foo:maunium.net":  rooms.NewRoom("!foo:maunium.net", cache),
+			"!bar:maunium.net":  rooms.NewRoom("!bar:maunium.net", cache),
+			"!test:maunium.net": rooms.NewRoom("!test:maunium.net", cache),
 		},
 	}
 	ml := &mockListener{}
@@ -98,37 +98,68 @@ func TestGomuksSyncer_ProcessResponse(t *testing.T) {
 		},
 	}
 
-	resp := newRespSync()
-	resp.Rooms.Join["!foo:maunium.net"] = join{
-		State:    events{Events: []*mautrix.Event{joinEvt}},
-		Timeline: timeline{Events: []*mautrix.Event{messageEvt, unhandledEvt}},
-	}
-	resp.Rooms.Invite["!bar:maunium.net"] = struct {
-		State struct {
-			Events []*mautrix.Event `json:"events"`
-		} `json:"invite_state"`
-	}{
-		State: events{Events: []*mautrix.Event{inviteEvt}},
+	resp := newRespSync(t, map[string]interface{}{
+		"join": map[string]interface{}{
+			"!foo:maunium.net": map[string]interface{}{
+				"state":    events{Events: []*mautrix.Event{joinEvt}},
+				"timeline": events{Events: []*mautrix.Event{messageEvt, unhandledEvt}},
+			},
+		},
+		"invite": map[string]interface{}{
+			"!bar:maunium.net": map[string]interface{}{
+				"invite_state": events{Events: []*mautrix.Event{inviteEvt}},
+			},
+		},
+		"leave": map[string]interface{}{
+			"!test:maunium.net": map[string]interface{}{
+				"state": events{Events: []*mautrix.Event{leaveEvt}},
+			},
+		},
+	})
+
+	syncer.ProcessResponse(resp, "since")
+	assert.Contains(t, ml.received, joinEvt.ID)
+	assert.Contains(t, ml.received, messageEvt.ID)
+	assert.NotContains(t, ml.received, unhandledEvt.ID)
+	assert.Contains(t, ml.received, inviteEvt.ID)
+	assert.Contains(t, ml.received, leaveEvt.ID)
+}
+
+func TestGomuksSyncer_ProcessResponse_UnknownStateType(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-synctest")
+	cache := rooms.NewRoomCache("/tmp/gomuks-synctest/rooms.gob.gz", "/tmp/gomuks-synctest/rooms", 32, 0, func() string {
+		return "@tulir:maunium.net"
+	})
+	room := rooms.NewRoom("!foo:maunium.net", cache)
+	mss := &mockSyncerSession{
+		userID: "@tulir:maunium.net",
+		rooms:  map[string]*rooms.Room{"!foo:maunium.net": room},
 	}
-	resp.Rooms.Leave["!test:maunium.net"] = struct {
-		State struct {
-			Events []*mautrix.Event `json:"events"`
-		} `json:"state"`
-		Timeline struct {
-			Events    []*mautrix.Event `json:"events"`
-			Limited   bool             `json:"limited"`
-			PrevBatch string           `json:"prev_batch"`
-		} `json:"timeline"`
-	}{
-		State: events{Events: []*mautrix.Event{leaveEvt}},
+	ml := &mockListener{}
+	syncer := matrix.NewGomuksSyncer(mss)
+	syncer.OnEventType(rooms.StateSpaceChild, ml.receive)
+	syncer.GetFilterJSON("@tulir:maunium.net")
+
+	childEvt := &mautrix.Event{
+		ID:       "!child:maunium.net",
+		Type:     mautrix.EventType{Type: "m.space.child"},
+		Sender:   "@tulir:maunium.net",
+		StateKey: ptr("!bar:maunium.net"),
+		Content: mautrix.Content{
+			Raw: map[string]interface{}{"via": []string{"maunium.net"}},
+		},
 	}
+	resp := newRespSync(t, map[string]interface{}{
+		"join": map[string]interface{}{
+			"!foo:maunium.net": map[string]interface{}{
+				"state": events{Events: []*mautrix.Event{childEvt}},
+			},
+		},
+	})
 
 	syncer.ProcessResponse(resp, "since")
-	assert.Contains(t, ml.received, joinEvt, joinEvt.ID)
-	assert.Contains(t, ml.received, messageEvt, messageEvt.ID)
-	assert.NotContains(t, ml.received, unhandledEvt, unhandledEvt.ID)
-	assert.Contains(t, ml.received, inviteEvt, inviteEvt.ID)
-	assert.Contains(t, ml.received, leaveEvt, leaveEvt.ID)
+	assert.Contains(t, ml.received, childEvt.ID)
+	assert.NotNil(t, room.GetStateEvent(rooms.StateSpaceChild, "!bar:maunium.net"))
 }
 
 type mockSyncerSession struct {
@@ -148,72 +179,26 @@ type events struct {
 	Events []*mautrix.Event `json:"events"`
 }
 
-type timeline struct {
-	Events    []*mautrix.Event `json:"events"`
-	Limited   bool             `json:"limited"`
-	PrevBatch string           `json:"prev_batch"`
-}
-type join struct {
-	State struct {
-		Events []*mautrix.Event `json:"events"`
-	} `json:"state"`
-	Timeline struct {
-		Events    []*mautrix.Event `json:"events"`
-		Limited   bool             `json:"limited"`
-		PrevBatch string           `json:"prev_batch"`
-	} `json:"timeline"`
-	Ephemeral struct {
-		Events []*mautrix.Event `json:"events"`
-	} `json:"ephemeral"`
-	AccountData struct {
-		Events []*mautrix.Event `json:"events"`
-	} `json:"account_data"`
-}
-
 func ptr(text string) *string {
 	return &text
 }
 
 type mockListener struct {
-	received []*mautrix.Event
+	received []string
 }
 
 func (ml *mockListener) receive(source matrix.EventSource, evt *mautrix.Event) {
-	ml.received = append(ml.received, evt)
+	ml.received = append(ml.received, evt.ID)
 }
 
-func newRespSync() *mautrix.RespSync {
-	resp := &mautrix.RespSync{NextBatch: "123"}
-	resp.Rooms.Join = make(map[string]struct {
-		State struct {
-			Events []*mautrix.Event `json:"events"`
-		} `json:"state"`
-		Timeline struct {
-			Events    []*mautrix.Event `json:"events"`
-			Limited   bool             `json:"limited"`
-			PrevBatch string           `json:"prev_batch"`
-		} `json:"timeline"`
-		Ephemeral struct {
-			Events []*mautrix.Event `json:"events"`
-		} `json:"ephemeral"`
-		AccountData struct {
-			Events []*mautrix.Event `json:"events"`
-		} `json:"account_data"`
-	})
-	resp.Rooms.Invite = make(map[string]struct {
-		State struct {
-			Events []*mautrix.Event `json:"events"`
-		} `json:"invite_state"`
-	})
-	resp.Rooms.Leave = make(map[string]struct {
-		State struct {
-			Events []*mautrix.Event `json:"events"`
-		} `json:"state"`
-		Timeline struct {
-			Events    []*mautrix.Event `json:"events"`
-			Limited   bool             `json:"limited"`
-			PrevBatch string           `json:"prev_batch"`
-		} `json:"timeline"`
+// newRespSync creates a sync response with the given rooms by encoding them as JSON and decoding the response.
+func newRespSync(t *testing.T, roomData map[string]interface{}) *mautrix.RespSync {
+	data, err := json.Marshal(map[string]interface{}{
+		"next_batch": "123",
+		"rooms":      roomData,
 	})
+	assert.Nil(t, err)
+	resp := &mautrix.RespSync{}
+	assert.Nil(t, json.Unmarshal(data, resp))
 	return resp
 }
@@ -0,0 +1,137 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package matrix
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+type respRelations struct {
+	Chunk     []*mautrix.Event `json:"chunk"`
+	NextBatch string           `json:"next_batch,omitempty"`
+}
+
+const (
+	// maxThreadPages limits how many pages of replies are fetched for a single thread.
+	maxThreadPages = 10
+	// threadPageSize is the number of replies requested per page.
+	threadPageSize = "50"
+)
+
+// GetThreadReplies fetches the replies in the thread started by the given event from the server and returns them
+// in chronological order. The thread summary of the root is updated in the local history to include the replies,
+// and the updated root is returned, or nil if the root isn't in the local history.
+func (c *Container) GetThreadReplies(room *rooms.Room, rootID string) ([]*event.Event, *event.Event, error) {
+	var chunk []*mautrix.Event
+	from := ""
+	for page := 0; page < maxThreadPages; page++ {
+		u, _ := url.Parse(c.client.BuildBaseURL("_matrix", "client", "v1", "rooms", room.ID, "relations", rootID, string(ifc.RelThread)))
+		query := u.Query()
+		query.Set("limit", threadPageSize)
+		if len(from) > 0 {
+			query.Set("from", from)
+		}
+		u.RawQuery = query.Encode()
+
+		var resp respRelations
+		if _, err := c.client.MakeRequest("GET", u.String(), nil, &resp); err != nil {
+			return nil, nil, err
+		}
+		chunk = append(chunk, resp.Chunk...)
+		if len(resp.NextBatch) == 0 {
+			break
+		}
+		from = resp.NextBatch
+	}
+	debug.Printf("Loaded %d replies in thread %s in %s from server", len(chunk), rootID, room.ID)
+
+	// The relations are returned newest first.
+	replies := make([]*event.Event, 0, len(chunk))
+	for i := len(chunk) - 1; i >= 0; i-- {
+		replies = append(replies, c.decryptEvent(chunk[i]))
+	}
+	var root *event.Event
+	err := c.history.Update(room, rootID, func(evt *event.Event) error {
+		if evt.Gomuks.Thread == nil {
+			evt.Gomuks.Thread = &event.ThreadInfo{}
+		}
+		for _, reply := range replies {
+			evt.Gomuks.Thread.AddReply(reply)
+		}
+		root = evt
+		return nil
+	})
+	if err != nil {
+		if err != EventNotFoundError && err != RoomNotFoundError {
+			debug.Printf("Failed to update thread summary of %s in history db: %v", rootID, err)
+		}
+		root = nil
+	}
+	return replies, root, nil
+}
+
+// threadRelation is the m.relates_to field of sent thread replies. mautrix.RelatesTo isn't used, because it can't
+// contain both the thread relation and the reply fallback for clients that don't support threads.
+type threadRelation struct {
+	Type          mautrix.RelationType `json:"rel_type"`
+	EventID       string               `json:"event_id"`
+	IsFallingBack bool                 `json:"is_falling_back"`
+	InReplyTo     threadInReplyTo      `json:"m.in_reply_to"`
+}
+
+type threadInReplyTo struct {
+	EventID string `json:"event_id"`
+}
+
+// latestThreadEvent returns the ID of the latest known reply in the thread, or the root ID if there are no replies.
+func (c *Container) latestThreadEvent(room *rooms.Room, rootID string) string {
+	root, err := c.history.Get(room, rootID)
+	if err != nil || root == nil || root.Gomuks.Thread == nil || len(root.Gomuks.Thread.Replies) == 0 {
+		return rootID
+	}
+	replies := root.Gomuks.Thread.Replies
+	return replies[len(replies)-1]
+}
+
+// threadReplyContent returns the content of the given thread reply with a reply to the latest event in the thread
+// as the fallback for clients that don't support threads.
+func (c *Container) threadReplyContent(room *rooms.Room, content *mautrix.Content) (map[string]interface{}, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	rootID := content.RelatesTo.EventID
+	raw["m.relates_to"] = &threadRelation{
+		Type:          ifc.RelThread,
+		EventID:       rootID,
+		IsFallingBack: true,
+		InReplyTo:     threadInReplyTo{EventID: c.latestThreadEvent(room, rootID)},
+	}
+	return raw, nil
+}
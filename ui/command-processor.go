@@ -71,7 +71,7 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 		gomuksPointerContainer: gomuksPointerContainer{
 			MainView: parent,
 			UI:       parent.parent,
-			Matrix:   parent.matrix,
+			Matrix:   parent.gmx.Matrix(),
 			Config:   parent.config,
 			Gomuks:   parent.gmx,
 		},
@@ -96,40 +96,69 @@ func NewCommandProcessor(parent *MainView) *CommandProcessor {
 		commands: map[string]CommandHandler{
 			"unknown-command": cmdUnknownCommand,
 
-			"id":         cmdID,
-			"help":       cmdHelp,
-			"me":         cmdMe,
-			"quit":       cmdQuit,
-			"clearcache": cmdClearCache,
-			"leave":      cmdLeave,
-			"create":     cmdCreateRoom,
-			"pm":         cmdPrivateMessage,
-			"join":       cmdJoin,
-			"kick":       cmdKick,
-			"ban":        cmdBan,
-			"unban":      cmdUnban,
-			"toggle":     cmdToggle,
-			"logout":     cmdLogout,
-			"accept":     cmdAccept,
-			"reject":     cmdReject,
-			"reply":      cmdReply,
-			"redact":     cmdRedact,
-			"react":      cmdReact,
-			"sendevent":  cmdSendEvent,
-			"msendevent": cmdMSendEvent,
-			"setstate":   cmdSetState,
-			"msetstate":  cmdMSetState,
-			"roomnick":   cmdRoomNick,
-			"rainbow":    cmdRainbow,
-			"rainbowme":  cmdRainbowMe,
-			"notice":     cmdNotice,
-			"tags":       cmdTags,
-			"tag":        cmdTag,
-			"untag":      cmdUntag,
-			"invite":     cmdInvite,
-			"hprof":      cmdHeapProfile,
-			"cprof":      cmdCPUProfile,
-			"trace":      cmdTrace,
+			"id":          cmdID,
+			"help":        cmdHelp,
+			"me":          cmdMe,
+			"quit":        cmdQuit,
+			"clearcache":  cmdClearCache,
+			"media":       cmdMedia,
+			"leave":       cmdLeave,
+			"create":      cmdCreateRoom,
+			"pm":          cmdPrivateMessage,
+			"join":        cmdJoin,
+			"directory":   cmdDirectory,
+			"search":      cmdSearch,
+			"kick":        cmdKick,
+			"ban":         cmdBan,
+			"unban":       cmdUnban,
+			"op":          cmdOp,
+			"deop":        cmdDeop,
+			"powerlevels": cmdPowerLevels,
+			"toggle":      cmdToggle,
+			"logout":      cmdLogout,
+			"addaccount":  cmdAddAccount,
+			"presence":    cmdPresence,
+			"accept":      cmdAccept,
+			"reject":      cmdReject,
+			"reply":       cmdReply,
+			"redact":      cmdRedact,
+			"react":       cmdReact,
+			"resend":      cmdResend,
+			"cancel":      cmdCancel,
+			"receipts":    cmdReceipts,
+			"thread":      cmdThread,
+			"upload":      cmdUpload,
+			"download":    cmdDownload,
+			"open":        cmdOpen,
+			"sendevent":   cmdSendEvent,
+			"msendevent":  cmdMSendEvent,
+			"setstate":    cmdSetState,
+			"msetstate":   cmdMSetState,
+			"roomnick":    cmdRoomNick,
+			"rainbow":     cmdRainbow,
+			"rainbowme":   cmdRainbowMe,
+			"notice":      cmdNotice,
+			"tags":        cmdTags,
+			"space":       cmdSpace,
+			"tag":         cmdTag,
+			"untag":       cmdUntag,
+			"invite":      cmdInvite,
+			"verify":      cmdVerify,
+			"export-keys": cmdExportKeys,
+			"import-keys": cmdImportKeys,
+			"hprof":       cmdHeapProfile,
+			"cprof":       cmdCPUProfile,
+			"trace":       cmdTrace,
+
+			"topic":              cmdTopic,
+			"roomname":           cmdRoomName,
+			"alias":              cmdAlias,
+			"joinrule":           cmdJoinRule,
+			"history-visibility": cmdHistoryVisibility,
+			"guestaccess":        cmdGuestAccess,
+			"serversearch":       cmdServerSearch,
+			"export":             cmdExport,
+			"compact-history":    cmdCompactHistory,
 		},
 	}
 }
@@ -140,8 +169,11 @@ func (ch *CommandProcessor) ParseCommand(roomView *RoomView, text string) *Comma
 	}
 	text = text[1:]
 	split := strings.SplitN(text, " ", -1)
+	pointers := ch.gomuksPointerContainer
+	// Commands apply to the account that the room belongs to.
+	pointers.Matrix = roomView.matrix
 	return &Command{
-		gomuksPointerContainer: ch.gomuksPointerContainer,
+		gomuksPointerContainer: pointers,
 		Handler:                ch,
 
 		Room:        roomView,
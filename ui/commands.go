@@ -20,7 +20,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"net/http"
 	"os"
 	"runtime"
 	dbg "runtime/debug"
@@ -36,6 +38,8 @@ import (
 	"maunium.net/go/mautrix"
 
 	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/rooms"
 )
 
 func cmdMe(cmd *Command) {
@@ -112,12 +116,12 @@ func cmdAccept(cmd *Command) {
 	_, server, _ := mautrix.ParseUserID(room.SessionMember.Sender)
 	_, err := cmd.Matrix.JoinRoom(room.ID, server)
 	if err != nil {
-		cmd.Reply("Failed to accept invite:", err)
+		cmd.Reply("Failed to accept invite: %v", err)
 	} else {
 		cmd.Reply("Successfully accepted invite")
 	}
 	cmd.MainView.UpdateTags(room)
-	go cmd.MainView.LoadHistory(room.ID)
+	go cmd.MainView.LoadHistory(cmd.Room)
 }
 
 func cmdReject(cmd *Command) {
@@ -141,9 +145,15 @@ func cmdID(cmd *Command) {
 type SelectReason string
 
 const (
-	SelectReply  SelectReason = "reply to"
-	SelectReact               = "react to"
-	SelectRedact              = "redact"
+	SelectReply    SelectReason = "reply to"
+	SelectReact                 = "react to"
+	SelectRedact                = "redact"
+	SelectResend                = "resend"
+	SelectCancel                = "cancel sending"
+	SelectReceipts              = "list read receipts of"
+	SelectThread                = "open the thread of"
+	SelectDownload              = "download the file of"
+	SelectOpen                  = "open"
 )
 
 func cmdReply(cmd *Command) {
@@ -154,6 +164,38 @@ func cmdRedact(cmd *Command) {
 	cmd.Room.StartSelecting(SelectRedact, strings.Join(cmd.Args, " "))
 }
 
+func cmdResend(cmd *Command) {
+	cmd.Room.StartSelecting(SelectResend, "")
+}
+
+func cmdCancel(cmd *Command) {
+	cmd.Room.StartSelecting(SelectCancel, "")
+}
+
+func cmdReceipts(cmd *Command) {
+	cmd.Room.StartSelecting(SelectReceipts, "")
+}
+
+func cmdThread(cmd *Command) {
+	cmd.Room.StartSelecting(SelectThread, strings.Join(cmd.Args, " "))
+}
+
+func cmdUpload(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply("Usage: /upload <path>")
+		return
+	}
+	go cmd.Room.SendFile(expandHome(strings.Join(cmd.Args, " ")))
+}
+
+func cmdDownload(cmd *Command) {
+	cmd.Room.StartSelecting(SelectDownload, strings.Join(cmd.Args, " "))
+}
+
+func cmdOpen(cmd *Command) {
+	cmd.Room.StartSelecting(SelectOpen, "")
+}
+
 func cmdReact(cmd *Command) {
 	if len(cmd.Args) == 0 {
 		cmd.Reply("Usage: /react <reaction>")
@@ -215,7 +257,7 @@ func cmdTag(cmd *Command) {
 		err = cmd.Matrix.Client().AddTag(cmd.Room.MxRoom().ID, cmd.Args[0], order)
 	}
 	if err != nil {
-		cmd.Reply("Failed to add tag:", err)
+		cmd.Reply("Failed to add tag: %v", err)
 	}
 }
 
@@ -226,7 +268,7 @@ func cmdUntag(cmd *Command) {
 	}
 	err := cmd.Matrix.Client().RemoveTag(cmd.Room.MxRoom().ID, cmd.Args[0])
 	if err != nil {
-		cmd.Reply("Failed to remove tag:", err)
+		cmd.Reply("Failed to remove tag: %v", err)
 	}
 }
 
@@ -236,10 +278,228 @@ func cmdRoomNick(cmd *Command) {
 	member.Displayname = strings.Join(cmd.Args, " ")
 	_, err := cmd.Matrix.Client().SendStateEvent(room.ID, mautrix.StateMember, room.SessionUserID, member)
 	if err != nil {
-		cmd.Reply("Failed to set room nick:", err)
+		cmd.Reply("Failed to set room nick: %v", err)
 	}
 }
 
+// sendRoomState sends a state event with an empty state key to the current room after checking that our power level
+// is high enough. The setting name is used in error messages.
+func sendRoomState(cmd *Command, setting string, evtType mautrix.EventType, content interface{}) bool {
+	room := cmd.Room.MxRoom()
+	err := checkPowerLevel(room, "Changing the "+setting, func(pl *mautrix.PowerLevels) int {
+		return pl.GetEventLevel(evtType)
+	}, "")
+	if err != nil {
+		cmd.Reply("Can't change the %s: %v", setting, err)
+		return false
+	}
+	_, err = cmd.Matrix.Client().SendStateEvent(room.ID, evtType, "", content)
+	if err != nil {
+		debug.Printf("Failed to change %s of %s: %v", setting, room.ID, err)
+		cmd.Reply("Failed to change the %s: %v", setting, err)
+		return false
+	}
+	return true
+}
+
+func cmdTopic(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		if topic := cmd.Room.MxRoom().GetTopic(); len(topic) > 0 {
+			cmd.Reply("Topic: %s", topic)
+		} else {
+			cmd.Reply("This room has no topic. Use /topic <text> to set one.")
+		}
+		return
+	}
+	sendRoomState(cmd, "topic", mautrix.StateTopic, map[string]interface{}{
+		"topic": strings.Join(cmd.Args, " "),
+	})
+}
+
+// maxRoomNameLength is the maximum length of room names in bytes.
+const maxRoomNameLength = 255
+
+func cmdRoomName(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		if evt := cmd.Room.MxRoom().GetStateEvent(mautrix.StateRoomName, ""); evt != nil && len(evt.Content.Name) > 0 {
+			cmd.Reply("Room name: %s", evt.Content.Name)
+		} else {
+			cmd.Reply("This room has no name. Use /roomname <name> to set one.")
+		}
+		return
+	}
+	name := strings.Join(cmd.Args, " ")
+	if len(name) > maxRoomNameLength {
+		cmd.Reply("Room names can be at most %d bytes long", maxRoomNameLength)
+		return
+	}
+	sendRoomState(cmd, "room name", mautrix.StateRoomName, map[string]interface{}{
+		"name": name,
+	})
+}
+
+// isValidAlias checks whether the given string looks like a room alias.
+func isValidAlias(alias string) bool {
+	sep := strings.IndexRune(alias, ':')
+	return strings.HasPrefix(alias, "#") && sep > 1 && sep < len(alias)-1 && !strings.ContainsAny(alias, " \t\n")
+}
+
+// canonicalAliasContent returns a copy of the content of the m.room.canonical_alias event in the given room.
+func canonicalAliasContent(room *rooms.Room) (content map[string]interface{}, altAliases []string) {
+	content = make(map[string]interface{})
+	if evt := room.GetStateEvent(mautrix.StateCanonicalAlias, ""); evt != nil {
+		for key, value := range evt.Content.Raw {
+			content[key] = value
+		}
+	}
+	rawAltAliases, _ := content["alt_aliases"].([]interface{})
+	for _, rawAlias := range rawAltAliases {
+		if alias, ok := rawAlias.(string); ok {
+			altAliases = append(altAliases, alias)
+		}
+	}
+	return
+}
+
+// withoutAlias returns the given aliases without the given alias.
+func withoutAlias(aliases []string, alias string) []string {
+	filtered := make([]string, 0, len(aliases))
+	for _, existing := range aliases {
+		if existing != alias {
+			filtered = append(filtered, existing)
+		}
+	}
+	return filtered
+}
+
+func cmdAlias(cmd *Command) {
+	room := cmd.Room.MxRoom()
+	if len(cmd.Args) == 0 {
+		content, altAliases := canonicalAliasContent(room)
+		alias, _ := content["alias"].(string)
+		if len(alias) == 0 && len(altAliases) == 0 {
+			cmd.Reply("This room has no published addresses.")
+			return
+		}
+		if len(alias) > 0 {
+			cmd.Reply("Main address: %s", alias)
+		}
+		if len(altAliases) > 0 {
+			cmd.Reply("Alternative addresses: %s", strings.Join(altAliases, ", "))
+		}
+		return
+	} else if len(cmd.Args) != 2 {
+		cmd.Reply("Usage: /alias <add/remove/canonical> <#alias:server>")
+		return
+	}
+	alias := cmd.Args[1]
+	if !isValidAlias(alias) {
+		cmd.Reply("Invalid alias %s, aliases look like #name:example.com", alias)
+		return
+	}
+	switch cmd.Args[0] {
+	case "add":
+		_, err := cmd.Matrix.Client().CreateAlias(alias, room.ID)
+		if err != nil {
+			cmd.Reply("Failed to add %s: %v", alias, err)
+			return
+		}
+		cmd.Reply("Added %s. Use /alias canonical %s to make it the main address of the room.", alias, alias)
+	case "remove":
+		_, err := cmd.Matrix.Client().DeleteAlias(alias)
+		if err != nil {
+			cmd.Reply("Failed to remove %s: %v", alias, err)
+			return
+		}
+		cmd.Reply("Removed %s", alias)
+		content, altAliases := canonicalAliasContent(room)
+		if mainAlias, _ := content["alias"].(string); mainAlias == alias || len(withoutAlias(altAliases, alias)) != len(altAliases) {
+			// Don't keep advertising the removed alias
+			if mainAlias == alias {
+				delete(content, "alias")
+			}
+			content["alt_aliases"] = withoutAlias(altAliases, alias)
+			sendRoomState(cmd, "published addresses", mautrix.StateCanonicalAlias, content)
+		}
+	case "canonical":
+		resp, err := cmd.Matrix.Client().ResolveAlias(alias)
+		if err != nil {
+			cmd.Reply("Failed to resolve %s: %v", alias, err)
+			return
+		} else if resp.RoomID != room.ID {
+			cmd.Reply("%s points to a different room (%s)", alias, resp.RoomID)
+			return
+		}
+		content, altAliases := canonicalAliasContent(room)
+		content["alias"] = alias
+		content["alt_aliases"] = withoutAlias(altAliases, alias)
+		sendRoomState(cmd, "main address", mautrix.StateCanonicalAlias, content)
+	default:
+		cmd.Reply("Usage: /alias <add/remove/canonical> <#alias:server>")
+	}
+}
+
+// fetchRoomSetting fetches a string field of a room setting state event from the server. The given default is
+// returned if the room doesn't have the state event.
+func fetchRoomSetting(cmd *Command, evtType mautrix.EventType, field, defaultValue string) (string, error) {
+	var content map[string]interface{}
+	err := cmd.Matrix.Client().StateEvent(cmd.Room.MxRoom().ID, evtType, "", &content)
+	if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.Code == http.StatusNotFound {
+		return defaultValue, nil
+	} else if err != nil {
+		return "", err
+	}
+	value, ok := content[field].(string)
+	if !ok {
+		return defaultValue, nil
+	}
+	return value, nil
+}
+
+// roomSetting shows or changes a room setting that is stored as a single string field in a state event and has a
+// fixed set of allowed values.
+func roomSetting(cmd *Command, setting string, evtType mautrix.EventType, field, defaultValue string, values []string) {
+	usage := fmt.Sprintf("Usage: /%s <%s>", cmd.Command, strings.Join(values, "/"))
+	if len(cmd.Args) == 0 {
+		current, err := fetchRoomSetting(cmd, evtType, field, defaultValue)
+		if err != nil {
+			cmd.Reply("Failed to fetch the %s: %v", setting, err)
+			return
+		}
+		cmd.Reply("The %s of this room is %s", setting, current)
+		cmd.Reply(usage)
+		return
+	} else if len(cmd.Args) != 1 {
+		cmd.Reply(usage)
+		return
+	}
+	value := strings.ToLower(cmd.Args[0])
+	for _, allowed := range values {
+		if value == allowed {
+			if sendRoomState(cmd, setting, evtType, map[string]interface{}{field: value}) {
+				cmd.Reply("Changed the %s to %s", setting, value)
+			}
+			return
+		}
+	}
+	cmd.Reply(usage)
+}
+
+func cmdJoinRule(cmd *Command) {
+	roomSetting(cmd, "join rule", mautrix.StateJoinRules, "join_rule", "invite",
+		[]string{"public", "invite", "knock"})
+}
+
+func cmdHistoryVisibility(cmd *Command) {
+	roomSetting(cmd, "history visibility", rooms.StateHistoryVisibility, "history_visibility", "shared",
+		[]string{"world_readable", "shared", "invited", "joined"})
+}
+
+func cmdGuestAccess(cmd *Command) {
+	roomSetting(cmd, "guest access", rooms.StateGuestAccess, "guest_access", "forbidden",
+		[]string{"can_join", "forbidden"})
+}
+
 func cmdHeapProfile(cmd *Command) {
 	runtime.GC()
 	dbg.FreeOSMemory()
@@ -297,10 +557,53 @@ func cmdQuit(cmd *Command) {
 }
 
 func cmdClearCache(cmd *Command) {
-	cmd.Config.Clear()
+	for _, account := range cmd.Gomuks.Accounts() {
+		account.Config().Clear()
+	}
 	cmd.Gomuks.Stop(false)
 }
 
+func cmdMedia(cmd *Command) {
+	if len(cmd.Args) != 1 {
+		cmd.Reply("Usage: /media <stats/clear/cancel>")
+		return
+	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "stats":
+		stats := cmd.Matrix.MediaCacheStats()
+		quota := "unlimited"
+		if stats.Quota > 0 {
+			quota = fmt.Sprintf("%.1f MiB", float64(stats.Quota)/1024/1024)
+		}
+		cmd.Reply("Media cache: %d files, %.1f MiB of %s", stats.Files, float64(stats.Size)/1024/1024, quota)
+	case "clear":
+		if err := cmd.Matrix.ClearMediaCache(); err != nil {
+			cmd.Reply("Failed to clear media cache: %v", err)
+		} else {
+			cmd.Reply("Media cache cleared")
+		}
+	case "cancel":
+		cmd.Reply("Cancelled %d downloads", cmd.Room.CancelDownloads())
+	default:
+		cmd.Reply("Usage: /media <stats/clear/cancel>")
+	}
+}
+
+func cmdCompactHistory(cmd *Command) {
+	cmd.Reply("Pruning and compacting history...")
+	go func() {
+		defer debug.Recover()
+		result, err := cmd.Matrix.CompactHistory()
+		if err != nil {
+			cmd.Reply("Failed to compact history: %v", err)
+		} else {
+			cmd.Reply("Pruned %d events, history database shrunk from %.1f MiB to %.1f MiB", result.PrunedEvents,
+				float64(result.SizeBefore)/1024/1024, float64(result.SizeAfter)/1024/1024)
+		}
+		cmd.UI.Render()
+	}()
+}
+
 func cmdUnknownCommand(cmd *Command) {
 	cmd.Reply("Unknown command \"%s\". Try \"/help\" for help.", cmd.Command)
 }
@@ -310,38 +613,74 @@ func cmdHelp(cmd *Command) {
 /help           - Show this "temporary" help message.
 /quit           - Quit gomuks.
 /clearcache     - Clear cache and quit gomuks.
-/logout         - Log out of Matrix.
+/media <stats/clear> - Show the size of the media cache or remove all cached media.
+/media cancel        - Cancel the file downloads started in the current room.
+/compact-history     - Prune old events from the local history and shrink the history database.
+/addaccount     - Log in to another Matrix account.
+/logout         - Log out of the account of the current room.
 /toggle <thing> - Temporary command to toggle various UI features.
 
-Things: rooms, users, baremessages, images, typingnotif
+Things: rooms, users, baremessages, images, typingnotif, presence
+
+/presence <online/unavailable/offline> [status] - Set your presence and status message.
 
 # Sending special messages
 /me <message>        - Send an emote message.
 /notice <message>    - Send a notice (generally used for bot messages).
 /rainbow <message>   - Send rainbow text (markdown not supported).
 /rainbowme <message> - Send rainbow text in an emote.
+/upload <path>       - Upload a file and send it as an image, video, audio or file message.
 /reply [text]        - Reply to the selected message.
 /react <reaction>    - React to the selected message.
 /redact [reason]    - Redact the selected message.
+/resend              - Retry sending the selected failed message.
+/cancel              - Discard the selected unsent message.
+/receipts            - List who has read the selected message.
+/thread [text]       - Open the thread of the selected message, or reply in it if text is given.
+/download [path]     - Save the file of the selected message to path or the download directory.
+/open                - Open the file or location of the selected message.
+/search [-r] <query> - Search the local history of all rooms, or only the current room with -r.
+/serversearch [-r] <query> - Search all rooms or the current room using the search API of the server.
+/export <text|html|json> <file> [date] - Save the history of the room, optionally starting from a YYYY-MM-DD date.
 
 # Rooms
 /pm <user id> <...>   - Create a private chat with the given user(s).
 /create [room name]   - Create a room.
 
 /join <room> [server] - Join a room.
+/directory [server] [search] - Browse the public room directory of a server.
 /accept               - Accept the invite.
 /reject               - Reject the invite.
 
 /invite <user id>     - Invite the given user to the room.
+/topic [topic]        - Show or change the topic of the room.
+/roomname [name]      - Show or change the name of the room.
+/alias [add/remove/canonical] [alias] - List, add or remove room addresses, or set the main address.
+/joinrule [public/invite/knock]       - Show or change who can join the room.
+/history-visibility [world_readable/shared/invited/joined] - Show or change who can read the history.
+/guestaccess [can_join/forbidden]     - Show or change whether guests can join the room.
 /roomnick <name>      - Change your per-room displayname.
 /tag <tag> <priority> - Add the room to <tag>.
 /untag <tag>          - Remove the room from <tag>.
 /tags                 - List the tags the room is in.
 
+/space [space]          - Only show the rooms in the given space, or all rooms if no space is given.
+/space browse [space]   - List the rooms in a space, including ones you haven't joined.
+
 /leave                     - Leave the current room.
 /kick   <user id> [reason] - Kick a user.
 /ban    <user id> [reason] - Ban a user.
-/unban  <user id>          - Unban a user.`)
+/unban  <user id>          - Unban a user.
+
+/op   <user id> [level] - Give a user the given power level, or 50 if no level is given.
+/deop <user id>         - Reset a user to the default power level of the room.
+/powerlevels            - Edit the power levels of the room.
+
+# Encryption
+/verify <user id> [device id] - Verify a device of the given user. If no
+                                device is given, any device can respond.
+/export-keys <file>           - Export all room keys to a passphrase-protected file.
+/import-keys <file>           - Import room keys from a passphrase-protected file.`)
 }
 
 func cmdLeave(cmd *Command) {
@@ -364,11 +703,88 @@ func cmdInvite(cmd *Command) {
 	}
 }
 
+func cmdVerify(cmd *Command) {
+	if len(cmd.Args) < 1 || len(cmd.Args) > 2 {
+		cmd.Reply("Usage: /verify <user id> [device id]")
+		return
+	}
+	mach := cmd.Matrix.Crypto()
+	if mach == nil {
+		cmd.Reply("End-to-end encryption is not enabled")
+		return
+	}
+	deviceID := ""
+	if len(cmd.Args) > 1 {
+		deviceID = cmd.Args[1]
+	}
+	_, err := mach.RequestVerification(cmd.Args[0], deviceID)
+	if err != nil {
+		debug.Print("Error requesting verification:", err)
+		cmd.Reply("Failed to request verification: %v", err)
+	}
+}
+
+func cmdExportKeys(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply("Usage: /export-keys <file>")
+		return
+	}
+	mach := cmd.Matrix.Crypto()
+	if mach == nil {
+		cmd.Reply("End-to-end encryption is not enabled")
+		return
+	}
+	path := strings.Join(cmd.Args, " ")
+	cmd.MainView.ShowModal(NewPassphraseModal(cmd.MainView, "Export Room Keys", true, func(passphrase string) {
+		cmd.Reply("Exporting room keys...")
+		data, count, err := mach.ExportKeys(passphrase)
+		if err != nil {
+			debug.Print("Error exporting keys:", err)
+			cmd.Reply("Failed to export keys: %v", err)
+			return
+		}
+		err = ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			debug.Print("Error writing key export:", err)
+			cmd.Reply("Failed to write keys to %s: %v", path, err)
+			return
+		}
+		cmd.Reply("Exported %d room keys to %s", count, path)
+	}))
+}
+
+func cmdImportKeys(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply("Usage: /import-keys <file>")
+		return
+	}
+	path := strings.Join(cmd.Args, " ")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		cmd.Reply("Failed to read %s: %v", path, err)
+		return
+	}
+	cmd.MainView.ShowModal(NewPassphraseModal(cmd.MainView, "Import Room Keys", false, func(passphrase string) {
+		cmd.Reply("Importing room keys...")
+		imported, total, err := cmd.Matrix.ImportKeys(data, passphrase)
+		if err != nil {
+			debug.Print("Error importing keys:", err)
+			cmd.Reply("Failed to import keys: %v", err)
+			return
+		}
+		cmd.Reply("Imported %d of %d room keys from %s", imported, total, path)
+	}))
+}
+
 func cmdBan(cmd *Command) {
 	if len(cmd.Args) < 1 {
 		cmd.Reply("Usage: /ban <user> [reason]")
 		return
 	}
+	if err := checkPowerLevel(cmd.Room.MxRoom(), "Banning users", (*mautrix.PowerLevels).Ban, cmd.Args[0]); err != nil {
+		cmd.Reply("Can't ban %s: %v", cmd.Args[0], err)
+		return
+	}
 	reason := "you are the weakest link, goodbye!"
 	if len(cmd.Args) >= 2 {
 		reason = strings.Join(cmd.Args[1:], " ")
@@ -398,6 +814,10 @@ func cmdKick(cmd *Command) {
 		cmd.Reply("Usage: /kick <user> [reason]")
 		return
 	}
+	if err := checkPowerLevel(cmd.Room.MxRoom(), "Kicking users", (*mautrix.PowerLevels).Kick, cmd.Args[0]); err != nil {
+		cmd.Reply("Can't kick %s: %v", cmd.Args[0], err)
+		return
+	}
 	reason := "you are the weakest link, goodbye!"
 	if len(cmd.Args) >= 2 {
 		reason = strings.Join(cmd.Args[1:], " ")
@@ -405,10 +825,75 @@ func cmdKick(cmd *Command) {
 	_, err := cmd.Matrix.Client().KickUser(cmd.Room.MxRoom().ID, &mautrix.ReqKickUser{Reason: reason, UserID: cmd.Args[0]})
 	if err != nil {
 		debug.Print("Error in kick call:", err)
-		debug.Print("Failed to kick user:", err)
+		cmd.Reply("Failed to kick user: %v", err)
 	}
 }
 
+// defaultOpLevel is the power level given by /op if no level is specified.
+const defaultOpLevel = 50
+
+func cmdOp(cmd *Command) {
+	if len(cmd.Args) < 1 || len(cmd.Args) > 2 {
+		cmd.Reply("Usage: /op <user> [level]")
+		return
+	}
+	level := defaultOpLevel
+	if len(cmd.Args) == 2 {
+		var err error
+		level, err = strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			cmd.Reply("Invalid power level %s", cmd.Args[1])
+			return
+		}
+	}
+	setUserPowerLevel(cmd, cmd.Args[0], &level)
+}
+
+func cmdDeop(cmd *Command) {
+	if len(cmd.Args) != 1 {
+		cmd.Reply("Usage: /deop <user>")
+		return
+	}
+	setUserPowerLevel(cmd, cmd.Args[0], nil)
+}
+
+// setUserPowerLevel changes the power level of a user in the current room. If level is nil, the user is reset to
+// the default power level of the room.
+func setUserPowerLevel(cmd *Command, userID string, level *int) {
+	room := cmd.Room.MxRoom()
+	err := checkPowerLevel(room, "Changing power levels", func(pl *mautrix.PowerLevels) int {
+		return pl.GetEventLevel(mautrix.StatePowerLevels)
+	}, userID)
+	if err != nil {
+		cmd.Reply("Can't change the power level of %s: %v", userID, err)
+		return
+	}
+	if ownLevel := room.GetPowerLevels().GetUserLevel(room.SessionUserID); level != nil && *level > ownLevel {
+		cmd.Reply("Can't give %s power level %d, which is higher than yours (%d)", userID, *level, ownLevel)
+		return
+	}
+	content := powerLevelContent(room)
+	users, ok := content["users"].(map[string]interface{})
+	if !ok {
+		users = make(map[string]interface{})
+		content["users"] = users
+	}
+	if level != nil {
+		users[userID] = *level
+	} else {
+		delete(users, userID)
+	}
+	_, err = cmd.Matrix.Client().SendStateEvent(room.ID, mautrix.StatePowerLevels, "", content)
+	if err != nil {
+		debug.Print("Error in power level change:", err)
+		cmd.Reply("Failed to change power level: %v", err)
+	}
+}
+
+func cmdPowerLevels(cmd *Command) {
+	cmd.MainView.ShowModal(NewPowerLevelEditor(cmd.MainView, cmd.Matrix, cmd.Room.MxRoom(), 70, 25))
+}
+
 func cmdCreateRoom(cmd *Command) {
 	req := &mautrix.ReqCreateRoom{}
 	if len(cmd.Args) > 0 {
@@ -416,7 +901,7 @@ func cmdCreateRoom(cmd *Command) {
 	}
 	room, err := cmd.Matrix.CreateRoom(req)
 	if err != nil {
-		cmd.Reply("Failed to create room:", err)
+		cmd.Reply("Failed to create room: %v", err)
 		return
 	}
 	cmd.MainView.SwitchRoom("", room)
@@ -432,7 +917,7 @@ func cmdPrivateMessage(cmd *Command) {
 	}
 	room, err := cmd.Matrix.CreateRoom(req)
 	if err != nil {
-		cmd.Reply("Failed to create room:", err)
+		cmd.Reply("Failed to create room: %v", err)
 		return
 	}
 	cmd.MainView.SwitchRoom("", room)
@@ -455,6 +940,78 @@ func cmdJoin(cmd *Command) {
 	}
 }
 
+func cmdDirectory(cmd *Command) {
+	server := ""
+	args := cmd.Args
+	// The first argument is a server name if it looks like a domain, everything else is the search term.
+	if len(args) > 0 && strings.ContainsAny(args[0], ".:") {
+		server = args[0]
+		args = args[1:]
+	}
+	cmd.MainView.ShowModal(NewRoomDirectoryModal(cmd.MainView, cmd.Matrix, server, strings.Join(args, " "), 80, 25))
+}
+
+func cmdSearch(cmd *Command) {
+	showSearch(cmd, false)
+}
+
+func cmdServerSearch(cmd *Command) {
+	showSearch(cmd, true)
+}
+
+// showSearch opens the search modal for the query in the command arguments. The query can be prefixed with -r to
+// only search the current room.
+func showSearch(cmd *Command, server bool) {
+	var room *rooms.Room
+	args := cmd.Args
+	if len(args) > 0 && (args[0] == "-r" || args[0] == "--room") {
+		room = cmd.Room.MxRoom()
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		cmd.Reply("Usage: /%s [-r] <query>", cmd.Command)
+		return
+	}
+	cmd.MainView.ShowModal(NewSearchModal(cmd.MainView, cmd.Matrix, room, server, strings.Join(args, " "), 90, 25))
+}
+
+func cmdExport(cmd *Command) {
+	if len(cmd.Args) < 2 || len(cmd.Args) > 3 {
+		cmd.Reply("Usage: /export <text|html|json> <file> [YYYY-MM-DD]")
+		return
+	}
+	format := strings.ToLower(cmd.Args[0])
+	if format != ExportText && format != ExportHTML && format != ExportJSON {
+		cmd.Reply("Unknown export format %s. Supported formats are text, html and json.", cmd.Args[0])
+		return
+	}
+	var since time.Time
+	if len(cmd.Args) == 3 {
+		var err error
+		since, err = time.ParseInLocation("2006-01-02", cmd.Args[2], time.Local)
+		if err != nil {
+			cmd.Reply("Invalid date %s, expected YYYY-MM-DD", cmd.Args[2])
+			return
+		}
+	}
+	path := expandHome(cmd.Args[1])
+	room := cmd.Room
+	go func() {
+		defer debug.Recover()
+		count, gaps, err := room.ExportHistory(format, path, since)
+		if err != nil {
+			room.AddServiceMessage(fmt.Sprintf("Failed to export history: %v", err))
+		} else if gaps > 0 {
+			room.AddServiceMessage(fmt.Sprintf("Exported %d events to %s, but the export is incomplete: "+
+				"%d gaps in the history haven't been loaded yet. Scroll through them and export again to include "+
+				"the missing messages.", count, path, gaps))
+		} else {
+			room.AddServiceMessage(fmt.Sprintf("Exported %d events to %s", count, path))
+		}
+		cmd.UI.Render()
+	}()
+}
+
 func cmdMSendEvent(cmd *Command) {
 	if len(cmd.Args) < 2 {
 		cmd.Reply("Usage: /msend <event type> <content>")
@@ -531,7 +1088,7 @@ func cmdSetState(cmd *Command) {
 
 func cmdToggle(cmd *Command) {
 	if len(cmd.Args) == 0 {
-		cmd.Reply("Usage: /toggle <rooms/users/baremessages/images/typingnotif/emojis>")
+		cmd.Reply("Usage: /toggle <rooms/users/baremessages/images/typingnotif/emojis/presence>")
 		return
 	}
 	switch cmd.Args[0] {
@@ -547,16 +1104,136 @@ func cmdToggle(cmd *Command) {
 		cmd.Config.Preferences.DisableTypingNotifs = !cmd.Config.Preferences.DisableTypingNotifs
 	case "emojis":
 		cmd.Config.Preferences.DisableEmojis = !cmd.Config.Preferences.DisableEmojis
+	case "presence":
+		cmd.Config.Preferences.EnablePresence = !cmd.Config.Preferences.EnablePresence
 	default:
-		cmd.Reply("Usage: /toggle <rooms/users/baremessages/images/typingnotif/emojis>")
+		cmd.Reply("Usage: /toggle <rooms/users/baremessages/images/typingnotif/emojis/presence>")
 		return
 	}
 	// is there a reason this is called twice?
 	// cmd.UI.Render()
 	cmd.UI.Render()
-	go cmd.Matrix.SendPreferencesToMatrix()
+	// Preferences are stored in the account data of the main account.
+	go cmd.Gomuks.Matrix().SendPreferencesToMatrix()
 }
 
 func cmdLogout(cmd *Command) {
 	cmd.Matrix.Logout()
 }
+
+func cmdPresence(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.Reply("Usage: /presence <online/unavailable/offline> [status message]")
+		return
+	} else if !cmd.Config.Preferences.EnablePresence {
+		cmd.Reply("Presence is disabled. Use /toggle presence to enable it.")
+		return
+	}
+	presence := strings.ToLower(cmd.Args[0])
+	switch presence {
+	case ifc.PresenceOnline, ifc.PresenceUnavailable, ifc.PresenceOffline:
+	default:
+		cmd.Reply("Usage: /presence <online/unavailable/offline> [status message]")
+		return
+	}
+	statusMsg := strings.Join(cmd.Args[1:], " ")
+	err := cmd.Matrix.SetPresence(presence, statusMsg)
+	if err != nil {
+		cmd.Reply("Failed to set presence: %v", err)
+	} else if len(statusMsg) > 0 {
+		cmd.Reply("Presence set to %s with status \"%s\"", presence, statusMsg)
+	} else {
+		cmd.Reply("Presence set to %s", presence)
+	}
+}
+
+// findSpace finds a joined space of the current account by room ID, alias or name.
+func findSpace(cmd *Command, identifier string) *rooms.Room {
+	cmd.MainView.roomsLock.RLock()
+	defer cmd.MainView.roomsLock.RUnlock()
+	for _, roomView := range cmd.MainView.rooms {
+		room := roomView.Room
+		if roomView.matrix != cmd.Matrix || !room.IsSpace || room.HasLeft {
+			continue
+		} else if room.ID == identifier || room.GetCanonicalAlias() == identifier ||
+			strings.EqualFold(room.GetTitle(), identifier) {
+			return room
+		}
+	}
+	return nil
+}
+
+func cmdSpace(cmd *Command) {
+	if len(cmd.Args) == 0 {
+		cmd.MainView.roomList.SetSpaceFilter(nil)
+		cmd.Reply("Showing rooms from all spaces.")
+		return
+	} else if strings.ToLower(cmd.Args[0]) == "browse" {
+		cmdBrowseSpace(cmd)
+		return
+	}
+	identifier := strings.Join(cmd.Args, " ")
+	space := findSpace(cmd, identifier)
+	if space == nil {
+		cmd.Reply("You're not in a space called \"%s\".", identifier)
+	} else if !cmd.MainView.roomList.SetSpaceFilter(space) {
+		cmd.Reply("%s isn't in the room list.", space.GetTitle())
+	} else {
+		cmd.Reply("Showing rooms in %s. Use /space without arguments to show all rooms.", space.GetTitle())
+	}
+}
+
+func cmdBrowseSpace(cmd *Command) {
+	spaceID := cmd.MainView.roomList.SpaceFilter()
+	if len(cmd.Args) > 1 {
+		identifier := strings.Join(cmd.Args[1:], " ")
+		if space := findSpace(cmd, identifier); space != nil {
+			spaceID = space.ID
+		} else {
+			// Allow browsing spaces that haven't been joined.
+			spaceID = identifier
+		}
+	} else if cmd.Room.MxRoom().IsSpace {
+		spaceID = cmd.Room.MxRoom().ID
+	}
+	if len(spaceID) == 0 {
+		cmd.Reply("Usage: /space browse <space>")
+		return
+	}
+	children, err := cmd.Matrix.GetSpaceChildren(spaceID)
+	if err != nil {
+		cmd.Reply("Failed to get rooms in space: %v", err)
+		return
+	} else if len(children) == 0 {
+		cmd.Reply("There are no rooms in that space.")
+		return
+	}
+	var resp strings.Builder
+	resp.WriteString("Rooms in the space:\n")
+	for _, child := range children {
+		name := child.Name
+		if len(name) == 0 {
+			name = child.RoomID
+		}
+		_, _ = fmt.Fprintf(&resp, "* %s", name)
+		if len(child.CanonicalAlias) > 0 {
+			_, _ = fmt.Fprintf(&resp, " (%s)", child.CanonicalAlias)
+		} else if name != child.RoomID {
+			_, _ = fmt.Fprintf(&resp, " (%s)", child.RoomID)
+		}
+		_, _ = fmt.Fprintf(&resp, " - %d members", child.NumJoinedMembers)
+		if child.RoomType == rooms.RoomTypeSpace {
+			resp.WriteString(", space")
+		}
+		if room, ok := cmd.MainView.getRoomView(cmd.Matrix.Config().UserID, child.RoomID, true); ok && !room.Room.HasLeft {
+			resp.WriteString(", joined")
+		}
+		resp.WriteRune('\n')
+	}
+	resp.WriteString("Use /join <room> to join a room.")
+	cmd.Reply(resp.String())
+}
+
+func cmdAddAccount(cmd *Command) {
+	cmd.UI.ShowLogin(cmd.Gomuks.AddAccount())
+}
@@ -0,0 +1,255 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/ui/messages"
+)
+
+// exportPageSize is the number of events requested per history page when exporting.
+const exportPageSize = 100
+
+// The formats that room history can be exported in.
+const (
+	ExportText = "text"
+	ExportHTML = "html"
+	ExportJSON = "json"
+)
+
+const exportTimeFormat = "2006-01-02 15:04:05"
+
+// ExportHistory writes the history of the room to the file at the given path. The history is walked backwards
+// until the start of the room, or until the given time if it's not zero. The format is one of ExportText,
+// ExportHTML or ExportJSON.
+//
+// Gaps in the local history aren't backfilled, so the number of gaps is returned along with the number of exported
+// events. If there are any, messages are missing from the export.
+func (view *RoomView) ExportHistory(format, path string, since time.Time) (exported, gaps int, err error) {
+	view.exportLock.Lock()
+	if view.exported >= 0 {
+		view.exportLock.Unlock()
+		return 0, 0, errors.New("an export is already in progress in this room")
+	}
+	view.exported = 0
+	view.exportLock.Unlock()
+	defer view.setExportProgress(-1)
+
+	events, err := view.collectHistory(since)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to fetch history: %v", err)
+	}
+	for _, evt := range events {
+		if evt.IsGap() {
+			gaps++
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	writer := bufio.NewWriter(file)
+	switch format {
+	case ExportText:
+		err = view.writeTextExport(writer, events)
+	case ExportHTML:
+		err = view.writeHTMLExport(writer, events)
+	case ExportJSON:
+		err = writeJSONExport(writer, events)
+	default:
+		err = fmt.Errorf("unknown export format %s", format)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return len(events) - gaps, gaps, err
+}
+
+func (view *RoomView) setExportProgress(exported int) {
+	view.exportLock.Lock()
+	view.exported = exported
+	view.exportLock.Unlock()
+	view.status.SetText(view.GetStatus())
+	view.parent.parent.Render()
+}
+
+// collectHistory loads the history of the room from the newest event backwards and returns it in chronological order.
+// The export keeps its own position in the history, so the message view isn't affected.
+func (view *RoomView) collectHistory(since time.Time) ([]*event.Event, error) {
+	sinceTS := since.UnixNano() / int64(time.Millisecond)
+	var events []*event.Event
+	var before string
+	for {
+		page, err := view.matrix.GetHistoryBefore(view.Room, before, exportPageSize)
+		if err != nil {
+			return nil, err
+		} else if len(page) == 0 {
+			break
+		}
+		// Pages are in reverse chronological order.
+		events = append(events, page...)
+		before = page[len(page)-1].ID
+		view.setExportProgress(len(events))
+		if !since.IsZero() && page[len(page)-1].Timestamp < sinceTS {
+			break
+		}
+	}
+	debug.Printf("Collected %d events from %s for export", len(events), view.Room.ID)
+
+	ordered := make([]*event.Event, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		if since.IsZero() || events[i].Timestamp >= sinceTS {
+			ordered = append(ordered, events[i])
+		}
+	}
+	return ordered, nil
+}
+
+func (view *RoomView) exportMessages(events []*event.Event, fn func(msg *messages.UIMessage) error) error {
+	mainView := view.parent.parent.MainView(view.matrix)
+	for _, evt := range events {
+		if msg := messages.ParseEvent(view.matrix, mainView, view.Room, evt); msg != nil {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeTextExport writes the messages in the same format as CapturePlaintext, but with full dates.
+func (view *RoomView) writeTextExport(w io.Writer, events []*event.Event) error {
+	return view.exportMessages(events, func(msg *messages.UIMessage) error {
+		var sender string
+		if len(msg.Sender()) > 0 {
+			sender = fmt.Sprintf(" <%s>", msg.Sender())
+		} else if msg.Type == mautrix.MsgEmote {
+			sender = fmt.Sprintf(" * %s", msg.SenderName)
+		}
+		_, err := fmt.Fprintf(w, "%s%s %s\n", msg.Timestamp.Format(exportTimeFormat), sender, msg.PlainText())
+		return err
+	})
+}
+
+const exportHTMLHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%[1]s</title>
+<style>
+body { font-family: sans-serif; background: #1e1e1e; color: #e0e0e0; }
+h2 { font-size: 1em; color: #909090; border-bottom: 1px solid #404040; }
+.message { margin: 0.2em 0; white-space: pre-wrap; }
+.time { color: #909090; font-family: monospace; }
+.sender { font-weight: bold; }
+.service { color: #909090; }
+</style>
+</head>
+<body>
+<h1>%[1]s</h1>
+`
+
+const exportHTMLFooter = `</body>
+</html>
+`
+
+func exportHTMLColor(color tcell.Color) string {
+	if hex := color.Hex(); hex >= 0 {
+		return fmt.Sprintf(` style="color: #%06x"`, hex)
+	}
+	return ""
+}
+
+// writeHTMLExport writes the messages as a standalone HTML page. Only the plaintext of messages is included, so
+// that the page doesn't contain any HTML from other users.
+func (view *RoomView) writeHTMLExport(w io.Writer, events []*event.Event) error {
+	if _, err := fmt.Fprintf(w, exportHTMLHeader, html.EscapeString(view.Room.GetTitle())); err != nil {
+		return err
+	}
+	var prevDate string
+	err := view.exportMessages(events, func(msg *messages.UIMessage) error {
+		if date := msg.FormatDate(); date != prevDate {
+			if _, err := fmt.Fprintf(w, "<h2>%s</h2>\n", html.EscapeString(date)); err != nil {
+				return err
+			}
+			prevDate = date
+		}
+		var sender string
+		if len(msg.Sender()) > 0 {
+			sender = fmt.Sprintf(`<span class="sender"%s>%s</span> `, exportHTMLColor(msg.SenderColor()), html.EscapeString(msg.Sender()))
+		} else if msg.Type == mautrix.MsgEmote {
+			sender = fmt.Sprintf(`<span class="sender"%s>* %s</span> `, exportHTMLColor(msg.SenderColor()), html.EscapeString(msg.SenderName))
+		}
+		class := "body"
+		if msg.IsService || len(sender) == 0 {
+			class = "body service"
+		}
+		_, err := fmt.Fprintf(w, `<div class="message"><span class="time">%s</span> %s<span class="%s">%s</span></div>`+"\n",
+			msg.FormatTime(), sender, class, html.EscapeString(msg.PlainText()))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, exportHTMLFooter)
+	return err
+}
+
+// exportedEvent is an event as written by the JSON export. The content is the original JSON content of the event
+// rather than the re-serialized parsed content, so fields that gomuks doesn't know about are preserved.
+type exportedEvent struct {
+	*mautrix.Event
+	Content json.RawMessage `json:"content"`
+}
+
+// writeJSONExport writes the raw events as JSON, one event per line.
+func writeJSONExport(w io.Writer, events []*event.Event) error {
+	enc := json.NewEncoder(w)
+	for _, evt := range events {
+		if evt.IsGap() {
+			continue
+		}
+		content := evt.Content.VeryRaw
+		if len(content) == 0 {
+			var err error
+			if content, err = json.Marshal(&evt.Content); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(&exportedEvent{Event: evt.Event, Content: content}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -27,16 +27,19 @@ import (
 	"maunium.net/go/mauview"
 	"maunium.net/go/tcell"
 
+	"maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/matrix/rooms"
 	"maunium.net/go/gomuks/ui/widget"
 )
 
 type MemberList struct {
 	list roomMemberList
+
+	parent *RoomView
 }
 
-func NewMemberList() *MemberList {
-	return &MemberList{}
+func NewMemberList(parent *RoomView) *MemberList {
+	return &MemberList{parent: parent}
 }
 
 type memberListItem struct {
@@ -104,23 +107,52 @@ func (ml *MemberList) Update(data map[string]*rooms.Member, levels *mautrix.Powe
 	return ml
 }
 
+// presenceMarker returns the character and style that show the presence of the given user.
+func presenceMarker(presence ifc.UserPresence) (rune, tcell.Style) {
+	switch presence.Presence {
+	case ifc.PresenceOnline:
+		return '●', tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	case ifc.PresenceUnavailable:
+		return '●', tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	default:
+		return '○', tcell.StyleDefault.Foreground(tcell.ColorGray)
+	}
+}
+
 func (ml *MemberList) Draw(screen mauview.Screen) {
 	width, _ := screen.Size()
 	sigilStyle := tcell.StyleDefault.Background(tcell.ColorGreen).Foreground(tcell.ColorWhite)
+	showPresence := ml.parent.config.Preferences.EnablePresence
 	for y, member := range ml.list {
 		if member.Sigil != ' ' {
 			screen.SetCell(0, y, sigilStyle, member.Sigil)
 		}
+		x := 1
+		var presence ifc.UserPresence
+		var hasPresence bool
+		if showPresence {
+			presence, hasPresence = ml.parent.matrix.GetPresence(member.UserID)
+			if hasPresence {
+				marker, style := presenceMarker(presence)
+				screen.SetCell(x, y, style, marker)
+			}
+			x++
+		}
+		nameWidth := runewidth.StringWidth(member.Displayname)
 		if member.Membership == "invite" {
-			widget.WriteLineSimpleColor(screen, member.Displayname, 2, y, member.Color)
-			screen.SetCell(1, y, tcell.StyleDefault, '(')
-			if sw := runewidth.StringWidth(member.Displayname); sw+2 < width {
-				screen.SetCell(sw+2, y, tcell.StyleDefault, ')')
+			widget.WriteLineSimpleColor(screen, member.Displayname, x+1, y, member.Color)
+			screen.SetCell(x, y, tcell.StyleDefault, '(')
+			if nameWidth+x+1 < width {
+				screen.SetCell(nameWidth+x+1, y, tcell.StyleDefault, ')')
 			} else {
 				screen.SetCell(width-1, y, tcell.StyleDefault, ')')
 			}
+			nameWidth += 2
 		} else {
-			widget.WriteLineSimpleColor(screen, member.Displayname, 1, y, member.Color)
+			widget.WriteLineSimpleColor(screen, member.Displayname, x, y, member.Color)
+		}
+		if statusX := x + nameWidth + 1; hasPresence && len(presence.StatusMsg) > 0 && statusX < width {
+			widget.WriteLineSimpleColor(screen, presence.StatusMsg, statusX, y, tcell.ColorGray)
 		}
 	}
 }
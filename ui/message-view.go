@@ -19,8 +19,10 @@ package ui
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/mattn/go-runewidth"
 	sync "github.com/sasha-s/go-deadlock"
@@ -32,7 +34,7 @@ import (
 	"maunium.net/go/gomuks/config"
 	"maunium.net/go/gomuks/debug"
 	"maunium.net/go/gomuks/interface"
-	"maunium.net/go/gomuks/lib/open"
+	"maunium.net/go/gomuks/matrix/rooms"
 	"maunium.net/go/gomuks/ui/messages"
 	"maunium.net/go/gomuks/ui/widget"
 )
@@ -67,8 +69,21 @@ type MessageView struct {
 	selected      *messages.UIMessage
 
 	initialHistoryLoaded bool
+	outboxLoaded         bool
+	// The room whose history is currently being loaded. This is nil until the history of the room
+	// itself has been exhausted and loading continues in the room it replaced.
+	historyRoom *rooms.Room
+	// The message to scroll to on the next draw, when the message buffer is up to date.
+	scrollTarget *messages.UIMessage
+	// When filling a gap in the history was last started. Gaps are filled when they're scrolled into view, but
+	// failed attempts are only retried after gapRetryDelay.
+	lastGapFill time.Time
+	// Set while a gap is being filled, so that only one fill request is in flight at a time.
+	fillingGap int32
 }
 
+const gapRetryDelay = 10 * time.Second
+
 func NewMessageView(parent *RoomView) *MessageView {
 	return &MessageView{
 		parent: parent,
@@ -99,6 +114,9 @@ func (view *MessageView) Unload() {
 	view.msgBuffer = make([]*messages.UIMessage, 0)
 	view.messages = make([]*messages.UIMessage, 0)
 	view.initialHistoryLoaded = false
+	view.outboxLoaded = false
+	view.historyRoom = nil
+	view.scrollTarget = nil
 	view.ScrollOffset = 0
 	view._widestSender = 5
 	view.prevMsgCount = -1
@@ -117,6 +135,18 @@ func (view *MessageView) updateWidestSender(sender string) {
 	}
 }
 
+// UpdateTrust re-checks whether the devices that sent the messages of the given user have been verified.
+func (view *MessageView) UpdateTrust(userID string) {
+	matrix := view.parent.matrix
+	view.messagesLock.RLock()
+	for _, message := range view.messages {
+		if message.SenderID == userID && message.Event != nil {
+			message.UnverifiedSender = messages.IsUnverifiedSender(matrix, message.Event)
+		}
+	}
+	view.messagesLock.RUnlock()
+}
+
 type MessageDirection int
 
 const (
@@ -151,7 +181,7 @@ func (view *MessageView) AddMessage(ifcMessage ifc.Message, direction MessageDir
 	width := view.width()
 	bare := view.config.Preferences.BareMessageView
 	if !bare {
-		width -= view.TimestampWidth + TimestampSenderGap + view.widestSender() + SenderMessageGap
+		width -= view.TimestampWidth + TimestampSenderGap + view.widestSender() + SenderMessageGap + ReadReceiptWidth
 	}
 	message.CalculateBuffer(view.config.Preferences, width)
 
@@ -195,6 +225,100 @@ func (view *MessageView) AddMessage(ifcMessage ifc.Message, direction MessageDir
 	}
 }
 
+// ReplaceGap replaces the given gap marker message with the messages that were backfilled into the gap, which must be
+// in chronological order. If the gap wasn't closed, newGap is the moved gap marker and is placed before the messages.
+// Date change messages around the gap are updated to match.
+func (view *MessageView) ReplaceGap(gap, newGap *messages.UIMessage, filled []*messages.UIMessage) {
+	width := view.width()
+	if !view.config.Preferences.BareMessageView {
+		width -= view.TimestampWidth + TimestampSenderGap + view.widestSender() + SenderMessageGap + ReadReceiptWidth
+	}
+	makeDateChange := func(message *messages.UIMessage) *messages.UIMessage {
+		dateChange := messages.NewDateChangeMessage(fmt.Sprintf("Date changed to %s", message.FormatDate()))
+		dateChange.CalculateBuffer(view.config.Preferences, width)
+		return dateChange
+	}
+
+	newMessages := make([]*messages.UIMessage, 0, len(filled)+1)
+	if newGap != nil {
+		newMessages = append(newMessages, newGap)
+	}
+	for _, message := range filled {
+		if view.getMessageByID(message.EventID) == nil {
+			newMessages = append(newMessages, message)
+		}
+	}
+
+	view.messagesLock.Lock()
+	index := -1
+	for i, msg := range view.messages {
+		if msg == gap {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		view.messagesLock.Unlock()
+		debug.Print("Called ReplaceGap() with gap that is not in the view:", gap.ID())
+		return
+	}
+	// The date change before the gap is recreated if it's still needed.
+	start := index
+	removedHeight := gap.Height()
+	if start > 0 && view.messages[start-1].IsDateChange {
+		start--
+		removedHeight += view.messages[start].Height()
+	}
+	var prev *messages.UIMessage
+	if start > 0 {
+		prev = view.messages[start-1]
+	}
+
+	inserted := make([]*messages.UIMessage, 0, len(newMessages)+2)
+	for _, message := range newMessages {
+		view.updateWidestSender(message.Sender())
+		message.CalculateBuffer(view.config.Preferences, width)
+		if prev != nil && !prev.SameDate(message) {
+			inserted = append(inserted, makeDateChange(message))
+		}
+		inserted = append(inserted, message)
+		prev = message
+	}
+	rest := view.messages[index+1:]
+	if prev != nil && len(rest) > 1 && rest[0].IsDateChange && prev.SameDate(rest[1]) {
+		removedHeight += rest[0].Height()
+		rest = rest[1:]
+	} else if prev != nil && len(rest) > 0 && !rest[0].IsDateChange && !prev.SameDate(rest[0]) {
+		inserted = append(inserted, makeDateChange(rest[0]))
+	}
+	insertedHeight := 0
+	for _, message := range inserted {
+		insertedHeight += message.Height()
+	}
+	view.messages = append(append(view.messages[:start:start], inserted...), rest...)
+	view.messagesLock.Unlock()
+
+	if newGap == nil {
+		view.deleteMessageID(gap.ID())
+	}
+	for _, message := range newMessages {
+		if len(message.ID()) > 0 {
+			view.setMessageID(message)
+		}
+	}
+	if view.selected == gap {
+		view.selected = nil
+	}
+	if view.ScrollOffset > 0 {
+		view.ScrollOffset += insertedHeight - removedHeight
+		if view.ScrollOffset < 0 {
+			view.ScrollOffset = 0
+		}
+	}
+	// Force the buffer to be recalculated on the next draw.
+	view.prevMsgCount = -1
+}
+
 func (view *MessageView) replaceMessage(original *messages.UIMessage, new *messages.UIMessage) {
 	if len(new.ID()) > 0 {
 		view.setMessageID(new)
@@ -208,6 +332,23 @@ func (view *MessageView) replaceMessage(original *messages.UIMessage, new *messa
 	view.messagesLock.Unlock()
 }
 
+func (view *MessageView) removeMessage(message *messages.UIMessage) {
+	view.deleteMessageID(message.ID())
+	view.messagesLock.Lock()
+	for index, msg := range view.messages {
+		if msg == message {
+			view.messages = append(view.messages[:index], view.messages[index+1:]...)
+			break
+		}
+	}
+	view.messagesLock.Unlock()
+	if view.selected == message {
+		view.selected = nil
+	}
+	// Force the buffer to be recalculated on the next draw.
+	view.prevMsgCount = -1
+}
+
 func (view *MessageView) getMessageByID(id string) *messages.UIMessage {
 	if id == "" {
 		return nil
@@ -313,7 +454,7 @@ func (view *MessageView) recalculateBuffers() {
 	if recalculateMessageBuffers || len(view.messages) != view.prevMsgCount {
 		width := view.width()
 		if !prefs.BareMessageView {
-			width -= view.TimestampWidth + TimestampSenderGap + view.widestSender() + SenderMessageGap
+			width -= view.TimestampWidth + TimestampSenderGap + view.widestSender() + SenderMessageGap + ReadReceiptWidth
 		}
 		view.msgBuffer = []*messages.UIMessage{}
 		view.prevMsgCount = 0
@@ -349,10 +490,13 @@ func (view *MessageView) SetSelected(message *messages.UIMessage) {
 }
 
 func (view *MessageView) handleMessageClick(message *messages.UIMessage, mod tcell.ModMask) bool {
-	if msg, ok := message.Renderer.(*messages.ImageMessage); ok && mod > 0 {
-		open.Open(msg.Path())
-		// No need to re-render
-		return false
+	switch message.Renderer.(type) {
+	case *messages.ImageMessage, *messages.FileMessage, *messages.LocationMessage:
+		if mod > 0 {
+			go view.parent.OpenMessage(message)
+			// No need to re-render
+			return false
+		}
 	}
 	view.SetSelected(message)
 	view.parent.OnSelect(view.selected)
@@ -400,7 +544,7 @@ func (view *MessageView) OnMouseEvent(event mauview.MouseEvent) bool {
 	switch event.Buttons() {
 	case tcell.WheelUp:
 		if view.IsAtTop() {
-			go view.parent.parent.LoadHistory(view.parent.Room.ID)
+			go view.parent.parent.LoadHistory(view.parent)
 		} else {
 			view.AddScrollOffset(WheelScrollOffsetDiff)
 			return true
@@ -453,6 +597,73 @@ func (view *MessageView) AddScrollOffset(diff int) {
 	if view.ScrollOffset < 0 {
 		view.ScrollOffset = 0
 	}
+	view.fillVisibleGap()
+}
+
+// visibleGap returns the newest gap marker that is on screen at the current scroll offset, or nil if there isn't one.
+func (view *MessageView) visibleGap() *messages.UIMessage {
+	top := view.ScrollOffset + view.Height()
+	view.messagesLock.RLock()
+	defer view.messagesLock.RUnlock()
+	bottom := 0
+	for i := len(view.messages) - 1; i >= 0 && bottom < top; i-- {
+		msg := view.messages[i]
+		if msg.IsGap() && bottom+msg.Height() > view.ScrollOffset {
+			return msg
+		}
+		bottom += msg.Height()
+	}
+	return nil
+}
+
+// fillVisibleGap starts filling the gap marker that is on screen, unless another gap is already being filled or the
+// last attempt was less than gapRetryDelay ago. Filling continues until the gap is closed or scrolled out of view.
+func (view *MessageView) fillVisibleGap() {
+	if time.Since(view.lastGapFill) < gapRetryDelay || !atomic.CompareAndSwapInt32(&view.fillingGap, 0, 1) {
+		return
+	}
+	gap := view.visibleGap()
+	if gap == nil {
+		atomic.StoreInt32(&view.fillingGap, 0)
+		return
+	}
+	view.lastGapFill = time.Now()
+	go func() {
+		ok := view.parent.parent.FillGap(view.parent, gap)
+		atomic.StoreInt32(&view.fillingGap, 0)
+		if ok {
+			view.lastGapFill = time.Time{}
+			view.fillVisibleGap()
+		}
+	}()
+}
+
+// ScrollToMessage selects the given message and scrolls the view so that the message is in the middle of the screen.
+func (view *MessageView) ScrollToMessage(message *messages.UIMessage) {
+	if view.selected != message {
+		view.SetSelected(message)
+	}
+	view.scrollTarget = message
+}
+
+// scrollTo changes the scroll offset to show the given message in the middle of the screen.
+// The message buffer must be up to date when calling this.
+func (view *MessageView) scrollTo(message *messages.UIMessage) {
+	index := -1
+	view.msgBufferLock.RLock()
+	for i := len(view.msgBuffer) - 1; i >= 0; i-- {
+		if view.msgBuffer[i] == message {
+			index = i
+			break
+		}
+	}
+	totalHeight := len(view.msgBuffer)
+	view.msgBufferLock.RUnlock()
+	if index == -1 {
+		return
+	}
+	view.ScrollOffset = 0
+	view.AddScrollOffset(totalHeight - 1 - index - view.Height()/2)
 }
 
 func (view *MessageView) setSize(width, height int) {
@@ -499,6 +710,8 @@ const (
 	TimestampSenderGap = 1
 	SenderSeparatorGap = 1
 	SenderMessageGap   = 3
+	// ReadReceiptWidth is the width of the column after messages where read receipts are shown.
+	ReadReceiptWidth = 3
 )
 
 func getScrollbarStyle(scrollbarHere, isTop, isBottom bool) (char rune, style tcell.Style) {
@@ -578,6 +791,10 @@ func (view *MessageView) CapturePlaintext(height int) string {
 func (view *MessageView) Draw(screen mauview.Screen) {
 	view.setSize(screen.Size())
 	view.recalculateBuffers()
+	if target := view.scrollTarget; target != nil {
+		view.scrollTarget = nil
+		view.scrollTo(target)
+	}
 
 	height := view.Height()
 	if view.TotalHeight() == 0 {
@@ -589,8 +806,13 @@ func (view *MessageView) Draw(screen mauview.Screen) {
 	messageX := usernameX + view.widestSender() + SenderMessageGap
 
 	bareMode := view.config.Preferences.BareMessageView
+	messageWidth := view.width() - messageX - ReadReceiptWidth
+	var receipts map[string][]string
 	if bareMode {
 		messageX = 0
+		messageWidth = view.width()
+	} else {
+		receipts = view.readReceiptsByEvent()
 	}
 
 	indexOffset := view.getIndexOffset(screen, height, messageX)
@@ -641,14 +863,81 @@ func (view *MessageView) Draw(screen mauview.Screen) {
 			// TODO add better indicator for edits
 			screen.SetCell(usernameX+view.widestSender(), line, tcell.StyleDefault.Foreground(tcell.ColorDarkRed), '*')
 		}
+		if msg.UnverifiedSender {
+			screen.SetCell(usernameX-TimestampSenderGap, line, tcell.StyleDefault.Foreground(tcell.ColorRed), '!')
+		}
 
 		for i := index - 1; i >= 0 && view.msgBuffer[i] == msg; i-- {
 			line--
 		}
-		msg.Draw(mauview.NewProxyScreen(screen, messageX, line, view.width()-messageX, msg.Height()))
+		msg.Draw(mauview.NewProxyScreen(screen, messageX, line, messageWidth, msg.Height()))
 		line += msg.Height()
+		if readers, ok := receipts[msg.EventID]; ok && len(msg.EventID) > 0 {
+			drawReadReceipts(screen, messageX+messageWidth, line-1, readers)
+		}
 
 		prevMsg = msg
 	}
 	view.msgBufferLock.RUnlock()
 }
+
+// readReceiptsByEvent returns the other users whose read receipt is at each event.
+func (view *MessageView) readReceiptsByEvent() map[string][]string {
+	room := view.parent.Room
+	receipts := make(map[string][]string)
+	for userID, receipt := range room.GetReadReceipts() {
+		if userID != room.SessionUserID {
+			receipts[receipt.EventID] = append(receipts[receipt.EventID], userID)
+		}
+	}
+	for _, userIDs := range receipts {
+		sort.Strings(userIDs)
+	}
+	return receipts
+}
+
+// drawReadReceipts draws a dot in the user's color for each of the given users.
+// If they don't all fit in the read receipt column, the last slot shows a plus sign instead.
+func drawReadReceipts(screen mauview.Screen, x, y int, userIDs []string) {
+	slots := ReadReceiptWidth - 1
+	for i, userID := range userIDs {
+		if i == slots-1 && len(userIDs) > slots {
+			screen.SetCell(x+1+i, y, tcell.StyleDefault.Foreground(tcell.ColorGray), '+')
+			break
+		}
+		screen.SetCell(x+1+i, y, tcell.StyleDefault.Foreground(widget.GetHashColor(userID)), '•')
+	}
+}
+
+// ReadBy returns the other users who have read the given message, i.e. whose read receipt is at that message or later.
+func (view *MessageView) ReadBy(message *messages.UIMessage) []string {
+	room := view.parent.Room
+	view.messagesLock.RLock()
+	indexes := make(map[string]int, len(view.messages))
+	for index, msg := range view.messages {
+		if len(msg.EventID) > 0 {
+			indexes[msg.EventID] = index
+		}
+	}
+	view.messagesLock.RUnlock()
+	msgIndex, msgLoaded := indexes[message.EventID]
+	msgTimestamp := message.Timestamp.UnixNano() / int64(time.Millisecond)
+
+	var readers []string
+	for userID, receipt := range room.GetReadReceipts() {
+		if userID == room.SessionUserID {
+			continue
+		}
+		receiptIndex, receiptLoaded := indexes[receipt.EventID]
+		if msgLoaded && receiptLoaded {
+			if receiptIndex >= msgIndex {
+				readers = append(readers, userID)
+			}
+		} else if receipt.Timestamp >= msgTimestamp {
+			// The receipt is for an event that isn't shown, so fall back to comparing timestamps.
+			readers = append(readers, userID)
+		}
+	}
+	sort.Strings(readers)
+	return readers
+}
@@ -77,11 +77,15 @@ type UIMessage struct {
 	State              event.OutgoingState
 	IsHighlight        bool
 	IsService          bool
+	IsDateChange       bool
 	IsSelected         bool
 	Edited             bool
+	UnverifiedSender   bool
 	Event              *event.Event
 	ReplyTo            *UIMessage
 	Reactions          ReactionSlice
+	ThreadReplies      int
+	ThreadLatest       string
 	Renderer           MessageRenderer
 }
 
@@ -92,6 +96,11 @@ func (msg *UIMessage) GetEvent() *event.Event {
 	return msg.Event
 }
 
+// IsGap returns whether the message is the marker of a gap in the history.
+func (msg *UIMessage) IsGap() bool {
+	return msg.Event != nil && msg.Event.IsGap()
+}
+
 const DateFormat = "January _2, 2006"
 const TimeFormat = "15:04:05"
 
@@ -263,9 +272,16 @@ func (msg *UIMessage) ReactionHeight() int {
 	return 0
 }
 
+func (msg *UIMessage) ThreadHeight() int {
+	if msg.ThreadReplies > 0 {
+		return 1
+	}
+	return 0
+}
+
 // Height returns the number of rows in the computed buffer (see Buffer()).
 func (msg *UIMessage) Height() int {
-	return msg.ReplyHeight() + msg.Renderer.Height() + msg.ReactionHeight()
+	return msg.ReplyHeight() + msg.Renderer.Height() + msg.ReactionHeight() + msg.ThreadHeight()
 }
 
 func (msg *UIMessage) Time() time.Time {
@@ -308,7 +324,7 @@ func (msg *UIMessage) DrawReactions(screen mauview.Screen) {
 		return
 	}
 	width, height := screen.Size()
-	screen = mauview.NewProxyScreen(screen, 0, height-1, width, 1)
+	screen = mauview.NewProxyScreen(screen, 0, height-1-msg.ThreadHeight(), width, 1)
 
 	x := 0
 	for _, reaction := range msg.Reactions {
@@ -320,10 +336,28 @@ func (msg *UIMessage) DrawReactions(screen mauview.Screen) {
 	}
 }
 
+// DrawThreadSummary draws the number of replies in the thread started by this message.
+func (msg *UIMessage) DrawThreadSummary(screen mauview.Screen) {
+	if msg.ThreadReplies == 0 {
+		return
+	}
+	_, height := screen.Size()
+	text := "1 reply in thread"
+	if msg.ThreadReplies != 1 {
+		text = fmt.Sprintf("%d replies in thread", msg.ThreadReplies)
+	}
+	if len(msg.ThreadLatest) > 0 {
+		text = fmt.Sprintf("%s, latest from %s", text, msg.ThreadLatest)
+	}
+	screen.SetCell(0, height-1, tcell.StyleDefault.Foreground(tcell.ColorGreen), '↳')
+	widget.WriteLineSimpleColor(screen, text, 2, height-1, tcell.ColorGreen)
+}
+
 func (msg *UIMessage) Draw(screen mauview.Screen) {
 	proxyScreen := msg.DrawReply(screen)
 	msg.Renderer.Draw(proxyScreen)
 	msg.DrawReactions(proxyScreen)
+	msg.DrawThreadSummary(proxyScreen)
 	if msg.IsSelected {
 		w, h := screen.Size()
 		for x := 0; x < w; x++ {
@@ -342,6 +376,7 @@ func (msg *UIMessage) Clone() *UIMessage {
 	clone := *msg
 	clone.ReplyTo = nil
 	clone.Reactions = nil
+	clone.ThreadReplies = 0
 	clone.Renderer = clone.Renderer.Clone()
 	return &clone
 }
@@ -41,16 +41,32 @@ func NewExpandedTextMessage(evt *event.Event, displayname string, text tstring.T
 	})
 }
 
+// NewUploadMessage creates a placeholder for the local echo of a media message whose file is still being uploaded.
+func NewUploadMessage(evt *event.Event, displayname string, percent int) *UIMessage {
+	text := fmt.Sprintf("Uploading %s... %d%%", evt.Content.Body, percent)
+	return NewExpandedTextMessage(evt, displayname, tstring.NewStyleTString(text, tcell.StyleDefault.Italic(true)))
+}
+
+// NewGapMessage creates the message shown for a gap marker event, i.e. where messages are missing from the history.
+func NewGapMessage(evt *event.Event) *UIMessage {
+	msg := NewExpandedTextMessage(evt, "*", tstring.NewStyleTString("Some messages are missing here",
+		tcell.StyleDefault.Italic(true).Foreground(tcell.ColorGray)))
+	msg.SenderID = "*"
+	msg.IsService = true
+	return msg
+}
+
 func NewDateChangeMessage(text string) *UIMessage {
 	midnight := time.Now()
 	midnight = time.Date(midnight.Year(), midnight.Month(), midnight.Day(),
 		0, 0, 0, 0,
 		midnight.Location())
 	return &UIMessage{
-		SenderID:   "*",
-		SenderName: "*",
-		Timestamp:  midnight,
-		IsService:  true,
+		SenderID:     "*",
+		SenderName:   "*",
+		Timestamp:    midnight,
+		IsService:    true,
+		IsDateChange: true,
 		Renderer: &ExpandedTextMessage{
 			Text: tstring.NewColorTString(text, tcell.ColorGreen),
 		},
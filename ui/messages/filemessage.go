@@ -0,0 +1,172 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/ui/messages/tstring"
+)
+
+// FileMessage is the renderer for file, video and audio messages.
+// The file itself isn't shown, only its name and metadata. It can be downloaded or opened from the UI.
+type FileMessage struct {
+	Type       mautrix.MessageType
+	Body       string
+	MimeType   string
+	Size       int
+	Duration   uint
+	Homeserver string
+	FileID     string
+	buffer     []tstring.TString
+
+	matrix ifc.MatrixContainer
+}
+
+// parseContentURL splits a mxc:// URL into the homeserver and file ID.
+func parseContentURL(mxcURL string) (homeserver, fileID string) {
+	parts := strings.SplitN(strings.TrimPrefix(mxcURL, "mxc://"), "/", 2)
+	if len(parts) != 2 || !strings.HasPrefix(mxcURL, "mxc://") {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// NewFileMessage creates a new FileMessage object with the metadata of the given event.
+func NewFileMessage(matrix ifc.MatrixContainer, evt *event.Event, displayname string) *UIMessage {
+	msg := &FileMessage{
+		Type:   evt.Content.MsgType,
+		Body:   evt.Content.Body,
+		matrix: matrix,
+	}
+	msg.Homeserver, msg.FileID = parseContentURL(evt.Content.URL)
+	if info := evt.Content.Info; info != nil {
+		msg.MimeType = info.MimeType
+		msg.Size = info.Size
+		msg.Duration = info.Duration
+	}
+	return newUIMessage(evt, displayname, msg)
+}
+
+func (msg *FileMessage) Clone() MessageRenderer {
+	return &FileMessage{
+		Type:       msg.Type,
+		Body:       msg.Body,
+		MimeType:   msg.MimeType,
+		Size:       msg.Size,
+		Duration:   msg.Duration,
+		Homeserver: msg.Homeserver,
+		FileID:     msg.FileID,
+		matrix:     msg.matrix,
+	}
+}
+
+func (msg *FileMessage) RegisterMatrix(matrix ifc.MatrixContainer) {
+	msg.matrix = matrix
+}
+
+func (msg *FileMessage) NotificationContent() string {
+	switch msg.Type {
+	case mautrix.MsgVideo:
+		return "Sent a video"
+	case mautrix.MsgAudio:
+		return "Sent an audio file"
+	default:
+		return "Sent a file"
+	}
+}
+
+func (msg *FileMessage) PlainText() string {
+	return fmt.Sprintf("%s: %s", msg.Body, msg.matrix.GetDownloadURL(msg.Homeserver, msg.FileID))
+}
+
+func (msg *FileMessage) String() string {
+	return fmt.Sprintf(`&messages.FileMessage{Type="%s", Body="%s", Homeserver="%s", FileID="%s"}`, msg.Type, msg.Body, msg.Homeserver, msg.FileID)
+}
+
+// Path returns the path where the file is cached. The file may not have been downloaded yet.
+func (msg *FileMessage) Path() string {
+	return msg.matrix.GetCachePath(msg.Homeserver, msg.FileID)
+}
+
+func (msg *FileMessage) label() string {
+	switch msg.Type {
+	case mautrix.MsgVideo:
+		return "video"
+	case mautrix.MsgAudio:
+		return "audio"
+	default:
+		return "file"
+	}
+}
+
+// metadata returns the duration, size and MIME type of the file in a human-readable format.
+func (msg *FileMessage) metadata() string {
+	var parts []string
+	if msg.Duration > 0 {
+		seconds := msg.Duration / 1000
+		parts = append(parts, fmt.Sprintf("%d:%02d", seconds/60, seconds%60))
+	}
+	if msg.Size > 0 {
+		parts = append(parts, formatSize(msg.Size))
+	}
+	if len(msg.MimeType) > 0 {
+		parts = append(parts, msg.MimeType)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatSize formats a number of bytes with a binary unit prefix.
+func formatSize(size int) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := unit, 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func (msg *FileMessage) CalculateBuffer(prefs config.UserPreferences, width int, uiMsg *UIMessage) {
+	text := tstring.NewColorTString(fmt.Sprintf("[%s] ", msg.label()), tcell.ColorBlue).
+		AppendStyle(msg.Body, tcell.StyleDefault.Foreground(uiMsg.TextColor()).Underline(true))
+	if meta := msg.metadata(); len(meta) > 0 {
+		text = text.AppendColor(fmt.Sprintf(" (%s)", meta), tcell.ColorGray)
+	}
+	msg.buffer = calculateBufferWithText(prefs, text, width, uiMsg)
+}
+
+func (msg *FileMessage) Height() int {
+	return len(msg.buffer)
+}
+
+func (msg *FileMessage) Draw(screen mauview.Screen) {
+	for y, line := range msg.buffer {
+		line.Draw(screen, 0, y)
+	}
+}
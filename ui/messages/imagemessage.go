@@ -19,9 +19,10 @@ package messages
 import (
 	"bytes"
 	"fmt"
-	"image"
 	"image/color"
 
+	sync "github.com/sasha-s/go-deadlock"
+
 	"maunium.net/go/gomuks/matrix/event"
 	"maunium.net/go/mauview"
 	"maunium.net/go/tcell"
@@ -37,41 +38,80 @@ type ImageMessage struct {
 	Body       string
 	Homeserver string
 	FileID     string
-	data       []byte
-	buffer     []tstring.TString
+	// Width is the width of the original image, or zero if the event didn't include it.
+	Width int
+
+	// lock protects the fields below, as thumbnails are loaded in the background while the message is drawn.
+	lock   sync.RWMutex
+	data   []byte
+	buffer []tstring.TString
+	// thumbnailSize is the size of the thumbnail that was last requested, or zero if nothing has been requested yet.
+	thumbnailSize int
+	loading       bool
+	// width is the width given to the last CalculateBuffer call that rendered the image, which is used to recalculate
+	// the buffer when a thumbnail has been loaded. It's zero if the image isn't being rendered.
+	width int
+	// onLoad is called after a thumbnail has been loaded and the buffer has been recalculated.
+	onLoad func()
 
 	matrix ifc.MatrixContainer
 }
 
-// NewImageMessage creates a new ImageMessage object with the provided values and the default state.
-func NewImageMessage(matrix ifc.MatrixContainer, evt *event.Event, displayname string, body, homeserver, fileID string, data []byte) *UIMessage {
-	return newUIMessage(evt, displayname, &ImageMessage{
-		Body: body,
-		Homeserver: homeserver,
-		FileID: fileID,
-		data: data,
+// thumbnailSizes are the thumbnail sizes that are requested from the server. Only requesting a few different sizes
+// means that resizing the terminal rarely causes new thumbnails to be downloaded.
+var thumbnailSizes = []int{32, 96, 320, 640, 800}
+
+// getThumbnailSize returns the smallest thumbnail size that is at least as big as the given width.
+func getThumbnailSize(width int) int {
+	for _, size := range thumbnailSizes {
+		if size >= width {
+			return size
+		}
+	}
+	return thumbnailSizes[len(thumbnailSizes)-1]
+}
+
+// NewImageMessage creates a new ImageMessage object for the given event.
+// The image isn't downloaded until the message is rendered, and then only as a thumbnail.
+func NewImageMessage(matrix ifc.MatrixContainer, evt *event.Event, displayname string) *UIMessage {
+	msg := &ImageMessage{
+		Body:   evt.Content.Body,
 		matrix: matrix,
-	})
+	}
+	msg.Homeserver, msg.FileID = parseContentURL(evt.Content.URL)
+	if info := evt.Content.Info; info != nil {
+		msg.Width = info.Width
+	}
+	return newUIMessage(evt, displayname, msg)
 }
 
 func (msg *ImageMessage) Clone() MessageRenderer {
+	msg.lock.RLock()
+	defer msg.lock.RUnlock()
 	data := make([]byte, len(msg.data))
 	copy(data, msg.data)
 	return &ImageMessage{
-		Body:        msg.Body,
-		Homeserver:  msg.Homeserver,
-		FileID:      msg.FileID,
-		data:        data,
-		matrix:      msg.matrix,
+		Body:          msg.Body,
+		Homeserver:    msg.Homeserver,
+		FileID:        msg.FileID,
+		Width:         msg.Width,
+		data:          data,
+		thumbnailSize: msg.thumbnailSize,
+		onLoad:        msg.onLoad,
+		matrix:        msg.matrix,
 	}
 }
 
+// SetOnLoad sets the function that is called when a thumbnail has been loaded in the background, which changes the
+// buffer and usually the height of the message.
+func (msg *ImageMessage) SetOnLoad(onLoad func()) {
+	msg.lock.Lock()
+	msg.onLoad = onLoad
+	msg.lock.Unlock()
+}
+
 func (msg *ImageMessage) RegisterMatrix(matrix ifc.MatrixContainer) {
 	msg.matrix = matrix
-
-	if len(msg.data) == 0 {
-		go msg.updateData()
-	}
 }
 
 func (msg *ImageMessage) NotificationContent() string {
@@ -86,60 +126,93 @@ func (msg *ImageMessage) String() string {
 	return fmt.Sprintf(`&messages.ImageMessage{Body="%s", Homeserver="%s", FileID="%s"}`, msg.Body, msg.Homeserver, msg.FileID)
 }
 
-func (msg *ImageMessage) updateData() {
+func (msg *ImageMessage) loadThumbnail(size int) {
 	defer debug.Recover()
-	debug.Print("Loading image:", msg.Homeserver, msg.FileID)
-	data, _, _, err := msg.matrix.Download(fmt.Sprintf("mxc://%s/%s", msg.Homeserver, msg.FileID))
+	debug.Printf("Loading %dx%d thumbnail of %s/%s", size, size, msg.Homeserver, msg.FileID)
+	data, err := msg.matrix.DownloadThumbnail(fmt.Sprintf("mxc://%s/%s", msg.Homeserver, msg.FileID), size, size)
+	msg.lock.Lock()
+	msg.loading = false
 	if err != nil {
-		debug.Printf("Failed to download image %s/%s: %v", msg.Homeserver, msg.FileID, err)
-		return
+		debug.Printf("Failed to download thumbnail of %s/%s: %v", msg.Homeserver, msg.FileID, err)
+	} else {
+		msg.data = data
+	}
+	if msg.width > 0 {
+		msg.renderImage()
+	}
+	onLoad := msg.onLoad
+	msg.lock.Unlock()
+	if onLoad != nil {
+		onLoad()
 	}
-	debug.Print("Image", msg.Homeserver, msg.FileID, "loaded.")
-	msg.data = data
-}
-
-func (msg *ImageMessage) Path() string {
-	return msg.matrix.GetCachePath(msg.Homeserver, msg.FileID)
 }
 
 // CalculateBuffer generates the internal buffer for this message that consists
 // of the text of this message split into lines at most as wide as the width
 // parameter. If the message width is larger than the width of the buffer
 // the message is scaled to one third the buffer width.
+//
+// Thumbnails are always downloaded in the background: a placeholder is shown until the first one has been loaded,
+// and if the width grows enough to need a bigger thumbnail, the smaller one is shown until the bigger one is loaded.
+// The buffer is recalculated and the onLoad function called whenever a thumbnail has been loaded.
 func (msg *ImageMessage) CalculateBuffer(prefs config.UserPreferences, width int, uiMsg *UIMessage) {
 	if width < 2 {
 		return
 	}
+	msg.lock.Lock()
+	defer msg.lock.Unlock()
 
 	if prefs.BareMessageView || prefs.DisableImages {
+		msg.width = 0
 		msg.buffer = calculateBufferWithText(prefs, tstring.NewTString(msg.PlainText()), width, uiMsg)
 		return
 	}
+	msg.width = width
 
-	img, _, err := image.DecodeConfig(bytes.NewReader(msg.data))
-	if err != nil {
-		debug.Print("Image could not be decoded:", err)
+	if size := getThumbnailSize(msg.imageWidth()); msg.thumbnailSize < size && !msg.loading {
+		msg.thumbnailSize = size
+		msg.loading = true
+		go msg.loadThumbnail(size)
 	}
-	imgWidth := img.Width
-	if img.Width > width {
-		imgWidth = width / 3
+	msg.renderImage()
+}
+
+// imageWidth returns the width that the image is rendered at. The lock must be held when calling this.
+func (msg *ImageMessage) imageWidth() int {
+	if msg.Width > 0 && msg.Width <= msg.width {
+		return msg.Width
 	}
+	return msg.width / 3
+}
 
-	ansImage, err := ansimage.NewScaledFromReader(bytes.NewReader(msg.data), 0, imgWidth, color.Black)
+// renderImage renders the loaded thumbnail into the buffer. The lock must be held when calling this.
+func (msg *ImageMessage) renderImage() {
+	if len(msg.data) == 0 {
+		if msg.loading {
+			msg.buffer = []tstring.TString{tstring.NewColorTString("Loading image...", tcell.ColorGray)}
+		} else {
+			msg.buffer = []tstring.TString{tstring.NewColorTString("Failed to load image", tcell.ColorRed)}
+		}
+		return
+	}
+	ansImage, err := ansimage.NewScaledFromReader(bytes.NewReader(msg.data), 0, msg.imageWidth(), color.Black)
 	if err != nil {
 		msg.buffer = []tstring.TString{tstring.NewColorTString("Failed to display image", tcell.ColorRed)}
 		debug.Print("Failed to display image:", err)
 		return
 	}
-
 	msg.buffer = ansImage.Render()
 }
 
 func (msg *ImageMessage) Height() int {
+	msg.lock.RLock()
+	defer msg.lock.RUnlock()
 	return len(msg.buffer)
 }
 
 func (msg *ImageMessage) Draw(screen mauview.Screen) {
+	msg.lock.RLock()
+	defer msg.lock.RUnlock()
 	for y, line := range msg.buffer {
 		line.Draw(screen, 0, y)
 	}
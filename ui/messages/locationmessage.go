@@ -0,0 +1,117 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/config"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/ui/messages/tstring"
+)
+
+// LocationMessage is the renderer for location messages.
+type LocationMessage struct {
+	Body      string
+	GeoURI    string
+	Latitude  float64
+	Longitude float64
+	// HasCoordinates is false if the geo URI couldn't be parsed.
+	HasCoordinates bool
+	buffer         []tstring.TString
+}
+
+// parseGeoURI parses the coordinates in a RFC 5870 geo URI, e.g. geo:60.1699,24.9384;u=35
+func parseGeoURI(uri string) (latitude, longitude float64, ok bool) {
+	if !strings.HasPrefix(uri, "geo:") {
+		return
+	}
+	coordinates := strings.Split(strings.SplitN(uri[len("geo:"):], ";", 2)[0], ",")
+	if len(coordinates) < 2 {
+		return
+	}
+	var err error
+	if latitude, err = strconv.ParseFloat(coordinates[0], 64); err != nil {
+		return
+	} else if longitude, err = strconv.ParseFloat(coordinates[1], 64); err != nil {
+		return
+	}
+	return latitude, longitude, true
+}
+
+// NewLocationMessage creates a new LocationMessage object with the body and geo URI of the given event.
+func NewLocationMessage(evt *event.Event, displayname string) *UIMessage {
+	geoURI, _ := evt.Content.Raw["geo_uri"].(string)
+	msg := &LocationMessage{
+		Body:   evt.Content.Body,
+		GeoURI: geoURI,
+	}
+	msg.Latitude, msg.Longitude, msg.HasCoordinates = parseGeoURI(geoURI)
+	return newUIMessage(evt, displayname, msg)
+}
+
+func (msg *LocationMessage) Clone() MessageRenderer {
+	return &LocationMessage{
+		Body:           msg.Body,
+		GeoURI:         msg.GeoURI,
+		Latitude:       msg.Latitude,
+		Longitude:      msg.Longitude,
+		HasCoordinates: msg.HasCoordinates,
+	}
+}
+
+func (msg *LocationMessage) RegisterMatrix(matrix ifc.MatrixContainer) {}
+
+func (msg *LocationMessage) NotificationContent() string {
+	return "Sent a location"
+}
+
+func (msg *LocationMessage) PlainText() string {
+	return fmt.Sprintf("%s: %s", msg.Body, msg.GeoURI)
+}
+
+func (msg *LocationMessage) String() string {
+	return fmt.Sprintf(`&messages.LocationMessage{Body="%s", GeoURI="%s"}`, msg.Body, msg.GeoURI)
+}
+
+func (msg *LocationMessage) CalculateBuffer(prefs config.UserPreferences, width int, uiMsg *UIMessage) {
+	text := tstring.NewColorTString("[location] ", tcell.ColorBlue).
+		AppendColor(msg.Body, uiMsg.TextColor())
+	if msg.HasCoordinates {
+		text = text.AppendColor(fmt.Sprintf("\n%.5f, %.5f", msg.Latitude, msg.Longitude), uiMsg.TextColor())
+	}
+	if len(msg.GeoURI) > 0 {
+		text = text.AppendColor(fmt.Sprintf(" (%s)", msg.GeoURI), tcell.ColorGray)
+	}
+	msg.buffer = calculateBufferWithText(prefs, text, width, uiMsg)
+}
+
+func (msg *LocationMessage) Height() int {
+	return len(msg.buffer)
+}
+
+func (msg *LocationMessage) Draw(screen mauview.Screen) {
+	for y, line := range msg.buffer {
+		line.Draw(screen, 0, y)
+	}
+}
@@ -0,0 +1,59 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package messages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGeoURI(t *testing.T) {
+	latitude, longitude, ok := parseGeoURI("geo:60.1699,24.9384")
+	assert.True(t, ok)
+	assert.Equal(t, 60.1699, latitude)
+	assert.Equal(t, 24.9384, longitude)
+}
+
+func TestParseGeoURI_Altitude(t *testing.T) {
+	latitude, longitude, ok := parseGeoURI("geo:-33.8688,151.2093,58")
+	assert.True(t, ok)
+	assert.Equal(t, -33.8688, latitude)
+	assert.Equal(t, 151.2093, longitude)
+}
+
+func TestParseGeoURI_Parameters(t *testing.T) {
+	latitude, longitude, ok := parseGeoURI("geo:60.1699,24.9384;u=35")
+	assert.True(t, ok)
+	assert.Equal(t, 60.1699, latitude)
+	assert.Equal(t, 24.9384, longitude)
+}
+
+func TestParseGeoURI_Invalid(t *testing.T) {
+	_, _, ok := parseGeoURI("geo:60.1699")
+	assert.False(t, ok)
+	_, _, ok = parseGeoURI("geo:60.1699;24.9384")
+	assert.False(t, ok)
+	_, _, ok = parseGeoURI("geo:north,24.9384")
+	assert.False(t, ok)
+	_, _, ok = parseGeoURI("60.1699,24.9384")
+	assert.False(t, ok)
+	_, _, ok = parseGeoURI("https://example.com/geo:60,24")
+	assert.False(t, ok)
+	_, _, ok = parseGeoURI("")
+	assert.False(t, ok)
+}
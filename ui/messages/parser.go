@@ -24,7 +24,6 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/tcell"
 
-	"maunium.net/go/gomuks/debug"
 	"maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/matrix/rooms"
 	"maunium.net/go/gomuks/ui/messages/html"
@@ -48,6 +47,25 @@ func ParseEvent(matrix ifc.MatrixContainer, mainView ifc.MainView, room *rooms.R
 	if msg == nil {
 		return nil
 	}
+	msg.UnverifiedSender = IsUnverifiedSender(matrix, evt)
+	if image, ok := msg.Renderer.(*ImageMessage); ok {
+		image.SetOnLoad(func() {
+			if roomView := mainView.GetRoom(room.ID); roomView != nil {
+				roomView.MessageSizeChanged()
+			}
+		})
+	}
+	if thread := evt.Gomuks.Thread; thread != nil && len(thread.Replies) > 0 {
+		msg.ThreadReplies = len(thread.Replies)
+		msg.ThreadLatest = thread.LatestSender
+		if member := room.GetMember(thread.LatestSender); member != nil {
+			msg.ThreadLatest = member.Displayname
+		}
+	}
+	// Replies that were loaded from history aren't in the local summary, so prefer the server's count if it's higher.
+	if count := evt.Unsigned.Relations.Raw[ifc.RelThread].Count; count > msg.ThreadReplies {
+		msg.ThreadReplies = count
+	}
 	if len(evt.Content.GetReplyTo()) > 0 {
 		if replyToMsg := getCachedEvent(mainView, room.ID, evt.Content.GetReplyTo()); replyToMsg != nil {
 			msg.ReplyTo = replyToMsg.Clone()
@@ -65,6 +83,16 @@ func ParseEvent(matrix ifc.MatrixContainer, mainView ifc.MainView, room *rooms.R
 	return msg
 }
 
+// IsUnverifiedSender checks whether the given event was decrypted and sent from a device that hasn't been verified.
+func IsUnverifiedSender(matrix ifc.MatrixContainer, evt *event.Event) bool {
+	info := evt.Gomuks.Encryption
+	if info == nil {
+		return false
+	}
+	mach := matrix.Crypto()
+	return mach == nil || !mach.IsDeviceVerified(evt.Sender, info.SenderDevice, info.SenderKey)
+}
+
 func directParseEvent(matrix ifc.MatrixContainer, room *rooms.Room, evt *event.Event) *UIMessage {
 	displayname := evt.Sender
 	member := room.GetMember(evt.Sender)
@@ -81,11 +109,17 @@ func directParseEvent(matrix ifc.MatrixContainer, room *rooms.Room, evt *event.E
 	case mautrix.EventMessage:
 		return ParseMessage(matrix, room, evt, displayname)
 	case mautrix.EventEncrypted:
-		return NewExpandedTextMessage(evt, displayname, tstring.NewStyleTString("Encrypted messages are not yet supported", tcell.StyleDefault.Italic(true)))
-	case mautrix.StateTopic, mautrix.StateRoomName, mautrix.StateAliases, mautrix.StateCanonicalAlias:
+		text := "Unable to decrypt message"
+		if len(evt.Gomuks.DecryptionError) > 0 {
+			text = fmt.Sprintf("%s: %s", text, evt.Gomuks.DecryptionError)
+		}
+		return NewExpandedTextMessage(evt, displayname, tstring.NewStyleTString(text, tcell.StyleDefault.Italic(true)))
+	case mautrix.StateTopic, mautrix.StateRoomName, mautrix.StateAliases, mautrix.StateCanonicalAlias, mautrix.StateTombstone:
 		return ParseStateEvent(evt, displayname)
 	case mautrix.StateMember:
 		return ParseMembershipEvent(room, evt)
+	case event.TypeGap:
+		return NewGapMessage(evt)
 	}
 
 	return nil
@@ -120,6 +154,15 @@ func ParseStateEvent(evt *event.Event, displayname string) *UIMessage {
 		}
 	case mautrix.StateAliases:
 		text = ParseAliasEvent(evt, displayname)
+	case mautrix.StateTombstone:
+		if len(evt.Content.ReplacementRoom) == 0 {
+			text = text.AppendColor(" shut down this room.", tcell.ColorGreen)
+		} else {
+			text = text.AppendColor(" replaced this room with a new version.", tcell.ColorGreen)
+		}
+		if len(evt.Content.Body) > 0 {
+			text = text.AppendColor(" "+evt.Content.Body, tcell.ColorGreen)
+		}
 	}
 	return NewExpandedTextMessage(evt, displayname, text)
 }
@@ -139,11 +182,11 @@ func ParseMessage(matrix ifc.MatrixContainer, room *rooms.Room, evt *event.Event
 		evt.Content.Body = strings.Replace(evt.Content.Body, "\t", "    ", -1)
 		return NewTextMessage(evt, displayname, evt.Content.Body)
 	case "m.image":
-		data, hs, id, err := matrix.Download(evt.Content.URL)
-		if err != nil {
-			debug.Printf("Failed to download %s: %v", evt.Content.URL, err)
-		}
-		return NewImageMessage(matrix, evt, displayname, evt.Content.Body, hs, id, data)
+		return NewImageMessage(matrix, evt, displayname)
+	case "m.file", "m.video", "m.audio":
+		return NewFileMessage(matrix, evt, displayname)
+	case "m.location":
+		return NewLocationMessage(evt, displayname)
 	}
 	return nil
 }
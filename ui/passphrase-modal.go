@@ -0,0 +1,139 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/debug"
+)
+
+type PassphraseModal struct {
+	mauview.Component
+
+	container *mauview.Box
+	errorText *mauview.TextView
+
+	fields  []*mauview.InputField
+	focused int
+
+	callback func(passphrase string)
+
+	parent *MainView
+}
+
+// NewPassphraseModal creates a modal that asks for a passphrase. If confirm is true, the passphrase must be entered
+// twice. The callback is called in a new goroutine after the modal is closed.
+func NewPassphraseModal(mainView *MainView, title string, confirm bool, callback func(passphrase string)) *PassphraseModal {
+	pm := &PassphraseModal{
+		parent:   mainView,
+		callback: callback,
+	}
+
+	flex := mauview.NewFlex().SetDirection(mauview.FlexRow)
+	labels := []string{"Passphrase:"}
+	if confirm {
+		labels = append(labels, "Confirm passphrase:")
+	}
+	for _, label := range labels {
+		field := mauview.NewInputField().
+			SetMaskCharacter('*').
+			SetTextColor(tcell.ColorWhite).
+			SetBackgroundColor(tcell.ColorDarkCyan)
+		pm.fields = append(pm.fields, field)
+		flex.AddFixedComponent(mauview.NewTextView().SetText(label), 1).
+			AddFixedComponent(field, 1).
+			AddFixedComponent(mauview.NewTextView(), 1)
+	}
+	pm.errorText = mauview.NewTextView().SetTextColor(tcell.ColorRed)
+	flex.AddProportionalComponent(pm.errorText, 1)
+	pm.fields[0].Focus()
+
+	pm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(title).
+		SetBlurCaptureFunc(func() bool {
+			pm.parent.HideModal()
+			return true
+		})
+
+	height := len(labels)*3 + 3
+	pm.Component = mauview.Center(pm.container, 50, height).SetAlwaysFocusChild(true)
+
+	return pm
+}
+
+func (pm *PassphraseModal) Focus() {
+	pm.container.Focus()
+}
+
+func (pm *PassphraseModal) Blur() {
+	pm.container.Blur()
+}
+
+func (pm *PassphraseModal) focus(index int) {
+	pm.fields[pm.focused].Blur()
+	pm.focused = index % len(pm.fields)
+	pm.fields[pm.focused].Focus()
+}
+
+func (pm *PassphraseModal) submit() {
+	passphrase := pm.fields[0].GetText()
+	if len(passphrase) == 0 {
+		pm.errorText.SetText("Passphrase can't be empty")
+		pm.focus(0)
+		return
+	}
+	for _, field := range pm.fields[1:] {
+		if field.GetText() != passphrase {
+			pm.errorText.SetText("Passphrases don't match")
+			return
+		}
+	}
+	pm.parent.HideModal()
+	go func() {
+		defer debug.Recover()
+		pm.callback(passphrase)
+	}()
+}
+
+func (pm *PassphraseModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	switch event.Key() {
+	case tcell.KeyEsc:
+		pm.parent.HideModal()
+		return true
+	case tcell.KeyTab, tcell.KeyDown:
+		pm.focus(pm.focused + 1)
+		return true
+	case tcell.KeyBacktab, tcell.KeyUp:
+		pm.focus(pm.focused + len(pm.fields) - 1)
+		return true
+	case tcell.KeyEnter:
+		if pm.focused < len(pm.fields)-1 {
+			pm.focus(pm.focused + 1)
+		} else {
+			pm.submit()
+		}
+		return true
+	}
+	return pm.fields[pm.focused].OnKeyEvent(event)
+}
+
+func (pm *PassphraseModal) OnPasteEvent(event mauview.PasteEvent) bool {
+	return pm.fields[pm.focused].OnPasteEvent(event)
+}
@@ -0,0 +1,274 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+// checkPowerLevel returns an error explaining why our user can't do the given action in the room, or nil if the
+// power levels allow it. If target is set, the action also requires the target user to have a lower power level
+// than us, unless the target is our own user.
+func checkPowerLevel(room *rooms.Room, action string, required func(pl *mautrix.PowerLevels) int, target string) error {
+	pl := room.GetPowerLevels()
+	ownLevel := pl.GetUserLevel(room.SessionUserID)
+	if requiredLevel := required(pl); ownLevel < requiredLevel {
+		return fmt.Errorf("%s requires power level %d, but you only have %d", action, requiredLevel, ownLevel)
+	}
+	if len(target) > 0 && target != room.SessionUserID {
+		if targetLevel := pl.GetUserLevel(target); targetLevel >= ownLevel {
+			return fmt.Errorf("%s has power level %d, which is not lower than yours (%d)", target, targetLevel, ownLevel)
+		}
+	}
+	return nil
+}
+
+// powerLevelContent returns a copy of the raw content of the power level event of the given room, which can be
+// modified and sent back to the server without affecting the stored room state.
+func powerLevelContent(room *rooms.Room) map[string]interface{} {
+	content := make(map[string]interface{})
+	evt := room.GetStateEvent(mautrix.StatePowerLevels, "")
+	if evt == nil {
+		return content
+	}
+	for key, value := range evt.Content.Raw {
+		if valueMap, ok := value.(map[string]interface{}); ok {
+			valueMapCopy := make(map[string]interface{}, len(valueMap))
+			for subKey, subValue := range valueMap {
+				valueMapCopy[subKey] = subValue
+			}
+			value = valueMapCopy
+		}
+		content[key] = value
+	}
+	return content
+}
+
+// powerLevelThresholds are the top-level power level fields shown in the power level editor, in display order.
+var powerLevelThresholds = []struct {
+	key   string
+	level func(pl *mautrix.PowerLevels) int
+}{
+	{"users_default", func(pl *mautrix.PowerLevels) int { return pl.UsersDefault }},
+	{"events_default", func(pl *mautrix.PowerLevels) int { return pl.EventsDefault }},
+	{"state_default", (*mautrix.PowerLevels).StateDefault},
+	{"ban", (*mautrix.PowerLevels).Ban},
+	{"kick", (*mautrix.PowerLevels).Kick},
+	{"redact", (*mautrix.PowerLevels).Redact},
+	{"invite", (*mautrix.PowerLevels).Invite},
+}
+
+// formatPowerLevels formats the power levels in the line-based format used by the power level editor.
+func formatPowerLevels(pl *mautrix.PowerLevels) string {
+	var buf strings.Builder
+	for _, threshold := range powerLevelThresholds {
+		_, _ = fmt.Fprintf(&buf, "%s: %d\n", threshold.key, threshold.level(pl))
+	}
+
+	users := make([]string, 0, len(pl.Users))
+	for userID := range pl.Users {
+		users = append(users, userID)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if pl.Users[users[i]] != pl.Users[users[j]] {
+			return pl.Users[users[i]] > pl.Users[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	buf.WriteString("\nusers:\n")
+	for _, userID := range users {
+		_, _ = fmt.Fprintf(&buf, "  %s: %d\n", userID, pl.Users[userID])
+	}
+
+	events := make([]string, 0, len(pl.Events))
+	for evtType := range pl.Events {
+		events = append(events, evtType)
+	}
+	sort.Strings(events)
+	buf.WriteString("\nevents:\n")
+	for _, evtType := range events {
+		_, _ = fmt.Fprintf(&buf, "  %s: %d\n", evtType, pl.Events[evtType])
+	}
+	return buf.String()
+}
+
+// parsePowerLevels parses text in the format produced by formatPowerLevels into the given power level content.
+// Fields the editor doesn't know about are left untouched.
+func parsePowerLevels(text string, content map[string]interface{}) error {
+	thresholds := make(map[string]bool, len(powerLevelThresholds))
+	for _, threshold := range powerLevelThresholds {
+		thresholds[threshold.key] = true
+	}
+	sections := map[string]map[string]interface{}{
+		"users":  {},
+		"events": {},
+	}
+	var section map[string]interface{}
+	for lineNum, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if !indented && strings.HasSuffix(trimmed, ":") {
+			var ok bool
+			section, ok = sections[strings.TrimSuffix(trimmed, ":")]
+			if !ok {
+				return fmt.Errorf("line %d: unknown section %s", lineNum+1, trimmed)
+			}
+			continue
+		}
+		// User IDs contain colons, so the last one separates the key and the level.
+		sep := strings.LastIndexByte(trimmed, ':')
+		if sep <= 0 {
+			return fmt.Errorf("line %d: expected key: level", lineNum+1)
+		}
+		key := strings.TrimSpace(trimmed[:sep])
+		level, err := strconv.Atoi(strings.TrimSpace(trimmed[sep+1:]))
+		if err != nil {
+			return fmt.Errorf("line %d: invalid power level for %s", lineNum+1, key)
+		}
+		if indented {
+			if section == nil {
+				return fmt.Errorf("line %d: %s is not in the users or events section", lineNum+1, key)
+			}
+			section[key] = level
+		} else if !thresholds[key] {
+			return fmt.Errorf("line %d: unknown field %s", lineNum+1, key)
+		} else {
+			section = nil
+			content[key] = level
+		}
+	}
+	for key, values := range sections {
+		content[key] = values
+	}
+	return nil
+}
+
+// PowerLevelEditor is a modal for editing the m.room.power_levels event of a room.
+type PowerLevelEditor struct {
+	mauview.Component
+
+	container *mauview.Box
+
+	editor *mauview.InputArea
+	status *mauview.TextView
+
+	parent *MainView
+	matrix ifc.MatrixContainer
+	room   *rooms.Room
+}
+
+func NewPowerLevelEditor(mainView *MainView, matrix ifc.MatrixContainer, room *rooms.Room, width, height int) *PowerLevelEditor {
+	ple := &PowerLevelEditor{
+		parent: mainView,
+		matrix: matrix,
+		room:   room,
+	}
+
+	ple.editor = mauview.NewInputArea().
+		SetTextColor(tcell.ColorWhite).
+		SetBackgroundColor(tcell.ColorDefault)
+	ple.editor.SetText(formatPowerLevels(room.GetPowerLevels()))
+	ple.editor.Focus()
+	ple.status = mauview.NewTextView().SetWordWrap(true)
+	if err := checkPowerLevel(room, "Changing power levels", ple.requiredLevel, ""); err != nil {
+		ple.status.SetText(fmt.Sprintf("Read only: %v. Press escape to close.", err))
+	} else {
+		ple.status.SetText("Press Ctrl+S to save or escape to cancel.")
+	}
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddProportionalComponent(ple.editor, 1).
+		AddFixedComponent(ple.status, 2)
+
+	ple.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(fmt.Sprintf("Power levels in %s", room.GetTitle())).
+		SetBlurCaptureFunc(func() bool {
+			ple.parent.HideModal()
+			return true
+		})
+
+	ple.Component = mauview.Center(ple.container, width, height).SetAlwaysFocusChild(true)
+
+	return ple
+}
+
+func (ple *PowerLevelEditor) requiredLevel(pl *mautrix.PowerLevels) int {
+	return pl.GetEventLevel(mautrix.StatePowerLevels)
+}
+
+func (ple *PowerLevelEditor) Focus() {
+	ple.container.Focus()
+}
+
+func (ple *PowerLevelEditor) Blur() {
+	ple.container.Blur()
+}
+
+func (ple *PowerLevelEditor) save() {
+	defer debug.Recover()
+	if err := checkPowerLevel(ple.room, "Changing power levels", ple.requiredLevel, ""); err != nil {
+		ple.setStatus(fmt.Sprintf("Can't save: %v", err))
+		return
+	}
+	content := powerLevelContent(ple.room)
+	if err := parsePowerLevels(ple.editor.GetText(), content); err != nil {
+		ple.setStatus(fmt.Sprintf("Can't save: %v", err))
+		return
+	}
+	ple.setStatus("Saving...")
+	_, err := ple.matrix.Client().SendStateEvent(ple.room.ID, mautrix.StatePowerLevels, "", content)
+	if err != nil {
+		debug.Print("Failed to save power levels:", err)
+		ple.setStatus(fmt.Sprintf("Failed to save power levels: %v", err))
+		return
+	}
+	ple.parent.HideModal()
+	ple.parent.parent.Render()
+}
+
+func (ple *PowerLevelEditor) setStatus(text string) {
+	ple.status.SetText(text)
+	ple.parent.parent.Render()
+}
+
+func (ple *PowerLevelEditor) OnKeyEvent(event mauview.KeyEvent) bool {
+	switch event.Key() {
+	case tcell.KeyEsc:
+		ple.parent.HideModal()
+		return true
+	case tcell.KeyCtrlS:
+		go ple.save()
+		return true
+	}
+	return ple.editor.OnKeyEvent(event)
+}
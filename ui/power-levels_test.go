@@ -0,0 +1,201 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+
+	"maunium.net/go/gomuks/matrix/rooms"
+)
+
+var plTestCache *rooms.RoomCache
+
+func init() {
+	plTestCache = rooms.NewRoomCache("/tmp/gomuks-pltest/rooms.gob.gz", "/tmp/gomuks-pltest/rooms", 32, 0, func() string {
+		return "@tulir:maunium.net"
+	})
+}
+
+func newPowerLevelEvent(pl *mautrix.PowerLevels) *mautrix.Event {
+	stateKey := ""
+	return &mautrix.Event{
+		Type:     mautrix.StatePowerLevels,
+		Sender:   "@admin:maunium.net",
+		StateKey: &stateKey,
+		Content:  mautrix.Content{PowerLevels: pl},
+	}
+}
+
+func TestCheckPowerLevel_Allowed(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-pltest")
+	room := rooms.NewRoom("!foo:maunium.net", plTestCache)
+	room.UpdateState(newPowerLevelEvent(&mautrix.PowerLevels{
+		Users: map[string]int{"@tulir:maunium.net": 50},
+	}))
+
+	err := checkPowerLevel(room, "Kicking", (*mautrix.PowerLevels).Kick, "")
+	assert.Nil(t, err)
+}
+
+func TestCheckPowerLevel_NotAllowed(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-pltest")
+	room := rooms.NewRoom("!foo:maunium.net", plTestCache)
+	room.UpdateState(newPowerLevelEvent(&mautrix.PowerLevels{
+		Users: map[string]int{"@tulir:maunium.net": 10},
+	}))
+
+	err := checkPowerLevel(room, "Kicking", (*mautrix.PowerLevels).Kick, "")
+	assert.EqualError(t, err, "Kicking requires power level 50, but you only have 10")
+}
+
+func TestCheckPowerLevel_CustomLevel(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-pltest")
+	kick := 5
+	room := rooms.NewRoom("!foo:maunium.net", plTestCache)
+	room.UpdateState(newPowerLevelEvent(&mautrix.PowerLevels{
+		Users:   map[string]int{"@tulir:maunium.net": 10},
+		KickPtr: &kick,
+	}))
+
+	err := checkPowerLevel(room, "Kicking", (*mautrix.PowerLevels).Kick, "")
+	assert.Nil(t, err)
+}
+
+func TestCheckPowerLevel_NoPowerLevels(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-pltest")
+	room := rooms.NewRoom("!foo:maunium.net", plTestCache)
+
+	err := checkPowerLevel(room, "Kicking", (*mautrix.PowerLevels).Kick, "")
+	assert.EqualError(t, err, "Kicking requires power level 50, but you only have 0")
+}
+
+func TestCheckPowerLevel_LowerTarget(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-pltest")
+	room := rooms.NewRoom("!foo:maunium.net", plTestCache)
+	room.UpdateState(newPowerLevelEvent(&mautrix.PowerLevels{
+		Users: map[string]int{"@tulir:maunium.net": 50, "@you:maunium.net": 49},
+	}))
+
+	err := checkPowerLevel(room, "Kicking", (*mautrix.PowerLevels).Kick, "@you:maunium.net")
+	assert.Nil(t, err)
+}
+
+func TestCheckPowerLevel_EqualTarget(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-pltest")
+	room := rooms.NewRoom("!foo:maunium.net", plTestCache)
+	room.UpdateState(newPowerLevelEvent(&mautrix.PowerLevels{
+		Users: map[string]int{"@tulir:maunium.net": 50, "@you:maunium.net": 50},
+	}))
+
+	err := checkPowerLevel(room, "Kicking", (*mautrix.PowerLevels).Kick, "@you:maunium.net")
+	assert.EqualError(t, err, "@you:maunium.net has power level 50, which is not lower than yours (50)")
+}
+
+func TestCheckPowerLevel_SelfTarget(t *testing.T) {
+	defer os.RemoveAll("/tmp/gomuks-pltest")
+	room := rooms.NewRoom("!foo:maunium.net", plTestCache)
+	room.UpdateState(newPowerLevelEvent(&mautrix.PowerLevels{
+		Users: map[string]int{"@tulir:maunium.net": 50},
+	}))
+
+	err := checkPowerLevel(room, "Kicking", (*mautrix.PowerLevels).Kick, "@tulir:maunium.net")
+	assert.Nil(t, err)
+}
+
+func TestParsePowerLevels(t *testing.T) {
+	content := make(map[string]interface{})
+	err := parsePowerLevels(`users_default: 0
+ban: 50
+# Moderators
+users:
+  @tulir:maunium.net: 100
+	@you:maunium.net: 50
+
+events:
+  m.room.name: 50
+`, content)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"users_default": 0,
+		"ban":           50,
+		"users": map[string]interface{}{
+			"@tulir:maunium.net": 100,
+			"@you:maunium.net":   50,
+		},
+		"events": map[string]interface{}{
+			"m.room.name": 50,
+		},
+	}, content)
+}
+
+func TestParsePowerLevels_ThresholdEndsSection(t *testing.T) {
+	content := make(map[string]interface{})
+	err := parsePowerLevels("users:\n  @tulir:maunium.net: 10\nredact: 5", content)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, content["redact"])
+	assert.Equal(t, map[string]interface{}{"@tulir:maunium.net": 10}, content["users"])
+}
+
+func TestParsePowerLevels_KeepsUnknownFields(t *testing.T) {
+	content := map[string]interface{}{
+		"notifications": map[string]interface{}{"room": 50},
+		"ban":           50,
+	}
+	err := parsePowerLevels("ban: 75", content)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"room": 50}, content["notifications"])
+	assert.Equal(t, 75, content["ban"])
+}
+
+func TestParsePowerLevels_UnknownSection(t *testing.T) {
+	err := parsePowerLevels("rooms:\n", make(map[string]interface{}))
+	assert.EqualError(t, err, "line 1: unknown section rooms:")
+}
+
+func TestParsePowerLevels_UnknownField(t *testing.T) {
+	err := parsePowerLevels("foo: 5", make(map[string]interface{}))
+	assert.EqualError(t, err, "line 1: unknown field foo")
+}
+
+func TestParsePowerLevels_InvalidLevel(t *testing.T) {
+	err := parsePowerLevels("\nban: fifty", make(map[string]interface{}))
+	assert.EqualError(t, err, "line 2: invalid power level for ban")
+}
+
+func TestParsePowerLevels_NotInSection(t *testing.T) {
+	err := parsePowerLevels("  @tulir:maunium.net: 10", make(map[string]interface{}))
+	assert.EqualError(t, err, "line 1: @tulir:maunium.net is not in the users or events section")
+}
+
+func TestFormatPowerLevels_RoundTrip(t *testing.T) {
+	pl := &mautrix.PowerLevels{
+		Users:  map[string]int{"@tulir:maunium.net": 100},
+		Events: map[string]int{"m.room.name": 50},
+	}
+	content := make(map[string]interface{})
+	err := parsePowerLevels(formatPowerLevels(pl), content)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"@tulir:maunium.net": 100}, content["users"])
+	assert.Equal(t, map[string]interface{}{"m.room.name": 50}, content["events"])
+	assert.Equal(t, 50, content["ban"])
+	assert.Equal(t, 50, content["state_default"])
+}
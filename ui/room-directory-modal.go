@@ -0,0 +1,347 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+)
+
+// directorySearchDelay is how long to wait after the search text changes before searching the directory.
+const directorySearchDelay = 500 * time.Millisecond
+
+// directoryPreviewLength is the number of events shown when previewing a room.
+const directoryPreviewLength = 10
+
+// RoomDirectoryModal is a modal for browsing and searching the public room directory of a server.
+//
+// Pressing enter once shows a preview of the selected room, and pressing it again joins the room.
+type RoomDirectoryModal struct {
+	mauview.Component
+
+	container *mauview.Box
+
+	search  *mauview.InputArea
+	results *mauview.TextView
+	details *mauview.TextView
+
+	parent *MainView
+	matrix ifc.MatrixContainer
+	server string
+
+	lock        sync.Mutex
+	rooms       []ifc.PublicRoom
+	nextBatch   string
+	selected    int
+	previewing  bool
+	loading     bool
+	generation  int
+	searchTimer *time.Timer
+}
+
+func NewRoomDirectoryModal(mainView *MainView, matrix ifc.MatrixContainer, server, search string, width, height int) *RoomDirectoryModal {
+	dm := &RoomDirectoryModal{
+		parent: mainView,
+		matrix: matrix,
+		server: server,
+	}
+
+	dm.results = mauview.NewTextView().SetRegions(true)
+	dm.details = mauview.NewTextView().SetWordWrap(true)
+	dm.search = mauview.NewInputArea().
+		SetTextColor(tcell.ColorWhite).
+		SetBackgroundColor(tcell.ColorDarkCyan).
+		SetPlaceholder("Search rooms...")
+	dm.search.SetText(search)
+	dm.search.SetChangedFunc(dm.changeHandler)
+	dm.search.Focus()
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddFixedComponent(dm.search, 1).
+		AddProportionalComponent(dm.results, 2).
+		AddProportionalComponent(dm.details, 1)
+
+	title := "Room Directory"
+	if len(server) > 0 {
+		title = fmt.Sprintf("Room Directory of %s", server)
+	}
+	dm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(title).
+		SetBlurCaptureFunc(func() bool {
+			dm.parent.HideModal()
+			return true
+		})
+
+	dm.Component = mauview.Center(dm.container, width, height).SetAlwaysFocusChild(true)
+
+	go dm.load(search, true)
+
+	return dm
+}
+
+func (dm *RoomDirectoryModal) Focus() {
+	dm.container.Focus()
+}
+
+func (dm *RoomDirectoryModal) Blur() {
+	dm.container.Blur()
+}
+
+func (dm *RoomDirectoryModal) changeHandler(str string) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	if dm.searchTimer != nil {
+		dm.searchTimer.Stop()
+	}
+	dm.searchTimer = time.AfterFunc(directorySearchDelay, func() {
+		dm.load(str, true)
+	})
+}
+
+// load fetches a page of the directory. If reset is true, the first page is fetched and the current results are
+// replaced, otherwise the next page is appended to the current results.
+func (dm *RoomDirectoryModal) load(search string, reset bool) {
+	defer debug.Recover()
+	dm.lock.Lock()
+	if reset {
+		dm.generation++
+		dm.rooms = nil
+		dm.nextBatch = ""
+		dm.selected = 0
+		dm.previewing = false
+	} else if dm.loading || len(dm.nextBatch) == 0 {
+		dm.lock.Unlock()
+		return
+	}
+	generation := dm.generation
+	since := dm.nextBatch
+	dm.loading = true
+	dm.lock.Unlock()
+	dm.render()
+
+	resp, err := dm.matrix.GetPublicRooms(dm.server, search, since)
+
+	dm.lock.Lock()
+	if generation != dm.generation {
+		// The search changed while this page was loading
+		dm.lock.Unlock()
+		return
+	}
+	dm.loading = false
+	if err != nil {
+		dm.lock.Unlock()
+		dm.details.SetText(fmt.Sprintf("Failed to fetch room directory: %v", err))
+		dm.parent.parent.Render()
+		return
+	}
+	dm.rooms = append(dm.rooms, resp.Rooms...)
+	dm.nextBatch = resp.NextBatch
+	dm.lock.Unlock()
+	dm.render()
+}
+
+// loadMore fetches the next page of the directory.
+func (dm *RoomDirectoryModal) loadMore() {
+	go dm.load(dm.search.GetText(), false)
+}
+
+func (dm *RoomDirectoryModal) render() {
+	dm.lock.Lock()
+	dm.results.Clear()
+	for index, room := range dm.rooms {
+		name := room.Name
+		if len(name) == 0 {
+			name = room.CanonicalAlias
+		}
+		if len(name) == 0 {
+			name = room.RoomID
+		}
+		_, _ = fmt.Fprintf(dm.results, `["%d"]%s`, index, name)
+		if len(room.CanonicalAlias) > 0 && room.CanonicalAlias != name {
+			_, _ = fmt.Fprintf(dm.results, " (%s)", room.CanonicalAlias)
+		}
+		_, _ = fmt.Fprintf(dm.results, ` - %d members[""]%s`, room.NumJoinedMembers, "\n")
+	}
+	if dm.loading {
+		_, _ = fmt.Fprint(dm.results, "Loading...\n")
+	} else if len(dm.nextBatch) > 0 {
+		_, _ = fmt.Fprint(dm.results, "Press page down at the end of the list to load more rooms\n")
+	} else if len(dm.rooms) == 0 {
+		_, _ = fmt.Fprint(dm.results, "No rooms found\n")
+	}
+	if len(dm.rooms) > 0 {
+		dm.results.Highlight(strconv.Itoa(dm.selected))
+		dm.results.ScrollToHighlight()
+	} else {
+		dm.results.Highlight()
+	}
+	if !dm.previewing {
+		dm.details.SetText(dm.describeSelected())
+	}
+	dm.lock.Unlock()
+	dm.parent.parent.Render()
+}
+
+// describeSelected returns the topic and other details of the selected room. The lock must be held when calling this.
+func (dm *RoomDirectoryModal) describeSelected() string {
+	if dm.selected >= len(dm.rooms) {
+		return ""
+	}
+	room := dm.rooms[dm.selected]
+	var buf strings.Builder
+	buf.WriteString(room.RoomID)
+	if room.WorldReadable {
+		buf.WriteString(" - history is public")
+	}
+	if room.GuestCanJoin {
+		buf.WriteString(" - guests can join")
+	}
+	buf.WriteString("\n")
+	if len(room.Topic) > 0 {
+		buf.WriteString(room.Topic)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("Press enter to preview the room")
+	return buf.String()
+}
+
+// preview shows the latest messages of the selected room in the details area.
+func (dm *RoomDirectoryModal) preview(room ifc.PublicRoom) {
+	defer debug.Recover()
+	var buf strings.Builder
+	if !room.WorldReadable {
+		buf.WriteString("The history of this room isn't public, so it can't be previewed.\n")
+	} else if evts, err := dm.matrix.PreviewRoom(room.RoomID, directoryPreviewLength); err != nil {
+		_, _ = fmt.Fprintf(&buf, "Failed to preview room: %v\n", err)
+	} else {
+		// The events are returned newest first.
+		for i := len(evts) - 1; i >= 0; i-- {
+			evt := evts[i]
+			if evt.Type == mautrix.EventMessage && len(evt.Content.Body) > 0 {
+				_, _ = fmt.Fprintf(&buf, "<%s> %s\n", evt.Sender, evt.Content.Body)
+			}
+		}
+	}
+	buf.WriteString("Press enter again to join the room or escape to go back")
+	dm.lock.Lock()
+	if dm.previewing && dm.selected < len(dm.rooms) && dm.rooms[dm.selected].RoomID == room.RoomID {
+		dm.details.SetText(buf.String())
+		dm.details.ScrollToEnd()
+	}
+	dm.lock.Unlock()
+	dm.parent.parent.Render()
+}
+
+func (dm *RoomDirectoryModal) join(room ifc.PublicRoom) {
+	defer debug.Recover()
+	target := room.RoomID
+	if len(room.CanonicalAlias) > 0 {
+		// Joining via the alias lets the server find other servers that are in the room.
+		target = room.CanonicalAlias
+	}
+	mxRoom, err := dm.matrix.JoinRoom(target, dm.server)
+	if err != nil {
+		dm.details.SetText(fmt.Sprintf("Failed to join room: %v", err))
+		dm.parent.parent.Render()
+		return
+	}
+	dm.parent.HideModal()
+	dm.parent.AddRoom(mxRoom)
+	dm.parent.SwitchRoom(mxRoom.Tags()[0].Tag, mxRoom)
+	dm.parent.parent.Render()
+}
+
+func (dm *RoomDirectoryModal) moveSelection(diff int) {
+	dm.lock.Lock()
+	if len(dm.rooms) == 0 {
+		dm.lock.Unlock()
+		return
+	}
+	dm.selected += diff
+	if dm.selected < 0 {
+		dm.selected = 0
+	} else if dm.selected >= len(dm.rooms) {
+		dm.selected = len(dm.rooms) - 1
+	}
+	dm.previewing = false
+	atEnd := dm.selected == len(dm.rooms)-1
+	dm.lock.Unlock()
+	if atEnd && diff > 0 {
+		dm.loadMore()
+	}
+	dm.render()
+}
+
+func (dm *RoomDirectoryModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	switch event.Key() {
+	case tcell.KeyEsc:
+		dm.lock.Lock()
+		previewing := dm.previewing
+		dm.previewing = false
+		dm.lock.Unlock()
+		if previewing {
+			dm.render()
+		} else {
+			dm.parent.HideModal()
+		}
+		return true
+	case tcell.KeyTab, tcell.KeyDown:
+		dm.moveSelection(1)
+		return true
+	case tcell.KeyBacktab, tcell.KeyUp:
+		dm.moveSelection(-1)
+		return true
+	case tcell.KeyPgDn:
+		dm.moveSelection(10)
+		return true
+	case tcell.KeyPgUp:
+		dm.moveSelection(-10)
+		return true
+	case tcell.KeyEnter:
+		dm.lock.Lock()
+		if dm.selected >= len(dm.rooms) {
+			dm.lock.Unlock()
+			return true
+		}
+		room := dm.rooms[dm.selected]
+		if dm.previewing {
+			dm.lock.Unlock()
+			dm.details.SetText("Joining room...")
+			go dm.join(room)
+		} else {
+			dm.previewing = true
+			dm.lock.Unlock()
+			dm.details.SetText("Loading preview...")
+			go dm.preview(room)
+		}
+		return true
+	}
+	return dm.search.OnKeyEvent(event)
+}
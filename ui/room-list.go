@@ -17,6 +17,7 @@
 package ui
 
 import (
+	"fmt"
 	"math"
 	"regexp"
 	"sort"
@@ -25,6 +26,7 @@ import (
 	sync "github.com/sasha-s/go-deadlock"
 
 	"maunium.net/go/mauview"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/tcell"
 
 	"maunium.net/go/gomuks/debug"
@@ -41,7 +43,27 @@ var tagOrder = map[string]int{
 	"net.maunium.gomuks.fake.leave": -3,
 }
 
-// TagNameList is a list of Matrix tag names where default names are sorted in a hardcoded way.
+// spaceTagPrefix is the prefix of the fake tags used for space sections. The rest of the tag is the path of space
+// room IDs from the top-level space, separated by slashes.
+const spaceTagPrefix = "net.maunium.gomuks.fake.space/"
+
+func isSpaceTag(key string) bool {
+	_, tag := splitTagKey(key)
+	return strings.HasPrefix(tag, spaceTagPrefix)
+}
+
+// splitTagKey splits a room list key into the user ID of the account and the Matrix tag name.
+// Tags of the main account don't have an account prefix.
+func splitTagKey(key string) (userID, tag string) {
+	parts := strings.SplitN(key, "\n", 2)
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// TagNameList is a list of room list keys. Rooms of the main account are first, and within an account,
+// default tag names are sorted in a hardcoded way.
 type TagNameList []string
 
 func (tnl TagNameList) Len() int {
@@ -49,12 +71,18 @@ func (tnl TagNameList) Len() int {
 }
 
 func (tnl TagNameList) Less(i, j int) bool {
-	orderI, _ := tagOrder[tnl[i]]
-	orderJ, _ := tagOrder[tnl[j]]
+	accountI, tagI := splitTagKey(tnl[i])
+	accountJ, tagJ := splitTagKey(tnl[j])
+	if accountI != accountJ {
+		return accountI < accountJ
+	}
+	// Spaces don't have an entry in tagOrder, so they're between the default rooms and low priority rooms.
+	orderI, _ := tagOrder[tagI]
+	orderJ, _ := tagOrder[tagJ]
 	if orderI != orderJ {
 		return orderI > orderJ
 	}
-	return strings.Compare(tnl[i], tnl[j]) > 0
+	return strings.Compare(tagI, tagJ) > 0
 }
 
 func (tnl TagNameList) Swap(i, j int) {
@@ -66,11 +94,15 @@ type RoomList struct {
 
 	parent *MainView
 
-	// The list of tags in display order.
+	// The list of tag keys (see tagKey) in display order.
 	tags TagNameList
 	// The list of rooms, in reverse order.
 	items map[string]*TagRoomList
-	// The selected room.
+	// The position of each space section in the space tree.
+	spaceRank map[string]int
+	// If set, only the section with this key and the sections of its subspaces are shown.
+	spaceFilter string
+	// The selected room and the key of the tag it was selected in.
 	selected    *rooms.Room
 	selectedTag string
 
@@ -90,8 +122,9 @@ func NewRoomList(parent *MainView) *RoomList {
 	list := &RoomList{
 		parent: parent,
 
-		items: make(map[string]*TagRoomList),
-		tags:  []string{},
+		items:     make(map[string]*TagRoomList),
+		tags:      []string{},
+		spaceRank: make(map[string]int),
 
 		scrollOffset: 0,
 
@@ -105,12 +138,26 @@ func NewRoomList(parent *MainView) *RoomList {
 	return list
 }
 
-func (list *RoomList) Contains(roomID string) bool {
+// tagKey returns the key of the given tag in the given room's account.
+func (list *RoomList) tagKey(room *rooms.Room, tag string) string {
+	if room.SessionUserID == list.parent.config.UserID {
+		return tag
+	}
+	return room.SessionUserID + "\n" + tag
+}
+
+// rawTag strips the account from the tag key returned alongside a room.
+func rawTag(key string, room *rooms.Room) (string, *rooms.Room) {
+	_, tag := splitTagKey(key)
+	return tag, room
+}
+
+func (list *RoomList) Contains(room *rooms.Room) bool {
 	list.RLock()
 	defer list.RUnlock()
 	for _, trl := range list.items {
-		for _, room := range trl.All() {
-			if room.ID == roomID {
+		for _, item := range trl.All() {
+			if item.ID == room.ID && item.SessionUserID == room.SessionUserID {
 				return true
 			}
 		}
@@ -122,6 +169,9 @@ func (list *RoomList) Add(room *rooms.Room) {
 	if room.IsReplaced() {
 		debug.Print(room.ID, "is replaced by", room.ReplacedBy(), "-> not adding to room list")
 		return
+	} else if room.IsSpace {
+		// Spaces are shown as sections (see UpdateSpaces)
+		return
 	}
 	debug.Print("Adding room to list", room.ID, room.GetTitle(), room.IsDirect, room.ReplacedBy(), room.Tags())
 	for _, tag := range room.Tags() {
@@ -134,41 +184,95 @@ func (list *RoomList) checkTag(tag string) {
 
 	trl, ok := list.items[tag]
 
-	if ok && trl.IsEmpty() {
+	// Space sections are kept even if they're empty, as their subspaces may have rooms.
+	if ok && trl.IsEmpty() && !isSpaceTag(tag) {
 		delete(list.items, tag)
 		ok = false
 	}
 
-	if ok && index == -1 {
+	visible := ok && list.tagVisible(tag)
+	if visible && index == -1 {
 		list.tags = append(list.tags, tag)
-		sort.Sort(list.tags)
-	} else if !ok && index != -1 {
+		list.sortTags()
+	} else if !visible && index != -1 {
 		list.tags = append(list.tags[0:index], list.tags[index+1:]...)
 	}
 }
 
+// tagVisible returns whether or not the section with the given key passes the space filter.
+func (list *RoomList) tagVisible(key string) bool {
+	return len(list.spaceFilter) == 0 || key == list.spaceFilter || strings.HasPrefix(key, list.spaceFilter+"/")
+}
+
+// sortTags sorts the tag list. Space sections are sorted in the order they have in the space tree.
+func (list *RoomList) sortTags() {
+	sort.SliceStable(list.tags, func(i, j int) bool {
+		accountI, _ := splitTagKey(list.tags[i])
+		accountJ, _ := splitTagKey(list.tags[j])
+		rankI, isSpaceI := list.spaceRank[list.tags[i]]
+		rankJ, isSpaceJ := list.spaceRank[list.tags[j]]
+		if accountI == accountJ && isSpaceI && isSpaceJ {
+			return rankI < rankJ
+		}
+		return list.tags.Less(i, j)
+	})
+}
+
+// rebuildTags recreates the list of shown tags after the space filter or the space sections have changed.
+func (list *RoomList) rebuildTags() {
+	list.tags = list.tags[:0]
+	for key := range list.items {
+		if list.tagVisible(key) {
+			list.tags = append(list.tags, key)
+		}
+	}
+	list.sortTags()
+	if list.selected == nil || list.indexTag(list.selectedTag) != -1 {
+		return
+	}
+	// The section the selected room was in was hidden, so find another one.
+	for _, key := range list.tags {
+		if list.items[key].Index(list.selected) != -1 {
+			list.selectedTag = key
+			return
+		}
+	}
+}
+
 func (list *RoomList) AddToTag(tag rooms.RoomTag, room *rooms.Room) {
 	list.Lock()
 	defer list.Unlock()
-	trl, ok := list.items[tag.Tag]
+	key := list.tagKey(room, tag.Tag)
+	trl, ok := list.items[key]
 	if !ok {
-		list.items[tag.Tag] = NewTagRoomList(list, tag.Tag, NewOrderedRoom(tag.Order, room))
+		list.items[key] = NewTagRoomList(list, key, NewOrderedRoom(tag.Order, room))
 	} else {
 		trl.Insert(tag.Order, room)
 	}
-	list.checkTag(tag.Tag)
+	list.checkTag(key)
 }
 
 func (list *RoomList) Remove(room *rooms.Room) {
-	for _, tag := range list.tags {
-		list.RemoveFromTag(tag, room)
+	// Hidden sections are in the items map, but not the tag list.
+	list.RLock()
+	keys := make([]string, 0, len(list.items))
+	for key := range list.items {
+		keys = append(keys, key)
+	}
+	list.RUnlock()
+	for _, key := range keys {
+		list.removeFromTag(key, room)
 	}
 }
 
 func (list *RoomList) RemoveFromTag(tag string, room *rooms.Room) {
+	list.removeFromTag(list.tagKey(room, tag), room)
+}
+
+func (list *RoomList) removeFromTag(key string, room *rooms.Room) {
 	list.Lock()
 	defer list.Unlock()
-	trl, ok := list.items[tag]
+	trl, ok := list.items[key]
 	if !ok {
 		return
 	}
@@ -202,18 +306,17 @@ func (list *RoomList) RemoveFromTag(tag string, room *rooms.Room) {
 			list.selectedTag = ""
 		}
 	}
-	list.checkTag(tag)
+	list.checkTag(key)
 }
 
 func (list *RoomList) Bump(room *rooms.Room) {
 	list.RLock()
 	defer list.RUnlock()
-	for _, tag := range room.Tags() {
-		trl, ok := list.items[tag.Tag]
-		if !ok {
-			return
+	// Rooms can be in space sections in addition to their tags.
+	for _, trl := range list.items {
+		if trl.Index(room) != -1 {
+			trl.Bump(room)
 		}
-		trl.Bump(room)
 	}
 }
 
@@ -222,6 +325,8 @@ func (list *RoomList) Clear() {
 	defer list.Unlock()
 	list.items = make(map[string]*TagRoomList)
 	list.tags = []string{}
+	list.spaceRank = make(map[string]int)
+	list.spaceFilter = ""
 	for _, tag := range list.tags {
 		list.items[tag] = NewTagRoomList(list, tag)
 	}
@@ -230,9 +335,10 @@ func (list *RoomList) Clear() {
 }
 
 func (list *RoomList) SetSelected(tag string, room *rooms.Room) {
+	key := list.tagKey(room, tag)
 	list.selected = room
-	list.selectedTag = tag
-	pos := list.index(tag, room)
+	list.selectedTag = key
+	pos := list.index(key, room)
 	if pos <= list.scrollOffset {
 		list.scrollOffset = pos - 1
 	} else if pos >= list.scrollOffset+list.height {
@@ -241,7 +347,7 @@ func (list *RoomList) SetSelected(tag string, room *rooms.Room) {
 	if list.scrollOffset < 0 {
 		list.scrollOffset = 0
 	}
-	debug.Print("Selecting", room.GetTitle(), "in", list.GetTagDisplayName(tag))
+	debug.Print("Selecting", room.GetTitle(), "in", list.GetTagDisplayName(key))
 }
 
 func (list *RoomList) HasSelected() bool {
@@ -249,7 +355,7 @@ func (list *RoomList) HasSelected() bool {
 }
 
 func (list *RoomList) Selected() (string, *rooms.Room) {
-	return list.selectedTag, list.selected
+	return rawTag(list.selectedTag, list.selected)
 }
 
 func (list *RoomList) SelectedRoom() *rooms.Room {
@@ -270,7 +376,7 @@ func (list *RoomList) AddScrollOffset(offset int) {
 func (list *RoomList) First() (string, *rooms.Room) {
 	list.RLock()
 	defer list.RUnlock()
-	return list.first()
+	return rawTag(list.first())
 }
 
 func (list *RoomList) first() (string, *rooms.Room) {
@@ -286,7 +392,7 @@ func (list *RoomList) first() (string, *rooms.Room) {
 func (list *RoomList) Last() (string, *rooms.Room) {
 	list.RLock()
 	defer list.RUnlock()
-	return list.last()
+	return rawTag(list.last())
 }
 
 func (list *RoomList) last() (string, *rooms.Room) {
@@ -312,13 +418,20 @@ func (list *RoomList) indexTag(tag string) int {
 func (list *RoomList) Previous() (string, *rooms.Room) {
 	list.RLock()
 	defer list.RUnlock()
+	return rawTag(list.previous())
+}
+
+func (list *RoomList) previous() (string, *rooms.Room) {
 	if len(list.items) == 0 {
 		return "", nil
 	} else if list.selected == nil {
 		return list.first()
 	}
 
-	trl := list.items[list.selectedTag]
+	trl, ok := list.items[list.selectedTag]
+	if !ok {
+		return list.first()
+	}
 	index := trl.IndexVisible(list.selected)
 	indexInvisible := trl.Index(list.selected)
 	if index == -1 && indexInvisible >= 0 {
@@ -347,13 +460,20 @@ func (list *RoomList) Previous() (string, *rooms.Room) {
 func (list *RoomList) Next() (string, *rooms.Room) {
 	list.RLock()
 	defer list.RUnlock()
+	return rawTag(list.next())
+}
+
+func (list *RoomList) next() (string, *rooms.Room) {
 	if len(list.items) == 0 {
 		return "", nil
 	} else if list.selected == nil {
 		return list.first()
 	}
 
-	trl := list.items[list.selectedTag]
+	trl, ok := list.items[list.selectedTag]
+	if !ok {
+		return list.first()
+	}
 	index := trl.IndexVisible(list.selected)
 	indexInvisible := trl.Index(list.selected)
 	if index == -1 && indexInvisible >= 0 {
@@ -391,10 +511,10 @@ func (list *RoomList) Next() (string, *rooms.Room) {
 func (list *RoomList) NextWithActivity() (string, *rooms.Room) {
 	list.RLock()
 	defer list.RUnlock()
-	for tag, trl := range list.items {
-		for _, room := range trl.All() {
+	for _, tag := range list.tags {
+		for _, room := range list.items[tag].All() {
 			if room.HasNewMessages() {
-				return tag, room.Room
+				return rawTag(tag, room.Room)
 			}
 		}
 	}
@@ -499,7 +619,7 @@ func (list *RoomList) clickRoom(line, column int, mod bool) bool {
 		} else if line < trl.Length() {
 			switchToRoom := trl.Visible()[trl.Length()-1-line].Room
 			list.RUnlock()
-			list.parent.SwitchRoom(tag, switchToRoom)
+			list.parent.SwitchRoom(rawTag(tag, switchToRoom))
 			return true
 		}
 
@@ -535,7 +655,26 @@ func (list *RoomList) clickRoom(line, column int, mod bool) bool {
 
 var nsRegex = regexp.MustCompile("^[a-z]+\\.[a-z]+(?:\\.[a-z]+)*$")
 
-func (list *RoomList) GetTagDisplayName(tag string) string {
+// GetTagDisplayName returns the display name of the tag with the given key. Tags of accounts other than the main
+// account are suffixed with the localpart of the account's user ID.
+func (list *RoomList) GetTagDisplayName(key string) string {
+	userID, tag := splitTagKey(key)
+	if strings.HasPrefix(tag, spaceTagPrefix) {
+		// The names of space sections are set when the section is created (see UpdateSpaces)
+		if trl, ok := list.items[key]; ok {
+			return trl.displayname
+		}
+		return "Space"
+	}
+	name := getTagDisplayName(tag)
+	if len(userID) > 0 && len(name) > 0 {
+		localpart, _, _ := mautrix.ParseUserID(userID)
+		name = fmt.Sprintf("%s (%s)", name, localpart)
+	}
+	return name
+}
+
+func getTagDisplayName(tag string) string {
 	switch {
 	case len(tag) == 0:
 		return "Rooms"
@@ -588,3 +727,175 @@ func (list *RoomList) Draw(screen mauview.Screen) {
 	}
 	list.RUnlock()
 }
+
+// UpdateSpaces recreates the space sections from the space state of the given rooms.
+func (list *RoomList) UpdateSpaces(allRooms []*rooms.Room) {
+	list.Lock()
+	defer list.Unlock()
+	// Keep the collapsed state of sections that still exist.
+	prevMaxShown := make(map[string]int)
+	for key, trl := range list.items {
+		if isSpaceTag(key) {
+			prevMaxShown[key] = trl.maxShown
+			delete(list.items, key)
+		}
+	}
+	list.spaceRank = make(map[string]int)
+
+	accounts := make(map[string][]*rooms.Room)
+	for _, room := range allRooms {
+		if room.HasLeft || room.IsReplaced() {
+			continue
+		}
+		accounts[room.SessionUserID] = append(accounts[room.SessionUserID], room)
+		if room.IsSpace {
+			// Spaces may have been added to the normal sections before their type was known.
+			for key, trl := range list.items {
+				if index := trl.Index(room); index != -1 && !isSpaceTag(key) {
+					trl.RemoveIndex(index)
+					list.checkTag(key)
+				}
+			}
+		}
+	}
+	for _, accountRooms := range accounts {
+		list.addSpaces(accountRooms, prevMaxShown)
+	}
+
+	if len(list.spaceFilter) > 0 {
+		if _, ok := list.items[list.spaceFilter]; !ok {
+			list.spaceFilter = ""
+		}
+	}
+	list.rebuildTags()
+}
+
+// addSpaces adds the sections for the spaces of a single account.
+func (list *RoomList) addSpaces(accountRooms []*rooms.Room, prevMaxShown map[string]int) {
+	byID := make(map[string]*rooms.Room, len(accountRooms))
+	for _, room := range accountRooms {
+		byID[room.ID] = room
+	}
+	// Rooms are in a space if either the space lists them or they list the space. Anyone who can send state events
+	// in a room can claim it's in a space, so those claims are only trusted if the sender could list it in the space.
+	children := make(map[string]map[*rooms.Room]bool)
+	isChild := make(map[string]bool)
+	addChild := func(space, child *rooms.Room) {
+		if !space.IsSpace || space == child {
+			return
+		} else if _, ok := children[space.ID]; !ok {
+			children[space.ID] = make(map[*rooms.Room]bool)
+		}
+		children[space.ID][child] = true
+		isChild[child.ID] = true
+	}
+	var spaces []*rooms.Room
+	for _, room := range accountRooms {
+		if room.IsSpace {
+			spaces = append(spaces, room)
+			for _, childID := range room.GetSpaceChildren() {
+				if child, ok := byID[childID]; ok {
+					addChild(room, child)
+				}
+			}
+		}
+		for parentID, sender := range room.GetSpaceParents() {
+			if parent, ok := byID[parentID]; ok && parent.IsSpace && canAddSpaceChild(parent, sender) {
+				addChild(parent, room)
+			}
+		}
+	}
+	sortByTitle(spaces)
+
+	shown := make(map[string]bool)
+	var addSpace func(space *rooms.Room, path []string)
+	addSpace = func(space *rooms.Room, path []string) {
+		shown[space.ID] = true
+		path = append(path, space.ID)
+		key := list.tagKey(space, spaceTagPrefix+strings.Join(path, "/"))
+		trl := NewTagRoomList(list, key)
+		trl.displayname = strings.Repeat("  ", len(path)-1) + space.GetTitle()
+		if maxShown, ok := prevMaxShown[key]; ok {
+			trl.maxShown = maxShown
+		}
+		var subspaces []*rooms.Room
+		for child := range children[space.ID] {
+			if child.IsSpace {
+				subspaces = append(subspaces, child)
+			} else {
+				trl.Insert("0.5", child)
+			}
+		}
+		list.items[key] = trl
+		list.spaceRank[key] = len(list.spaceRank)
+
+		sortByTitle(subspaces)
+	Subspaces:
+		for _, subspace := range subspaces {
+			for _, parentID := range path {
+				if subspace.ID == parentID {
+					// Don't get stuck in loops
+					continue Subspaces
+				}
+			}
+			addSpace(subspace, path)
+		}
+	}
+	for _, space := range spaces {
+		if !isChild[space.ID] {
+			addSpace(space, nil)
+		}
+	}
+	// Spaces that are only children of each other don't have a top-level space.
+	for _, space := range spaces {
+		if !shown[space.ID] {
+			addSpace(space, nil)
+		}
+	}
+}
+
+// canAddSpaceChild returns whether the user has a high enough power level to send m.space.child events in the space.
+func canAddSpaceChild(space *rooms.Room, userID string) bool {
+	pl := space.GetPowerLevels()
+	return pl.GetUserLevel(userID) >= pl.GetEventLevel(rooms.StateSpaceChild)
+}
+
+func sortByTitle(list []*rooms.Room) {
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].GetTitle()) < strings.ToLower(list[j].GetTitle())
+	})
+}
+
+// SpaceFilter returns the ID of the space the room list is filtered to, or an empty string if there's no filter.
+func (list *RoomList) SpaceFilter() string {
+	list.RLock()
+	defer list.RUnlock()
+	if len(list.spaceFilter) == 0 {
+		return ""
+	}
+	return list.spaceFilter[strings.LastIndex(list.spaceFilter, "/")+1:]
+}
+
+// SetSpaceFilter makes the room list only show the given space and its subspaces.
+// If space is nil, all rooms are shown again. It returns false if the space isn't in the room list.
+func (list *RoomList) SetSpaceFilter(space *rooms.Room) bool {
+	list.Lock()
+	defer list.Unlock()
+	filter := ""
+	if space != nil {
+		for key := range list.items {
+			_, tag := splitTagKey(key)
+			if strings.HasPrefix(tag, spaceTagPrefix) && strings.HasSuffix(tag, "/"+space.ID) &&
+				list.tagKey(space, tag) == key && (len(filter) == 0 || len(key) < len(filter)) {
+				filter = key
+			}
+		}
+		if len(filter) == 0 {
+			return false
+		}
+	}
+	list.spaceFilter = filter
+	list.scrollOffset = 0
+	list.rebuildTags()
+	return true
+}
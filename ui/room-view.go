@@ -17,14 +17,21 @@
 package ui
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/kyokomi/emoji"
 	"github.com/mattn/go-runewidth"
+	sync "github.com/sasha-s/go-deadlock"
 
 	"maunium.net/go/gomuks/debug"
 	"maunium.net/go/gomuks/matrix/event"
@@ -36,6 +43,7 @@ import (
 
 	"maunium.net/go/gomuks/config"
 	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/lib/open"
 	"maunium.net/go/gomuks/lib/util"
 	"maunium.net/go/gomuks/matrix/rooms"
 	"maunium.net/go/gomuks/ui/messages"
@@ -63,6 +71,7 @@ type RoomView struct {
 	prevScreen mauview.Screen
 
 	parent *MainView
+	matrix ifc.MatrixContainer
 	config *config.Config
 
 	typing []string
@@ -81,13 +90,27 @@ type RoomView struct {
 		textCache string
 		time      time.Time
 	}
+
+	downloads     []*mediaDownload
+	downloadsLock sync.Mutex
+
+	// exported is the number of events collected by the history export in progress, or -1 if there is none.
+	exported   int
+	exportLock sync.Mutex
+}
+
+// mediaDownload is a file download started from a room view. Downloads in progress are shown in the status bar.
+type mediaDownload struct {
+	name   string
+	done   int64
+	total  int64
+	cancel context.CancelFunc
 }
 
-func NewRoomView(parent *MainView, room *rooms.Room) *RoomView {
+func NewRoomView(parent *MainView, matrix ifc.MatrixContainer, room *rooms.Room) *RoomView {
 	view := &RoomView{
 		topic:    mauview.NewTextView(),
 		status:   mauview.NewTextField(),
-		userList: NewMemberList(),
 		ulBorder: widget.NewBorder(),
 		input:    mauview.NewInputArea(),
 		Room:     room,
@@ -100,9 +123,13 @@ func NewRoomView(parent *MainView, room *rooms.Room) *RoomView {
 		ulScreen:       &mauview.ProxyScreen{OffsetY: StatusBarHeight, Width: UserListWidth},
 
 		parent: parent,
+		matrix: matrix,
 		config: parent.config,
+
+		exported: -1,
 	}
 	view.content = NewMessageView(view)
+	view.userList = NewMemberList(view)
 	view.Room.SetPreUnload(func() bool {
 		if view.parent.currentRoom == view {
 			return false
@@ -129,10 +156,6 @@ func NewRoomView(parent *MainView, room *rooms.Room) *RoomView {
 	return view
 }
 
-func (view *RoomView) logPath(dir string) string {
-	return filepath.Join(dir, fmt.Sprintf("%s.gmxlog", view.Room.ID))
-}
-
 func (view *RoomView) SetInputChangedFunc(fn func(room *RoomView, text string)) *RoomView {
 	view.input.SetChangedFunc(func(text string) {
 		fn(view, text)
@@ -190,7 +213,23 @@ func (view *RoomView) OnSelect(message *messages.UIMessage) {
 	case SelectReact:
 		go view.SendReaction(message.EventID, view.selectContent)
 	case SelectRedact:
-		go view.Redact(message.EventID, view.selectContent)
+		if err := view.checkRedact(message); err != nil {
+			view.AddServiceMessage(fmt.Sprintf("Can't redact message: %v", err))
+		} else {
+			go view.Redact(message.EventID, view.selectContent)
+		}
+	case SelectResend:
+		go view.ResendMessage(message)
+	case SelectCancel:
+		go view.CancelMessage(message)
+	case SelectReceipts:
+		view.ShowReadReceipts(message)
+	case SelectThread:
+		view.OpenThread(message, view.selectContent)
+	case SelectDownload:
+		go view.DownloadMessage(message, expandHome(view.selectContent))
+	case SelectOpen:
+		go view.OpenMessage(message)
 	}
 	view.selecting = false
 	view.selectContent = ""
@@ -198,9 +237,38 @@ func (view *RoomView) OnSelect(message *messages.UIMessage) {
 	view.input.Focus()
 }
 
+// connectionStatus returns a description of the connection state, or an empty string if everything is fine.
+func (view *RoomView) connectionStatus() string {
+	status := view.matrix.ConnectionStatus()
+	var retry string
+	if !status.NextRetry.IsZero() {
+		seconds := int(math.Ceil(time.Until(status.NextRetry).Seconds()))
+		if seconds > 0 {
+			retry = fmt.Sprintf(", retrying in %ds", seconds)
+		} else {
+			retry = ", retrying now"
+		}
+	}
+	switch status.State {
+	case ifc.ConnectionSyncing:
+		return "Syncing..."
+	case ifc.ConnectionRetrying:
+		return "Sync failed" + retry
+	case ifc.ConnectionOffline:
+		return "Offline" + retry
+	default:
+		return ""
+	}
+}
+
 func (view *RoomView) GetStatus() string {
 	var buf strings.Builder
 
+	if conn := view.connectionStatus(); len(conn) > 0 {
+		buf.WriteString(conn)
+		buf.WriteString(" - ")
+	}
+
 	if view.editing != nil {
 		buf.WriteString("Editing message - ")
 	} else if view.replying != nil {
@@ -222,6 +290,22 @@ func (view *RoomView) GetStatus() string {
 		}
 	}
 
+	view.downloadsLock.Lock()
+	for _, dl := range view.downloads {
+		if dl.total > 0 {
+			_, _ = fmt.Fprintf(&buf, "Downloading %s (%d%%) - ", dl.name, dl.done*100/dl.total)
+		} else {
+			_, _ = fmt.Fprintf(&buf, "Downloading %s - ", dl.name)
+		}
+	}
+	view.downloadsLock.Unlock()
+
+	view.exportLock.Lock()
+	if view.exported >= 0 {
+		_, _ = fmt.Fprintf(&buf, "Exporting history (%d events) - ", view.exported)
+	}
+	view.exportLock.Unlock()
+
 	if len(view.typing) == 1 {
 		buf.WriteString("Typing: " + view.typing[0])
 		buf.WriteString(" - ")
@@ -330,7 +414,7 @@ func (view *RoomView) OnKeyEvent(event mauview.KeyEvent) bool {
 		return true
 	case tcell.KeyPgUp:
 		if msgView.IsAtTop() {
-			go view.parent.LoadHistory(view.Room.ID)
+			go view.parent.LoadHistory(view)
 		}
 		msgView.AddScrollOffset(+msgView.Height() / 2)
 		return true
@@ -443,6 +527,67 @@ func (view *RoomView) autocompleteEmoji(word string) (completions []string) {
 	return
 }
 
+// expandHome replaces a leading ~ in the given path with the home directory of the current user.
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// autocompletePath lists the local files and directories whose path starts with the given text.
+// Directories get a trailing slash so that completing can continue inside them.
+func autocompletePath(existingText string) (completions []string) {
+	dir, prefix := filepath.Split(existingText)
+	listDir := expandHome(dir)
+	if len(listDir) == 0 {
+		listDir = "."
+	}
+	files, err := ioutil.ReadDir(listDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, prefix) || (name[0] == '.' && !strings.HasPrefix(prefix, ".")) {
+			continue
+		}
+		if file.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(filepath.Join(listDir, name)); err == nil {
+				file = target
+			}
+		}
+		if file.IsDir() {
+			name += string(filepath.Separator)
+		}
+		completions = append(completions, dir+name)
+	}
+	return
+}
+
+func (view *RoomView) tabCompletePath(text, str, prefix string) {
+	completions := autocompletePath(str[len(prefix):])
+	if len(completions) > 0 {
+		text = prefix + util.LongestCommonPrefix(completions) + text[len(str):]
+	}
+	view.input.SetTextAndMoveCursor(text)
+
+	var names []string
+	if len(completions) > 1 {
+		for _, completion := range completions {
+			name := filepath.Base(completion)
+			if strings.HasSuffix(completion, string(filepath.Separator)) {
+				name += string(filepath.Separator)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	view.SetCompletions(names)
+}
+
 func (view *RoomView) SetEditing(evt *event.Event) {
 	if evt == nil {
 		view.editing = nil
@@ -467,7 +612,7 @@ func (view *RoomView) SetEditing(evt *event.Event) {
 
 func (view *RoomView) findMessage(current *event.Event, ownMessage, forward bool) *messages.UIMessage {
 	currentFound := current == nil
-	self := view.parent.matrix.Client().UserID
+	self := view.matrix.Client().UserID
 	msgs := view.MessageView().messages
 	for i := 0; i < len(msgs); i++ {
 		index := i
@@ -530,6 +675,10 @@ func (view *RoomView) SelectPrevious() {
 func (view *RoomView) InputTabComplete(text string, cursorOffset int) {
 	debug.Print("Tab completing", cursorOffset, text)
 	str := runewidth.Truncate(text, cursorOffset, "")
+	if strings.HasPrefix(str, "/upload ") {
+		view.tabCompletePath(text, str, "/upload ")
+		return
+	}
 	word := findWordToTabComplete(str)
 	startIndex := len(str) - len(word)
 
@@ -568,6 +717,9 @@ func (view *RoomView) InputTabComplete(text string, cursorOffset int) {
 
 func (view *RoomView) InputSubmit(text string) {
 	if len(text) == 0 {
+		if view.Room.IsReplaced() {
+			go view.FollowReplacement()
+		}
 		return
 	} else if cmd := view.parent.cmdProcessor.ParseCommand(view, text); cmd != nil {
 		go view.parent.cmdProcessor.HandleCommand(cmd)
@@ -578,9 +730,50 @@ func (view *RoomView) InputSubmit(text string) {
 	view.SetInputText("")
 }
 
+// FollowReplacement switches to the room that replaced this room, joining it first if necessary.
+func (view *RoomView) FollowReplacement() {
+	defer debug.Recover()
+	replacementID := view.Room.ReplacedBy()
+	if len(replacementID) == 0 {
+		return
+	}
+	room := view.matrix.GetRoom(replacementID)
+	if room == nil || room.HasLeft {
+		var server string
+		if tombstone := view.Room.GetStateEvent(mautrix.StateTombstone, ""); tombstone != nil {
+			// The server that sent the tombstone is most likely in the new room.
+			if parts := strings.SplitN(tombstone.Sender, ":", 2); len(parts) == 2 {
+				server = parts[1]
+			}
+		}
+		var err error
+		room, err = view.matrix.JoinRoom(replacementID, server)
+		if err != nil {
+			view.AddServiceMessage(fmt.Sprintf("Failed to join the new room: %v", err))
+			view.parent.parent.Render()
+			return
+		}
+	}
+	view.parent.AddRoom(room)
+	view.parent.SwitchRoom(room.Tags()[0].Tag, room)
+	view.parent.parent.Render()
+}
+
+// checkRedact checks whether our power level is high enough to redact the given message.
+func (view *RoomView) checkRedact(message *messages.UIMessage) error {
+	return checkPowerLevel(view.Room, "Redacting messages", func(pl *mautrix.PowerLevels) int {
+		level := pl.GetEventLevel(mautrix.EventRedaction)
+		if message.SenderID != view.Room.SessionUserID && pl.Redact() > level {
+			// Redacting messages of other users also requires the redact power level.
+			level = pl.Redact()
+		}
+		return level
+	}, "")
+}
+
 func (view *RoomView) Redact(eventID, reason string) {
 	defer debug.Recover()
-	err := view.parent.matrix.Redact(view.Room.ID, eventID, reason)
+	err := view.matrix.Redact(view.Room.ID, eventID, reason)
 	if err != nil {
 		if httpErr, ok := err.(mautrix.HTTPError); ok {
 			err = httpErr
@@ -596,7 +789,7 @@ func (view *RoomView) Redact(eventID, reason string) {
 func (view *RoomView) SendReaction(eventID string, reaction string) {
 	defer debug.Recover()
 	debug.Print("Reacting to", eventID, "in", view.Room.ID, "with", reaction)
-	eventID, err := view.parent.matrix.SendEvent(&event.Event{
+	eventID, err := view.matrix.SendEvent(&event.Event{
 		Event: &mautrix.Event{
 			Type:   mautrix.EventReaction,
 			RoomID: view.Room.ID,
@@ -639,30 +832,337 @@ func (view *RoomView) SendMessage(msgtype mautrix.MessageType, text string) {
 			Event: view.replying,
 		}
 	}
-	evt := view.parent.matrix.PrepareMarkdownMessage(view.Room.ID, msgtype, text, rel)
+	evt := view.matrix.PrepareMarkdownMessage(view.Room.ID, msgtype, text, rel)
 	msg := view.parseEvent(evt.SomewhatDangerousCopy())
 	view.content.AddMessage(msg, AppendMessage)
 	view.ClearAllContext()
 	view.status.SetText(view.GetStatus())
-	eventID, err := view.parent.matrix.SendEvent(evt)
+	err := view.matrix.QueueEvent(evt)
 	if err != nil {
 		msg.State = event.StateSendFail
-		// Show shorter version if available
-		if httpErr, ok := err.(mautrix.HTTPError); ok {
-			err = httpErr
-			if respErr := httpErr.RespError; respErr != nil {
-				err = respErr
+		view.AddServiceMessage(fmt.Sprintf("Failed to queue message: %v", err))
+		view.parent.parent.Render()
+	}
+}
+
+// SendFile uploads the file at the given path and sends it as a media message.
+// The local echo of the message shows the upload progress until the upload is done.
+func (view *RoomView) SendFile(path string) {
+	defer debug.Recover()
+	debug.Print("Uploading", path, "to", view.Room.ID)
+	evt, data, err := view.matrix.PrepareMediaMessage(view.Room.ID, path)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to upload %s: %v", path, err))
+		view.parent.parent.Render()
+		return
+	}
+	displayname := evt.Sender
+	if member := view.Room.GetMember(evt.Sender); member != nil {
+		displayname = member.Displayname
+	}
+	msg := messages.NewUploadMessage(evt, displayname, 0)
+	view.content.AddMessage(msg, AppendMessage)
+	view.parent.parent.Render()
+
+	lastPercent := 0
+	err = view.matrix.UploadMedia(evt, data, func(sent, total int64) {
+		percent := int(sent * 100 / total)
+		if percent != lastPercent {
+			lastPercent = percent
+			msg = messages.NewUploadMessage(evt, displayname, percent)
+			view.content.AddMessage(msg, AppendMessage)
+			view.parent.parent.Render()
+		}
+	})
+	if err != nil {
+		view.content.removeMessage(msg)
+		view.AddServiceMessage(fmt.Sprintf("Failed to upload %s: %v", evt.Content.Body, err))
+		view.parent.parent.Render()
+		return
+	}
+
+	if parsed := view.parseEvent(evt.SomewhatDangerousCopy()); parsed != nil {
+		msg = parsed
+		view.content.AddMessage(msg, AppendMessage)
+	}
+	err = view.matrix.QueueEvent(evt)
+	if err != nil {
+		msg.State = event.StateSendFail
+		view.AddServiceMessage(fmt.Sprintf("Failed to queue message: %v", err))
+	}
+	view.parent.parent.Render()
+}
+
+// uniqueFilePath appends a number to the name of the file if a file already exists at the given path.
+func uniqueFilePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// downloadFile downloads the file in the given message content into the media cache and returns the path to the
+// cached file. The download is shown in the status bar until it's done, and can be cancelled with CancelDownloads.
+func (view *RoomView) downloadFile(content mautrix.Content) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dl := &mediaDownload{name: content.Body, total: -1, cancel: cancel}
+	view.downloadsLock.Lock()
+	view.downloads = append(view.downloads, dl)
+	view.downloadsLock.Unlock()
+	view.status.SetText(view.GetStatus())
+	view.parent.parent.Render()
+
+	defer func() {
+		cancel()
+		view.downloadsLock.Lock()
+		for i, other := range view.downloads {
+			if other == dl {
+				view.downloads = append(view.downloads[:i], view.downloads[i+1:]...)
+				break
 			}
 		}
-		view.AddServiceMessage(fmt.Sprintf("Failed to send message: %v", err))
+		view.downloadsLock.Unlock()
+		view.status.SetText(view.GetStatus())
 		view.parent.parent.Render()
+	}()
+
+	lastPercent := int64(-1)
+	return view.matrix.DownloadFile(ctx, content.URL, func(done, total int64) {
+		view.downloadsLock.Lock()
+		dl.done, dl.total = done, total
+		view.downloadsLock.Unlock()
+		if total > 0 && done*100/total != lastPercent {
+			lastPercent = done * 100 / total
+			view.status.SetText(view.GetStatus())
+			view.parent.parent.Render()
+		}
+	})
+}
+
+// CancelDownloads cancels all file downloads started from this room and returns the number of cancelled downloads.
+func (view *RoomView) CancelDownloads() int {
+	view.downloadsLock.Lock()
+	defer view.downloadsLock.Unlock()
+	for _, dl := range view.downloads {
+		dl.cancel()
+	}
+	return len(view.downloads)
+}
+
+// copyFile copies the file at src to dst, overwriting dst if it exists.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// DownloadMessage saves the file of the given message to the given path.
+// If the path is empty, the file is saved to the download directory with the name given in the message.
+// If the path is a directory, the file is saved in that directory.
+func (view *RoomView) DownloadMessage(message *messages.UIMessage, path string) {
+	defer debug.Recover()
+	defer view.parent.parent.Render()
+	content := message.Event.Content
+	if len(content.URL) == 0 {
+		view.AddServiceMessage("That message doesn't have a file")
+		return
+	}
+	cacheFile, err := view.downloadFile(content)
+	if err == context.Canceled {
+		view.AddServiceMessage(fmt.Sprintf("Cancelled downloading %s", content.Body))
+		return
+	} else if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to download %s: %v", content.Body, err))
+		return
+	}
+
+	if len(path) == 0 {
+		path = view.config.DownloadDir
+		_ = os.MkdirAll(path, 0700)
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		name := filepath.Base(content.Body)
+		if len(content.Body) == 0 || name == "." || name == string(filepath.Separator) {
+			name = filepath.Base(cacheFile)
+		}
+		path = uniqueFilePath(filepath.Join(path, name))
+	}
+	if err = copyFile(cacheFile, path); err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to save %s: %v", content.Body, err))
+		return
+	}
+	view.AddServiceMessage(fmt.Sprintf("Downloaded %s to %s", content.Body, path))
+}
+
+// OpenMessage opens the file or location of the given message with the default program of the system.
+func (view *RoomView) OpenMessage(message *messages.UIMessage) {
+	defer debug.Recover()
+	var err error
+	if location, ok := message.Renderer.(*messages.LocationMessage); ok {
+		err = open.Open(location.GeoURI)
+	} else if len(message.Event.Content.URL) == 0 {
+		err = fmt.Errorf("that message doesn't have a file")
+	} else if cacheFile, dlErr := view.downloadFile(message.Event.Content); dlErr == context.Canceled {
+		return
+	} else if dlErr != nil {
+		err = dlErr
 	} else {
-		debug.Print("Event ID received:", eventID)
+		err = open.Open(cacheFile)
+	}
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to open message: %v", err))
+		view.parent.parent.Render()
+	}
+}
+
+// SetOutgoingState updates the state of the local echo of the given event.
+// If the event was sent successfully, the event ID should be provided too.
+func (view *RoomView) SetOutgoingState(evt *event.Event, eventID string, state event.OutgoingState) {
+	msgView := view.MessageView()
+	if thread := view.threadView(ifc.ThreadRootID(evt)); thread != nil {
+		msgView = thread.content
+	}
+	msg := msgView.getMessageByID(evt.ID)
+	if msg == nil || msg.TxnID != evt.Unsigned.TransactionID {
+		// Message not in view or the remote echo already replaced it
+		return
+	}
+	msg.State = state
+	// Edits use the ID of the original event, which shouldn't be replaced.
+	if len(eventID) > 0 && evt.ID == evt.Unsigned.TransactionID {
 		msg.EventID = eventID
-		msg.State = event.StateDefault
-		view.MessageView().setMessageID(msg)
+		msgView.setMessageID(msg)
+	}
+}
+
+// ResendMessage retries sending a message that failed to send.
+func (view *RoomView) ResendMessage(msg *messages.UIMessage) {
+	defer debug.Recover()
+	if msg.State != event.StateSendFail || len(msg.TxnID) == 0 {
+		view.AddServiceMessage("Only messages that failed to send can be resent")
+	} else if err := view.matrix.ResendEvent(msg.TxnID); err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to resend message: %v", err))
+	} else {
+		msg.State = event.StateLocalEcho
+	}
+	view.parent.parent.Render()
+}
+
+// CancelMessage discards a message that hasn't been sent yet.
+func (view *RoomView) CancelMessage(msg *messages.UIMessage) {
+	defer debug.Recover()
+	if msg.State == event.StateDefault || len(msg.TxnID) == 0 {
+		view.AddServiceMessage("Only messages that haven't been sent can be cancelled")
 		view.parent.parent.Render()
+		return
 	}
+	evt, err := view.matrix.CancelEvent(msg.TxnID)
+	if err != nil {
+		view.AddServiceMessage(fmt.Sprintf("Failed to cancel message: %v", err))
+	} else if evt.ID != evt.Unsigned.TransactionID {
+		// The message was an edit, so show the original event again.
+		if orig, err := view.matrix.GetEvent(view.Room, evt.ID); err == nil {
+			view.AddEdit(orig)
+		}
+	} else {
+		view.MessageView().removeMessage(msg)
+	}
+	view.parent.parent.Render()
+}
+
+// ShowReadReceipts lists the users who have read the given message.
+func (view *RoomView) ShowReadReceipts(msg *messages.UIMessage) {
+	if len(msg.EventID) == 0 {
+		view.AddServiceMessage("Only sent messages have read receipts")
+		return
+	}
+	readers := view.MessageView().ReadBy(msg)
+	if len(readers) == 0 {
+		view.AddServiceMessage("Nobody else has read that message yet")
+		return
+	}
+	names := make([]string, len(readers))
+	for i, userID := range readers {
+		names[i] = userID
+		if member := view.Room.GetMember(userID); member != nil && len(member.Displayname) > 0 {
+			names[i] = fmt.Sprintf("%s (%s)", member.Displayname, userID)
+		}
+	}
+	view.AddServiceMessage(fmt.Sprintf("Read by %d users: %s", len(readers), strings.Join(names, ", ")))
+}
+
+// OpenThread shows the thread started by the given message. If text is given, it's sent as a reply in the thread
+// instead of opening the thread view.
+func (view *RoomView) OpenThread(msg *messages.UIMessage, text string) {
+	if msg.Event == nil || len(msg.EventID) == 0 {
+		view.AddServiceMessage("Only sent messages can start threads")
+		return
+	}
+	thread := NewThreadView(view, msg.Event)
+	if len(text) > 0 {
+		go thread.SendMessage(mautrix.MsgText, text)
+		return
+	}
+	view.parent.ShowModal(thread)
+	go thread.Load()
+}
+
+// threadView returns the thread view of the thread with the given root if it's currently open.
+func (view *RoomView) threadView(rootID string) *ThreadView {
+	thread, ok := view.parent.modal.(*ThreadView)
+	if !ok || len(rootID) == 0 || thread.parent != view || thread.root.ID != rootID {
+		return nil
+	}
+	return thread
+}
+
+// maxJumpHistoryPages is the maximum number of history pages that are loaded when looking for a message to jump to.
+const maxJumpHistoryPages = 20
+
+// JumpToEvent scrolls to the message with the given event ID, loading more history if it isn't loaded yet.
+func (view *RoomView) JumpToEvent(eventID string) {
+	defer debug.Recover()
+	msgView := view.MessageView()
+	for page := 0; ; page++ {
+		if msg := msgView.getMessageByID(eventID); msg != nil {
+			msgView.ScrollToMessage(msg)
+			view.parent.parent.Render()
+			return
+		} else if page >= maxJumpHistoryPages {
+			break
+		}
+		for atomic.LoadInt32(&msgView.loadingMessages) != 0 {
+			// Wait for history that is already being loaded, e.g. right after switching rooms.
+			time.Sleep(50 * time.Millisecond)
+		}
+		msgView.messagesLock.RLock()
+		prevCount := len(msgView.messages)
+		msgView.messagesLock.RUnlock()
+		view.parent.LoadHistory(view)
+		msgView.messagesLock.RLock()
+		count := len(msgView.messages)
+		msgView.messagesLock.RUnlock()
+		if count == prevCount {
+			break
+		}
+	}
+	view.AddServiceMessage("Couldn't find the message in the history of this room")
+	view.parent.parent.Render()
 }
 
 func (view *RoomView) MessageView() *MessageView {
@@ -674,18 +1174,26 @@ func (view *RoomView) MxRoom() *rooms.Room {
 }
 
 func (view *RoomView) Update() {
-	view.topic.SetText(strings.Replace(view.Room.GetTopic(), "\n", " ", -1))
+	if view.Room.IsReplaced() {
+		view.topic.SetBackgroundColor(tcell.ColorDarkRed)
+		if len(view.Room.ReplacedBy()) == 0 {
+			view.topic.SetText("This room has been shut down.")
+		} else if replacement := view.matrix.GetRoom(view.Room.ReplacedBy()); replacement != nil && !replacement.HasLeft {
+			view.topic.SetText("This room has been replaced. Press enter to go to the new room.")
+		} else {
+			view.topic.SetText("This room has been replaced. Press enter to join the new room.")
+		}
+	} else {
+		view.topic.SetBackgroundColor(tcell.ColorDarkGreen)
+		view.topic.SetText(strings.Replace(view.Room.GetTopic(), "\n", " ", -1))
+	}
 	if !view.userListLoaded {
 		view.UpdateUserList()
 	}
 }
 
 func (view *RoomView) UpdateUserList() {
-	pls := &mautrix.PowerLevels{}
-	if plEvent := view.Room.GetStateEvent(mautrix.StatePowerLevels, ""); plEvent != nil {
-		pls = plEvent.Content.GetPowerLevels()
-	}
-	view.userList.Update(view.Room.GetMembers(), pls)
+	view.userList.Update(view.Room.GetMembers(), view.Room.GetPowerLevels())
 	view.userListLoaded = true
 }
 
@@ -693,12 +1201,26 @@ func (view *RoomView) AddServiceMessage(text string) {
 	view.content.AddMessage(messages.NewServiceMessage(text), AppendMessage)
 }
 
+// MessageSizeChanged makes the message buffers of the room and its open thread be rebuilt on the next draw.
+func (view *RoomView) MessageSizeChanged() {
+	view.content.prevMsgCount = -1
+	if thread, ok := view.parent.modal.(*ThreadView); ok && thread.parent == view {
+		thread.content.prevMsgCount = -1
+	}
+	view.parent.parent.Render()
+}
+
 func (view *RoomView) parseEvent(evt *event.Event) *messages.UIMessage {
-	return messages.ParseEvent(view.parent.matrix, view.parent, view.Room, evt)
+	return messages.ParseEvent(view.matrix, view.parent.parent.MainView(view.matrix), view.Room, evt)
 }
 
-func (view *RoomView) AddHistoryEvent(evt *event.Event) {
-	if msg := view.parseEvent(evt); msg != nil {
+// AddHistoryEvent prepends an event loaded from the history of the given room, which is either this room or one
+// of its predecessors.
+func (view *RoomView) AddHistoryEvent(room *rooms.Room, evt *event.Event) {
+	if len(ifc.ThreadRootID(evt)) > 0 {
+		// Thread replies are only shown in the thread view.
+		return
+	} else if msg := messages.ParseEvent(view.matrix, view.parent.parent.MainView(view.matrix), room, evt); msg != nil {
 		view.content.AddMessage(msg, PrependMessage)
 	}
 }
@@ -716,8 +1238,17 @@ func (view *RoomView) AddRedaction(redactedEvt *event.Event) {
 }
 
 func (view *RoomView) AddEdit(evt *event.Event) {
+	msgView := view.content
+	if rootID := ifc.ThreadRootID(evt); len(rootID) > 0 {
+		thread := view.threadView(rootID)
+		if thread == nil {
+			// Thread replies are only shown in the thread view
+			return
+		}
+		msgView = thread.content
+	}
 	if msg := view.parseEvent(evt); msg != nil {
-		view.content.AddMessage(msg, IgnoreMessage)
+		msgView.AddMessage(msg, IgnoreMessage)
 	}
 }
 
@@ -737,6 +1268,22 @@ func (view *RoomView) AddReaction(evt *event.Event, key string) {
 	}
 }
 
+// AddThreadReply updates the thread summary of the given root message and adds the reply to the thread view if the
+// thread is open.
+func (view *RoomView) AddThreadReply(root *event.Event, reply *event.Event) ifc.Message {
+	if view.content.getMessageByID(root.ID) != nil {
+		view.AddEdit(root)
+	}
+	if thread := view.threadView(root.ID); thread != nil {
+		if msg := thread.AddEvent(reply); msg != nil {
+			return msg
+		}
+	} else if msg := view.parseEvent(reply); msg != nil {
+		return msg
+	}
+	return nil
+}
+
 func (view *RoomView) GetEvent(eventID string) ifc.Message {
 	message, ok := view.content.messageIDs[eventID]
 	if !ok {
@@ -0,0 +1,322 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/matrix/rooms"
+	"maunium.net/go/gomuks/ui/messages"
+)
+
+// searchResultLimit is the maximum number of messages shown in the search modal when searching the local history.
+const searchResultLimit = 100
+
+// searchResult is a message found by searching, along with the events around it if the search returned them.
+type searchResult struct {
+	event        *event.Event
+	eventsBefore []*event.Event
+	eventsAfter  []*event.Event
+}
+
+// SearchModal is a modal for searching messages in all rooms or a single room, either in the locally stored history
+// or using the search API of the homeserver.
+//
+// Pressing enter searches for the entered text, or jumps to the selected message if the text hasn't changed.
+type SearchModal struct {
+	mauview.Component
+
+	container *mauview.Box
+
+	query   *mauview.InputArea
+	results *mauview.TextView
+
+	parent *MainView
+	matrix ifc.MatrixContainer
+	room   *rooms.Room
+	server bool
+
+	lock       sync.Mutex
+	found      []searchResult
+	selected   int
+	lastQuery  string
+	nextBatch  string
+	count      int
+	searching  bool
+	generation int
+	err        error
+}
+
+// NewSearchModal creates a search modal. If room is nil, all rooms are searched. If server is true, the search API
+// of the homeserver is used instead of the local history.
+func NewSearchModal(mainView *MainView, matrix ifc.MatrixContainer, room *rooms.Room, server bool, query string, width, height int) *SearchModal {
+	sm := &SearchModal{
+		parent: mainView,
+		matrix: matrix,
+		room:   room,
+		server: server,
+	}
+
+	sm.results = mauview.NewTextView().SetRegions(true)
+	sm.query = mauview.NewInputArea().
+		SetTextColor(tcell.ColorWhite).
+		SetBackgroundColor(tcell.ColorDarkCyan).
+		SetPlaceholder("Search messages...")
+	sm.query.SetText(query)
+	sm.query.Focus()
+
+	flex := mauview.NewFlex().
+		SetDirection(mauview.FlexRow).
+		AddFixedComponent(sm.query, 1).
+		AddProportionalComponent(sm.results, 1)
+
+	title := "Search all rooms"
+	if room != nil {
+		title = fmt.Sprintf("Search %s", room.GetTitle())
+	}
+	if server {
+		title += " on the server"
+	}
+	sm.container = mauview.NewBox(flex).
+		SetBorder(true).
+		SetTitle(title).
+		SetBlurCaptureFunc(func() bool {
+			sm.parent.HideModal()
+			return true
+		})
+
+	sm.Component = mauview.Center(sm.container, width, height).SetAlwaysFocusChild(true)
+
+	if len(query) > 0 {
+		sm.searching = true
+		go sm.search(query, true)
+	}
+
+	return sm
+}
+
+func (sm *SearchModal) Focus() {
+	sm.container.Focus()
+}
+
+func (sm *SearchModal) Blur() {
+	sm.container.Blur()
+}
+
+// search runs a search. If reset is true, the current results are replaced, otherwise the next page of server-side
+// results is appended to the current results.
+func (sm *SearchModal) search(query string, reset bool) {
+	defer debug.Recover()
+	sm.lock.Lock()
+	if reset {
+		sm.generation++
+		sm.found = nil
+		sm.nextBatch = ""
+		sm.count = 0
+		sm.selected = 0
+	} else if sm.searching || len(sm.nextBatch) == 0 {
+		sm.lock.Unlock()
+		return
+	}
+	generation := sm.generation
+	nextBatch := sm.nextBatch
+	sm.lastQuery = query
+	sm.searching = true
+	sm.err = nil
+	sm.lock.Unlock()
+	sm.render()
+
+	var found []searchResult
+	var count int
+	var err error
+	if sm.server {
+		var page *ifc.ServerSearchPage
+		page, err = sm.matrix.SearchServer(query, sm.room, nextBatch)
+		if err == nil {
+			for _, result := range page.Results {
+				found = append(found, searchResult{result.Event, result.EventsBefore, result.EventsAfter})
+			}
+			nextBatch = page.NextBatch
+			count = page.Count
+		}
+	} else {
+		var events []*event.Event
+		events, err = sm.matrix.SearchHistory(query, sm.room, searchResultLimit)
+		for _, evt := range events {
+			found = append(found, searchResult{event: evt})
+		}
+	}
+	if err != nil {
+		debug.Print("Failed to search messages:", err)
+	}
+
+	sm.lock.Lock()
+	if generation != sm.generation {
+		// The query changed while this search was running
+		sm.lock.Unlock()
+		return
+	}
+	sm.searching = false
+	sm.err = err
+	if err == nil {
+		sm.found = append(sm.found, found...)
+		sm.nextBatch = nextBatch
+		sm.count = count
+	}
+	sm.lock.Unlock()
+	sm.render()
+}
+
+// formatEvent formats an event as a single line using the normal message parser.
+func (sm *SearchModal) formatEvent(evt *event.Event) string {
+	sender := evt.Sender
+	text := evt.Content.Body
+	room := sm.matrix.GetRoom(evt.RoomID)
+	if room != nil {
+		if msg := messages.ParseEvent(sm.matrix, sm.parent.parent.MainView(sm.matrix), room, evt); msg != nil {
+			sender = msg.Sender()
+			text = msg.PlainText()
+		}
+	}
+	timestamp := time.Unix(evt.Timestamp/1000, evt.Timestamp%1000*int64(time.Millisecond))
+	var buf strings.Builder
+	buf.WriteString(timestamp.Format("2006-01-02 15:04 "))
+	if sm.room == nil {
+		roomName := evt.RoomID
+		if room != nil {
+			roomName = room.GetTitle()
+		}
+		buf.WriteString(roomName)
+		buf.WriteRune(' ')
+	}
+	_, _ = fmt.Fprintf(&buf, "<%s> %s", sender, strings.Replace(text, "\n", " ", -1))
+	return mauview.Escape(buf.String())
+}
+
+func (sm *SearchModal) render() {
+	sm.lock.Lock()
+	sm.results.Clear()
+	for index, result := range sm.found {
+		for _, evt := range result.eventsBefore {
+			_, _ = fmt.Fprintf(sm.results, "    %s\n", sm.formatEvent(evt))
+		}
+		_, _ = fmt.Fprintf(sm.results, `["%d"]%s[""]%s`, index, sm.formatEvent(result.event), "\n")
+		for _, evt := range result.eventsAfter {
+			_, _ = fmt.Fprintf(sm.results, "    %s\n", sm.formatEvent(evt))
+		}
+	}
+	if sm.searching {
+		_, _ = fmt.Fprint(sm.results, "Searching...\n")
+	} else if sm.err != nil {
+		_, _ = fmt.Fprintf(sm.results, "Search failed: %v\n", sm.err)
+	} else if len(sm.lastQuery) > 0 && len(sm.found) == 0 {
+		_, _ = fmt.Fprint(sm.results, "No messages found\n")
+	} else if len(sm.nextBatch) > 0 {
+		_, _ = fmt.Fprintf(sm.results, "Showing %d of about %d results, press page down at the end of the list to load more\n",
+			len(sm.found), sm.count)
+	}
+	if len(sm.found) > 0 {
+		sm.results.Highlight(strconv.Itoa(sm.selected))
+		sm.results.ScrollToHighlight()
+	} else {
+		sm.results.Highlight()
+	}
+	sm.lock.Unlock()
+	sm.parent.parent.Render()
+}
+
+func (sm *SearchModal) moveSelection(diff int) {
+	sm.lock.Lock()
+	if len(sm.found) == 0 {
+		sm.lock.Unlock()
+		return
+	}
+	sm.selected += diff
+	if sm.selected < 0 {
+		sm.selected = 0
+	} else if sm.selected >= len(sm.found) {
+		sm.selected = len(sm.found) - 1
+	}
+	atEnd := sm.selected == len(sm.found)-1
+	query := sm.lastQuery
+	sm.lock.Unlock()
+	if atEnd && diff > 0 {
+		go sm.search(query, false)
+	}
+	sm.render()
+}
+
+// jump switches to the room of the selected message and scrolls to the message.
+func (sm *SearchModal) jump(evt *event.Event) {
+	room := sm.matrix.GetRoom(evt.RoomID)
+	if room == nil {
+		return
+	}
+	roomView, ok := sm.parent.getRoomView(room.SessionUserID, room.ID, true)
+	if !ok {
+		return
+	}
+	sm.parent.HideModal()
+	sm.parent.SwitchRoom(room.Tags()[0].Tag, room)
+	go roomView.JumpToEvent(evt.ID)
+}
+
+func (sm *SearchModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	switch event.Key() {
+	case tcell.KeyEsc:
+		sm.parent.HideModal()
+		return true
+	case tcell.KeyTab, tcell.KeyDown:
+		sm.moveSelection(1)
+		return true
+	case tcell.KeyBacktab, tcell.KeyUp:
+		sm.moveSelection(-1)
+		return true
+	case tcell.KeyPgDn:
+		sm.moveSelection(10)
+		return true
+	case tcell.KeyPgUp:
+		sm.moveSelection(-10)
+		return true
+	case tcell.KeyEnter:
+		query := sm.query.GetText()
+		sm.lock.Lock()
+		if query != sm.lastQuery {
+			sm.lock.Unlock()
+			go sm.search(query, true)
+		} else if sm.selected < len(sm.found) {
+			evt := sm.found[sm.selected].event
+			sm.lock.Unlock()
+			sm.jump(evt)
+		} else {
+			sm.lock.Unlock()
+		}
+		return true
+	}
+	return sm.query.OnKeyEvent(event)
+}
@@ -0,0 +1,259 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+
+	"github.com/kyokomi/emoji"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/event"
+	"maunium.net/go/gomuks/ui/messages"
+	"maunium.net/go/gomuks/ui/widget"
+)
+
+// ThreadView is a modal that shows the replies in a single thread and has its own input for replying in the thread.
+type ThreadView struct {
+	container *mauview.Box
+	separator *widget.Border
+	content   *MessageView
+	input     *mauview.InputArea
+
+	boxScreen       *mauview.ProxyScreen
+	contentScreen   *mauview.ProxyScreen
+	separatorScreen *mauview.ProxyScreen
+	inputScreen     *mauview.ProxyScreen
+
+	root   *event.Event
+	parent *RoomView
+}
+
+func NewThreadView(parent *RoomView, root *event.Event) *ThreadView {
+	tv := &ThreadView{
+		container: mauview.NewBox(nil).
+			SetBorder(true).
+			SetTitle("Thread"),
+		separator: widget.NewBorder(),
+		content:   NewMessageView(parent),
+		input:     mauview.NewInputArea(),
+
+		boxScreen:       &mauview.ProxyScreen{},
+		contentScreen:   &mauview.ProxyScreen{},
+		separatorScreen: &mauview.ProxyScreen{Height: 1},
+		inputScreen:     &mauview.ProxyScreen{},
+
+		root:   root,
+		parent: parent,
+	}
+	tv.input.
+		SetBackgroundColor(tcell.ColorDefault).
+		SetPlaceholder("Reply in thread...").
+		SetPlaceholderTextColor(tcell.ColorGray)
+	return tv
+}
+
+// Load adds the thread root and its replies to the message view. The replies are fetched from the server, as replies
+// that were loaded from history rather than received live aren't in the local thread summary.
+func (tv *ThreadView) Load() {
+	defer debug.Recover()
+	matrix := tv.parent.matrix
+	room := tv.parent.Room
+	if root, err := matrix.GetEvent(room, tv.root.ID); err == nil {
+		tv.root = root
+	}
+	replies, root, err := matrix.GetThreadReplies(room, tv.root.ID)
+	if err != nil {
+		debug.Printf("Failed to fetch replies in thread %s: %v", tv.root.ID, err)
+	} else if root != nil {
+		tv.root = root
+		// Update the thread summary in the room view.
+		if tv.parent.content.getMessageByID(root.ID) != nil {
+			tv.parent.AddEdit(root)
+		}
+	}
+	if msg := tv.parent.parseEvent(tv.root); msg != nil {
+		// The summary is redundant when the replies are right below the root.
+		msg.ThreadReplies = 0
+		tv.content.AddMessage(msg, AppendMessage)
+	}
+	for _, evt := range replies {
+		tv.AddEvent(evt)
+	}
+	if thread := tv.root.Gomuks.Thread; thread != nil && err != nil {
+		// Fall back to the replies that are known locally.
+		for _, eventID := range thread.Replies {
+			evt, err := matrix.GetEvent(room, eventID)
+			if err != nil {
+				debug.Printf("Failed to load thread reply %s: %v", eventID, err)
+				continue
+			}
+			tv.AddEvent(evt)
+		}
+	}
+	if err != nil {
+		tv.AddServiceMessage("Failed to fetch replies from server, only locally known replies are shown")
+	}
+	// Show replies that are still being sent.
+	for _, evt := range matrix.GetOutgoing(room.ID) {
+		if ifc.ThreadRootID(evt) == tv.root.ID && evt.ID == evt.Unsigned.TransactionID {
+			tv.AddEvent(evt)
+		}
+	}
+	tv.parent.parent.parent.Render()
+}
+
+func (tv *ThreadView) AddEvent(evt *event.Event) *messages.UIMessage {
+	msg := tv.parent.parseEvent(evt)
+	if msg != nil {
+		tv.content.AddMessage(msg, AppendMessage)
+	}
+	return msg
+}
+
+func (tv *ThreadView) AddServiceMessage(text string) {
+	tv.content.AddMessage(messages.NewServiceMessage(text), AppendMessage)
+}
+
+// SendMessage sends a message with a relation to the thread root.
+func (tv *ThreadView) SendMessage(msgtype mautrix.MessageType, text string) {
+	defer debug.Recover()
+	if !tv.parent.config.Preferences.DisableEmojis {
+		text = emoji.Sprint(text)
+	}
+	matrix := tv.parent.matrix
+	evt := matrix.PrepareMarkdownMessage(tv.parent.Room.ID, msgtype, text, &ifc.Relation{
+		Type:  ifc.RelThread,
+		Event: tv.root,
+	})
+	msg := tv.AddEvent(evt.SomewhatDangerousCopy())
+	err := matrix.QueueEvent(evt)
+	if err != nil {
+		if msg != nil {
+			msg.State = event.StateSendFail
+		}
+		tv.AddServiceMessage(fmt.Sprintf("Failed to queue message: %v", err))
+	}
+	tv.parent.parent.parent.Render()
+}
+
+func (tv *ThreadView) InputSubmit(text string) {
+	if len(text) == 0 {
+		return
+	}
+	go tv.SendMessage(mautrix.MsgText, text)
+	tv.input.SetTextAndMoveCursor("")
+}
+
+func (tv *ThreadView) Focus() {
+	tv.input.Focus()
+}
+
+func (tv *ThreadView) Blur() {
+	tv.input.Blur()
+}
+
+func (tv *ThreadView) Draw(screen mauview.Screen) {
+	width, height := screen.Size()
+	// Leave a bit of the room visible around the thread so it's clear that it's an overlay.
+	tv.boxScreen.Width = width - width/5
+	tv.boxScreen.Height = height - height/5
+	tv.boxScreen.OffsetX = (width - tv.boxScreen.Width) / 2
+	tv.boxScreen.OffsetY = (height - tv.boxScreen.Height) / 2
+	if tv.boxScreen.Width <= 2 || tv.boxScreen.Height <= 4 {
+		return
+	}
+
+	innerX, innerY := tv.boxScreen.OffsetX+1, tv.boxScreen.OffsetY+1
+	innerWidth, innerHeight := tv.boxScreen.Width-2, tv.boxScreen.Height-2
+
+	tv.input.PrepareDraw(innerWidth)
+	inputHeight := tv.input.GetTextHeight()
+	if inputHeight > MaxInputHeight {
+		inputHeight = MaxInputHeight
+	} else if inputHeight < 1 {
+		inputHeight = 1
+	}
+
+	tv.contentScreen.OffsetX = innerX
+	tv.contentScreen.OffsetY = innerY
+	tv.contentScreen.Width = innerWidth
+	tv.contentScreen.Height = innerHeight - inputHeight - 1
+	tv.separatorScreen.OffsetX = innerX
+	tv.separatorScreen.OffsetY = tv.contentScreen.YEnd()
+	tv.separatorScreen.Width = innerWidth
+	tv.inputScreen.OffsetX = innerX
+	tv.inputScreen.OffsetY = tv.separatorScreen.YEnd()
+	tv.inputScreen.Width = innerWidth
+	tv.inputScreen.Height = inputHeight
+
+	for _, proxy := range []*mauview.ProxyScreen{tv.boxScreen, tv.contentScreen, tv.separatorScreen, tv.inputScreen} {
+		proxy.Parent = screen
+	}
+
+	tv.container.Draw(tv.boxScreen)
+	tv.content.Draw(tv.contentScreen)
+	tv.separator.Draw(tv.separatorScreen)
+	tv.input.Draw(tv.inputScreen)
+}
+
+func (tv *ThreadView) OnKeyEvent(event mauview.KeyEvent) bool {
+	switch event.Key() {
+	case tcell.KeyEscape:
+		tv.parent.parent.HideModal()
+		return true
+	case tcell.KeyPgUp:
+		tv.content.AddScrollOffset(+tv.content.Height() / 2)
+		return true
+	case tcell.KeyPgDn:
+		tv.content.AddScrollOffset(-tv.content.Height() / 2)
+		return true
+	case tcell.KeyEnter:
+		if event.Modifiers()&tcell.ModShift == 0 && event.Modifiers()&tcell.ModCtrl == 0 {
+			tv.InputSubmit(tv.input.GetText())
+			return true
+		}
+	}
+	return tv.input.OnKeyEvent(event)
+}
+
+func (tv *ThreadView) OnPasteEvent(event mauview.PasteEvent) bool {
+	return tv.input.OnPasteEvent(event)
+}
+
+func (tv *ThreadView) OnMouseEvent(event mauview.MouseEvent) bool {
+	if event.HasMotion() {
+		return false
+	}
+	switch event.Buttons() {
+	case tcell.WheelUp:
+		tv.content.AddScrollOffset(WheelScrollOffsetDiff)
+		return true
+	case tcell.WheelDown:
+		tv.content.AddScrollOffset(-WheelScrollOffsetDiff)
+		return true
+	}
+	if tv.inputScreen.IsInArea(event.Position()) {
+		return tv.input.OnMouseEvent(tv.inputScreen.OffsetMouseEvent(event))
+	}
+	return false
+}
@@ -63,7 +63,7 @@ func NewGomuksUI(gmx ifc.Gomuks) ifc.GomuksUI {
 
 func (ui *GomuksUI) Init() {
 	ui.views = map[View]mauview.Component{
-		ViewLogin: ui.NewLoginView(),
+		ViewLogin: ui.NewLoginView(ui.gmx.Matrix()),
 		ViewMain:  ui.NewMainView(),
 	}
 	ui.SetView(ViewLogin)
@@ -91,10 +91,29 @@ func (ui *GomuksUI) OnLogin() {
 	ui.SetView(ViewMain)
 }
 
-func (ui *GomuksUI) OnLogout() {
+// OnLogout removes the rooms of the given account. If no accounts are logged in anymore, the login view is shown.
+func (ui *GomuksUI) OnLogout(account ifc.MatrixContainer) {
+	ui.mainView.RemoveAccount(account)
+	if !ui.hasLoggedInAccount() {
+		ui.ShowLogin(ui.gmx.Matrix())
+	}
+}
+
+// ShowLogin shows the login view for the given account.
+func (ui *GomuksUI) ShowLogin(account ifc.MatrixContainer) {
+	ui.views[ViewLogin] = ui.NewLoginView(account)
 	ui.SetView(ViewLogin)
 }
 
+func (ui *GomuksUI) hasLoggedInAccount() bool {
+	for _, account := range ui.gmx.Accounts() {
+		if len(account.Config().AccessToken) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (ui *GomuksUI) HandleNewPreferences() {
 	ui.Render()
 }
@@ -111,6 +130,6 @@ func (ui *GomuksUI) SetView(name View) {
 	}
 }
 
-func (ui *GomuksUI) MainView() ifc.MainView {
-	return ui.mainView
+func (ui *GomuksUI) MainView(account ifc.MatrixContainer) ifc.MainView {
+	return &accountView{ui.mainView, account}
 }
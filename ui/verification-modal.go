@@ -0,0 +1,164 @@
+// gomuks - A terminal Matrix client written in Go.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mauview"
+	"maunium.net/go/tcell"
+
+	"maunium.net/go/gomuks/debug"
+	"maunium.net/go/gomuks/interface"
+	"maunium.net/go/gomuks/matrix/crypto"
+)
+
+type VerificationModal struct {
+	mauview.Component
+
+	container *mauview.Box
+	text      *mauview.TextView
+
+	verification *crypto.Verification
+
+	parent *MainView
+	matrix ifc.MatrixContainer
+}
+
+func NewVerificationModal(mainView *MainView, matrix ifc.MatrixContainer, v *crypto.Verification, width int, height int) *VerificationModal {
+	vm := &VerificationModal{
+		parent:       mainView,
+		matrix:       matrix,
+		verification: v,
+	}
+
+	vm.text = mauview.NewTextView().SetWordWrap(true)
+	vm.container = mauview.NewBox(vm.text).
+		SetBorder(true).
+		SetTitle("Device Verification")
+
+	vm.Component = mauview.Center(vm.container, width, height).SetAlwaysFocusChild(true)
+
+	return vm
+}
+
+func (vm *VerificationModal) Focus() {
+	vm.container.Focus()
+}
+
+func (vm *VerificationModal) Blur() {
+	vm.container.Blur()
+}
+
+func (vm *VerificationModal) Draw(screen mauview.Screen) {
+	vm.text.SetText(vm.describe())
+	vm.Component.Draw(screen)
+}
+
+func (vm *VerificationModal) describe() string {
+	v := vm.verification
+	device := v.OtherDeviceID()
+	if len(device) == 0 {
+		device = "any device"
+	}
+	other := fmt.Sprintf("%s (%s)", v.OtherUserID, device)
+	switch v.State() {
+	case crypto.VerificationStateRequested:
+		if v.Incoming {
+			return fmt.Sprintf("%s wants to verify this device.\n\nPress y to accept or n to decline.", other)
+		}
+		return fmt.Sprintf("Waiting for %s to accept the verification request...\n\nPress Esc to cancel.", other)
+	case crypto.VerificationStateReady, crypto.VerificationStateStarted, crypto.VerificationStateAccepted:
+		return fmt.Sprintf("Exchanging keys with %s...\n\nPress Esc to cancel.", other)
+	case crypto.VerificationStateKeysExchanged:
+		var buf strings.Builder
+		fmt.Fprintf(&buf, "Check that %s shows the same ", other)
+		if emojis, ok := v.Emoji(); ok {
+			buf.WriteString("emojis:\n\n")
+			for i, emoji := range emojis {
+				fmt.Fprintf(&buf, "%s %-11s", emoji.Emoji, emoji.Name)
+				if i == 3 {
+					buf.WriteRune('\n')
+				}
+			}
+			buf.WriteString("\n\nor numbers: ")
+		} else {
+			buf.WriteString("numbers:\n\n")
+		}
+		if decimal, ok := v.Decimal(); ok {
+			fmt.Fprintf(&buf, "%d %d %d", decimal[0], decimal[1], decimal[2])
+		}
+		buf.WriteString("\n\nPress y if they match or n if they don't.")
+		return buf.String()
+	case crypto.VerificationStateConfirmed:
+		return fmt.Sprintf("Waiting for %s to confirm...\n\nPress Esc to cancel.", other)
+	case crypto.VerificationStateDone:
+		return fmt.Sprintf("%s has been verified.\n\nPress Enter to close.", other)
+	case crypto.VerificationStateCancelled:
+		return fmt.Sprintf("Verification with %s was cancelled: %s\n\nPress Enter to close.", other, v.CancelReason())
+	default:
+		return ""
+	}
+}
+
+func (vm *VerificationModal) async(fn func(mach *crypto.OlmMachine) error) {
+	mach := vm.matrix.Crypto()
+	if mach == nil {
+		return
+	}
+	go func() {
+		defer debug.Recover()
+		if err := fn(mach); err != nil {
+			debug.Print("Failed to update verification:", err)
+		}
+		vm.parent.parent.Render()
+	}()
+}
+
+func (vm *VerificationModal) OnKeyEvent(event mauview.KeyEvent) bool {
+	v := vm.verification
+	state := v.State()
+	finished := state == crypto.VerificationStateDone || state == crypto.VerificationStateCancelled
+	switch {
+	case event.Key() == tcell.KeyEsc:
+		if !finished {
+			vm.async(func(mach *crypto.OlmMachine) error {
+				return mach.CancelVerification(v)
+			})
+		}
+		vm.parent.HideModal()
+	case finished:
+		if event.Key() == tcell.KeyEnter {
+			vm.parent.HideModal()
+		}
+	case event.Rune() == 'y' && state == crypto.VerificationStateRequested && v.Incoming:
+		vm.async(func(mach *crypto.OlmMachine) error {
+			return mach.AcceptVerification(v)
+		})
+	case event.Rune() == 'n' && state == crypto.VerificationStateRequested && v.Incoming:
+		vm.async(func(mach *crypto.OlmMachine) error {
+			return mach.CancelVerification(v)
+		})
+	case (event.Rune() == 'y' || event.Rune() == 'n') && state == crypto.VerificationStateKeysExchanged:
+		match := event.Rune() == 'y'
+		vm.async(func(mach *crypto.OlmMachine) error {
+			return mach.ConfirmVerification(v, match)
+		})
+	}
+	return true
+}
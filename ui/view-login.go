@@ -53,7 +53,8 @@ type LoginView struct {
 	parent *GomuksUI
 }
 
-func (ui *GomuksUI) NewLoginView() mauview.Component {
+// NewLoginView creates a login view for the given account.
+func (ui *GomuksUI) NewLoginView(matrix ifc.MatrixContainer) mauview.Component {
 	view := &LoginView{
 		Form: mauview.NewForm(),
 
@@ -68,17 +69,24 @@ func (ui *GomuksUI) NewLoginView() mauview.Component {
 		loginButton: mauview.NewButton("Login"),
 		quitButton:  mauview.NewButton("Quit"),
 
-		matrix: ui.gmx.Matrix(),
-		config: ui.gmx.Config(),
+		matrix: matrix,
+		config: matrix.Config(),
 		parent: ui,
 	}
 
-	hs := ui.gmx.Config().HS
+	hs := view.config.HS
 	view.homeserver.SetPlaceholder("https://example.com").SetText(hs)
-	view.username.SetPlaceholder("@user:example.com").SetText(ui.gmx.Config().UserID)
+	view.username.SetPlaceholder("@user:example.com").SetText(view.config.UserID)
 	view.password.SetPlaceholder("correct horse battery staple").SetMaskCharacter('*')
 
-	view.quitButton.SetOnClick(func() { ui.gmx.Stop(true) }).SetBackgroundColor(tcell.ColorDarkCyan)
+	if ui.hasLoggedInAccount() {
+		// Other accounts are logged in, so the main view can be returned to instead of quitting.
+		view.quitButton.SetText("Cancel")
+		view.quitButton.SetOnClick(view.Cancel)
+	} else {
+		view.quitButton.SetOnClick(func() { ui.gmx.Stop(true) })
+	}
+	view.quitButton.SetBackgroundColor(tcell.ColorDarkCyan)
 	view.loginButton.SetOnClick(view.Login).SetBackgroundColor(tcell.ColorDarkCyan)
 
 	view.
@@ -169,6 +177,16 @@ func (view *LoginView) actuallyLogin(hs, mxid, password string) {
 	view.loginButton.SetText("Login")
 }
 
+// Cancel removes the account that was being added and returns to the main view.
+func (view *LoginView) Cancel() {
+	if view.loading {
+		return
+	} else if view.matrix != view.parent.gmx.Matrix() {
+		view.parent.gmx.RemoveAccount(view.matrix)
+	}
+	view.parent.SetView(ViewMain)
+}
+
 func (view *LoginView) Login() {
 	if view.loading {
 		return
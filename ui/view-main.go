@@ -34,6 +34,7 @@ import (
 	"maunium.net/go/gomuks/debug"
 	"maunium.net/go/gomuks/interface"
 	"maunium.net/go/gomuks/lib/notification"
+	"maunium.net/go/gomuks/matrix/crypto"
 	"maunium.net/go/gomuks/matrix/pushrules"
 	"maunium.net/go/gomuks/matrix/rooms"
 	"maunium.net/go/gomuks/ui/widget"
@@ -53,8 +54,10 @@ type MainView struct {
 	modal mauview.Component
 
 	lastFocusTime time.Time
+	// idleTimer marks the user as idle when there's no keyboard activity for IdleTimeout.
+	idleTimer *time.Timer
+	idle      int32
 
-	matrix ifc.MatrixContainer
 	gmx    ifc.Gomuks
 	config *config.Config
 	parent *GomuksUI
@@ -66,7 +69,6 @@ func (ui *GomuksUI) NewMainView() mauview.Component {
 		roomView: mauview.NewBox(nil).SetBorder(false),
 		rooms:    make(map[string]*RoomView),
 
-		matrix: ui.gmx.Matrix(),
 		gmx:    ui.gmx,
 		config: ui.gmx.Config(),
 		parent: ui,
@@ -78,6 +80,7 @@ func (ui *GomuksUI) NewMainView() mauview.Component {
 		AddFixedComponent(mainView.roomList, 25).
 		AddFixedComponent(widget.NewBorder(), 1).
 		AddProportionalComponent(mainView.roomView, 1)
+	mainView.idleTimer = time.AfterFunc(IdleTimeout, mainView.becomeIdle)
 	mainView.BumpFocus(nil)
 
 	ui.mainView = mainView
@@ -85,6 +88,18 @@ func (ui *GomuksUI) NewMainView() mauview.Component {
 	return mainView
 }
 
+// accountView is the main view as seen by the container of a single account.
+// Room IDs given to it refer to the rooms of that account.
+type accountView struct {
+	*MainView
+	matrix ifc.MatrixContainer
+}
+
+// roomViewKey returns the key of the view of the given room in the given account in MainView.rooms.
+func roomViewKey(userID, roomID string) string {
+	return userID + " " + roomID
+}
+
 func (view *MainView) ShowModal(modal mauview.Component) {
 	view.modal = modal
 	var ok bool
@@ -113,7 +128,23 @@ func (view *MainView) Draw(screen mauview.Screen) {
 	}
 }
 
+// IdleTimeout is how long the user has to be inactive before their presence is set to unavailable.
+const IdleTimeout = 5 * time.Minute
+
+func (view *MainView) becomeIdle() {
+	atomic.StoreInt32(&view.idle, 1)
+	for _, account := range view.gmx.Accounts() {
+		account.SetIdle(true)
+	}
+}
+
 func (view *MainView) BumpFocus(roomView *RoomView) {
+	view.idleTimer.Reset(IdleTimeout)
+	if atomic.CompareAndSwapInt32(&view.idle, 1, 0) {
+		for _, account := range view.gmx.Accounts() {
+			account.SetIdle(false)
+		}
+	}
 	if roomView != nil {
 		view.lastFocusTime = time.Now()
 		view.MarkRead(roomView)
@@ -126,7 +157,7 @@ func (view *MainView) MarkRead(roomView *RoomView) {
 		if len(msgList) > 0 {
 			msg := msgList[len(msgList)-1]
 			if roomView.Room.MarkRead(msg.ID()) {
-				view.matrix.MarkRead(roomView.Room.ID, msg.ID())
+				roomView.matrix.MarkRead(roomView.Room.ID, msg.ID())
 			}
 		}
 	}
@@ -134,7 +165,7 @@ func (view *MainView) MarkRead(roomView *RoomView) {
 
 func (view *MainView) InputChanged(roomView *RoomView, text string) {
 	if !roomView.config.Preferences.DisableTypingNotifs {
-		view.matrix.SendTyping(roomView.Room.ID, len(text) > 0 && text[0] != '/')
+		roomView.matrix.SendTyping(roomView.Room.ID, len(text) > 0 && text[0] != '/')
 	}
 }
 
@@ -252,7 +283,7 @@ func (view *MainView) switchRoom(tag string, room *rooms.Room, lock bool) {
 	}
 	room.Load()
 
-	roomView, ok := view.getRoomView(room.ID, lock)
+	roomView, ok := view.getRoomView(room.SessionUserID, room.ID, lock)
 	if !ok {
 		debug.Print("Tried to switch to room with nonexistent roomView!")
 		debug.Print(tag, room)
@@ -270,11 +301,11 @@ func (view *MainView) switchRoom(tag string, room *rooms.Room, lock bool) {
 
 	if msgView := roomView.MessageView(); len(msgView.messages) < 20 && !msgView.initialHistoryLoaded {
 		msgView.initialHistoryLoaded = true
-		go view.LoadHistory(room.ID)
+		go view.LoadHistory(roomView)
 	}
 	if !room.MembersFetched {
 		go func() {
-			err := view.matrix.FetchMembers(room)
+			err := roomView.matrix.FetchMembers(room)
 			if err != nil {
 				debug.Print("Error fetching members:", err)
 				return
@@ -285,42 +316,58 @@ func (view *MainView) switchRoom(tag string, room *rooms.Room, lock bool) {
 	}
 }
 
-func (view *MainView) addRoomPage(room *rooms.Room) *RoomView {
-	if _, ok := view.rooms[room.ID]; !ok {
-		roomView := NewRoomView(view, room).
+func (view *MainView) addRoomPage(matrix ifc.MatrixContainer, room *rooms.Room) *RoomView {
+	key := roomViewKey(room.SessionUserID, room.ID)
+	if _, ok := view.rooms[key]; !ok {
+		roomView := NewRoomView(view, matrix, room).
 			SetInputChangedFunc(view.InputChanged)
-		view.rooms[room.ID] = roomView
+		view.rooms[key] = roomView
 		return roomView
 	}
 	return nil
 }
 
-func (view *MainView) GetRoom(roomID string) ifc.RoomView {
-	room, ok := view.getRoomView(roomID, true)
+func (view *accountView) GetRoom(roomID string) ifc.RoomView {
+	room, ok := view.getRoomView(view.matrix.Config().UserID, roomID, true)
 	if !ok {
-		return view.addRoom(view.matrix.GetOrCreateRoom(roomID))
+		return view.addRoom(view.matrix, view.matrix.GetOrCreateRoom(roomID))
 	}
 	return room
 }
 
-func (view *MainView) getRoomView(roomID string, lock bool) (room *RoomView, ok bool) {
+func (view *MainView) getRoomView(userID, roomID string, lock bool) (room *RoomView, ok bool) {
+	key := roomViewKey(userID, roomID)
 	if lock {
 		view.roomsLock.RLock()
-		room, ok = view.rooms[roomID]
+		room, ok = view.rooms[key]
 		view.roomsLock.RUnlock()
 	} else {
-		room, ok = view.rooms[roomID]
+		room, ok = view.rooms[key]
 	}
 	return room, ok
 }
 
+// accountOf returns the container of the account with the given user ID.
+func (view *MainView) accountOf(userID string) ifc.MatrixContainer {
+	for _, account := range view.gmx.Accounts() {
+		if account.Config().UserID == userID {
+			return account
+		}
+	}
+	return view.gmx.Matrix()
+}
+
 func (view *MainView) AddRoom(room *rooms.Room) {
-	view.addRoom(room)
+	view.addRoom(view.accountOf(room.SessionUserID), room)
+}
+
+func (view *accountView) AddRoom(room *rooms.Room) {
+	view.addRoom(view.matrix, room)
 }
 
 func (view *MainView) RemoveRoom(room *rooms.Room) {
 	view.roomsLock.Lock()
-	_, ok := view.getRoomView(room.ID, false)
+	_, ok := view.getRoomView(room.SessionUserID, room.ID, false)
 	if !ok {
 		view.roomsLock.Unlock()
 		debug.Print("Remove aborted (not found)", room.ID, room.GetTitle())
@@ -331,47 +378,84 @@ func (view *MainView) RemoveRoom(room *rooms.Room) {
 	view.roomList.Remove(room)
 	t, r := view.roomList.Selected()
 	view.switchRoom(t, r, false)
-	delete(view.rooms, room.ID)
+	delete(view.rooms, roomViewKey(room.SessionUserID, room.ID))
 	view.roomsLock.Unlock()
 
+	if room.IsSpace {
+		view.UpdateSpaces()
+	}
 	view.parent.Render()
 }
 
-func (view *MainView) addRoom(room *rooms.Room) *RoomView {
-	if view.roomList.Contains(room.ID) {
+func (view *MainView) addRoom(matrix ifc.MatrixContainer, room *rooms.Room) *RoomView {
+	if view.roomList.Contains(room) {
 		debug.Print("Add aborted (room exists)", room.ID, room.GetTitle())
 		return nil
 	}
 	debug.Print("Adding", room.ID, room.GetTitle())
 	view.roomList.Add(room)
 	view.roomsLock.Lock()
-	roomView := view.addRoomPage(room)
+	roomView := view.addRoomPage(matrix, room)
 	if !view.roomList.HasSelected() {
 		t, r := view.roomList.First()
 		view.switchRoom(t, r, false)
 	}
 	view.roomsLock.Unlock()
+	view.UpdateSpaces()
 	return roomView
 }
 
-func (view *MainView) SetRooms(rooms *rooms.RoomCache) {
-	view.roomList.Clear()
+// SetRooms replaces the rooms of this account in the room list.
+func (view *accountView) SetRooms(rooms *rooms.RoomCache) {
 	view.roomsLock.Lock()
-	view.rooms = make(map[string]*RoomView)
+	reselect := view.clearRooms()
 	for _, room := range rooms.Map {
 		if room.HasLeft {
 			continue
 		}
 		view.roomList.Add(room)
-		view.addRoomPage(room)
+		view.addRoomPage(view.matrix, room)
+	}
+	if reselect {
+		t, r := view.roomList.First()
+		view.switchRoom(t, r, false)
 	}
-	t, r := view.roomList.First()
-	view.switchRoom(t, r, false)
 	view.roomsLock.Unlock()
+	view.UpdateSpaces()
+}
+
+// RemoveAccount removes all rooms of the given account, e.g. after it has been logged out.
+func (view *MainView) RemoveAccount(matrix ifc.MatrixContainer) {
+	accView := &accountView{view, matrix}
+	view.roomsLock.Lock()
+	if accView.clearRooms() {
+		t, r := view.roomList.First()
+		view.switchRoom(t, r, false)
+	}
+	view.roomsLock.Unlock()
+	view.UpdateSpaces()
+}
+
+// clearRooms removes the room views of this account and returns whether the current room was one of them.
+// The caller must hold the rooms lock.
+func (view *accountView) clearRooms() (currentRemoved bool) {
+	currentRemoved = view.currentRoom == nil
+	for key, roomView := range view.rooms {
+		if roomView.matrix != view.matrix {
+			continue
+		} else if roomView == view.currentRoom {
+			currentRemoved = true
+			view.currentRoom = nil
+			view.roomView.SetInnerComponent(nil)
+		}
+		view.roomList.Remove(roomView.Room)
+		delete(view.rooms, key)
+	}
+	return
 }
 
 func (view *MainView) UpdateTags(room *rooms.Room) {
-	if !view.roomList.Contains(room.ID) {
+	if !view.roomList.Contains(room) {
 		return
 	}
 	reselect := view.roomList.selected == room
@@ -380,11 +464,34 @@ func (view *MainView) UpdateTags(room *rooms.Room) {
 	if reselect {
 		view.roomList.SetSelected(room.Tags()[0].Tag, room)
 	}
+	// Removing the room also removed it from its space sections.
+	view.UpdateSpaces()
+}
+
+// RoomReplaced moves a room that has been tombstoned out of the room list. The room view is kept so that the old
+// history can still be read and the replacement banner can be shown.
+func (view *MainView) RoomReplaced(room *rooms.Room) {
+	view.roomList.Remove(room)
+	if roomView, ok := view.getRoomView(room.SessionUserID, room.ID, true); ok {
+		roomView.Update()
+	}
+	view.UpdateSpaces()
+}
+
+// UpdateSpaces recreates the space sections of the room list.
+func (view *MainView) UpdateSpaces() {
+	view.roomsLock.RLock()
+	allRooms := make([]*rooms.Room, 0, len(view.rooms))
+	for _, roomView := range view.rooms {
+		allRooms = append(allRooms, roomView.Room)
+	}
+	view.roomsLock.RUnlock()
+	view.roomList.UpdateSpaces(allRooms)
 	view.parent.Render()
 }
 
-func (view *MainView) SetTyping(roomID string, users []string) {
-	roomView, ok := view.getRoomView(roomID, true)
+func (view *accountView) SetTyping(roomID string, users []string) {
+	roomView, ok := view.getRoomView(view.matrix.Config().UserID, roomID, true)
 	if ok {
 		roomView.SetTyping(users)
 		view.parent.Render()
@@ -406,7 +513,7 @@ func (view *MainView) Bump(room *rooms.Room) {
 func (view *MainView) NotifyMessage(room *rooms.Room, message ifc.Message, should pushrules.PushActionArrayShould) {
 	view.Bump(room)
 	uiMsg, ok := message.(*messages.UIMessage)
-	if ok && uiMsg.SenderID == view.config.UserID {
+	if ok && uiMsg.SenderID == room.SessionUserID {
 		return
 	}
 	// Whether or not the room where the message came is the currently shown room.
@@ -421,8 +528,8 @@ func (view *MainView) NotifyMessage(room *rooms.Room, message ifc.Message, shoul
 	if !isCurrent || !isFocused {
 		// The message is not in the current room, show new message status in room list.
 		room.AddUnread(message.ID(), shouldNotify, should.Highlight)
-	} else {
-		view.matrix.MarkRead(room.ID, message.ID())
+	} else if roomView, ok := view.getRoomView(room.SessionUserID, room.ID, true); ok {
+		roomView.matrix.MarkRead(room.ID, message.ID())
 	}
 
 	if shouldNotify && !recentlyFocused {
@@ -438,12 +545,55 @@ func (view *MainView) NotifyMessage(room *rooms.Room, message ifc.Message, shoul
 	message.SetIsHighlight(should.Highlight)
 }
 
-func (view *MainView) LoadHistory(roomID string) {
+// ShowVerification shows a modal for new verification requests. Later updates are shown in the existing modal.
+func (view *accountView) ShowVerification(v *crypto.Verification) {
+	state := v.State()
+	if modal, ok := view.modal.(*VerificationModal); (!ok || modal.verification != v) && state == crypto.VerificationStateRequested {
+		view.ShowModal(NewVerificationModal(view.MainView, view.matrix, v, 60, 13))
+	}
+	if state == crypto.VerificationStateDone {
+		view.roomsLock.RLock()
+		for _, roomView := range view.rooms {
+			if roomView.matrix == view.matrix {
+				roomView.MessageView().UpdateTrust(v.OtherUserID)
+			}
+		}
+		view.roomsLock.RUnlock()
+	}
+}
+
+// FillGap loads the events that are missing at the given gap marker and shows them in the room view. It returns
+// whether the gap was filled successfully.
+func (view *MainView) FillGap(roomView *RoomView, gapMsg *messages.UIMessage) (ok bool) {
 	defer debug.Recover()
-	roomView, ok := view.getRoomView(roomID, true)
-	if !ok {
-		return
+	msgView := roomView.MessageView()
+
+	events, gap, err := roomView.matrix.FillGap(roomView.Room, gapMsg.Event)
+	if err != nil {
+		debug.Print("Failed to fill gap", gapMsg.EventID, "in", roomView.Room.ID, err)
+		return false
+	}
+	// The events are in reverse chronological order.
+	filled := make([]*messages.UIMessage, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		if len(ifc.ThreadRootID(events[i])) > 0 {
+			// Thread replies are only shown in the thread view.
+			continue
+		} else if msg := roomView.parseEvent(events[i]); msg != nil {
+			filled = append(filled, msg)
+		}
 	}
+	var newGap *messages.UIMessage
+	if gap != nil {
+		newGap = roomView.parseEvent(gap)
+	}
+	msgView.ReplaceGap(gapMsg, newGap, filled)
+	view.parent.Render()
+	return true
+}
+
+func (view *MainView) LoadHistory(roomView *RoomView) {
+	defer debug.Recover()
 	msgView := roomView.MessageView()
 
 	if !atomic.CompareAndSwapInt32(&msgView.loadingMessages, 0, 1) {
@@ -454,15 +604,43 @@ func (view *MainView) LoadHistory(roomID string) {
 	// Update the "Loading more messages..." text
 	view.parent.Render()
 
-	history, err := view.matrix.GetHistory(roomView.Room, 50)
+	historyRoom := msgView.historyRoom
+	if historyRoom == nil {
+		historyRoom = roomView.Room
+	}
+	history, err := roomView.matrix.GetHistory(historyRoom, 50)
 	if err != nil {
 		roomView.AddServiceMessage("Failed to fetch history")
-		debug.Print("Failed to fetch history for", roomView.Room.ID, err)
+		debug.Print("Failed to fetch history for", historyRoom.ID, err)
 		view.parent.Render()
 		return
 	}
 	for _, evt := range history {
-		roomView.AddHistoryEvent(evt)
+		roomView.AddHistoryEvent(historyRoom, evt)
+	}
+	if len(history) == 0 {
+		// The start of the room was reached, continue with the room it replaced if we know it.
+		if predecessor := roomView.matrix.GetRoom(historyRoom.Predecessor()); predecessor != nil {
+			debug.Print("History of", historyRoom.ID, "exhausted, continuing in predecessor", predecessor.ID)
+			msgView.historyRoom = predecessor
+			roomView.content.AddMessage(messages.NewServiceMessage(
+				fmt.Sprintf("This room replaced %s, scroll up to see its history", predecessor.GetTitle())), PrependMessage)
+		}
+	}
+	if !msgView.outboxLoaded {
+		msgView.outboxLoaded = true
+		// Show messages that were still being sent when gomuks was last closed.
+		for _, evt := range roomView.matrix.GetOutgoing(roomView.Room.ID) {
+			if evt.ID != evt.Unsigned.TransactionID && roomView.GetEvent(evt.ID) == nil {
+				// Edit of a message that isn't loaded
+				continue
+			} else if len(ifc.ThreadRootID(evt)) > 0 {
+				// Thread replies are loaded when the thread is opened
+				continue
+			}
+			roomView.AddEvent(evt)
+		}
 	}
 	view.parent.Render()
+	msgView.fillVisibleGap()
 }